@@ -26,6 +26,8 @@ var (
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var migrateHostConfig bool
+	var enableWebhook bool
 	var probeAddr string
 	var abAPIExportName string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
@@ -35,6 +37,12 @@ func main() {
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&migrateHostConfig, "migrate-host-config", false,
+		"Create HostPool, DynamicPlatform and DynamicPoolPlatform objects from the host-config ConfigMap on startup. "+
+			"Nothing is done if any of these objects already exist.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve the validating webhook for the host-config ConfigMap. "+
+			"The serving certificate must be mounted in the default controller-runtime certificate directory.")
 	opts := zap.Options{
 		TimeEncoder: zapcore.RFC3339TimeEncoder,
 		ZapOpts:     []zap2.Option{zap2.WithCaller(true)},
@@ -61,7 +69,7 @@ func main() {
 	mopts.Metrics.BindAddress = metricsAddr
 
 	mainLog.Info("The apis.kcp.dev group is not present - creating standard manager")
-	mgr, err = controller.NewManager(restConfig, mopts)
+	mgr, err = controller.NewManager(restConfig, mopts, migrateHostConfig, enableWebhook)
 	if err != nil {
 		mainLog.Error(err, "unable to start manager")
 		os.Exit(1)
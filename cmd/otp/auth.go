@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/utils/strings/slices"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// authenticator checks the bearer token of a request with a TokenReview, and only accepts the allowed users, which
+// are normally the service account of the controller
+type authenticator struct {
+	client  client.Client
+	allowed []string
+}
+
+func NewAuthenticator(client client.Client, allowed []string) *authenticator {
+	return &authenticator{client: client, allowed: allowed}
+}
+
+// authenticate returns the name of the user that made the request, or an error if it is not allowed
+func (a *authenticator) authenticate(ctx context.Context, request *http.Request) (string, error) {
+	token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", fmt.Errorf("no bearer token")
+	}
+	review := authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	err := a.client.Create(ctx, &review)
+	if err != nil {
+		return "", fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("token is not valid: %s", review.Status.Error)
+	}
+	user := review.Status.User.Username
+	if !slices.Contains(a.allowed, user) {
+		return user, fmt.Errorf("user %s may not store keys", user)
+	}
+	return user, nil
+}
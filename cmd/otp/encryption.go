@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// encryptedStorage encrypts values with AES-GCM before they reach the backend. The backend never sees the one time
+// password either, entries are stored under an HMAC of it, which is also authenticated with the value so entries
+// cannot be swapped.
+type encryptedStorage struct {
+	backend Storage
+	aead    cipher.AEAD
+	idKey   []byte
+}
+
+// LoadEncryptionKey reads the key from a file mounted from a Secret, any random content of at least 32 bytes will do
+func LoadEncryptionKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("encryption key in %s must be at least 32 bytes", path)
+	}
+	return key, nil
+}
+
+func NewEncryptedStorage(backend Storage, key []byte) (*encryptedStorage, error) {
+	block, err := aes.NewCipher(deriveKey(key, "otp-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{backend: backend, aead: aead, idKey: deriveKey(key, "otp-id")}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (e *encryptedStorage) storageId(id string) string {
+	mac := hmac.New(sha256.New, e.idKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e *encryptedStorage) Put(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	storageId := e.storageId(id)
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return e.backend.Put(ctx, storageId, e.aead.Seal(nonce, nonce, value, []byte(storageId)), ttl)
+}
+
+func (e *encryptedStorage) Take(ctx context.Context, id string) ([]byte, error) {
+	storageId := e.storageId(id)
+	sealed, err := e.backend.Take(ctx, storageId)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < e.aead.NonceSize() {
+		return nil, fmt.Errorf("stored value is too short")
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	value, err := e.aead.Open(nil, nonce, ciphertext, []byte(storageId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored value: %w", err)
+	}
+	return value, nil
+}
+
+func (e *encryptedStorage) Sweep(ctx context.Context) (int, error) {
+	return e.backend.Sweep(ctx)
+}
@@ -2,15 +2,23 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	zap2 "go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"k8s.io/klog/v2"
 	"log"
 	"net/http"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"strings"
 	"time"
 )
 
@@ -23,6 +31,22 @@ const (
 	KeyFilePath  = "/tls/tls.key"
 )
 
+var (
+	storageType       = flag.String("storage", StorageMemory, "where keys are kept until they are fetched: memory, secret or redis. Only secret and redis can be shared by several replicas")
+	encryptionKeyFile = flag.String("encryption-key-file", "/encryption/key", "file with the key stored keys are encrypted with, required for secret and redis storage")
+	redisAddress      = flag.String("redis-address", "", "host:port of the redis server")
+	redisPasswordFile = flag.String("redis-password-file", "", "file with the redis password")
+	redisTls          = flag.Bool("redis-tls", false, "connect to redis with TLS")
+	keyTtl            = flag.Duration("key-ttl", time.Hour, "how long a key is kept if it is not fetched")
+	sweepInterval     = flag.Duration("sweep-interval", time.Minute, "how often expired keys are removed")
+	maxKeySize        = flag.Int64("max-key-size", 16*1024, "the largest key that can be stored, in bytes")
+	rateLimit         = flag.Float64("rate-limit", 5, "requests per second allowed from each client, 0 disables the limit")
+	rateBurst         = flag.Int("rate-burst", 20, "requests a client can make at once before the rate limit applies")
+	authenticate      = flag.Bool("authenticate", true, "only allow the allowed users to store keys, checked with a TokenReview of their bearer token")
+	allowedUsers      = flag.String("allowed-users", "", "comma separated users that can store keys, defaults to the multi-platform-controller service account in the namespace of the server")
+	metricsAddress    = flag.String("metrics-address", ":8080", "the address the metrics endpoint binds to")
+)
+
 func main() {
 
 	klog.InitFlags(flag.CommandLine)
@@ -41,8 +65,38 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error loading certificate and key file: %v", err)
 	}
-	otp := NewOtp(&logger)
-	store := NewStoreKey(&logger)
+	var kubeClient client.Client
+	if *storageType == StorageSecret || *authenticate {
+		kubeClient, err = client.New(config.GetConfigOrDie(), client.Options{})
+		if err != nil {
+			log.Fatalf("Error creating kubernetes client: %v", err)
+		}
+	}
+	storage, err := newStorage(kubeClient)
+	if err != nil {
+		log.Fatalf("Error setting up %s storage: %v", *storageType, err)
+	}
+	settings := settings{ttl: *keyTtl, maxKeySize: *maxKeySize, metrics: NewOtpMetrics(prometheus.DefaultRegisterer)}
+	if *rateLimit > 0 {
+		settings.limiter = NewClientLimiter(*rateLimit, *rateBurst)
+	}
+	if *authenticate {
+		users := *allowedUsers
+		if users == "" {
+			users = "system:serviceaccount:" + os.Getenv("POD_NAMESPACE") + ":multi-platform-controller"
+		}
+		settings.auth = NewAuthenticator(kubeClient, strings.Split(users, ","))
+	}
+	go sweep(context.Background(), &logger, storage, &settings, *sweepInterval)
+	go func() {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsServer := http.Server{Addr: *metricsAddress, Handler: metricsMux, ReadHeaderTimeout: time.Second * 3}
+		logger.Info("starting metrics server", "address", *metricsAddress)
+		log.Fatal(metricsServer.ListenAndServe())
+	}()
+	otp := NewOtp(&logger, storage, &settings)
+	store := NewStoreKey(&logger, storage, &settings)
 	mux := http.NewServeMux()
 	mux.Handle("/store-key", store)
 	mux.Handle("/otp", otp)
@@ -61,3 +115,41 @@ func main() {
 	defer server.Close()
 	log.Fatal(server.ListenAndServeTLS("", ""))
 }
+
+func newStorage(kubeClient client.Client) (Storage, error) {
+	var backend Storage
+	switch *storageType {
+	case StorageMemory:
+		backend = NewMemoryStorage()
+	case StorageSecret:
+		backend = NewSecretStorage(kubeClient, os.Getenv("POD_NAMESPACE"))
+	case StorageRedis:
+		if *redisAddress == "" {
+			return nil, fmt.Errorf("redis-address must be set")
+		}
+		password := ""
+		if *redisPasswordFile != "" {
+			data, err := os.ReadFile(*redisPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		var tlsConfig *tls.Config
+		if *redisTls {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		backend = NewRedisStorage(*redisAddress, password, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unknown storage %s", *storageType)
+	}
+	key, err := LoadEncryptionKey(*encryptionKeyFile)
+	if err != nil {
+		if *storageType == StorageMemory && os.IsNotExist(err) {
+			// Keys held in memory are not at rest, and this keeps existing deployments working
+			return backend, nil
+		}
+		return nil, err
+	}
+	return NewEncryptedStorage(backend, key)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	RejectedTooLarge     = "too_large"
+	RejectedRateLimited  = "rate_limited"
+	RejectedUnauthorized = "unauthorized"
+	RejectedUnknownOtp   = "unknown_otp"
+)
+
+type otpMetrics struct {
+	stored   prometheus.Counter
+	served   prometheus.Counter
+	expired  prometheus.Counter
+	rejected *prometheus.CounterVec
+}
+
+func NewOtpMetrics(registry prometheus.Registerer) *otpMetrics {
+	ret := otpMetrics{
+		stored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multi_platform_otp_keys_stored_total",
+			Help: "The number of keys stored",
+		}),
+		served: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multi_platform_otp_keys_served_total",
+			Help: "The number of keys fetched with their one time password",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multi_platform_otp_keys_expired_total",
+			Help: "The number of keys removed because they were not fetched in time, keys expired by redis are not counted",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "multi_platform_otp_requests_rejected_total",
+			Help: "The number of rejected requests",
+		}, []string{"endpoint", "reason"}),
+	}
+	registry.MustRegister(ret.stored, ret.served, ret.expired, ret.rejected)
+	return &ret
+}
@@ -1,39 +1,99 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"github.com/go-logr/logr"
 	"io"
 	"math/big"
 	"net/http"
-	"sync"
+	"time"
 )
 
-var mutex = sync.Mutex{}
-var globalMap = map[string][]byte{}
+const (
+	// maxOtpSize is the largest body accepted by /otp, one time passwords are much shorter
+	maxOtpSize = 1024
+)
 
-// otp service example implementation.
-// The example methods log the requests and return zero values.
-type storekey struct {
-	logger *logr.Logger
+// settings are shared by both endpoints
+type settings struct {
+	ttl        time.Duration
+	maxKeySize int64
+	// limiter limits requests per client, if it is nil there is no limit
+	limiter *clientLimiter
+	// auth checks who stores keys, if it is nil anyone can store keys
+	auth    *authenticator
+	metrics *otpMetrics
 }
 
-func (s *storekey) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	body, err := io.ReadAll(request.Body)
+// allow applies the rate limit, it writes the error response and returns false if the request is rejected. It is
+// checked before anything else, so rejected clients can't cause any other work such as token reviews.
+func (s *settings) allow(writer http.ResponseWriter, request *http.Request, logger *logr.Logger, endpoint string) bool {
+	if s.limiter != nil && !s.limiter.allow(request.RemoteAddr, time.Now()) {
+		s.metrics.rejected.WithLabelValues(endpoint, RejectedRateLimited).Inc()
+		logger.Info("rate limited request", "address", request.RemoteAddr)
+		writer.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// readBody applies the size limit, it writes the error response and returns false if the request is rejected
+func (s *settings) readBody(writer http.ResponseWriter, request *http.Request, logger *logr.Logger, endpoint string, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, limit))
 	if err != nil {
-		s.logger.Error(err, "failed to read request body", "address", request.RemoteAddr)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.metrics.rejected.WithLabelValues(endpoint, RejectedTooLarge).Inc()
+			logger.Info("rejected request body that is too large", "address", request.RemoteAddr, "limit", limit)
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		logger.Error(err, "failed to read request body", "address", request.RemoteAddr)
 		writer.WriteHeader(500)
+		return nil, false
+	}
+	return body, true
+}
+
+// storekey stores a key and returns the one time password to fetch it
+type storekey struct {
+	logger   *logr.Logger
+	storage  Storage
+	settings *settings
+}
+
+func (s *storekey) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !s.settings.allow(writer, request, s.logger, "store-key") {
+		return
+	}
+	if s.settings.auth != nil {
+		user, err := s.settings.auth.authenticate(request.Context(), request)
+		if err != nil {
+			s.settings.metrics.rejected.WithLabelValues("store-key", RejectedUnauthorized).Inc()
+			s.logger.Info("rejected unauthorized request", "address", request.RemoteAddr, "user", user, "reason", err.Error())
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	body, ok := s.settings.readBody(writer, request, s.logger, "store-key", s.settings.maxKeySize)
+	if !ok {
 		return
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
 	otp, err := GenerateRandomString(20)
 	if err != nil {
 		s.logger.Error(err, "failed to generate OTP password", "address", request.RemoteAddr)
 		writer.WriteHeader(500)
 		return
 	}
-	globalMap[otp] = body
+	err = s.storage.Put(request.Context(), otp, body, s.settings.ttl)
+	if err != nil {
+		s.logger.Error(err, "failed to store SSH key", "address", request.RemoteAddr)
+		writer.WriteHeader(500)
+		return
+	}
+	s.settings.metrics.stored.Inc()
 	_, err = writer.Write([]byte(otp))
 	if err != nil {
 		s.logger.Error(err, "failed to write http response", "address", request.RemoteAddr)
@@ -43,36 +103,44 @@ func (s *storekey) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 	}
 }
 
-// NewOtp returns the otp service implementation.
-func NewStoreKey(logger *logr.Logger) *storekey {
-	return &storekey{logger}
+// NewStoreKey returns the store-key service implementation.
+func NewStoreKey(logger *logr.Logger, storage Storage, settings *settings) *storekey {
+	return &storekey{logger, storage, settings}
 }
 
+// otp returns a stored key, once, to whoever has its one time password
 type otp struct {
-	logger *logr.Logger
+	logger   *logr.Logger
+	storage  Storage
+	settings *settings
 }
 
 // NewOtp returns the otp service implementation.
-func NewOtp(logger *logr.Logger) *otp {
-	return &otp{logger}
+func NewOtp(logger *logr.Logger, storage Storage, settings *settings) *otp {
+	return &otp{logger, storage, settings}
 }
 
 func (s *otp) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-
-	body, err := io.ReadAll(request.Body)
-	if err != nil {
-		s.logger.Error(err, "failed to read request body")
-		writer.WriteHeader(500)
+	if !s.settings.allow(writer, request, s.logger, "otp") {
 		return
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	res, loaded := globalMap[string(body)]
-	delete(globalMap, string(body))
-	if !loaded {
+	body, ok := s.settings.readBody(writer, request, s.logger, "otp", maxOtpSize)
+	if !ok {
+		return
+	}
+	res, err := s.storage.Take(request.Context(), string(body))
+	if errors.Is(err, errNotFound) {
+		s.settings.metrics.rejected.WithLabelValues("otp", RejectedUnknownOtp).Inc()
 		writer.WriteHeader(400)
+	} else if errors.Is(err, errExpired) {
+		s.settings.metrics.expired.Inc()
+		s.logger.Info("one time password has expired", "address", request.RemoteAddr)
+		writer.WriteHeader(400)
+	} else if err != nil {
+		s.logger.Error(err, "failed to read SSH key", "address", request.RemoteAddr)
+		writer.WriteHeader(500)
 	} else {
+		s.settings.metrics.served.Inc()
 		_, err := writer.Write(res)
 		if err != nil {
 			s.logger.Error(err, "failed to write http response", "address", request.RemoteAddr)
@@ -83,6 +151,30 @@ func (s *otp) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// sweep removes expired keys and idle rate limits until the context is cancelled
+func sweep(ctx context.Context, logger *logr.Logger, storage Storage, settings *settings, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := storage.Sweep(ctx)
+			if err != nil {
+				logger.Error(err, "failed to remove expired keys")
+			}
+			if removed > 0 {
+				settings.metrics.expired.Add(float64(removed))
+				logger.Info("removed expired keys", "count", removed)
+			}
+			if settings.limiter != nil {
+				settings.limiter.prune(time.Now())
+			}
+		}
+	}
+}
+
 // GenerateRandomString returns a securely generated random string.
 // It will return an error if the system's secure random
 // number generator fails to function correctly, in which
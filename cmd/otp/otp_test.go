@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const controllerUser = "system:serviceaccount:multi-platform-controller:multi-platform-controller"
+
+func testSettings() *settings {
+	return &settings{ttl: time.Hour, maxKeySize: 64, metrics: NewOtpMetrics(prometheus.NewRegistry())}
+}
+
+func storeKey(handler http.Handler, key string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/store-key", strings.NewReader(key))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+func fetchKey(handler http.Handler, otp string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/otp", strings.NewReader(otp)))
+	return response
+}
+
+func TestHandlers(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	storage := NewMemoryStorage()
+	settings := testSettings()
+	store := storeKey(NewStoreKey(&logger, storage, settings), "ssh-key", "")
+	g.Expect(store.Code).Should(Equal(http.StatusOK))
+	otp := store.Body.String()
+	g.Expect(otp).Should(HaveLen(20))
+
+	// Another replica sharing the storage serves the key, once
+	fetch := fetchKey(NewOtp(&logger, storage, settings), otp)
+	g.Expect(fetch.Code).Should(Equal(http.StatusOK))
+	g.Expect(fetch.Body.String()).Should(Equal("ssh-key"))
+	fetch = fetchKey(NewOtp(&logger, storage, settings), otp)
+	g.Expect(fetch.Code).Should(Equal(http.StatusBadRequest))
+
+	g.Expect(testutil.ToFloat64(settings.metrics.stored)).Should(Equal(1.0))
+	g.Expect(testutil.ToFloat64(settings.metrics.served)).Should(Equal(1.0))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("otp", RejectedUnknownOtp))).Should(Equal(1.0))
+}
+
+func TestSizeLimits(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	storage := NewMemoryStorage()
+	settings := testSettings()
+	g.Expect(storeKey(NewStoreKey(&logger, storage, settings), strings.Repeat("k", 64), "").Code).Should(Equal(http.StatusOK))
+	g.Expect(storeKey(NewStoreKey(&logger, storage, settings), strings.Repeat("k", 65), "").Code).Should(Equal(http.StatusRequestEntityTooLarge))
+	g.Expect(fetchKey(NewOtp(&logger, storage, settings), strings.Repeat("o", maxOtpSize+1)).Code).Should(Equal(http.StatusRequestEntityTooLarge))
+	g.Expect(storage.keys).Should(HaveLen(1))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("store-key", RejectedTooLarge))).Should(Equal(1.0))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("otp", RejectedTooLarge))).Should(Equal(1.0))
+}
+
+func TestRateLimit(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	settings := testSettings()
+	settings.limiter = NewClientLimiter(1, 2)
+	handler := NewOtp(&logger, NewMemoryStorage(), settings)
+	// httptest requests all come from the same address
+	g.Expect(fetchKey(handler, "guess").Code).Should(Equal(http.StatusBadRequest))
+	g.Expect(fetchKey(handler, "guess").Code).Should(Equal(http.StatusBadRequest))
+	g.Expect(fetchKey(handler, "guess").Code).Should(Equal(http.StatusTooManyRequests))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("otp", RejectedRateLimited))).Should(Equal(1.0))
+
+	// Other clients have their own limit
+	now := time.Now()
+	g.Expect(settings.limiter.allow("10.0.0.1:1234", now)).Should(BeTrue())
+	g.Expect(settings.limiter.allow("10.0.0.1:5678", now)).Should(BeTrue())
+	g.Expect(settings.limiter.allow("10.0.0.1:1234", now)).Should(BeFalse())
+	g.Expect(settings.limiter.allow("10.0.0.2:1234", now)).Should(BeTrue())
+
+	settings.limiter.prune(now.Add(time.Minute * 2))
+	g.Expect(settings.limiter.clients).Should(BeEmpty())
+}
+
+func TestAuthentication(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	kubeClient := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, client client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			review := obj.(*authenticationv1.TokenReview)
+			switch review.Spec.Token {
+			case "controller-token":
+				review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: controllerUser}}
+			case "build-token":
+				review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "system:serviceaccount:user-ns:pipeline"}}
+			default:
+				review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+			}
+			return nil
+		},
+	}).Build()
+	storage := NewMemoryStorage()
+	settings := testSettings()
+	settings.auth = NewAuthenticator(kubeClient, []string{controllerUser})
+	handler := NewStoreKey(&logger, storage, settings)
+
+	g.Expect(storeKey(handler, "ssh-key", "").Code).Should(Equal(http.StatusUnauthorized))
+	g.Expect(storeKey(handler, "ssh-key", "forged-token").Code).Should(Equal(http.StatusUnauthorized))
+	g.Expect(storeKey(handler, "ssh-key", "build-token").Code).Should(Equal(http.StatusUnauthorized))
+	g.Expect(storage.keys).Should(BeEmpty())
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("store-key", RejectedUnauthorized))).Should(Equal(3.0))
+
+	g.Expect(storeKey(handler, "ssh-key", "controller-token").Code).Should(Equal(http.StatusOK))
+	g.Expect(storage.keys).Should(HaveLen(1))
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	reviews := 0
+	kubeClient := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, client client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			reviews++
+			obj.(*authenticationv1.TokenReview).Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+			return nil
+		},
+	}).Build()
+	settings := testSettings()
+	settings.auth = NewAuthenticator(kubeClient, []string{controllerUser})
+	settings.limiter = NewClientLimiter(1, 2)
+	handler := NewStoreKey(&logger, NewMemoryStorage(), settings)
+
+	// Rate limited requests are rejected without a token review
+	g.Expect(storeKey(handler, "ssh-key", "forged-token").Code).Should(Equal(http.StatusUnauthorized))
+	g.Expect(storeKey(handler, "ssh-key", "forged-token").Code).Should(Equal(http.StatusUnauthorized))
+	g.Expect(storeKey(handler, "ssh-key", "forged-token").Code).Should(Equal(http.StatusTooManyRequests))
+	g.Expect(reviews).Should(Equal(2))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("store-key", RejectedRateLimited))).Should(Equal(1.0))
+	g.Expect(testutil.ToFloat64(settings.metrics.rejected.WithLabelValues("store-key", RejectedUnauthorized))).Should(Equal(2.0))
+}
+
+func TestExpiry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	logger := logr.Discard()
+	now := time.Now()
+	storage := NewMemoryStorage()
+	storage.now = func() time.Time { return now }
+	settings := testSettings()
+	settings.ttl = time.Minute
+	fetched := storeKey(NewStoreKey(&logger, storage, settings), "fetched-key", "").Body.String()
+	storeKey(NewStoreKey(&logger, storage, settings), "forgotten-key", "")
+
+	now = now.Add(time.Minute * 2)
+	g.Expect(fetchKey(NewOtp(&logger, storage, settings), fetched).Code).Should(Equal(http.StatusBadRequest))
+	g.Expect(testutil.ToFloat64(settings.metrics.expired)).Should(Equal(1.0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sweep(ctx, &logger, storage, settings, time.Millisecond*10)
+	g.Eventually(func() float64 { return testutil.ToFloat64(settings.metrics.expired) }).Should(Equal(2.0))
+	g.Eventually(func() int {
+		storage.lock.Lock()
+		defer storage.lock.Unlock()
+		return len(storage.keys)
+	}).Should(Equal(0))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type clientLimit struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiter limits the rate of requests from each client address, the addresses are forgotten once they have
+// been idle for long enough to have a full burst again
+type clientLimiter struct {
+	lock    sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*clientLimit
+}
+
+func NewClientLimiter(perSecond float64, burst int) *clientLimiter {
+	return &clientLimiter{limit: rate.Limit(perSecond), burst: burst, clients: map[string]*clientLimit{}}
+}
+
+// allow is true if the client has not used up its requests, the client is identified by the remote address
+// without the port
+func (c *clientLimiter) allow(remoteAddr string, now time.Time) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	client := c.clients[host]
+	if client == nil {
+		client = &clientLimit{limiter: rate.NewLimiter(c.limit, c.burst)}
+		c.clients[host] = client
+	}
+	client.lastSeen = now
+	return client.limiter.AllowN(now, 1)
+}
+
+// prune forgets idle clients
+func (c *clientLimiter) prune(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	idle := time.Minute
+	if c.limit > 0 {
+		idle += time.Duration(float64(c.burst) / float64(c.limit) * float64(time.Second))
+	}
+	for host, client := range c.clients {
+		if now.Sub(client.lastSeen) > idle {
+			delete(c.clients, host)
+		}
+	}
+}
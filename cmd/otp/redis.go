@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "multi-platform-otp:"
+	redisTimeout   = time.Second * 5
+)
+
+// redisStorage keeps keys in a server that speaks the Redis protocol. It needs GETDEL, which was added in Redis 6.2,
+// to read and remove a key in one step. Requests are rare so every operation uses its own connection. Keys are
+// expired by the server, so the sweeper has nothing to do.
+type redisStorage struct {
+	address  string
+	password string
+	tls      *tls.Config
+}
+
+func NewRedisStorage(address string, password string, tlsConfig *tls.Config) *redisStorage {
+	return &redisStorage{address: address, password: password, tls: tlsConfig}
+}
+
+func (r *redisStorage) Put(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	reply, err := r.do(ctx, "SET", redisKeyPrefix+id, string(value), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errExists
+	}
+	return nil
+}
+
+func (r *redisStorage) Take(ctx context.Context, id string) ([]byte, error) {
+	reply, err := r.do(ctx, "GETDEL", redisKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errNotFound
+	}
+	return reply, nil
+}
+
+func (r *redisStorage) Sweep(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// do sends one command and returns its reply, a nil reply is returned as nil
+func (r *redisStorage) do(ctx context.Context, args ...string) ([]byte, error) {
+	dialer := net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: &dialer, Config: r.tls}).DialContext(ctx, "tcp", r.address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", r.address, err)
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if r.password != "" {
+		if _, err := redisCommand(conn, reader, "AUTH", r.password); err != nil {
+			return nil, fmt.Errorf("failed to authenticate to redis: %w", err)
+		}
+	}
+	return redisCommand(conn, reader, args...)
+}
+
+func redisCommand(writer io.Writer, reader *bufio.Reader, args ...string) ([]byte, error) {
+	command := strings.Builder{}
+	command.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		command.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := io.WriteString(writer, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(reader)
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply
+func readRedisReply(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk string length %s", line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+	return nil, fmt.Errorf("unsupported redis reply %q", line)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	StorageMemory = "memory"
+	StorageSecret = "secret"
+	StorageRedis  = "redis"
+
+	// OtpSecretLabel marks the Secrets the secret storage keeps keys in
+	OtpSecretLabel = "build.appstudio.redhat.com/otp"
+	// OtpExpiresAnnotation is when the key in a Secret expires, in RFC 3339 format
+	OtpExpiresAnnotation = "build.appstudio.redhat.com/otp-expires"
+	otpSecretKey         = "value"
+)
+
+var (
+	errNotFound = fmt.Errorf("one time password not found")
+	errExpired  = fmt.Errorf("one time password has expired")
+	errExists   = fmt.Errorf("one time password already exists")
+)
+
+// Storage holds keys until they are fetched or expire. Take must return a key at most once, even when several
+// replicas of the server share the storage.
+type Storage interface {
+	// Put stores the value under the id until the ttl runs out, it returns errExists if the id is in use
+	Put(ctx context.Context, id string, value []byte, ttl time.Duration) error
+	// Take removes the value and returns it, it returns errNotFound if there is no value for the id, or errExpired
+	// if the value expired but has not been swept yet
+	Take(ctx context.Context, id string) ([]byte, error)
+	// Sweep removes expired values and returns how many it removed
+	Sweep(ctx context.Context) (int, error)
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStorage keeps keys in the process, they are lost on restart and not shared with other replicas
+type memoryStorage struct {
+	lock sync.Mutex
+	keys map[string]memoryEntry
+	now  func() time.Time
+}
+
+func NewMemoryStorage() *memoryStorage {
+	return &memoryStorage{keys: map[string]memoryEntry{}, now: time.Now}
+}
+
+func (m *memoryStorage) Put(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.keys[id]; exists {
+		return errExists
+	}
+	m.keys[id] = memoryEntry{value: value, expires: m.now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryStorage) Take(ctx context.Context, id string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, exists := m.keys[id]
+	if !exists {
+		return nil, errNotFound
+	}
+	delete(m.keys, id)
+	if !m.now().Before(entry.expires) {
+		return nil, errExpired
+	}
+	return entry.value, nil
+}
+
+func (m *memoryStorage) Sweep(ctx context.Context) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	removed := 0
+	for id, entry := range m.keys {
+		if !now.Before(entry.expires) {
+			delete(m.keys, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// secretStorage keeps each key in its own Secret. Take deletes the Secret with a UID precondition, so if two
+// replicas read it at the same time only one of them returns the key.
+type secretStorage struct {
+	client    client.Client
+	namespace string
+	now       func() time.Time
+}
+
+func NewSecretStorage(client client.Client, namespace string) *secretStorage {
+	return &secretStorage{client: client, namespace: namespace, now: time.Now}
+}
+
+// secretName hashes the id, which may not be a valid object name
+func (s *secretStorage) secretName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "otp-" + hex.EncodeToString(sum[:])
+}
+
+func (s *secretStorage) Put(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	secret := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        s.secretName(id),
+			Namespace:   s.namespace,
+			Labels:      map[string]string{OtpSecretLabel: "true"},
+			Annotations: map[string]string{OtpExpiresAnnotation: s.now().Add(ttl).UTC().Format(time.RFC3339)},
+		},
+		Data: map[string][]byte{otpSecretKey: value},
+	}
+	err := s.client.Create(ctx, &secret)
+	if errors.IsAlreadyExists(err) {
+		return errExists
+	}
+	return err
+}
+
+func (s *secretStorage) Take(ctx context.Context, id string) ([]byte, error) {
+	secret := v1.Secret{}
+	err := s.client.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.secretName(id)}, &secret)
+	if errors.IsNotFound(err) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	err = s.delete(ctx, &secret)
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(&secret) {
+		return nil, errExpired
+	}
+	return secret.Data[otpSecretKey], nil
+}
+
+func (s *secretStorage) Sweep(ctx context.Context) (int, error) {
+	list := v1.SecretList{}
+	err := s.client.List(ctx, &list, client.InNamespace(s.namespace), client.MatchingLabels{OtpSecretLabel: "true"})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range list.Items {
+		secret := &list.Items[i]
+		if !s.expired(secret) {
+			continue
+		}
+		err := s.delete(ctx, secret)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// delete removes the Secret if it has not been replaced, it returns errNotFound if another replica removed it first
+func (s *secretStorage) delete(ctx context.Context, secret *v1.Secret) error {
+	err := s.client.Delete(ctx, secret, client.Preconditions{UID: &secret.UID})
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		return errNotFound
+	}
+	return err
+}
+
+// expired is true if the Secret has passed its expiry time, a Secret with a missing or invalid time has expired
+func (s *secretStorage) expired(secret *v1.Secret) bool {
+	expires, err := time.Parse(time.RFC3339, secret.Annotations[OtpExpiresAnnotation])
+	return err != nil || !s.now().Before(expires)
+}
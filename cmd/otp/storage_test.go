@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestSecretStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	kubeClient := fake.NewClientBuilder().Build()
+	storage := NewSecretStorage(kubeClient, "test-ns")
+	testStorage(t, storage)
+
+	// Only the ciphertext ends up in the Secret
+	encrypted, err := NewEncryptedStorage(storage, testEncryptionKey)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(encrypted.Put(context.Background(), "otp", []byte("ssh-key"), time.Hour)).Should(Succeed())
+	list := v1.SecretList{}
+	g.Expect(kubeClient.List(context.Background(), &list, client.InNamespace("test-ns"))).Should(Succeed())
+	g.Expect(list.Items).Should(HaveLen(1))
+	g.Expect(list.Items[0].Labels).Should(HaveKeyWithValue(OtpSecretLabel, "true"))
+	g.Expect(list.Items[0].Name).ShouldNot(ContainSubstring("otp-otp"))
+	g.Expect(bytes.Contains(list.Items[0].Data[otpSecretKey], []byte("ssh-key"))).Should(BeFalse())
+}
+
+func TestRedisStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	server := startFakeRedis(t, "secret")
+	testStorage(t, NewRedisStorage(server.address, "secret", nil))
+
+	_, err := NewRedisStorage(server.address, "wrong", nil).Take(context.Background(), "otp")
+	g.Expect(err).Should(MatchError(ContainSubstring("failed to authenticate")))
+
+	encrypted, err := NewEncryptedStorage(NewRedisStorage(server.address, "secret", nil), testEncryptionKey)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(encrypted.Put(context.Background(), "otp", []byte("ssh-key"), time.Hour)).Should(Succeed())
+	server.lock.Lock()
+	for key, value := range server.values {
+		g.Expect(key).Should(HavePrefix(redisKeyPrefix))
+		g.Expect(strings.TrimPrefix(key, redisKeyPrefix)).ShouldNot(Equal("otp"))
+		g.Expect(value).ShouldNot(ContainSubstring("ssh-key"))
+		// Redis expires the key itself
+		g.Expect(server.ttls[key]).Should(Equal("3600000"))
+	}
+	server.lock.Unlock()
+}
+
+func TestMemoryStorageExpiry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	now := time.Now()
+	storage := NewMemoryStorage()
+	storage.now = func() time.Time { return now }
+	g.Expect(storage.Put(ctx, "short", []byte("short-key"), time.Minute)).Should(Succeed())
+	g.Expect(storage.Put(ctx, "long", []byte("long-key"), time.Hour)).Should(Succeed())
+	g.Expect(storage.Put(ctx, "fetched", []byte("fetched-key"), time.Minute)).Should(Succeed())
+
+	now = now.Add(time.Minute * 2)
+	_, err := storage.Take(ctx, "fetched")
+	g.Expect(err).Should(MatchError(errExpired))
+	g.Expect(storage.Sweep(ctx)).Should(Equal(1))
+	g.Expect(storage.keys).Should(HaveLen(1))
+	g.Expect(storage.Take(ctx, "long")).Should(Equal([]byte("long-key")))
+}
+
+func TestSecretStorageExpiry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	now := time.Now()
+	kubeClient := fake.NewClientBuilder().Build()
+	storage := NewSecretStorage(kubeClient, "test-ns")
+	storage.now = func() time.Time { return now }
+	g.Expect(storage.Put(ctx, "short", []byte("short-key"), time.Minute)).Should(Succeed())
+	g.Expect(storage.Put(ctx, "long", []byte("long-key"), time.Hour)).Should(Succeed())
+	g.Expect(storage.Put(ctx, "fetched", []byte("fetched-key"), time.Minute)).Should(Succeed())
+	// Secrets the server did not create are left alone
+	g.Expect(kubeClient.Create(ctx, &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "test-ns"}})).Should(Succeed())
+
+	now = now.Add(time.Minute * 2)
+	_, err := storage.Take(ctx, "fetched")
+	g.Expect(err).Should(MatchError(errExpired))
+	g.Expect(storage.Sweep(ctx)).Should(Equal(1))
+	list := v1.SecretList{}
+	g.Expect(kubeClient.List(ctx, &list, client.InNamespace("test-ns"))).Should(Succeed())
+	g.Expect(list.Items).Should(HaveLen(2))
+	g.Expect(storage.Take(ctx, "long")).Should(Equal([]byte("long-key")))
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	backend := NewMemoryStorage()
+	storage, err := NewEncryptedStorage(backend, testEncryptionKey)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	testStorage(t, storage)
+
+	// A value stored under another id fails authentication
+	g.Expect(storage.Put(context.Background(), "first", []byte("first-key"), time.Hour)).Should(Succeed())
+	g.Expect(storage.Put(context.Background(), "second", []byte("second-key"), time.Hour)).Should(Succeed())
+	backend.keys[storage.storageId("first")], backend.keys[storage.storageId("second")] = backend.keys[storage.storageId("second")], backend.keys[storage.storageId("first")]
+	_, err = storage.Take(context.Background(), "first")
+	g.Expect(err).Should(MatchError(ContainSubstring("failed to decrypt")))
+
+	// Another replica with a different key cannot read the values
+	g.Expect(storage.Put(context.Background(), "third", []byte("third-key"), time.Hour)).Should(Succeed())
+	other, err := NewEncryptedStorage(backend, []byte("fedcba9876543210fedcba9876543210"))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	_, err = other.Take(context.Background(), "third")
+	g.Expect(err).Should(MatchError(errNotFound))
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	_, err := storage.Take(ctx, "missing")
+	g.Expect(err).Should(MatchError(errNotFound))
+	g.Expect(storage.Put(ctx, "otp", []byte("ssh-key"), time.Hour)).Should(Succeed())
+	g.Expect(storage.Put(ctx, "otp", []byte("other-key"), time.Hour)).Should(MatchError(errExists))
+
+	// Concurrent fetches get the key exactly once
+	results := make(chan error, 5)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := storage.Take(ctx, "otp")
+			if err == nil && string(value) != "ssh-key" {
+				err = errors.New("unexpected value " + string(value))
+			}
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	found := 0
+	for err := range results {
+		if err == nil {
+			found++
+		} else {
+			g.Expect(err).Should(MatchError(errNotFound))
+		}
+	}
+	g.Expect(found).Should(Equal(1))
+}
+
+// fakeRedis implements the few commands the storage uses
+type fakeRedis struct {
+	address string
+	lock    sync.Mutex
+	values  map[string]string
+	ttls    map[string]string
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	server := &fakeRedis{address: listener.Addr().String(), values: map[string]string{}, ttls: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, password)
+		}
+	}()
+	return server
+}
+
+func (f *fakeRedis) serve(conn net.Conn, password string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		f.lock.Lock()
+		switch {
+		case args[0] == "AUTH" && args[1] == password:
+			authenticated = true
+			reply = "+OK\r\n"
+		case args[0] == "AUTH":
+			reply = "-WRONGPASS invalid password\r\n"
+		case !authenticated:
+			reply = "-NOAUTH Authentication required\r\n"
+		case args[0] == "SET" && len(args) == 6 && args[3] == "NX" && args[4] == "PX":
+			if _, exists := f.values[args[1]]; exists {
+				reply = "$-1\r\n"
+			} else {
+				f.values[args[1]] = args[2]
+				f.ttls[args[1]] = args[5]
+				reply = "+OK\r\n"
+			}
+		case args[0] == "GETDEL":
+			if value, exists := f.values[args[1]]; exists {
+				delete(f.values, args[1])
+				reply = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+			} else {
+				reply = "$-1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.lock.Unlock()
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for i := 0; i < count; i++ {
+		value, err := readRedisReply(reader)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(value))
+	}
+	return args, nil
+}
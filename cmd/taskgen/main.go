@@ -105,9 +105,18 @@ else
   cp /ssh/id_rsa ~/.ssh
 fi
 chmod 0400 ~/.ssh/id_rsa
+if [ -e "/ssh/id_rsa-cert.pub" ]; then
+  cp /ssh/id_rsa-cert.pub ~/.ssh
+fi
 export SSH_HOST=$(cat /ssh/host)
 export BUILD_DIR=$(cat /ssh/user-dir)
-export SSH_ARGS="-o StrictHostKeyChecking=no"
+if [ -s "/ssh/known_hosts" ]; then
+  # rsync also uses ~/.ssh/known_hosts, so it checks the host key as well
+  cp /ssh/known_hosts ~/.ssh/known_hosts
+  export SSH_ARGS="-o StrictHostKeyChecking=yes"
+else
+  export SSH_ARGS="-o StrictHostKeyChecking=no"
+fi
 mkdir -p scripts
 echo "$BUILD_DIR"
 ssh $SSH_ARGS "$SSH_HOST"  mkdir -p "$BUILD_DIR/workspaces" "$BUILD_DIR/scripts"
@@ -0,0 +1,228 @@
+/*
+Copyright 2021-2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Hosts",type=integer,JSONPath=`.status.hostCount`
+// +kubebuilder:printcolumn:name="Running",type=integer,JSONPath=`.status.runningTasks`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// HostPool is a set of statically provisioned hosts that builds are scheduled onto
+type HostPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   HostPoolSpec   `json:"spec"`
+	Status HostPoolStatus `json:"status,omitempty"`
+}
+
+// HostPoolSpec defines the hosts that are part of the pool
+type HostPoolSpec struct {
+	// +kubebuilder:validation:MinItems=1
+	Hosts []HostSpec `json:"hosts"`
+}
+
+// HostSpec defines a single static host
+type HostSpec struct {
+	// Name is used to identify the host, it is used as a label value so must be a valid label
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	Name string `json:"name"`
+	// Address is the host name or IP the host can be reached at
+	// +kubebuilder:validation:MinLength=1
+	Address string `json:"address"`
+	// Platform is the platform the host builds for, e.g. linux/arm64
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]+(/[a-z0-9_]+)+$`
+	Platform string `json:"platform"`
+	// User is the privileged user the controller connects as to provision build users
+	// +kubebuilder:validation:MinLength=1
+	User string `json:"user"`
+	// Secret is the name of the secret holding the SSH key for User
+	// +kubebuilder:validation:MinLength=1
+	Secret string `json:"secret"`
+	// Concurrency is the maximum number of builds that can run on the host at once
+	// +kubebuilder:validation:Minimum=1
+	Concurrency int `json:"concurrency"`
+	// HostKey pins the SSH host key, in authorized keys format. If it is not set the key is captured the first time
+	// the host is used.
+	// +optional
+	HostKey string `json:"hostKey,omitempty"`
+}
+
+// HostPoolStatus reports the live state of the pool
+type HostPoolStatus struct {
+	// +optional
+	HostCount int `json:"hostCount"`
+	// +optional
+	RunningTasks int `json:"runningTasks"`
+	// +optional
+	Hosts []HostStatus `json:"hosts,omitempty"`
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// HostStatus reports the live state of a single host
+type HostStatus struct {
+	Name         string `json:"name"`
+	Platform     string `json:"platform"`
+	RunningTasks int    `json:"runningTasks"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+
+// HostPoolList contains a list of HostPool
+type HostPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []HostPool `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Platform",type=string,JSONPath=`.spec.platform`
+// +kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+// +kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.status.instances`
+// +kubebuilder:printcolumn:name="Max",type=integer,JSONPath=`.spec.maxInstances`
+
+// DynamicPlatform is a platform where a new cloud instance is launched for every build
+type DynamicPlatform struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DynamicPlatformSpec   `json:"spec"`
+	Status DynamicPlatformStatus `json:"status,omitempty"`
+}
+
+// DynamicPlatformSpec defines the cloud provider settings for the platform
+type DynamicPlatformSpec struct {
+	// Platform is the platform instances are launched for, e.g. linux/arm64
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]+(/[a-z0-9_]+)+$`
+	Platform string `json:"platform"`
+	// Type is the cloud provider used to launch instances
+	// +kubebuilder:validation:Enum=aws;ibmz;ibmp;gcp;azure;libvirt;kubevirt;openstack
+	Type string `json:"type"`
+	// MaxInstances is the maximum number of instances that can be running at once
+	// +kubebuilder:validation:Minimum=0
+	MaxInstances int `json:"maxInstances"`
+	// SshSecret is the name of the secret holding the SSH key used to access the instances
+	// +kubebuilder:validation:MinLength=1
+	SshSecret string `json:"sshSecret"`
+	// InstanceTag is used to identify instances, defaults to the global instance-tag setting
+	// +optional
+	InstanceTag string `json:"instanceTag,omitempty"`
+	// AllocationTimeout is how long in seconds to wait for an instance to become available, defaults to 600
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	AllocationTimeout int64 `json:"allocationTimeout,omitempty"`
+	// Config holds provider specific settings, keyed the same as host-config without the dynamic.<platform>. prefix
+	// +optional
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// DynamicPlatformStatus reports the live state of the platform
+type DynamicPlatformStatus struct {
+	// +optional
+	Instances int `json:"instances"`
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+
+// DynamicPlatformList contains a list of DynamicPlatform
+type DynamicPlatformList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DynamicPlatform `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Platform",type=string,JSONPath=`.spec.platform`
+// +kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+// +kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.status.instances`
+// +kubebuilder:printcolumn:name="Running",type=integer,JSONPath=`.status.runningTasks`
+
+// DynamicPoolPlatform is a platform backed by a pool of shared cloud instances that are launched on demand
+type DynamicPoolPlatform struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DynamicPoolPlatformSpec   `json:"spec"`
+	Status DynamicPoolPlatformStatus `json:"status,omitempty"`
+}
+
+// DynamicPoolPlatformSpec defines the cloud provider and pool settings for the platform
+type DynamicPoolPlatformSpec struct {
+	// Platform is the platform instances are launched for, e.g. linux/arm64
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]+(/[a-z0-9_]+)+$`
+	Platform string `json:"platform"`
+	// Type is the cloud provider used to launch instances
+	// +kubebuilder:validation:Enum=aws;ibmz;ibmp;gcp;azure;libvirt;kubevirt;openstack
+	Type string `json:"type"`
+	// MaxInstances is the maximum number of instances that can be running at once
+	// +kubebuilder:validation:Minimum=0
+	MaxInstances int `json:"maxInstances"`
+	// Concurrency is the number of builds that can share a single instance
+	// +kubebuilder:validation:Minimum=1
+	Concurrency int `json:"concurrency"`
+	// MaxAge is the age in minutes after which an instance is no longer used for new builds and is shut down once idle
+	// +kubebuilder:validation:Minimum=1
+	MaxAge int `json:"maxAge"`
+	// SshSecret is the name of the secret holding the SSH key used to access the instances
+	// +kubebuilder:validation:MinLength=1
+	SshSecret string `json:"sshSecret"`
+	// InstanceTag is used to identify instances, defaults to the global instance-tag setting
+	// +optional
+	InstanceTag string `json:"instanceTag,omitempty"`
+	// Config holds provider specific settings, keyed the same as host-config without the dynamic.<platform>. prefix
+	// +optional
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// DynamicPoolPlatformStatus reports the live state of the pool
+type DynamicPoolPlatformStatus struct {
+	// +optional
+	Instances int `json:"instances"`
+	// +optional
+	RunningTasks int `json:"runningTasks"`
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+
+// DynamicPoolPlatformList contains a list of DynamicPoolPlatform
+type DynamicPoolPlatformList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DynamicPoolPlatform `json:"items"`
+}
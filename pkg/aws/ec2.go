@@ -15,24 +15,43 @@ import (
 	"os"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strconv"
+	"strings"
 )
 
 const MultiPlatformManaged = "MultiPlatformManaged"
 
 func Ec2Provider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	launchTemplate := config["dynamic."+platformName+".launch-template-id"]
 	disk, err := strconv.Atoi(config["dynamic."+platformName+".disk"])
 	if err != nil {
 		disk = 40
+		if launchTemplate != "" {
+			// Leave the block devices to the launch template
+			disk = 0
+		}
 	}
+	instanceType := config["dynamic."+platformName+".instance-type"]
+	subnetId := config["dynamic."+platformName+".subnet-id"]
 	return AwsDynamicConfig{Region: config["dynamic."+platformName+".region"],
 		Ami:             config["dynamic."+platformName+".ami"],
-		InstanceType:    config["dynamic."+platformName+".instance-type"],
+		InstanceType:    instanceType,
+		InstanceTypes:   splitList(instanceType, config["dynamic."+platformName+".fallback-instance-types"]),
 		KeyName:         config["dynamic."+platformName+".key-name"],
 		Secret:          config["dynamic."+platformName+".aws-secret"],
 		SecurityGroup:   config["dynamic."+platformName+".security-group"],
-		SubnetId:        config["dynamic."+platformName+".subnet-id"],
+		SubnetId:        subnetId,
+		SubnetIds:       splitList(subnetId, config["dynamic."+platformName+".fallback-subnet-ids"]),
 		SystemNamespace: systemNamespace,
 		Disk:            int32(disk),
+		Spot:            config["dynamic."+platformName+".spot"] == "true",
+		SpotMaxPrice:    config["dynamic."+platformName+".spot-max-price"],
+
+		LaunchTemplateId:      launchTemplate,
+		LaunchTemplateVersion: config["dynamic."+platformName+".launch-template-version"],
+		UserDataConfigMap:     config["dynamic."+platformName+".user-data-configmap"],
+		InstanceProfile:       config["dynamic."+platformName+".iam-instance-profile"],
+		SecurityGroupIds:      splitList("", config["dynamic."+platformName+".security-group-ids"]),
+		Tags:                  parseTags(config["dynamic."+platformName+".tags"]),
 	}
 }
 
@@ -50,42 +69,107 @@ func (r AwsDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Log
 	// Create an EC2 client
 	ec2Client := ec2.NewFromConfig(cfg)
 
-	var subnet *string
-	if r.SubnetId != "" {
-		subnet = aws.String(r.SubnetId)
+	launchInput, err := r.launchInput(kubeClient, ctx, name, instanceTag)
+	if err != nil {
+		return "", err
 	}
+
+	// Walk through the subnets and instance types until one has capacity
+	launchErr := fmt.Errorf("no instance type is configured")
+	for _, option := range r.launchOptions() {
+		launchInput.InstanceType = types.InstanceType(option.instanceType)
+		launchInput.SubnetId = nil
+		if option.subnet != "" {
+			launchInput.SubnetId = aws.String(option.subnet)
+		}
+		launchInput.InstanceMarketOptions = nil
+		if option.capacityType == CapacityTypeSpot {
+			launchInput.InstanceMarketOptions = r.spotOptions()
+		}
+
+		// Launch the new EC2 instance
+		result, err := ec2Client.RunInstances(ctx, launchInput)
+		if err != nil {
+			code := capacityErrorCode(err)
+			if code == "" {
+				return "", err
+			}
+			log.Info("no capacity available, trying the next option", "capacityType", option.capacityType, "instanceType", option.instanceType, "subnet", option.subnet, "code", code)
+			if r.launchMetrics != nil {
+				r.launchMetrics.CapacityError(option.capacityType, option.instanceType, option.subnet, code)
+			}
+			launchErr = err
+			continue
+		}
+
+		// The result will contain information about the newly created instance(s)
+		if len(result.Instances) > 0 {
+			instance := result.Instances[0]
+			zone := ""
+			if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+				zone = *instance.Placement.AvailabilityZone
+			}
+			if r.launchMetrics != nil {
+				r.launchMetrics.InstanceLaunched(option.capacityType, string(instance.InstanceType), zone)
+			}
+			return cloud.InstanceIdentifier(*instance.InstanceId), nil
+		} else {
+			return "", fmt.Errorf("no instances were created")
+		}
+	}
+	return "", launchErr
+}
+
+// launchInput returns the RunInstances parameters, apart from the options that are changed when there is no capacity
+func (r AwsDynamicConfig) launchInput(kubeClient client.Client, ctx context.Context, name string, instanceTag string) (*ec2.RunInstancesInput, error) {
 	// Specify the parameters for the new EC2 instance
 	launchInput := &ec2.RunInstancesInput{
-		KeyName:        aws.String(r.KeyName),
-		ImageId:        aws.String(r.Ami), //ARM RHEL
-		InstanceType:   types.InstanceType(r.InstanceType),
-		MinCount:       aws.Int32(1),
-		MaxCount:       aws.Int32(1),
-		EbsOptimized:   aws.Bool(true),
-		SecurityGroups: []string{r.SecurityGroup},
-		SubnetId:       subnet,
-		BlockDeviceMappings: []types.BlockDeviceMapping{{
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		InstanceInitiatedShutdownBehavior: types.ShutdownBehaviorTerminate,
+		TagSpecifications:                 []types.TagSpecification{{ResourceType: types.ResourceTypeInstance, Tags: append(append([]types.Tag{}, r.Tags...), types.Tag{Key: aws.String(MultiPlatformManaged), Value: aws.String("true")}, types.Tag{Key: aws.String(cloud.InstanceTag), Value: aws.String(instanceTag)}, types.Tag{Key: aws.String("Name"), Value: aws.String("multi-platform-builder-" + name)})}},
+	}
+	if r.KeyName != "" {
+		launchInput.KeyName = aws.String(r.KeyName)
+	}
+	if r.Ami != "" {
+		launchInput.ImageId = aws.String(r.Ami) //ARM RHEL
+	}
+	if len(r.SecurityGroupIds) > 0 {
+		launchInput.SecurityGroupIds = r.SecurityGroupIds
+	} else if r.SecurityGroup != "" {
+		launchInput.SecurityGroups = []string{r.SecurityGroup}
+	}
+	if r.Disk > 0 {
+		launchInput.BlockDeviceMappings = []types.BlockDeviceMapping{{
 			DeviceName:  aws.String("/dev/sda1"),
 			VirtualName: aws.String("ephemeral0"),
 			Ebs:         &types.EbsBlockDevice{VolumeSize: aws.Int32(r.Disk)},
-		}},
-		InstanceInitiatedShutdownBehavior: types.ShutdownBehaviorTerminate,
-		TagSpecifications:                 []types.TagSpecification{{ResourceType: types.ResourceTypeInstance, Tags: []types.Tag{{Key: aws.String(MultiPlatformManaged), Value: aws.String("true")}, {Key: aws.String(cloud.InstanceTag), Value: aws.String(instanceTag)}, {Key: aws.String("Name"), Value: aws.String("multi-platform-builder-" + name)}}}},
-	}
-
-	// Launch the new EC2 instance
-	result, err := ec2Client.RunInstances(context.TODO(), launchInput)
-	if err != nil {
-		return "", err
+		}}
 	}
-
-	// The result will contain information about the newly created instance(s)
-	if len(result.Instances) > 0 {
-		//hard coded 10m timeout
-		return cloud.InstanceIdentifier(*result.Instances[0].InstanceId), nil
+	if r.LaunchTemplateId != "" {
+		launchInput.LaunchTemplate = &types.LaunchTemplateSpecification{LaunchTemplateId: aws.String(r.LaunchTemplateId)}
+		if r.LaunchTemplateVersion != "" {
+			launchInput.LaunchTemplate.Version = aws.String(r.LaunchTemplateVersion)
+		}
 	} else {
-		return "", fmt.Errorf("no instances were created")
+		launchInput.EbsOptimized = aws.Bool(true)
+	}
+	if r.InstanceProfile != "" {
+		if strings.HasPrefix(r.InstanceProfile, "arn:") {
+			launchInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{Arn: aws.String(r.InstanceProfile)}
+		} else {
+			launchInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{Name: aws.String(r.InstanceProfile)}
+		}
 	}
+	if r.UserDataConfigMap != "" {
+		userData, err := r.userData(kubeClient, ctx)
+		if err != nil {
+			return nil, err
+		}
+		launchInput.UserData = aws.String(userData)
+	}
+	return launchInput, nil
 }
 
 func (r AwsDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
@@ -107,7 +191,7 @@ func (r AwsDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Log
 	count := 0
 	for _, res := range res.Reservations {
 		for _, inst := range res.Instances {
-			if inst.State.Name != types.InstanceStateNameTerminated && string(inst.InstanceType) == r.InstanceType {
+			if inst.State.Name != types.InstanceStateNameTerminated && !isStopped(&inst) && r.isManagedType(inst.InstanceType) {
 				log.Info(fmt.Sprintf("counting instance %s towards running count", *inst.InstanceId))
 				count++
 			}
@@ -138,6 +222,13 @@ func (r AwsDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr
 	if len(res.Reservations) > 0 {
 		if len(res.Reservations[0].Instances) > 0 {
 			instance := res.Reservations[0].Instances[0]
+			if instance.State != nil && (instance.State.Name == types.InstanceStateNameShuttingDown || instance.State.Name == types.InstanceStateNameTerminated) {
+				// This will never come up, most likely a spot instance that was reclaimed before it started
+				if msg := spotInterruption(&instance, nil); msg != "" {
+					return "", fmt.Errorf("%s", msg)
+				}
+				return "", fmt.Errorf("instance %s was terminated before it became available", instanceId)
+			}
 			return r.checkInstanceConnectivity(&instance, log)
 		}
 	}
@@ -197,10 +288,10 @@ func (r AwsDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logg
 	for _, res := range res.Reservations {
 		for i := range res.Instances {
 			inst := res.Instances[i]
-			if inst.State.Name != types.InstanceStateNameTerminated && string(inst.InstanceType) == r.InstanceType {
+			if inst.State.Name != types.InstanceStateNameTerminated && !isStopped(&inst) && r.isManagedType(inst.InstanceType) {
 				address, err := r.checkInstanceConnectivity(&inst, log)
 				if err == nil {
-					ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(*inst.InstanceId), StartTime: *inst.LaunchTime, Address: address})
+					ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(*inst.InstanceId), StartTime: creationTime(&inst), Address: address})
 					log.Info(fmt.Sprintf("counting instance %s towards running count", *inst.InstanceId))
 				}
 			}
@@ -209,6 +300,16 @@ func (r AwsDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logg
 	return ret, nil
 }
 
+func (r AwsDynamicConfig) ec2Client(kubeClient client.Client, ctx context.Context) (*ec2.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(SecretCredentialsProvider{Name: r.Secret, Namespace: r.SystemNamespace, Client: kubeClient}),
+		config.WithRegion(r.Region))
+	if err != nil {
+		return nil, err
+	}
+	return ec2.NewFromConfig(cfg), nil
+}
+
 type SecretCredentialsProvider struct {
 	Name      string
 	Namespace string
@@ -240,6 +341,22 @@ type AwsDynamicConfig struct {
 	SecurityGroup   string
 	SubnetId        string
 	Disk            int32
+	// InstanceTypes and SubnetIds are tried in order when there is no capacity, starting with InstanceType and SubnetId
+	InstanceTypes []string
+	SubnetIds     []string
+	// Spot requests spot capacity, falling back to on-demand if none is available
+	Spot         bool
+	SpotMaxPrice string
+	// LaunchTemplateId lets the instance shape be managed in AWS, the other settings override the template if they are set
+	LaunchTemplateId      string
+	LaunchTemplateVersion string
+	// UserDataConfigMap is the name of a ConfigMap in the system namespace with the user-data script under the user-data key
+	UserDataConfigMap string
+	InstanceProfile   string
+	SecurityGroupIds  []string
+	Tags              []types.Tag
+	// launchMetrics records each launch attempt, it is set by the controller with WithLaunchMetrics
+	launchMetrics cloud.LaunchMetrics
 }
 
 func (r AwsDynamicConfig) SshUser() string {
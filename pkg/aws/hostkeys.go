@@ -0,0 +1,64 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// GetHostKeys reads the host keys cloud-init writes to the console when the instance first boots
+func (r AwsDynamicConfig) GetHostKeys(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) ([]string, error) {
+	log.Info(fmt.Sprintf("reading host keys of AWS instance %s", instanceId))
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := ec2Client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{InstanceId: aws.String(string(instanceId))})
+	if err != nil {
+		return nil, err
+	}
+	if output.Output == nil {
+		return nil, nil
+	}
+	console, err := base64.StdEncoding.DecodeString(*output.Output)
+	if err != nil {
+		return nil, err
+	}
+	return parseConsoleHostKeys(string(console)), nil
+}
+
+// parseConsoleHostKeys returns the keys between the cloud-init markers, or nil if they have not been written yet
+func parseConsoleHostKeys(console string) []string {
+	start := strings.LastIndex(console, hostKeysBegin)
+	if start < 0 {
+		return nil
+	}
+	end := strings.Index(console[start:], hostKeysEnd)
+	if end < 0 {
+		return nil
+	}
+	var ret []string
+	for _, line := range strings.Split(console[start+len(hostKeysBegin):start+end], "\n") {
+		// Console lines can have a timestamp prefix, the key starts at its type
+		line = strings.TrimSpace(line)
+		for _, prefix := range []string{"ssh-", "ecdsa-"} {
+			if i := strings.Index(line, prefix); i >= 0 {
+				ret = append(ret, line[i:])
+				break
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,24 @@
+package aws
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseConsoleHostKeys(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(parseConsoleHostKeys("[   10.1] cloud-init[1234]: Cloud-init v. 22.1 running")).Should(BeNil())
+	console := `[   12.0] cloud-init[1234]: Cloud-init v. 22.1 running 'modules:final'
+-----BEGIN SSH HOST KEY KEYS-----
+ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY= root@ip-10-0-0-1
+[   12.5] ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA== root@ip-10-0-0-1
+-----END SSH HOST KEY KEYS-----
+[   13.0] cloud-init[1234]: Cloud-init v. 22.1 finished`
+	g.Expect(parseConsoleHostKeys(console)).Should(Equal([]string{
+		"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY= root@ip-10-0-0-1",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA== root@ip-10-0-0-1",
+	}))
+	// The end marker has not been written yet
+	g.Expect(parseConsoleHostKeys(console[:len(console)-120])).Should(BeNil())
+}
@@ -0,0 +1,129 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	CapacityTypeSpot     = "spot"
+	CapacityTypeOnDemand = "on-demand"
+)
+
+// capacityErrorCodes are the RunInstances error codes that mean the requested capacity can't be had right now, so it
+// is worth trying a different subnet, instance type or capacity type
+var capacityErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity":      true,
+	"InsufficientFreeAddressesInSubnet": true,
+	"InstanceLimitExceeded":             true,
+	"VcpuLimitExceeded":                 true,
+	"Unsupported":                       true,
+	"SpotMaxPriceTooLow":                true,
+	"MaxSpotInstanceCountExceeded":      true,
+	"UnfulfillableCapacity":             true,
+}
+
+// WithLaunchMetrics returns a copy of the config that reports each launch attempt to the metrics
+func (r AwsDynamicConfig) WithLaunchMetrics(metrics cloud.LaunchMetrics) cloud.CloudProvider {
+	r.launchMetrics = metrics
+	return r
+}
+
+// launchOption is a single combination of settings to try when launching an instance
+type launchOption struct {
+	capacityType string
+	instanceType string
+	subnet       string
+}
+
+// launchOptions returns every combination of capacity type, instance type and subnet in order of preference. Spot
+// capacity is tried everywhere before falling back to on-demand, as it is much cheaper.
+func (r AwsDynamicConfig) launchOptions() []launchOption {
+	capacityTypes := []string{CapacityTypeOnDemand}
+	if r.Spot {
+		capacityTypes = []string{CapacityTypeSpot, CapacityTypeOnDemand}
+	}
+	subnets := r.SubnetIds
+	if len(subnets) == 0 {
+		// Use the default subnet for the region
+		subnets = []string{""}
+	}
+	instanceTypes := r.InstanceTypes
+	if len(instanceTypes) == 0 && r.LaunchTemplateId != "" {
+		// Use the instance type from the launch template
+		instanceTypes = []string{""}
+	}
+	ret := []launchOption{}
+	for _, capacityType := range capacityTypes {
+		for _, instanceType := range instanceTypes {
+			for _, subnet := range subnets {
+				ret = append(ret, launchOption{capacityType: capacityType, instanceType: instanceType, subnet: subnet})
+			}
+		}
+	}
+	return ret
+}
+
+func capacityErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && capacityErrorCodes[apiErr.ErrorCode()] {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// splitList parses a comma separated config value, ignoring empty entries
+func splitList(primary string, list string) []string {
+	ret := []string{}
+	for _, i := range append([]string{primary}, strings.Split(list, ",")...) {
+		if i = strings.TrimSpace(i); i != "" {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+func (r AwsDynamicConfig) isManagedType(instanceType types.InstanceType) bool {
+	if len(r.InstanceTypes) == 0 && r.LaunchTemplateId != "" {
+		// The type comes from the launch template, so the tags are all we can go on
+		return true
+	}
+	for _, i := range r.InstanceTypes {
+		if i == string(instanceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeInstance reports the availability zone, instance type and capacity type the instance ended up with
+func (r AwsDynamicConfig) DescribeInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (*cloud.InstanceDetails, error) {
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{string(instanceId)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Reservations) == 0 || len(res.Reservations[0].Instances) == 0 {
+		return nil, errors.New("instance " + string(instanceId) + " not found")
+	}
+	instance := res.Reservations[0].Instances[0]
+	ret := cloud.InstanceDetails{InstanceType: string(instance.InstanceType), CapacityType: CapacityTypeOnDemand}
+	if instance.InstanceLifecycle == types.InstanceLifecycleTypeSpot {
+		ret.CapacityType = CapacityTypeSpot
+	}
+	if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+		ret.Zone = *instance.Placement.AvailabilityZone
+	}
+	return &ret, nil
+}
@@ -0,0 +1,74 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+)
+
+func TestLaunchOptions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	provider := Ec2Provider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.instance-type":           "m5.xlarge",
+		"dynamic.linux-amd64.fallback-instance-types": "m6i.xlarge, m5a.xlarge",
+		"dynamic.linux-amd64.subnet-id":               "subnet-a",
+		"dynamic.linux-amd64.fallback-subnet-ids":     "subnet-b,",
+	}, "multi-platform-controller").(AwsDynamicConfig)
+	g.Expect(provider.launchOptions()).Should(Equal([]launchOption{
+		{capacityType: CapacityTypeOnDemand, instanceType: "m5.xlarge", subnet: "subnet-a"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m5.xlarge", subnet: "subnet-b"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m6i.xlarge", subnet: "subnet-a"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m6i.xlarge", subnet: "subnet-b"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m5a.xlarge", subnet: "subnet-a"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m5a.xlarge", subnet: "subnet-b"},
+	}))
+	g.Expect(provider.isManagedType(types.InstanceType("m6i.xlarge"))).Should(BeTrue())
+	g.Expect(provider.isManagedType(types.InstanceType("t4g.medium"))).Should(BeFalse())
+
+	// Spot is tried everywhere before on-demand, and the default subnet is used if none are configured
+	provider = Ec2Provider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.instance-type":           "m5.xlarge",
+		"dynamic.linux-amd64.fallback-instance-types": "m6i.xlarge",
+		"dynamic.linux-amd64.spot":                    "true",
+	}, "multi-platform-controller").(AwsDynamicConfig)
+	g.Expect(provider.launchOptions()).Should(Equal([]launchOption{
+		{capacityType: CapacityTypeSpot, instanceType: "m5.xlarge"},
+		{capacityType: CapacityTypeSpot, instanceType: "m6i.xlarge"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m5.xlarge"},
+		{capacityType: CapacityTypeOnDemand, instanceType: "m6i.xlarge"},
+	}))
+}
+
+func TestCapacityErrorCode(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(capacityErrorCode(&smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"})).Should(Equal("InsufficientInstanceCapacity"))
+	g.Expect(capacityErrorCode(fmt.Errorf("operation error EC2: RunInstances, %w", &smithy.GenericAPIError{Code: "VcpuLimitExceeded"}))).Should(Equal("VcpuLimitExceeded"))
+	g.Expect(capacityErrorCode(&smithy.GenericAPIError{Code: "InvalidAMIID.NotFound"})).Should(BeEmpty())
+	g.Expect(capacityErrorCode(fmt.Errorf("connection refused"))).Should(BeEmpty())
+}
+
+type recordingLaunchMetrics struct {
+	launches []string
+}
+
+func (r *recordingLaunchMetrics) InstanceLaunched(capacityType string, instanceType string, zone string) {
+	r.launches = append(r.launches, capacityType+"/"+instanceType+"/"+zone)
+}
+
+func (r *recordingLaunchMetrics) CapacityError(capacityType string, instanceType string, subnet string, code string) {
+}
+
+func TestWithLaunchMetrics(t *testing.T) {
+	g := NewGomegaWithT(t)
+	provider := Ec2Provider("linux-amd64", map[string]string{"dynamic.linux-amd64.instance-type": "m5.xlarge"}, "multi-platform-controller")
+	metrics := &recordingLaunchMetrics{}
+	reporting := provider.(cloud.LaunchReporter).WithLaunchMetrics(metrics).(AwsDynamicConfig)
+	g.Expect(reporting.launchMetrics).Should(BeIdenticalTo(metrics))
+	g.Expect(reporting.InstanceTypes).Should(Equal([]string{"m5.xlarge"}))
+	// The original config is left unchanged
+	g.Expect(provider.(AwsDynamicConfig).launchMetrics).Should(BeNil())
+}
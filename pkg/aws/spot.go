@@ -0,0 +1,78 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// spotInterruptionCodes are the spot request status codes AWS uses once it has decided to reclaim an instance
+var spotInterruptionCodes = map[string]bool{
+	"marked-for-termination":                      true,
+	"marked-for-stop":                             true,
+	"instance-terminated-by-price":                true,
+	"instance-terminated-no-capacity":             true,
+	"instance-terminated-capacity-oversubscribed": true,
+	"instance-terminated-launch-group-constraint": true,
+}
+
+func (r AwsDynamicConfig) spotOptions() *types.InstanceMarketOptionsRequest {
+	options := &types.SpotMarketOptions{
+		SpotInstanceType:             types.SpotInstanceTypeOneTime,
+		InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorTerminate,
+	}
+	if r.SpotMaxPrice != "" {
+		options.MaxPrice = aws.String(r.SpotMaxPrice)
+	}
+	return &types.InstanceMarketOptionsRequest{MarketType: types.MarketTypeSpot, SpotOptions: options}
+}
+
+// spotInterruption returns a message if the instance has been, or is about to be, reclaimed by AWS
+func spotInterruption(instance *types.Instance, request *types.SpotInstanceRequest) string {
+	if instance.InstanceLifecycle != types.InstanceLifecycleTypeSpot {
+		return ""
+	}
+	if request != nil && request.Status != nil && request.Status.Code != nil && spotInterruptionCodes[*request.Status.Code] {
+		return fmt.Sprintf("spot instance %s was reclaimed by AWS (%s), the build was interrupted and should be retried", *instance.InstanceId, *request.Status.Code)
+	}
+	if instance.StateReason != nil && instance.StateReason.Code != nil && *instance.StateReason.Code == "Server.SpotInstanceTermination" {
+		return fmt.Sprintf("spot instance %s was reclaimed by AWS, the build was interrupted and should be retried", *instance.InstanceId)
+	}
+	return ""
+}
+
+// CheckInterruption reports if a spot instance is being reclaimed, so the task using it can be failed straight away
+// rather than waiting for the build to time out
+func (r AwsDynamicConfig) CheckInterruption(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	if !r.Spot {
+		return "", nil
+	}
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	res, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{string(instanceId)}})
+	if err != nil {
+		return "", err
+	}
+	if len(res.Reservations) == 0 || len(res.Reservations[0].Instances) == 0 {
+		return "", nil
+	}
+	instance := res.Reservations[0].Instances[0]
+	var request *types.SpotInstanceRequest
+	if instance.SpotInstanceRequestId != nil {
+		requests, err := ec2Client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{SpotInstanceRequestIds: []string{*instance.SpotInstanceRequestId}})
+		if err != nil {
+			log.Error(err, "failed to describe spot instance request", "instance", instanceId)
+		} else if len(requests.SpotInstanceRequests) > 0 {
+			request = &requests.SpotInstanceRequests[0]
+		}
+	}
+	return spotInterruption(&instance, request), nil
+}
@@ -0,0 +1,43 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	. "github.com/onsi/gomega"
+)
+
+func TestSpotConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	provider := Ec2Provider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.spot":           "true",
+		"dynamic.linux-arm64.spot-max-price": "0.05",
+	}, "multi-platform-controller").(AwsDynamicConfig)
+	g.Expect(provider.Spot).Should(BeTrue())
+	options := provider.spotOptions()
+	g.Expect(options.MarketType).Should(Equal(types.MarketTypeSpot))
+	g.Expect(*options.SpotOptions.MaxPrice).Should(Equal("0.05"))
+	g.Expect(options.SpotOptions.InstanceInterruptionBehavior).Should(Equal(types.InstanceInterruptionBehaviorTerminate))
+
+	// No max price means the on-demand price is the limit
+	provider = Ec2Provider("linux-arm64", map[string]string{"dynamic.linux-arm64.spot": "true"}, "multi-platform-controller").(AwsDynamicConfig)
+	g.Expect(provider.spotOptions().SpotOptions.MaxPrice).Should(BeNil())
+
+	provider = Ec2Provider("linux-arm64", map[string]string{}, "multi-platform-controller").(AwsDynamicConfig)
+	g.Expect(provider.Spot).Should(BeFalse())
+}
+
+func TestSpotInterruption(t *testing.T) {
+	g := NewGomegaWithT(t)
+	onDemand := types.Instance{InstanceId: aws.String("i-1"), StateReason: &types.StateReason{Code: aws.String("Client.UserInitiatedShutdown")}}
+	g.Expect(spotInterruption(&onDemand, nil)).Should(BeEmpty())
+
+	spot := types.Instance{InstanceId: aws.String("i-2"), InstanceLifecycle: types.InstanceLifecycleTypeSpot}
+	g.Expect(spotInterruption(&spot, nil)).Should(BeEmpty())
+	g.Expect(spotInterruption(&spot, &types.SpotInstanceRequest{Status: &types.SpotInstanceStatus{Code: aws.String("fulfilled")}})).Should(BeEmpty())
+	g.Expect(spotInterruption(&spot, &types.SpotInstanceRequest{Status: &types.SpotInstanceStatus{Code: aws.String("marked-for-termination")}})).Should(ContainSubstring("i-2"))
+
+	spot.StateReason = &types.StateReason{Code: aws.String("Server.SpotInstanceTermination")}
+	g.Expect(spotInterruption(&spot, nil)).Should(ContainSubstring("reclaimed"))
+}
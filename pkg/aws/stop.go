@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// isStopped returns true for instances that are stopped, or on their way to being stopped. These are not counted as
+// running, as they can't be used until they are started again.
+func isStopped(instance *types.Instance) bool {
+	return instance.State != nil && (instance.State.Name == types.InstanceStateNameStopped || instance.State.Name == types.InstanceStateNameStopping)
+}
+
+// creationTime is when the instance was first launched. LaunchTime is reset every time an instance is started, but the
+// primary network interface stays attached for the life of the instance.
+func creationTime(instance *types.Instance) time.Time {
+	for _, ni := range instance.NetworkInterfaces {
+		if ni.Attachment != nil && ni.Attachment.DeviceIndex != nil && *ni.Attachment.DeviceIndex == 0 && ni.Attachment.AttachTime != nil {
+			return *ni.Attachment.AttachTime
+		}
+	}
+	if instance.LaunchTime != nil {
+		return *instance.LaunchTime
+	}
+	return time.Time{}
+}
+
+func (r AwsDynamicConfig) StopInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to stop AWS instance %s", instanceId))
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{string(instanceId)}})
+	return err
+}
+
+func (r AwsDynamicConfig) StartInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to start AWS instance %s", instanceId))
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: []string{string(instanceId)}})
+	return err
+}
+
+func (r AwsDynamicConfig) ListStoppedInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list stopped AWS instances")
+	ec2Client, err := r.ec2Client(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+		{Name: aws.String("tag:" + cloud.InstanceTag), Values: []string{instanceTag}},
+		{Name: aws.String("tag:" + MultiPlatformManaged), Values: []string{"true"}},
+		{Name: aws.String("instance-state-name"), Values: []string{string(types.InstanceStateNameStopped), string(types.InstanceStateNameStopping)}},
+	}})
+	if err != nil {
+		log.Error(err, "failed to describe instance")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for _, res := range res.Reservations {
+		for i := range res.Instances {
+			inst := res.Instances[i]
+			if isStopped(&inst) && r.isManagedType(inst.InstanceType) {
+				ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(*inst.InstanceId), StartTime: creationTime(&inst)})
+			}
+		}
+	}
+	return ret, nil
+}
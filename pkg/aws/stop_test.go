@@ -0,0 +1,36 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	. "github.com/onsi/gomega"
+)
+
+func TestStoppedInstances(t *testing.T) {
+	g := NewGomegaWithT(t)
+	created := time.Now().Add(-time.Hour)
+	started := time.Now()
+	instance := types.Instance{
+		InstanceId: aws.String("i-1"),
+		LaunchTime: &started,
+		State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+		NetworkInterfaces: []types.InstanceNetworkInterface{
+			{Attachment: &types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(1), AttachTime: &started}},
+			{Attachment: &types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(0), AttachTime: &created}},
+		},
+	}
+	g.Expect(isStopped(&instance)).Should(BeFalse())
+	// Starting a stopped instance resets the launch time, but not when it was created
+	g.Expect(creationTime(&instance)).Should(Equal(created))
+
+	instance.State.Name = types.InstanceStateNameStopping
+	g.Expect(isStopped(&instance)).Should(BeTrue())
+	instance.State.Name = types.InstanceStateNameStopped
+	g.Expect(isStopped(&instance)).Should(BeTrue())
+
+	instance.NetworkInterfaces = nil
+	g.Expect(creationTime(&instance)).Should(Equal(started))
+}
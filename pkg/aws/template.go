@@ -0,0 +1,52 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	types2 "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// UserDataKey is the key in the user-data ConfigMap that holds the script
+const UserDataKey = "user-data"
+
+// userData reads the user-data script from the ConfigMap, encoded the way RunInstances expects
+func (r AwsDynamicConfig) userData(kubeClient client.Client, ctx context.Context) (string, error) {
+	cm := v1.ConfigMap{}
+	err := kubeClient.Get(ctx, types2.NamespacedName{Namespace: r.SystemNamespace, Name: r.UserDataConfigMap}, &cm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// The controller only caches labeled ConfigMaps, so an unlabeled one looks like it does not exist
+			return "", fmt.Errorf("user-data ConfigMap %s not found, it must be in namespace %s with the label build.appstudio.redhat.com/multi-platform-config", r.UserDataConfigMap, r.SystemNamespace)
+		}
+		return "", err
+	}
+	script, ok := cm.Data[UserDataKey]
+	if !ok {
+		return "", fmt.Errorf("user-data ConfigMap %s has no %s key", r.UserDataConfigMap, UserDataKey)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(script)), nil
+}
+
+// parseTags parses extra instance tags in the form key=value,key2=value2. The tags the controller uses to find its own
+// instances can't be overridden.
+func parseTags(value string) []types.Tag {
+	ret := []types.Tag{}
+	for _, i := range strings.Split(value, ",") {
+		key, val, found := strings.Cut(i, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || key == MultiPlatformManaged || key == cloud.InstanceTag || key == "Name" {
+			continue
+		}
+		ret = append(ret, types.Tag{Key: aws.String(key), Value: aws.String(strings.TrimSpace(val))})
+	}
+	return ret
+}
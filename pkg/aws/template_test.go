@@ -0,0 +1,95 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const systemNamespace = "multi-platform-controller"
+
+func TestLaunchTemplateInput(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cm := v1.ConfigMap{}
+	cm.Name = "bootstrap"
+	cm.Namespace = systemNamespace
+	cm.Data = map[string]string{UserDataKey: "#!/bin/bash\necho hello\n"}
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&cm).Build()
+
+	provider := Ec2Provider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.launch-template-id":      "lt-0123456789",
+		"dynamic.linux-amd64.launch-template-version": "$Latest",
+		"dynamic.linux-amd64.user-data-configmap":     "bootstrap",
+		"dynamic.linux-amd64.iam-instance-profile":    "builder",
+		"dynamic.linux-amd64.security-group-ids":      "sg-1,sg-2",
+		"dynamic.linux-amd64.tags":                    "team=build, cost-center=1234,Name=ignored",
+	}, systemNamespace).(AwsDynamicConfig)
+	input, err := provider.launchInput(kubeClient, context.Background(), "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(*input.LaunchTemplate.LaunchTemplateId).Should(Equal("lt-0123456789"))
+	g.Expect(*input.LaunchTemplate.Version).Should(Equal("$Latest"))
+	// The shape of the instance is left to the template
+	g.Expect(input.ImageId).Should(BeNil())
+	g.Expect(input.KeyName).Should(BeNil())
+	g.Expect(input.BlockDeviceMappings).Should(BeEmpty())
+	g.Expect(input.EbsOptimized).Should(BeNil())
+	g.Expect(input.SecurityGroups).Should(BeEmpty())
+	g.Expect(input.SecurityGroupIds).Should(Equal([]string{"sg-1", "sg-2"}))
+	g.Expect(*input.IamInstanceProfile.Name).Should(Equal("builder"))
+	userData, err := base64.StdEncoding.DecodeString(*input.UserData)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(string(userData)).Should(Equal("#!/bin/bash\necho hello\n"))
+
+	tags := map[string]string{}
+	for _, tag := range input.TagSpecifications[0].Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	g.Expect(tags).Should(Equal(map[string]string{"team": "build", "cost-center": "1234", MultiPlatformManaged: "true", cloud.InstanceTag: "prod-amd64", "Name": "multi-platform-builder-test"}))
+
+	// Instances launched from the template are counted whatever their type
+	g.Expect(provider.isManagedType(types.InstanceType("c7g.large"))).Should(BeTrue())
+	g.Expect(provider.launchOptions()).Should(Equal([]launchOption{{capacityType: CapacityTypeOnDemand}}))
+
+	// The AMI and type can still be overridden
+	provider = Ec2Provider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.launch-template-id":   "lt-0123456789",
+		"dynamic.linux-amd64.ami":                  "ami-1",
+		"dynamic.linux-amd64.instance-type":        "m5.xlarge",
+		"dynamic.linux-amd64.iam-instance-profile": "arn:aws:iam::123456789012:instance-profile/builder",
+	}, systemNamespace).(AwsDynamicConfig)
+	input, err = provider.launchInput(kubeClient, context.Background(), "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(*input.ImageId).Should(Equal("ami-1"))
+	g.Expect(input.LaunchTemplate.Version).Should(BeNil())
+	g.Expect(*input.IamInstanceProfile.Arn).Should(Equal("arn:aws:iam::123456789012:instance-profile/builder"))
+	g.Expect(provider.isManagedType(types.InstanceType("c7g.large"))).Should(BeFalse())
+
+	provider.UserDataConfigMap = "missing"
+	_, err = provider.launchInput(kubeClient, context.Background(), "test", "prod-amd64")
+	g.Expect(err).Should(MatchError(ContainSubstring("build.appstudio.redhat.com/multi-platform-config")))
+}
+
+func TestLaunchInputWithoutTemplate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	provider := Ec2Provider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.ami":            "ami-1",
+		"dynamic.linux-arm64.key-name":       "builder",
+		"dynamic.linux-arm64.security-group": "launch-wizard-1",
+	}, systemNamespace).(AwsDynamicConfig)
+	input, err := provider.launchInput(nil, context.Background(), "test", "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(input.LaunchTemplate).Should(BeNil())
+	g.Expect(*input.EbsOptimized).Should(BeTrue())
+	g.Expect(input.SecurityGroups).Should(Equal([]string{"launch-wizard-1"}))
+	g.Expect(*input.BlockDeviceMappings[0].Ebs.VolumeSize).Should(Equal(int32(40)))
+	g.Expect(input.UserData).Should(BeNil())
+}
@@ -0,0 +1,499 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v5"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	types2 "k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MultiPlatformManaged = "MultiPlatformManaged"
+
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
+// clientOptions configures the Azure clients, it is only set by tests to point them at a stand-in for the API
+var clientOptions *arm.ClientOptions
+
+func AzureProvider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	disk, err := strconv.Atoi(config["dynamic."+platformName+".disk"])
+	if err != nil {
+		disk = 40
+	}
+	user := config["dynamic."+platformName+".admin-user"]
+	if user == "" {
+		user = "azureuser"
+	}
+	return AzureDynamicConfig{
+		SubscriptionId:  config["dynamic."+platformName+".subscription-id"],
+		ResourceGroup:   config["dynamic."+platformName+".resource-group"],
+		Location:        config["dynamic."+platformName+".location"],
+		VmSize:          config["dynamic."+platformName+".vm-size"],
+		Image:           config["dynamic."+platformName+".image"],
+		SubnetId:        config["dynamic."+platformName+".subnet-id"],
+		SshPublicKey:    config["dynamic."+platformName+".ssh-public-key"],
+		Secret:          config["dynamic."+platformName+".azure-secret"],
+		PublicIp:        config["dynamic."+platformName+".public-ip"] != "false",
+		User:            user,
+		Disk:            int32(disk),
+		SystemNamespace: systemNamespace,
+	}
+}
+
+func (r AzureDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	log.Info(fmt.Sprintf("attempting to launch Azure VM for %s", name))
+	credential, err := r.credential(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	imageReference, err := r.imageReference()
+	if err != nil {
+		return "", err
+	}
+	// VM names are limited to 64 characters, and Linux host names to 63
+	vmName := "mpc-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	tags := map[string]*string{MultiPlatformManaged: to.Ptr("true"), cloud.InstanceTag: to.Ptr(instanceTag), "Name": to.Ptr("multi-platform-builder-" + name)}
+
+	// The NIC and public IP must exist before the VM can be created. If anything fails they are removed again.
+	ipConfig := armnetwork.InterfaceIPConfigurationPropertiesFormat{
+		Subnet:                    &armnetwork.Subnet{ID: to.Ptr(r.SubnetId)},
+		PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
+	}
+	if r.PublicIp {
+		ipClient, err := armnetwork.NewPublicIPAddressesClient(r.SubscriptionId, credential, clientOptions)
+		if err != nil {
+			return "", err
+		}
+		poller, err := ipClient.BeginCreateOrUpdate(ctx, r.ResourceGroup, publicIpName(vmName), armnetwork.PublicIPAddress{
+			Location: to.Ptr(r.Location),
+			Tags:     tags,
+			SKU:      &armnetwork.PublicIPAddressSKU{Name: to.Ptr(armnetwork.PublicIPAddressSKUNameStandard)},
+			Properties: &armnetwork.PublicIPAddressPropertiesFormat{
+				PublicIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodStatic),
+				DeleteOption:             to.Ptr(armnetwork.DeleteOptionsDelete),
+			},
+		}, nil)
+		if err == nil {
+			var ip armnetwork.PublicIPAddressesClientCreateOrUpdateResponse
+			ip, err = poller.PollUntilDone(ctx, nil)
+			ipConfig.PublicIPAddress = &armnetwork.PublicIPAddress{
+				ID:         ip.ID,
+				Properties: &armnetwork.PublicIPAddressPropertiesFormat{DeleteOption: to.Ptr(armnetwork.DeleteOptionsDelete)},
+			}
+		}
+		if err != nil {
+			r.cleanupFailedLaunch(ctx, credential, log, vmName)
+			return "", err
+		}
+	}
+
+	nicClient, err := armnetwork.NewInterfacesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		r.cleanupFailedLaunch(ctx, credential, log, vmName)
+		return "", err
+	}
+	nicPoller, err := nicClient.BeginCreateOrUpdate(ctx, r.ResourceGroup, nicName(vmName), armnetwork.Interface{
+		Location: to.Ptr(r.Location),
+		Tags:     tags,
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{Name: to.Ptr("ipconfig"), Properties: &ipConfig}},
+		},
+	}, nil)
+	if err != nil {
+		r.cleanupFailedLaunch(ctx, credential, log, vmName)
+		return "", err
+	}
+	nic, err := nicPoller.PollUntilDone(ctx, nil)
+	if err != nil {
+		r.cleanupFailedLaunch(ctx, credential, log, vmName)
+		return "", err
+	}
+
+	vmClient, err := armcompute.NewVirtualMachinesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		r.cleanupFailedLaunch(ctx, credential, log, vmName)
+		return "", err
+	}
+	_, err = vmClient.BeginCreateOrUpdate(ctx, r.ResourceGroup, vmName, armcompute.VirtualMachine{
+		Location: to.Ptr(r.Location),
+		Tags:     tags,
+		Properties: &armcompute.VirtualMachineProperties{
+			HardwareProfile: &armcompute.HardwareProfile{VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes(r.VmSize))},
+			StorageProfile: &armcompute.StorageProfile{
+				ImageReference: imageReference,
+				OSDisk: &armcompute.OSDisk{
+					Name:         to.Ptr(diskName(vmName)),
+					CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+					DeleteOption: to.Ptr(armcompute.DiskDeleteOptionTypesDelete),
+					DiskSizeGB:   to.Ptr(r.Disk),
+					ManagedDisk:  &armcompute.ManagedDiskParameters{StorageAccountType: to.Ptr(armcompute.StorageAccountTypesStandardSSDLRS)},
+				},
+			},
+			OSProfile: &armcompute.OSProfile{
+				ComputerName:  to.Ptr(vmName),
+				AdminUsername: to.Ptr(r.User),
+				LinuxConfiguration: &armcompute.LinuxConfiguration{
+					DisablePasswordAuthentication: to.Ptr(true),
+					SSH: &armcompute.SSHConfiguration{PublicKeys: []*armcompute.SSHPublicKey{{
+						Path:    to.Ptr("/home/" + r.User + "/.ssh/authorized_keys"),
+						KeyData: to.Ptr(r.SshPublicKey),
+					}}},
+				},
+			},
+			NetworkProfile: &armcompute.NetworkProfile{NetworkInterfaces: []*armcompute.NetworkInterfaceReference{{
+				ID:         nic.ID,
+				Properties: &armcompute.NetworkInterfaceReferenceProperties{Primary: to.Ptr(true), DeleteOption: to.Ptr(armcompute.DeleteOptionsDelete)},
+			}}},
+		},
+	}, nil)
+	if err != nil {
+		r.cleanupFailedLaunch(ctx, credential, log, vmName)
+		return "", err
+	}
+	return cloud.InstanceIdentifier(vmName), nil
+}
+
+// cleanupFailedLaunch removes whatever was created before a launch failed. The error is only logged, as the launch
+// error is the one that is returned.
+func (r AzureDynamicConfig) cleanupFailedLaunch(ctx context.Context, credential azcore.TokenCredential, log *logr.Logger, vmName string) {
+	err := r.cleanup(ctx, credential, vmName)
+	if err != nil {
+		log.Error(err, "failed to clean up after failed launch", "vm", vmName)
+	}
+}
+
+// imageReference accepts either a gallery image resource ID, or a marketplace URN in the form publisher:offer:sku:version
+func (r AzureDynamicConfig) imageReference() (*armcompute.ImageReference, error) {
+	if strings.HasPrefix(r.Image, "/") {
+		return &armcompute.ImageReference{ID: to.Ptr(r.Image)}, nil
+	}
+	parts := strings.Split(r.Image, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid image %s, must be a resource ID or publisher:offer:sku:version", r.Image)
+	}
+	return &armcompute.ImageReference{Publisher: to.Ptr(parts[0]), Offer: to.Ptr(parts[1]), SKU: to.Ptr(parts[2]), Version: to.Ptr(parts[3])}, nil
+}
+
+func (r AzureDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	log.Info("attempting to count Azure VMs")
+	vms, err := r.listVms(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list VMs")
+		return 0, err
+	}
+	for _, vm := range vms {
+		log.Info(fmt.Sprintf("counting instance %s towards running count", *vm.Name))
+	}
+	return len(vms), nil
+}
+
+func (r AzureDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	log.Info(fmt.Sprintf("attempting to get Azure VM address %s", instanceId))
+	credential, err := r.credential(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	vmClient, err := armcompute.NewVirtualMachinesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return "", err
+	}
+	vm, err := vmClient.Get(ctx, r.ResourceGroup, string(instanceId), &armcompute.VirtualMachinesClientGetOptions{Expand: to.Ptr(armcompute.InstanceViewTypesInstanceView)})
+	if err != nil {
+		if isNotFound(err) {
+			return "", fmt.Errorf("VM %s no longer exists", instanceId)
+		}
+		log.Error(err, "failed to get VM")
+		//this might be transient, just log it
+		return "", nil
+	}
+	if vm.Properties == nil || vm.Properties.ProvisioningState == nil {
+		return "", nil
+	}
+	switch *vm.Properties.ProvisioningState {
+	case "Failed", "Deleting":
+		return "", fmt.Errorf("VM %s is in state %s", instanceId, *vm.Properties.ProvisioningState)
+	case "Succeeded":
+		address, err := r.vmAddress(credential, ctx, &vm.VirtualMachine)
+		if err != nil {
+			log.Error(err, "failed to get VM address")
+			return "", nil
+		}
+		return checkInstanceConnectivity(address, log), nil
+	}
+	return "", nil
+}
+
+// vmAddress looks up the address of the primary NIC, using the public IP if there is one
+func (r AzureDynamicConfig) vmAddress(credential azcore.TokenCredential, ctx context.Context, vm *armcompute.VirtualMachine) (string, error) {
+	if vm.Properties.NetworkProfile == nil || len(vm.Properties.NetworkProfile.NetworkInterfaces) == 0 {
+		return "", nil
+	}
+	nicClient, err := armnetwork.NewInterfacesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return "", err
+	}
+	nic, err := nicClient.Get(ctx, r.ResourceGroup, path.Base(*vm.Properties.NetworkProfile.NetworkInterfaces[0].ID), nil)
+	if err != nil {
+		return "", err
+	}
+	if nic.Properties == nil || len(nic.Properties.IPConfigurations) == 0 || nic.Properties.IPConfigurations[0].Properties == nil {
+		return "", nil
+	}
+	ipConfig := nic.Properties.IPConfigurations[0].Properties
+	if ipConfig.PublicIPAddress == nil || ipConfig.PublicIPAddress.ID == nil {
+		return str(ipConfig.PrivateIPAddress), nil
+	}
+	ipClient, err := armnetwork.NewPublicIPAddressesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return "", err
+	}
+	ip, err := ipClient.Get(ctx, r.ResourceGroup, path.Base(*ipConfig.PublicIPAddress.ID), nil)
+	if err != nil {
+		return "", err
+	}
+	if ip.Properties == nil {
+		return "", nil
+	}
+	return str(ip.Properties.IPAddress), nil
+}
+
+func checkInstanceConnectivity(address string, log *logr.Logger) string {
+	if address == "" {
+		return ""
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, sshPort), 5*time.Second)
+	if err != nil {
+		log.Info("Azure VM is not yet reachable", "address", address, "error", err.Error())
+		return ""
+	}
+	defer conn.Close()
+	return address
+}
+
+// TerminateInstance starts deleting the VM and returns without waiting for it, as that can take several minutes. The
+// NIC, public IP and disk are created with a delete option, so Azure removes them along with the VM.
+func (r AzureDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to terminate Azure VM %s", instance))
+	credential, err := r.credential(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	vmClient, err := armcompute.NewVirtualMachinesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return err
+	}
+	_, err = vmClient.BeginDelete(ctx, r.ResourceGroup, string(instance), nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete Azure VM %s: %w", instance, err)
+	}
+	return nil
+}
+
+// cleanup deletes the VM and the resources created for it, waiting until they are gone, as after a failed launch the NIC
+// and public IP may exist without a VM to be deleted with. Resources that don't exist are ignored.
+func (r AzureDynamicConfig) cleanup(ctx context.Context, credential azcore.TokenCredential, vmName string) error {
+	vmClient, err := armcompute.NewVirtualMachinesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return err
+	}
+	poller, err := vmClient.BeginDelete(ctx, r.ResourceGroup, vmName, nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
+	}
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete Azure VM %s: %w", vmName, err)
+	}
+	// The resources are normally deleted with the VM, but not if the VM was never created
+	err = deleteResource("network interface", nicName(vmName), func() error {
+		nicClient, err := armnetwork.NewInterfacesClient(r.SubscriptionId, credential, clientOptions)
+		if err != nil {
+			return err
+		}
+		p, err := nicClient.BeginDelete(ctx, r.ResourceGroup, nicName(vmName), nil)
+		if err != nil {
+			return err
+		}
+		_, err = p.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = deleteResource("public IP", publicIpName(vmName), func() error {
+		ipClient, err := armnetwork.NewPublicIPAddressesClient(r.SubscriptionId, credential, clientOptions)
+		if err != nil {
+			return err
+		}
+		p, err := ipClient.BeginDelete(ctx, r.ResourceGroup, publicIpName(vmName), nil)
+		if err != nil {
+			return err
+		}
+		_, err = p.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return deleteResource("disk", diskName(vmName), func() error {
+		diskClient, err := armcompute.NewDisksClient(r.SubscriptionId, credential, clientOptions)
+		if err != nil {
+			return err
+		}
+		p, err := diskClient.BeginDelete(ctx, r.ResourceGroup, diskName(vmName), nil)
+		if err != nil {
+			return err
+		}
+		_, err = p.PollUntilDone(ctx, nil)
+		return err
+	})
+}
+
+func deleteResource(kind string, name string, f func() error) error {
+	err := f()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete Azure %s %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+func (r AzureDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list Azure VMs")
+	credential, err := r.credential(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := r.listVms(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list VMs")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for _, vm := range vms {
+		if str(vm.Properties.ProvisioningState) != "Succeeded" || vm.Properties.TimeCreated == nil {
+			continue
+		}
+		address, err := r.vmAddress(credential, ctx, vm)
+		if err != nil {
+			log.Error(err, "failed to get VM address", "vm", *vm.Name)
+			continue
+		}
+		address = checkInstanceConnectivity(address, log)
+		if address == "" {
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(*vm.Name), StartTime: *vm.Properties.TimeCreated, Address: address})
+		log.Info(fmt.Sprintf("counting instance %s towards running count", *vm.Name))
+	}
+	return ret, nil
+}
+
+// listVms returns the VMs in the resource group with the given tag and size. Tags are used rather than the name, so
+// other workloads can share the resource group.
+func (r AzureDynamicConfig) listVms(kubeClient client.Client, ctx context.Context, instanceTag string) ([]*armcompute.VirtualMachine, error) {
+	credential, err := r.credential(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	vmClient, err := armcompute.NewVirtualMachinesClient(r.SubscriptionId, credential, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*armcompute.VirtualMachine{}
+	pager := vmClient.NewListPager(r.ResourceGroup, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range page.Value {
+			if str(vm.Tags[MultiPlatformManaged]) != "true" || str(vm.Tags[cloud.InstanceTag]) != instanceTag {
+				continue
+			}
+			if vm.Properties == nil || vm.Properties.HardwareProfile == nil || string(*vm.Properties.HardwareProfile.VMSize) != r.VmSize {
+				continue
+			}
+			if str(vm.Properties.ProvisioningState) == "Deleting" {
+				continue
+			}
+			ret = append(ret, vm)
+		}
+	}
+	return ret, nil
+}
+
+// credential authenticates as the service principal in the configured secret
+func (r AzureDynamicConfig) credential(kubeClient client.Client, ctx context.Context) (azcore.TokenCredential, error) {
+	if kubeClient == nil {
+		return azidentity.NewEnvironmentCredential(nil)
+	}
+	s := v1.Secret{}
+	err := kubeClient.Get(ctx, types2.NamespacedName{Name: r.Secret, Namespace: r.SystemNamespace}, &s)
+	if err != nil {
+		return nil, err
+	}
+	var options *azidentity.ClientSecretCredentialOptions
+	if clientOptions != nil {
+		options = &azidentity.ClientSecretCredentialOptions{ClientOptions: clientOptions.ClientOptions, DisableInstanceDiscovery: true}
+	}
+	return azidentity.NewClientSecretCredential(string(s.Data["tenant-id"]), string(s.Data["client-id"]), string(s.Data["client-secret"]), options)
+}
+
+func isNotFound(err error) bool {
+	var responseError *azcore.ResponseError
+	return errors.As(err, &responseError) && responseError.StatusCode == http.StatusNotFound
+}
+
+func nicName(vmName string) string {
+	return vmName + "-nic"
+}
+
+func publicIpName(vmName string) string {
+	return vmName + "-ip"
+}
+
+func diskName(vmName string) string {
+	return vmName + "-osdisk"
+}
+
+func str(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+type AzureDynamicConfig struct {
+	SubscriptionId  string
+	ResourceGroup   string
+	Location        string
+	VmSize          string
+	Image           string
+	SubnetId        string
+	SshPublicKey    string
+	Secret          string
+	PublicIp        bool
+	User            string
+	Disk            int32
+	SystemNamespace string
+}
+
+func (r AzureDynamicConfig) SshUser() string {
+	return r.User
+}
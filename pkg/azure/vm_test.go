@@ -0,0 +1,225 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	azcloud "github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const systemNamespace = "multi-platform-controller"
+
+const resourceGroupPath = "/subscriptions/test-subscription/resourceGroups/builders/providers/"
+
+// armStandIn implements just enough of Entra ID and Resource Manager to create, list and delete VMs and their
+// network resources. Deletes complete asynchronously, the resource is only removed once the operation is polled.
+type armStandIn struct {
+	lock      sync.Mutex
+	url       string
+	address   string
+	resources map[string]map[string]interface{}
+	polls     int
+}
+
+func (a *armStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch req.URL.Path {
+	case "/tenant/v2.0/.well-known/openid-configuration":
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"token_endpoint":         a.url + "/tenant/oauth2/v2.0/token",
+			"authorization_endpoint": a.url + "/tenant/oauth2/v2.0/authorize",
+			"issuer":                 a.url + "/tenant/v2.0",
+		})
+		return
+	case "/tenant/oauth2/v2.0/token":
+		_ = req.ParseForm()
+		if req.PostForm.Get("client_id") != "client" || req.PostForm.Get("client_secret") != "secret" {
+			writeJson(w, http.StatusUnauthorized, map[string]interface{}{"error": "invalid_client"})
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{"access_token": "token", "token_type": "Bearer", "expires_in": 3600})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.ToLower(req.URL.Path)
+	if strings.HasPrefix(path, "/operations/") {
+		// The delete has finished once it is polled
+		a.polls++
+		delete(a.resources, strings.TrimPrefix(path, "/operations"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if path == strings.ToLower(resourceGroupPath+"Microsoft.Compute/virtualMachines") {
+		list := []interface{}{}
+		for key, resource := range a.resources {
+			if strings.Contains(key, "/virtualmachines/") {
+				list = append(list, resource)
+			}
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{"value": list})
+		return
+	}
+	resource := a.resources[path]
+	switch {
+	case req.Method == http.MethodPut:
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		properties, _ := body["properties"].(map[string]interface{})
+		body["id"] = req.URL.Path
+		body["name"] = req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		properties["provisioningState"] = "Succeeded"
+		switch {
+		case strings.Contains(path, "/publicipaddresses/"):
+			properties["ipAddress"] = a.address
+		case strings.Contains(path, "/networkinterfaces/"):
+			ipConfig := properties["ipConfigurations"].([]interface{})[0].(map[string]interface{})["properties"].(map[string]interface{})
+			ipConfig["privateIPAddress"] = "10.0.0.2"
+		case strings.Contains(path, "/virtualmachines/"):
+			properties["timeCreated"] = time.Now().Format(time.RFC3339)
+		}
+		a.resources[path] = body
+		writeJson(w, http.StatusOK, body)
+	case resource == nil:
+		writeJson(w, http.StatusNotFound, map[string]interface{}{"error": map[string]interface{}{"code": "ResourceNotFound", "message": "not found"}})
+	case req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, resource)
+	case req.Method == http.MethodDelete:
+		resource["properties"].(map[string]interface{})["provisioningState"] = "Deleting"
+		w.Header().Set("Location", a.url+"/operations"+path)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func TestAzureProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+
+	// VMs are only returned once SSH is reachable, so point the stand-in public IPs at a local listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+
+	standIn := &armStandIn{address: host, resources: map[string]map[string]interface{}{}}
+	server := httptest.NewTLSServer(standIn)
+	defer server.Close()
+	standIn.url = server.URL
+	clientOptions = &arm.ClientOptions{ClientOptions: policy.ClientOptions{
+		Cloud: azcloud.Configuration{
+			ActiveDirectoryAuthorityHost: server.URL + "/",
+			Services: map[azcloud.ServiceName]azcloud.ServiceConfiguration{
+				azcloud.ResourceManager: {Endpoint: server.URL, Audience: "https://management.core.windows.net/"},
+			},
+		},
+		Transport: server.Client(),
+		Retry:     policy.RetryOptions{MaxRetries: -1},
+	}}
+	defer func() { clientOptions = nil }()
+
+	secret := v1.Secret{}
+	secret.Name = "azurekey"
+	secret.Namespace = systemNamespace
+	secret.Data = map[string][]byte{"tenant-id": []byte("tenant"), "client-id": []byte("client"), "client-secret": []byte("secret")}
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&secret).Build()
+
+	provider := AzureProvider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.subscription-id": "test-subscription",
+		"dynamic.linux-amd64.resource-group":  "builders",
+		"dynamic.linux-amd64.location":        "eastus",
+		"dynamic.linux-amd64.vm-size":         "Standard_D4s_v5",
+		"dynamic.linux-amd64.image":           "RedHat:RHEL:9-lvm-gen2:latest",
+		"dynamic.linux-amd64.subnet-id":       "/subscriptions/test-subscription/resourceGroups/builders/providers/Microsoft.Network/virtualNetworks/builders/subnets/default",
+		"dynamic.linux-amd64.ssh-public-key":  "ssh-ed25519 AAAA",
+		"dynamic.linux-amd64.azure-secret":    "azurekey",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	vm := standIn.resources[strings.ToLower(resourceGroupPath+"Microsoft.Compute/virtualMachines/"+string(id))]
+	g.Expect(vm).ShouldNot(BeNil())
+	g.Expect(vm["tags"]).Should(HaveKeyWithValue(cloud.InstanceTag, "prod-amd64"))
+	g.Expect(standIn.resources).Should(HaveKey(strings.ToLower(resourceGroupPath + "Microsoft.Network/networkInterfaces/" + nicName(string(id)))))
+	g.Expect(standIn.resources).Should(HaveKey(strings.ToLower(resourceGroupPath + "Microsoft.Network/publicIPAddresses/" + publicIpName(string(id)))))
+
+	address, err := provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+
+	count, err := provider.CountInstances(kubeClient, &log, ctx, "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "staging-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(0))
+
+	instances, err := provider.ListInstances(kubeClient, &log, ctx, "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(HaveLen(1))
+	g.Expect(instances[0].InstanceId).Should(Equal(id))
+	g.Expect(instances[0].Address).Should(Equal(host))
+
+	// The public IP is deleted along with the VM, like the NIC and disk
+	publicIp := standIn.resources[strings.ToLower(resourceGroupPath+"Microsoft.Network/publicIPAddresses/"+publicIpName(string(id)))]
+	g.Expect(publicIp["properties"]).Should(HaveKeyWithValue("deleteOption", "Delete"))
+
+	// Terminate only starts deleting the VM, it doesn't wait for it to finish
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	g.Expect(standIn.polls).Should(Equal(0))
+	g.Expect(vm["properties"]).Should(HaveKeyWithValue("provisioningState", "Deleting"))
+	_, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).Should(HaveOccurred())
+	instances, err = provider.ListInstances(kubeClient, &log, ctx, "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(BeEmpty())
+	// terminating a VM that is already being deleted, or is gone, is not an error
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	delete(standIn.resources, strings.ToLower(resourceGroupPath+"Microsoft.Compute/virtualMachines/"+string(id)))
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+
+	// a failed delete is returned rather than ignored
+	id, err = provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			writeJson(w, http.StatusConflict, map[string]interface{}{"error": map[string]interface{}{"code": "Conflict", "message": "busy"}})
+			return
+		}
+		standIn.ServeHTTP(w, req)
+	})
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).ShouldNot(Succeed())
+}
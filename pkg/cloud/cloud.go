@@ -26,3 +26,53 @@ type CloudVMInstance struct {
 }
 
 type InstanceIdentifier string
+
+// InterruptionChecker is implemented by providers that can launch instances the cloud may reclaim at short notice,
+// such as AWS spot instances. CheckInterruption returns a message describing why the instance is being reclaimed, or
+// an empty string if it is not.
+type InterruptionChecker interface {
+	CheckInterruption(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId InstanceIdentifier) (string, error)
+}
+
+// InstanceDetails describes where and how an instance was launched
+type InstanceDetails struct {
+	Zone         string
+	InstanceType string
+	CapacityType string
+}
+
+// InstanceDescriber is implemented by providers that fall back to other zones, instance types or capacity types when
+// the preferred one is not available, so the choice that was made can be recorded against the task
+type InstanceDescriber interface {
+	DescribeInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId InstanceIdentifier) (*InstanceDetails, error)
+}
+
+// InstanceStopper is implemented by providers that can stop an idle instance and start it again later, which is
+// faster and cheaper than launching a new one. CountInstances and ListInstances only report running instances, stopped
+// instances are reported by ListStoppedInstances. The StartTime of a stopped instance is the time it was first
+// launched, so it is still retired once it reaches the maximum age.
+type InstanceStopper interface {
+	StopInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId InstanceIdentifier) error
+	StartInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId InstanceIdentifier) error
+	ListStoppedInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]CloudVMInstance, error)
+}
+
+// HostKeyReader is implemented by providers that can read the SSH host keys an instance reported when it booted, e.g.
+// from its console output. This lets the key be pinned before the controller first connects to the instance. It
+// returns nil if the keys are not available yet.
+type HostKeyReader interface {
+	GetHostKeys(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId InstanceIdentifier) ([]string, error)
+}
+
+// LaunchMetrics records the outcome of each attempt to launch an instance
+type LaunchMetrics interface {
+	InstanceLaunched(capacityType string, instanceType string, zone string)
+	CapacityError(capacityType string, instanceType string, subnet string, code string)
+}
+
+// LaunchReporter is implemented by providers that fall back to other zones, instance types or capacity types when a
+// launch fails for lack of capacity. WithLaunchMetrics returns a copy of the provider that reports every attempt, so
+// the controller can record them in the platform's metrics.
+type LaunchReporter interface {
+	WithLaunchMetrics(metrics LaunchMetrics) CloudProvider
+}
@@ -0,0 +1,41 @@
+package cloud
+
+import (
+	"sigs.k8s.io/yaml"
+)
+
+// cloudConfig is the part of the cloud-init user-data used to set up the SSH user of an instance
+type cloudConfig struct {
+	Users []cloudConfigUser `json:"users"`
+}
+
+type cloudConfigUser struct {
+	Name              string   `json:"name"`
+	Sudo              string   `json:"sudo"`
+	Shell             string   `json:"shell"`
+	SshAuthorizedKeys []string `json:"ssh_authorized_keys"`
+}
+
+// UserData returns cloud-init user-data that creates the user with passwordless sudo and the SSH key. It is
+// marshalled rather than templated, so the values can't change the structure of the document.
+func UserData(user string, sshPublicKey string) (string, error) {
+	data, err := yaml.Marshal(cloudConfig{Users: []cloudConfigUser{{
+		Name:              user,
+		Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+		Shell:             "/bin/bash",
+		SshAuthorizedKeys: []string{sshPublicKey},
+	}}})
+	if err != nil {
+		return "", err
+	}
+	return "#cloud-config\n" + string(data), nil
+}
+
+// MetaData returns cloud-init NoCloud meta-data for an instance with the given name
+func MetaData(name string) (string, error) {
+	data, err := yaml.Marshal(map[string]string{"instance-id": name, "local-hostname": name})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
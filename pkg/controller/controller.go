@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"fmt"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
 	"github.com/redhat-appstudio/multi-platform-controller/pkg/reconciler/taskrun"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -21,13 +22,14 @@ import (
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 var (
 	controllerLog = ctrl.Log.WithName("controller")
 )
 
-func NewManager(cfg *rest.Config, options ctrl.Options) (ctrl.Manager, error) {
+func NewManager(cfg *rest.Config, options ctrl.Options, migrateHostConfig bool, enableWebhook bool) (ctrl.Manager, error) {
 	// do not check tekton in kcp
 	// we have seen in e2e testing that this path can get invoked prior to the TaskRun CRD getting generated,
 	// and controller-runtime does not retry on missing CRDs.
@@ -55,6 +57,10 @@ func NewManager(cfg *rest.Config, options ctrl.Options) (ctrl.Manager, error) {
 	if err := pipelinev1.AddToScheme(options.Scheme); err != nil {
 		return nil, err
 	}
+
+	if err := v1alpha1.AddToScheme(options.Scheme); err != nil {
+		return nil, err
+	}
 	var mgr ctrl.Manager
 	var err error
 
@@ -72,14 +78,18 @@ func NewManager(cfg *rest.Config, options ctrl.Options) (ctrl.Manager, error) {
 	}
 	secretSelector = secretSelector.Add(*secretLabels)
 
+	operatorNamespace := os.Getenv("POD_NAMESPACE")
+	operatorNamespaceOnly := map[string]cache.Config{operatorNamespace: {}}
 	options.Cache = cache.Options{
 		ByObject: map[client.Object]cache.ByObject{
-			&pipelinev1.TaskRun{}: {},
-			&v1.Secret{}:          {Label: secretSelector},
-			&v1.ConfigMap{}:       {Label: configMapSelector},
+			&pipelinev1.TaskRun{}:           {},
+			&v1.Secret{}:                    {Label: secretSelector},
+			&v1.ConfigMap{}:                 {Label: configMapSelector},
+			&v1alpha1.HostPool{}:            {Namespaces: operatorNamespaceOnly},
+			&v1alpha1.DynamicPlatform{}:     {Namespaces: operatorNamespaceOnly},
+			&v1alpha1.DynamicPoolPlatform{}: {Namespaces: operatorNamespaceOnly},
 		},
 	}
-	operatorNamespace := os.Getenv("POD_NAMESPACE")
 	mgr, err = ctrl.NewManager(cfg, options)
 
 	if err != nil {
@@ -89,6 +99,18 @@ func NewManager(cfg *rest.Config, options ctrl.Options) (ctrl.Manager, error) {
 	if err := taskrun.SetupNewReconcilerWithManager(mgr, operatorNamespace); err != nil {
 		return nil, err
 	}
+	if enableWebhook {
+		taskrun.SetupHostConfigWebhook(mgr, operatorNamespace)
+	}
+
+	if migrateHostConfig {
+		err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return taskrun.MigrateHostConfig(ctx, mgr.GetClient(), operatorNamespace, &controllerLog)
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	ticker := time.NewTicker(time.Hour * 24)
 	go func() {
@@ -0,0 +1,296 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	v1 "k8s.io/api/core/v1"
+	types2 "k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCE label keys and values must be lower case, so the AWS style MultiPlatformManaged tag can't be used directly
+const MultiPlatformManaged = "multi-platform-managed"
+
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
+func GceProvider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	disk, err := strconv.Atoi(config["dynamic."+platformName+".disk"])
+	if err != nil {
+		disk = 40
+	}
+	imageProject := config["dynamic."+platformName+".image-project"]
+	if imageProject == "" {
+		imageProject = config["dynamic."+platformName+".project"]
+	}
+	user := config["dynamic."+platformName+".ssh-user"]
+	if user == "" {
+		user = "cloud-user"
+	}
+	return GceDynamicConfig{
+		Project:         config["dynamic."+platformName+".project"],
+		Zone:            config["dynamic."+platformName+".zone"],
+		MachineType:     config["dynamic."+platformName+".machine-type"],
+		ImageFamily:     config["dynamic."+platformName+".image-family"],
+		ImageProject:    imageProject,
+		Network:         config["dynamic."+platformName+".network"],
+		Subnet:          config["dynamic."+platformName+".subnet"],
+		Secret:          config["dynamic."+platformName+".gcp-secret"],
+		SshKeys:         config["dynamic."+platformName+".ssh-keys"],
+		User:            user,
+		PrivateIp:       config["dynamic."+platformName+".private-ip"] == "true",
+		Endpoint:        config["dynamic."+platformName+".endpoint"],
+		Disk:            int64(disk),
+		SystemNamespace: systemNamespace,
+	}
+}
+
+func (r GceDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	log.Info(fmt.Sprintf("attempting to launch GCP instance for %s", name))
+	service, err := r.computeService(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Instance names must start with a letter and only contain lower case letters, digits and dashes
+	instanceName := "mpc-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	networkInterface := compute.NetworkInterface{}
+	if r.Network != "" {
+		networkInterface.Network = "global/networks/" + r.Network
+	}
+	if r.Subnet != "" {
+		networkInterface.Subnetwork = "regions/" + r.region() + "/subnetworks/" + r.Subnet
+	}
+	if !r.PrivateIp {
+		networkInterface.AccessConfigs = []*compute.AccessConfig{{Name: "External NAT", Type: "ONE_TO_ONE_NAT"}}
+	}
+	instance := compute.Instance{
+		Name:        instanceName,
+		Description: "multi-platform-builder-" + name,
+		MachineType: "zones/" + r.Zone + "/machineTypes/" + r.MachineType,
+		Disks: []*compute.AttachedDisk{{
+			Boot:       true,
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: "projects/" + r.ImageProject + "/global/images/family/" + r.ImageFamily,
+				DiskSizeGb:  r.Disk,
+			},
+		}},
+		NetworkInterfaces: []*compute.NetworkInterface{&networkInterface},
+		Labels:            map[string]string{MultiPlatformManaged: "true", cloud.InstanceTag: labelValue(instanceTag)},
+	}
+	if r.SshKeys != "" {
+		instance.Metadata = &compute.Metadata{Items: []*compute.MetadataItems{{Key: "ssh-keys", Value: &r.SshKeys}}}
+	}
+
+	_, err = service.Instances.Insert(r.Project, r.Zone, &instance).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return cloud.InstanceIdentifier(instanceName), nil
+}
+
+func (r GceDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	log.Info("attempting to count GCP instances")
+	instances, err := r.listInstances(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list instances")
+		return 0, err
+	}
+	count := 0
+	for _, inst := range instances {
+		log.Info(fmt.Sprintf("counting instance %s towards running count", inst.Name))
+		count++
+	}
+	return count, nil
+}
+
+func (r GceDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	log.Info(fmt.Sprintf("attempting to get GCP instance address %s", instanceId))
+	service, err := r.computeService(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	instance, err := service.Instances.Get(r.Project, r.Zone, string(instanceId)).Context(ctx).Do()
+	if err != nil {
+		if isNotFound(err) {
+			return "", fmt.Errorf("instance %s no longer exists", instanceId)
+		}
+		log.Error(err, "failed to get instance")
+		//this might be transient, just log it
+		return "", nil
+	}
+	switch instance.Status {
+	case "STOPPING", "TERMINATED", "SUSPENDING", "SUSPENDED":
+		return "", fmt.Errorf("instance %s is %s", instanceId, instance.Status)
+	case "RUNNING":
+		return r.checkInstanceConnectivity(instance, log), nil
+	}
+	return "", nil
+}
+
+// checkInstanceConnectivity returns the address of the instance if SSH is reachable, or an empty string if not
+func (r GceDynamicConfig) checkInstanceConnectivity(instance *compute.Instance, log *logr.Logger) string {
+	address := r.instanceAddress(instance)
+	if address == "" {
+		return ""
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, sshPort), 5*time.Second)
+	if err != nil {
+		log.Info("GCP instance is not yet reachable", "instance", instance.Name, "error", err.Error())
+		return ""
+	}
+	defer conn.Close()
+	return address
+}
+
+func (r GceDynamicConfig) instanceAddress(instance *compute.Instance) string {
+	for _, ni := range instance.NetworkInterfaces {
+		if r.PrivateIp {
+			if ni.NetworkIP != "" {
+				return ni.NetworkIP
+			}
+			continue
+		}
+		for _, ac := range ni.AccessConfigs {
+			if ac.NatIP != "" {
+				return ac.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+func (r GceDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to terminate GCP instance %s", instance))
+	service, err := r.computeService(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	_, err = service.Instances.Delete(r.Project, r.Zone, string(instance)).Context(ctx).Do()
+	if err != nil && isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r GceDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list GCP instances")
+	instances, err := r.listInstances(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list instances")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for _, inst := range instances {
+		if inst.Status != "RUNNING" {
+			continue
+		}
+		address := r.checkInstanceConnectivity(inst, log)
+		if address == "" {
+			continue
+		}
+		startTime, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+		if err != nil {
+			log.Error(err, "failed to parse instance creation time", "instance", inst.Name)
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(inst.Name), StartTime: startTime, Address: address})
+		log.Info(fmt.Sprintf("counting instance %s towards running count", inst.Name))
+	}
+	return ret, nil
+}
+
+// listInstances returns all instances with the given tag and machine type that have not been shut down
+func (r GceDynamicConfig) listInstances(kubeClient client.Client, ctx context.Context, instanceTag string) ([]*compute.Instance, error) {
+	service, err := r.computeService(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("(labels.%s = \"%s\") AND (labels.%s = \"true\")", cloud.InstanceTag, labelValue(instanceTag), MultiPlatformManaged)
+	ret := []*compute.Instance{}
+	err = service.Instances.List(r.Project, r.Zone).Filter(filter).Pages(ctx, func(list *compute.InstanceList) error {
+		for _, inst := range list.Items {
+			if inst.Status == "TERMINATED" || inst.Status == "STOPPING" || path.Base(inst.MachineType) != r.MachineType {
+				continue
+			}
+			ret = append(ret, inst)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// computeService creates a client using the service account key in the configured secret
+func (r GceDynamicConfig) computeService(kubeClient client.Client, ctx context.Context) (*compute.Service, error) {
+	opts := []option.ClientOption{}
+	if r.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(r.Endpoint))
+	}
+	if kubeClient != nil {
+		s := v1.Secret{}
+		err := kubeClient.Get(ctx, types2.NamespacedName{Name: r.Secret, Namespace: r.SystemNamespace}, &s)
+		if err != nil {
+			return nil, err
+		}
+		credentials, err := google.CredentialsFromJSON(ctx, s.Data["key.json"], compute.ComputeScope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service account key in secret %s: %w", r.Secret, err)
+		}
+		opts = append(opts, option.WithCredentials(credentials))
+	}
+	return compute.NewService(ctx, opts...)
+}
+
+func (r GceDynamicConfig) region() string {
+	pos := strings.LastIndex(r.Zone, "-")
+	if pos == -1 {
+		return r.Zone
+	}
+	return r.Zone[0:pos]
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// labelValue converts an instance tag to a valid GCE label value
+func labelValue(value string) string {
+	return strings.ToLower(strings.NewReplacer(".", "-", "/", "-").Replace(value))
+}
+
+type GceDynamicConfig struct {
+	Project         string
+	Zone            string
+	MachineType     string
+	ImageFamily     string
+	ImageProject    string
+	Network         string
+	Subnet          string
+	Secret          string
+	SshKeys         string
+	User            string
+	PrivateIp       bool
+	Endpoint        string
+	Disk            int64
+	SystemNamespace string
+}
+
+func (r GceDynamicConfig) SshUser() string {
+	return r.User
+}
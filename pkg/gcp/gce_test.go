@@ -0,0 +1,168 @@
+package gcp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const systemNamespace = "multi-platform-controller"
+
+// computeStandIn implements just enough of the Compute API to launch, list and delete instances
+type computeStandIn struct {
+	lock      sync.Mutex
+	instances map[string]*compute.Instance
+	address   string
+}
+
+func (c *computeStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if req.URL.Path == "/token" {
+		writeJson(w, map[string]interface{}{"access_token": "token", "token_type": "Bearer", "expires_in": 3600})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	prefix := "/compute/v1/projects/test-project/zones/us-central1-a/instances"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	switch {
+	case req.Method == http.MethodPost && name == "":
+		instance := compute.Instance{}
+		if err := json.NewDecoder(req.Body).Decode(&instance); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		instance.Status = "RUNNING"
+		instance.MachineType = "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/" + instance.MachineType
+		instance.CreationTimestamp = time.Now().Format(time.RFC3339)
+		instance.NetworkInterfaces[0].NetworkIP = "10.0.0.2"
+		instance.NetworkInterfaces[0].AccessConfigs[0].NatIP = c.address
+		c.instances[instance.Name] = &instance
+		writeJson(w, compute.Operation{Name: "insert", Status: "RUNNING"})
+	case req.Method == http.MethodGet && name == "":
+		list := compute.InstanceList{}
+		for _, i := range c.instances {
+			if strings.Contains(req.URL.Query().Get("filter"), "labels."+cloud.InstanceTag+" = \""+i.Labels[cloud.InstanceTag]+"\"") {
+				list.Items = append(list.Items, i)
+			}
+		}
+		writeJson(w, list)
+	case c.instances[name] == nil:
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "not found"}})
+	case req.Method == http.MethodGet:
+		writeJson(w, c.instances[name])
+	case req.Method == http.MethodDelete:
+		delete(c.instances, name)
+		writeJson(w, compute.Operation{Name: "delete", Status: "RUNNING"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func TestGceProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+
+	// Instances are only returned once SSH is reachable, so point the stand-in instances at a local listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+
+	standIn := &computeStandIn{instances: map[string]*compute.Instance{}, address: host}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	keyJson, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "builder@test-project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    server.URL + "/token",
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	secret := v1.Secret{}
+	secret.Name = "gcpkey"
+	secret.Namespace = systemNamespace
+	secret.Data = map[string][]byte{"key.json": keyJson}
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&secret).Build()
+
+	provider := GceProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.project":      "test-project",
+		"dynamic.linux-arm64.zone":         "us-central1-a",
+		"dynamic.linux-arm64.machine-type": "t2a-standard-4",
+		"dynamic.linux-arm64.image-family": "rhel-9-arm64",
+		"dynamic.linux-arm64.subnet":       "builders",
+		"dynamic.linux-arm64.gcp-secret":   "gcpkey",
+		"dynamic.linux-arm64.endpoint":     server.URL + "/compute/v1/",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	instance := standIn.instances[string(id)]
+	g.Expect(instance).ShouldNot(BeNil())
+	g.Expect(instance.Labels).Should(Equal(map[string]string{MultiPlatformManaged: "true", cloud.InstanceTag: "prod-arm64"}))
+	g.Expect(instance.Disks[0].InitializeParams.SourceImage).Should(Equal("projects/test-project/global/images/family/rhel-9-arm64"))
+	g.Expect(instance.NetworkInterfaces[0].Subnetwork).Should(Equal("regions/us-central1/subnetworks/builders"))
+
+	address, err := provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+
+	count, err := provider.CountInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "staging-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(0))
+
+	instances, err := provider.ListInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(HaveLen(1))
+	g.Expect(instances[0].InstanceId).Should(Equal(id))
+	g.Expect(instances[0].Address).Should(Equal(host))
+
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	g.Expect(standIn.instances).Should(BeEmpty())
+	// terminating an instance that is already gone is not an error
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	_, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).Should(HaveOccurred())
+}
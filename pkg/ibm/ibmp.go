@@ -36,6 +36,7 @@ func IBMPowerProvider(platform string, config map[string]string, systemNamespace
 		CRN:             config["dynamic."+platform+".crn"],
 		Network:         config["dynamic."+platform+".network"],
 		System:          config["dynamic."+platform+".system"],
+		IamUrl:          config["dynamic."+platform+".iam-url"],
 		Cores:           cores,
 		Memory:          mem,
 		SystemNamespace: systemNamespace,
@@ -66,38 +67,15 @@ func (r IBMPowerDynamicConfig) CountInstances(kubeClient client.Client, log *log
 	if err != nil {
 		return 0, err
 	}
-	builder := core.NewRequestBuilder(core.GET)
-	builder = builder.WithContext(ctx)
-	builder.EnableGzipCompression = service.GetEnableGzipCompression()
-
-	pathParamsMap := map[string]string{
-		"cloud": r.pCloudId(),
-	}
-	_, err = builder.ResolveRequestURL(r.Url, `/pcloud/v1/cloud-instances/{cloud}/pvm-instances`, pathParamsMap)
+	instances, err := r.listInstances(ctx, service, instanceTag)
 	if err != nil {
+		log.Error(err, "failed to list power servers")
 		return 0, err
 	}
-	builder.AddHeader("CRN", r.CRN)
-	builder.AddHeader("Accept", "application/json")
-
-	request, err := builder.Build()
-	if err != nil {
-		return 0, err
+	for _, instance := range instances {
+		log.Info(fmt.Sprintf("counting instance %s towards running count", instance.PvmInstanceID))
 	}
-
-	var rawResponse map[string]json.RawMessage
-	_, err = service.Request(request, &rawResponse)
-	//println(response.String())
-	if err != nil {
-		return 0, err
-	}
-	instancesData := rawResponse["pvmInstances"]
-	instances := []json.RawMessage{}
-	err = json.Unmarshal(instancesData, &instances)
-	if err != nil {
-		return 0, err
-	}
-	return len(rawResponse), nil
+	return len(instances), nil
 }
 
 func (r IBMPowerDynamicConfig) authenticate(kubeClient client.Client, ctx context.Context) (*core.BaseService, error) {
@@ -116,6 +94,7 @@ func (r IBMPowerDynamicConfig) authenticate(kubeClient client.Client, ctx contex
 		URL: r.Url,
 		Authenticator: &core.IamAuthenticator{
 			ApiKey: apiKey,
+			URL:    r.IamUrl,
 		},
 	}
 
@@ -139,8 +118,30 @@ func (r IBMPowerDynamicConfig) GetInstanceAddress(kubeClient client.Client, log
 }
 
 func (r IBMPowerDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
-	return nil, fmt.Errorf("not impelemented")
+	service, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := r.listInstances(ctx, service, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list power servers")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for _, instance := range instances {
+		if instance.Status != "ACTIVE" {
+			continue
+		}
+		address, err := checkAddressLive(instance.externalIp(), log)
+		if err != nil || address == "" {
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(instance.PvmInstanceID), StartTime: instance.CreationDate, Address: address})
+		log.Info(fmt.Sprintf("counting instance %s towards running count", instance.PvmInstanceID))
+	}
+	return ret, nil
 }
+
 func (r IBMPowerDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
 	log.Info("attempting to terminate power server %s", "instance", instanceId)
 	service, err := r.authenticate(kubeClient, ctx)
@@ -175,6 +176,27 @@ func (r IBMPowerDynamicConfig) TerminateInstance(kubeClient client.Client, log *
 	return nil
 }
 
+// pvmInstance holds the fields of a PowerVS PVM instance that the controller uses
+type pvmInstance struct {
+	PvmInstanceID string       `json:"pvmInstanceID"`
+	ServerName    string       `json:"serverName"`
+	Status        string       `json:"status"`
+	CreationDate  time.Time    `json:"creationDate"`
+	Networks      []pvmNetwork `json:"networks"`
+}
+
+type pvmNetwork struct {
+	IPAddress  string `json:"ipAddress"`
+	ExternalIP string `json:"externalIP"`
+}
+
+func (i pvmInstance) externalIp() string {
+	if len(i.Networks) == 0 {
+		return ""
+	}
+	return i.Networks[0].ExternalIP
+}
+
 type IBMPowerDynamicConfig struct {
 	SystemNamespace string
 	Secret          string
@@ -186,6 +208,8 @@ type IBMPowerDynamicConfig struct {
 	Cores           float64
 	Memory          int
 	System          string
+	// IamUrl overrides the IAM token endpoint, e.g. to use the private endpoint
+	IamUrl string
 }
 
 func (r IBMPowerDynamicConfig) pCloudId() string {
@@ -258,28 +282,52 @@ func (r IBMPowerDynamicConfig) createServerInstance(ctx context.Context, log *lo
 }
 
 func (r IBMPowerDynamicConfig) lookupIp(ctx context.Context, service *core.BaseService, pvmId string) (string, error) {
-
-	rawResponse, err := r.lookupInstance(ctx, service, pvmId)
+	instance, err := r.lookupInstance(ctx, service, pvmId)
 	if err != nil {
 		return "", err
 	}
-	info := rawResponse["networks"]
-	nwList := []map[string]json.RawMessage{}
-	err = json.Unmarshal(info, &nwList)
+	return instance.externalIp(), nil
+}
+
+// listInstances returns all PVM instances launched with the given tag. Instance names are the tag followed by 20
+// random characters and an x, so other tags that start with this one are not matched.
+func (r IBMPowerDynamicConfig) listInstances(ctx context.Context, service *core.BaseService, instanceTag string) ([]pvmInstance, error) {
+	builder := core.NewRequestBuilder(core.GET)
+	builder = builder.WithContext(ctx)
+	builder.EnableGzipCompression = service.GetEnableGzipCompression()
+
+	pathParamsMap := map[string]string{
+		"cloud": r.pCloudId(),
+	}
+	_, err := builder.ResolveRequestURL(r.Url, `/pcloud/v1/cloud-instances/{cloud}/pvm-instances`, pathParamsMap)
+	if err != nil {
+		return nil, err
+	}
+	builder.AddHeader("CRN", r.CRN)
+	builder.AddHeader("Accept", "application/json")
+
+	request, err := builder.Build()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if len(nwList) == 0 {
-		return "", err
+
+	response := struct {
+		PvmInstances []pvmInstance `json:"pvmInstances"`
+	}{}
+	_, err = service.Request(request, &response)
+	if err != nil {
+		return nil, err
 	}
-	external := string(nwList[0]["externalIP"])
-	if external[0] == '"' {
-		return external[1 : len(external)-1], nil
+	ret := []pvmInstance{}
+	for _, instance := range response.PvmInstances {
+		if strings.HasPrefix(instance.ServerName, instanceTag) && strings.HasSuffix(instance.ServerName, "x") && len(instance.ServerName) == len(instanceTag)+21 {
+			ret = append(ret, instance)
+		}
 	}
-	return external, nil
+	return ret, nil
 }
 
-func (r IBMPowerDynamicConfig) lookupInstance(ctx context.Context, service *core.BaseService, pvmId string) (map[string]json.RawMessage, error) {
+func (r IBMPowerDynamicConfig) lookupInstance(ctx context.Context, service *core.BaseService, pvmId string) (*pvmInstance, error) {
 	builder := core.NewRequestBuilder(core.GET)
 	builder = builder.WithContext(ctx)
 	builder.EnableGzipCompression = service.GetEnableGzipCompression()
@@ -300,13 +348,12 @@ func (r IBMPowerDynamicConfig) lookupInstance(ctx context.Context, service *core
 		return nil, err
 	}
 
-	var rawResponse map[string]json.RawMessage
-	_, err = service.Request(request, &rawResponse)
-	//println(response.String())
+	instance := pvmInstance{}
+	_, err = service.Request(request, &instance)
 	if err != nil {
 		return nil, err
 	}
-	return rawResponse, nil
+	return &instance, nil
 }
 
 func (r IBMPowerDynamicConfig) deleteServer(ctx context.Context, service *core.BaseService, pvmId string) error {
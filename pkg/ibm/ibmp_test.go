@@ -0,0 +1,169 @@
+package ibm
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	systemNamespace = "multi-platform-controller"
+	cloudId         = "8c9ef568-16a5-4aa2-bfd5-946349c9aeac"
+	crn             = "crn:v1:bluemix:public:power-iaas:dal10:a/934e118c399b4a28a70afdf2210d708f:" + cloudId + "::"
+)
+
+// powerStandIn implements just enough of IAM and the PowerVS API to launch, list and delete PVM instances
+type powerStandIn struct {
+	lock      sync.Mutex
+	address   string
+	instances map[string]map[string]interface{}
+	nextId    int
+}
+
+func (p *powerStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if req.URL.Path == "/identity/token" {
+		writeJson(w, map[string]interface{}{"access_token": "token", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600, "expiration": time.Now().Add(time.Hour).Unix()})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("CRN") != crn {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	prefix := "/pcloud/v1/cloud-instances/" + cloudId + "/pvm-instances"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		p.nextId++
+		id = "pvm-" + string(rune('a'+p.nextId))
+		p.instances[id] = map[string]interface{}{
+			"pvmInstanceID": id,
+			"serverName":    body["serverName"],
+			"status":        "ACTIVE",
+			"creationDate":  time.Now().UTC().Format(time.RFC3339),
+			"networks":      []interface{}{map[string]interface{}{"ipAddress": "192.168.0.5", "externalIP": p.address}},
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJson(w, []interface{}{map[string]interface{}{"pvmInstanceID": id}})
+	case req.Method == http.MethodGet && id == "":
+		list := []interface{}{}
+		for _, i := range p.instances {
+			list = append(list, i)
+		}
+		writeJson(w, map[string]interface{}{"pvmInstances": list})
+	case p.instances[id] == nil:
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, map[string]interface{}{"description": "pvm-instance does not exist"})
+	case req.Method == http.MethodGet:
+		writeJson(w, p.instances[id])
+	case req.Method == http.MethodDelete:
+		delete(p.instances, id)
+		writeJson(w, map[string]interface{}{})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func TestIBMPowerProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+
+	// Instances are only listed once SSH is reachable, so point the external IP at a local listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+
+	standIn := &powerStandIn{address: host, instances: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	// Instances from other tags, including tags that start with ours, must not be counted
+	standIn.instances["other"] = map[string]interface{}{"pvmInstanceID": "other", "serverName": "prod-ppc64le-stagingabcdefghijklmnopqrstx", "status": "ACTIVE", "creationDate": time.Now().UTC().Format(time.RFC3339)}
+	standIn.instances["manual"] = map[string]interface{}{"pvmInstanceID": "manual", "serverName": "build-server", "status": "ACTIVE", "creationDate": time.Now().UTC().Format(time.RFC3339)}
+
+	secret := v1.Secret{}
+	secret.Name = "ibmiam"
+	secret.Namespace = systemNamespace
+	secret.Data = map[string][]byte{"api-key": []byte("key")}
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&secret).Build()
+
+	provider := IBMPowerProvider("linux-ppc64le", map[string]string{
+		"dynamic.linux-ppc64le.key":     "builder",
+		"dynamic.linux-ppc64le.image":   "rhel-9",
+		"dynamic.linux-ppc64le.secret":  "ibmiam",
+		"dynamic.linux-ppc64le.url":     server.URL,
+		"dynamic.linux-ppc64le.iam-url": server.URL,
+		"dynamic.linux-ppc64le.crn":     crn,
+		"dynamic.linux-ppc64le.network": "network",
+		"dynamic.linux-ppc64le.system":  "e980",
+	}, systemNamespace)
+
+	count, err := provider.CountInstances(kubeClient, &log, ctx, "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(0))
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(standIn.instances[string(id)]).ShouldNot(BeNil())
+
+	address, err := provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+
+	instances, err := provider.ListInstances(kubeClient, &log, ctx, "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(HaveLen(1))
+	g.Expect(instances[0].InstanceId).Should(Equal(id))
+	g.Expect(instances[0].Address).Should(Equal(host))
+	g.Expect(instances[0].StartTime).Should(BeTemporally("~", time.Now(), time.Minute))
+
+	// Instances that are still building are counted, but can't be used yet
+	standIn.instances[string(id)]["status"] = "BUILD"
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+	instances, err = provider.ListInstances(kubeClient, &log, ctx, "prod-ppc64le")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(BeEmpty())
+}
+
+func TestPvmInstanceWithoutNetwork(t *testing.T) {
+	g := NewGomegaWithT(t)
+	instance := pvmInstance{}
+	g.Expect(json.Unmarshal([]byte(`{"pvmInstanceID":"pvm","serverName":"build","status":"BUILD","networks":[]}`), &instance)).Should(Succeed())
+	g.Expect(instance.externalIp()).Should(BeEmpty())
+}
@@ -120,7 +120,7 @@ func (r IBMZDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Lo
 	}
 	count := 0
 	for _, instance := range instances.Instances {
-		if strings.HasPrefix(*instance.Name, instanceTag) {
+		if strings.HasPrefix(*instance.Name, instanceTag) && !isStopped(&instance) {
 			count++
 		}
 	}
@@ -143,7 +143,7 @@ func (r IBMZDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Log
 	}
 	ret := []cloud.CloudVMInstance{}
 	for _, instance := range instances.Instances {
-		if strings.HasPrefix(*instance.Name, instanceTag) {
+		if strings.HasPrefix(*instance.Name, instanceTag) && !isStopped(&instance) {
 			identifier := cloud.InstanceIdentifier(*instance.ID)
 			addr, err := r.GetInstanceAddress(kubeClient, log, ctx, identifier)
 			if err != nil {
@@ -156,6 +156,54 @@ func (r IBMZDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Log
 	return ret, nil
 }
 
+// isStopped returns true for instances that are stopped, or are being stopped, which can't run tasks until they are
+// started again
+func isStopped(instance *vpcv1.Instance) bool {
+	return instance.Status != nil && (*instance.Status == vpcv1.InstanceStatusStoppedConst || *instance.Status == vpcv1.InstanceStatusStoppingConst)
+}
+
+func (r IBMZDynamicConfig) ListStoppedInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	vpcService, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vpc, err := r.lookupVpc(vpcService)
+	if err != nil {
+		return nil, err
+	}
+	instances, _, err := vpcService.ListInstances(&vpcv1.ListInstancesOptions{ResourceGroupID: vpc.ResourceGroup.ID, VPCName: &r.Vpc})
+	if err != nil {
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for i := range instances.Instances {
+		instance := instances.Instances[i]
+		if strings.HasPrefix(*instance.Name, instanceTag) && isStopped(&instance) {
+			ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(*instance.ID), StartTime: time.Time(*instance.CreatedAt)})
+		}
+	}
+	return ret, nil
+}
+
+func (r IBMZDynamicConfig) StopInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	return r.instanceAction(kubeClient, log, ctx, instanceId, vpcv1.CreateInstanceActionOptionsTypeStopConst)
+}
+
+func (r IBMZDynamicConfig) StartInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	return r.instanceAction(kubeClient, log, ctx, instanceId, vpcv1.CreateInstanceActionOptionsTypeStartConst)
+}
+
+func (r IBMZDynamicConfig) instanceAction(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier, action string) error {
+	log.Info(fmt.Sprintf("attempting to %s system z instance %s", action, instanceId))
+	vpcService, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = vpcService.CreateInstanceAction(&vpcv1.CreateInstanceActionOptions{InstanceID: ptr(string(instanceId)), Type: ptr(action)})
+	return err
+}
+
 func (r IBMZDynamicConfig) lookupSubnet(vpcService *vpcv1.VpcV1) (*vpcv1.Subnet, error) {
 	subnets, _, err := vpcService.ListSubnets(&vpcv1.ListSubnetsOptions{})
 	if err != nil {
@@ -304,8 +352,11 @@ func (r IBMZDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *log
 	return checkAddressLive(*ip.Address, log)
 }
 
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
 func checkAddressLive(addr string, log *logr.Logger) (string, error) {
-	server, _ := net.ResolveTCPAddr("tcp", addr+":22")
+	server, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr, sshPort))
 	conn, err := net.DialTCP("tcp", nil, server)
 	if err != nil {
 		log.Info("failed to connect to IBM host " + addr)
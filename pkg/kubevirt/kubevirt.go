@@ -0,0 +1,317 @@
+package kubevirt
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MultiPlatformManaged = "build.appstudio.redhat.com/multi-platform-managed"
+	PlatformLabel        = "build.appstudio.redhat.com/platform"
+)
+
+// KubeVirt and CDI objects are handled as unstructured, so the controller does not need the KubeVirt API types
+var (
+	VirtualMachineInstanceGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachineInstance"}
+	DataVolumeGVK             = schema.GroupVersionKind{Group: "cdi.kubevirt.io", Version: "v1beta1", Kind: "DataVolume"}
+)
+
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
+func KubeVirtProvider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	namespace := config["dynamic."+platformName+".namespace"]
+	if namespace == "" {
+		namespace = systemNamespace
+	}
+	memory := config["dynamic."+platformName+".memory"]
+	if memory == "" {
+		memory = "4Gi"
+	}
+	cpu, err := strconv.Atoi(config["dynamic."+platformName+".cpu"])
+	if err != nil {
+		cpu = 2
+	}
+	disk := config["dynamic."+platformName+".disk"]
+	if disk == "" {
+		disk = "40Gi"
+	}
+	sourceNamespace := config["dynamic."+platformName+".source-pvc-namespace"]
+	if sourceNamespace == "" {
+		sourceNamespace = namespace
+	}
+	user := config["dynamic."+platformName+".ssh-user"]
+	if user == "" {
+		user = "cloud-user"
+	}
+	return KubeVirtDynamicConfig{
+		Platform:           platformName,
+		Namespace:          namespace,
+		ContainerDisk:      config["dynamic."+platformName+".container-disk"],
+		SourcePvc:          config["dynamic."+platformName+".source-pvc"],
+		SourcePvcNamespace: sourceNamespace,
+		StorageClass:       config["dynamic."+platformName+".storage-class"],
+		Disk:               disk,
+		Memory:             memory,
+		Cpu:                cpu,
+		Arch:               config["dynamic."+platformName+".arch"],
+		SshPublicKey:       config["dynamic."+platformName+".ssh-public-key"],
+		User:               user,
+	}
+}
+
+func (r KubeVirtDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	log.Info(fmt.Sprintf("attempting to launch KubeVirt VMI for %s", name))
+	vmiName := "mpc-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	// The boot disk is either an ephemeral container disk, or a DataVolume cloned from a PVC holding the base image
+	bootVolume := map[string]interface{}{"name": "boot"}
+	if r.SourcePvc != "" {
+		bootVolume["dataVolume"] = map[string]interface{}{"name": vmiName}
+	} else {
+		bootVolume["containerDisk"] = map[string]interface{}{"image": r.ContainerDisk}
+	}
+	userData, err := cloud.UserData(r.User, r.SshPublicKey)
+	if err != nil {
+		return "", err
+	}
+	spec := map[string]interface{}{
+		"domain": map[string]interface{}{
+			"cpu": map[string]interface{}{"cores": int64(r.Cpu)},
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"memory": r.Memory},
+			},
+			"devices": map[string]interface{}{
+				"disks": []interface{}{
+					map[string]interface{}{"name": "boot", "disk": map[string]interface{}{"bus": "virtio"}},
+					map[string]interface{}{"name": "cloudinit", "disk": map[string]interface{}{"bus": "virtio"}},
+				},
+				"interfaces": []interface{}{map[string]interface{}{"name": "default", "masquerade": map[string]interface{}{}}},
+			},
+		},
+		"networks": []interface{}{map[string]interface{}{"name": "default", "pod": map[string]interface{}{}}},
+		"volumes": []interface{}{
+			bootVolume,
+			map[string]interface{}{"name": "cloudinit", "cloudInitNoCloud": map[string]interface{}{"userData": userData}},
+		},
+	}
+	if r.Arch != "" {
+		spec["nodeSelector"] = map[string]interface{}{"kubernetes.io/arch": r.Arch}
+	}
+
+	// The DataVolume is created first so the clone has started by the time the VMI is scheduled
+	var dv *unstructured.Unstructured
+	if r.SourcePvc != "" {
+		dv = &unstructured.Unstructured{}
+		dv.SetGroupVersionKind(DataVolumeGVK)
+		dv.SetName(vmiName)
+		dv.SetNamespace(r.Namespace)
+		dv.SetLabels(r.labels(instanceTag))
+		storage := map[string]interface{}{
+			"resources": map[string]interface{}{"requests": map[string]interface{}{"storage": r.Disk}},
+		}
+		if r.StorageClass != "" {
+			storage["storageClassName"] = r.StorageClass
+		}
+		dv.Object["spec"] = map[string]interface{}{
+			"source":  map[string]interface{}{"pvc": map[string]interface{}{"name": r.SourcePvc, "namespace": r.SourcePvcNamespace}},
+			"storage": storage,
+		}
+		if err := kubeClient.Create(ctx, dv); err != nil {
+			return "", err
+		}
+	}
+
+	vmi := &unstructured.Unstructured{}
+	vmi.SetGroupVersionKind(VirtualMachineInstanceGVK)
+	vmi.SetName(vmiName)
+	vmi.SetNamespace(r.Namespace)
+	vmi.SetLabels(r.labels(instanceTag))
+	vmi.SetAnnotations(map[string]string{"build.appstudio.redhat.com/task-run": name})
+	vmi.Object["spec"] = spec
+	if err := kubeClient.Create(ctx, vmi); err != nil {
+		if dv != nil {
+			log.Error(err, "failed to create VMI, removing DataVolume", "vmi", vmiName)
+			r.deleteObject(kubeClient, log, ctx, dv)
+		}
+		return "", err
+	}
+
+	if dv != nil {
+		// The DataVolume is owned by the VMI so it is garbage collected when the VMI is deleted
+		patch := client.MergeFrom(dv.DeepCopy())
+		dv.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: VirtualMachineInstanceGVK.GroupVersion().String(), Kind: VirtualMachineInstanceGVK.Kind, Name: vmiName, UID: vmi.GetUID()}})
+		if err := kubeClient.Patch(ctx, dv, patch); err != nil {
+			log.Error(err, "failed to set DataVolume owner, removing VMI and DataVolume", "vmi", vmiName)
+			r.deleteObject(kubeClient, log, ctx, vmi)
+			r.deleteObject(kubeClient, log, ctx, dv)
+			return "", err
+		}
+	}
+	return cloud.InstanceIdentifier(vmiName), nil
+}
+
+// deleteObject removes an object left behind by a failed launch, errors are only logged as the launch error is returned
+func (r KubeVirtDynamicConfig) deleteObject(kubeClient client.Client, log *logr.Logger, ctx context.Context, obj client.Object) {
+	if err := kubeClient.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "failed to delete object", "kind", obj.GetObjectKind().GroupVersionKind().Kind, "name", obj.GetName())
+	}
+}
+
+func (r KubeVirtDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	log.Info("attempting to count KubeVirt VMIs")
+	vmis, err := r.listInstances(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list VMIs")
+		return 0, err
+	}
+	count := 0
+	for _, vmi := range vmis {
+		log.Info(fmt.Sprintf("counting VMI %s towards running count", vmi.GetName()))
+		count++
+	}
+	return count, nil
+}
+
+func (r KubeVirtDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	log.Info(fmt.Sprintf("attempting to get KubeVirt VMI address %s", instanceId))
+	vmi := &unstructured.Unstructured{}
+	vmi.SetGroupVersionKind(VirtualMachineInstanceGVK)
+	err := kubeClient.Get(ctx, types.NamespacedName{Namespace: r.Namespace, Name: string(instanceId)}, vmi)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", fmt.Errorf("VMI %s no longer exists", instanceId)
+		}
+		log.Error(err, "failed to get VMI")
+		//this might be transient, just log it
+		return "", nil
+	}
+	phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+	switch phase {
+	case "Failed", "Succeeded":
+		return "", fmt.Errorf("VMI %s is %s", instanceId, phase)
+	case "Running":
+		return checkInstanceConnectivity(vmi, log), nil
+	}
+	return "", nil
+}
+
+// checkInstanceConnectivity returns the pod network address of the VMI if SSH is reachable, or an empty string if not
+func checkInstanceConnectivity(vmi *unstructured.Unstructured, log *logr.Logger) string {
+	address := instanceAddress(vmi)
+	if address == "" {
+		return ""
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, sshPort), 5*time.Second)
+	if err != nil {
+		log.Info("KubeVirt VMI is not yet reachable", "vmi", vmi.GetName(), "error", err.Error())
+		return ""
+	}
+	defer conn.Close()
+	return address
+}
+
+func instanceAddress(vmi *unstructured.Unstructured) string {
+	interfaces, _, _ := unstructured.NestedSlice(vmi.Object, "status", "interfaces")
+	for _, i := range interfaces {
+		iface, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if address, _, _ := unstructured.NestedString(iface, "ipAddress"); address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+func (r KubeVirtDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to terminate KubeVirt VMI %s", instance))
+	vmi := &unstructured.Unstructured{}
+	vmi.SetGroupVersionKind(VirtualMachineInstanceGVK)
+	vmi.SetName(string(instance))
+	vmi.SetNamespace(r.Namespace)
+	err := kubeClient.Delete(ctx, vmi, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r KubeVirtDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list KubeVirt VMIs")
+	vmis, err := r.listInstances(kubeClient, ctx, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list VMIs")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for i := range vmis {
+		vmi := &vmis[i]
+		if phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase"); phase != "Running" {
+			continue
+		}
+		address := checkInstanceConnectivity(vmi, log)
+		if address == "" {
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(vmi.GetName()), StartTime: vmi.GetCreationTimestamp().Time, Address: address})
+		log.Info(fmt.Sprintf("counting VMI %s towards running count", vmi.GetName()))
+	}
+	return ret, nil
+}
+
+// listInstances returns the VMIs for this platform with the given tag that are not being deleted and have not finished
+func (r KubeVirtDynamicConfig) listInstances(kubeClient client.Client, ctx context.Context, instanceTag string) ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(VirtualMachineInstanceGVK.GroupVersion().WithKind(VirtualMachineInstanceGVK.Kind + "List"))
+	err := kubeClient.List(ctx, list, client.InNamespace(r.Namespace), client.MatchingLabels(r.labels(instanceTag)))
+	if err != nil {
+		return nil, err
+	}
+	ret := []unstructured.Unstructured{}
+	for _, vmi := range list.Items {
+		phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+		if vmi.GetDeletionTimestamp() != nil || phase == "Failed" || phase == "Succeeded" {
+			continue
+		}
+		ret = append(ret, vmi)
+	}
+	return ret, nil
+}
+
+func (r KubeVirtDynamicConfig) labels(instanceTag string) map[string]string {
+	return map[string]string{MultiPlatformManaged: "true", cloud.InstanceTag: instanceTag, PlatformLabel: r.Platform}
+}
+
+type KubeVirtDynamicConfig struct {
+	Platform           string
+	Namespace          string
+	ContainerDisk      string
+	SourcePvc          string
+	SourcePvcNamespace string
+	StorageClass       string
+	Disk               string
+	Memory             string
+	Cpu                int
+	Arch               string
+	SshPublicKey       string
+	User               string
+}
+
+func (r KubeVirtDynamicConfig) SshUser() string {
+	return r.User
+}
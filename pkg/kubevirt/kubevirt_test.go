@@ -0,0 +1,292 @@
+package kubevirt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/yaml"
+)
+
+const systemNamespace = "multi-platform-controller"
+
+// testClient returns a client for an envtest API server with the KubeVirt CRDs installed if KUBEBUILDER_ASSETS is set,
+// otherwise a fake client
+func testClient(t *testing.T, g *WithT) client.Client {
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Log("KUBEBUILDER_ASSETS is not set, using a fake client")
+		return fake.NewClientBuilder().WithScheme(scheme).Build()
+	}
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("testdata", "crds")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	g.Expect(err).ShouldNot(HaveOccurred())
+	t.Cleanup(func() {
+		_ = env.Stop()
+	})
+	kubeClient, err := client.New(cfg, client.Options{Scheme: scheme})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	ns := v1.Namespace{}
+	ns.Name = systemNamespace
+	g.Expect(kubeClient.Create(context.Background(), &ns)).Should(Succeed())
+	return kubeClient
+}
+
+func TestKubeVirtProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+	kubeClient := testClient(t, g)
+
+	// Instances are only returned once SSH is reachable, so point the VMI status at a local listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+
+	provider := KubeVirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.source-pvc":     "rhel-9-arm64",
+		"dynamic.linux-arm64.arch":           "arm64",
+		"dynamic.linux-arm64.cpu":            "4",
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	vmi := &unstructured.Unstructured{}
+	vmi.SetGroupVersionKind(VirtualMachineInstanceGVK)
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Namespace: systemNamespace, Name: string(id)}, vmi)).Should(Succeed())
+	g.Expect(vmi.GetLabels()).Should(HaveKeyWithValue(cloud.InstanceTag, "prod-arm64"))
+	cores, _, _ := unstructured.NestedInt64(vmi.Object, "spec", "domain", "cpu", "cores")
+	g.Expect(cores).Should(Equal(int64(4)))
+	volumes, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "volumes")
+	g.Expect(volumes).Should(HaveLen(2))
+	g.Expect(volumes[0]).Should(HaveKeyWithValue("dataVolume", map[string]interface{}{"name": string(id)}))
+	userData, _, _ := unstructured.NestedString(volumes[1].(map[string]interface{}), "cloudInitNoCloud", "userData")
+	g.Expect(userData).Should(ContainSubstring("- ssh-rsa AAAA builder"))
+
+	dv := &unstructured.Unstructured{}
+	dv.SetGroupVersionKind(DataVolumeGVK)
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Namespace: systemNamespace, Name: string(id)}, dv)).Should(Succeed())
+	g.Expect(dv.GetOwnerReferences()).Should(HaveLen(1))
+	g.Expect(dv.GetOwnerReferences()[0].UID).Should(Equal(vmi.GetUID()))
+
+	// Not running yet, so no address but it is counted
+	address, err := provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(BeEmpty())
+	count, err := provider.CountInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "staging-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(0))
+
+	vmi.Object["status"] = map[string]interface{}{
+		"phase":      "Running",
+		"interfaces": []interface{}{map[string]interface{}{"name": "default", "ipAddress": host}},
+	}
+	g.Expect(kubeClient.Update(ctx, vmi)).Should(Succeed())
+
+	address, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+
+	instances, err := provider.ListInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(HaveLen(1))
+	g.Expect(instances[0].InstanceId).Should(Equal(id))
+	g.Expect(instances[0].Address).Should(Equal(host))
+
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	// terminating an instance that is already gone is not an error
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	_, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).Should(HaveOccurred())
+}
+
+// failingVmiClient rejects VMI creation so the launch cleanup can be checked
+type failingVmiClient struct {
+	client.Client
+}
+
+func (c failingVmiClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if obj.GetObjectKind().GroupVersionKind() == VirtualMachineInstanceGVK {
+		return fmt.Errorf("VMI creation rejected")
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestLaunchFailureRemovesDataVolume(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+	kubeClient := testClient(t, g)
+
+	provider := KubeVirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.source-pvc":     "rhel-9-arm64",
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder",
+	}, systemNamespace)
+
+	_, err := provider.LaunchInstance(failingVmiClient{kubeClient}, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).Should(HaveOccurred())
+
+	dvs := &unstructured.UnstructuredList{}
+	dvs.SetGroupVersionKind(DataVolumeGVK.GroupVersion().WithKind(DataVolumeGVK.Kind + "List"))
+	g.Expect(kubeClient.List(ctx, dvs, client.InNamespace(systemNamespace))).Should(Succeed())
+	g.Expect(dvs.Items).Should(BeEmpty())
+}
+
+func TestUserDataIsQuoted(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+	kubeClient := testClient(t, g)
+
+	provider := KubeVirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.container-disk": "quay.io/containerdisks/fedora:latest",
+		"dynamic.linux-arm64.ssh-user":       "builder: true",
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder\n  - name: root",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	vmi := &unstructured.Unstructured{}
+	vmi.SetGroupVersionKind(VirtualMachineInstanceGVK)
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Namespace: systemNamespace, Name: string(id)}, vmi)).Should(Succeed())
+	volumes, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "volumes")
+	userData, _, _ := unstructured.NestedString(volumes[1].(map[string]interface{}), "cloudInitNoCloud", "userData")
+
+	config := struct {
+		Users []struct {
+			Name              string   `json:"name"`
+			SshAuthorizedKeys []string `json:"ssh_authorized_keys"`
+		} `json:"users"`
+	}{}
+	g.Expect(yaml.Unmarshal([]byte(userData), &config)).Should(Succeed())
+	g.Expect(config.Users).Should(HaveLen(1))
+	g.Expect(config.Users[0].Name).Should(Equal("builder: true"))
+	g.Expect(config.Users[0].SshAuthorizedKeys).Should(Equal([]string{"ssh-rsa AAAA builder\n  - name: root"}))
+}
+
+// verbRecordingClient records the API group, resource and verb of every request, so they can be checked against the
+// controller RBAC
+type verbRecordingClient struct {
+	client.Client
+	verbs map[string]bool
+}
+
+func (c verbRecordingClient) record(obj runtime.Object, verb string) {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	resource := strings.ToLower(strings.TrimSuffix(gvk.Kind, "List")) + "s"
+	c.verbs[gvk.Group+"/"+resource+"/"+verb] = true
+}
+
+func (c verbRecordingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	c.record(obj, "get")
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c verbRecordingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.record(list, "list")
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c verbRecordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.record(obj, "create")
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c verbRecordingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.record(obj, "update")
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c verbRecordingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.record(obj, "patch")
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c verbRecordingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.record(obj, "delete")
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// grantedVerbs returns the group/resource/verb combinations granted by the ClusterRoles in the operator RBAC
+func grantedVerbs(g *WithT) map[string]bool {
+	data, err := os.ReadFile(filepath.Join("..", "..", "deploy", "operator", "rbac.yaml"))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	granted := map[string]bool{}
+	for _, doc := range strings.Split(string(data), "\n---") {
+		role := rbacv1.ClusterRole{}
+		g.Expect(yaml.Unmarshal([]byte(doc), &role)).Should(Succeed())
+		if role.Kind != "ClusterRole" {
+			continue
+		}
+		for _, rule := range role.Rules {
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					for _, verb := range rule.Verbs {
+						granted[group+"/"+resource+"/"+verb] = true
+					}
+				}
+			}
+		}
+	}
+	return granted
+}
+
+func TestProviderVerbsAreGranted(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+	kubeClient := verbRecordingClient{Client: testClient(t, g), verbs: map[string]bool{}}
+
+	provider := KubeVirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.source-pvc":     "rhel-9-arm64",
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	_, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	_, err = provider.CountInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	_, err = provider.ListInstances(kubeClient, &log, ctx, "prod-arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	// the rollback of a failed launch deletes the DataVolume
+	_, err = provider.LaunchInstance(verbRecordingClient{Client: failingVmiClient{kubeClient.Client}, verbs: kubeClient.verbs}, &log, ctx, "test", "prod-arm64")
+	g.Expect(err).Should(HaveOccurred())
+
+	g.Expect(kubeClient.verbs).Should(HaveKey("cdi.kubevirt.io/datavolumes/patch"))
+	g.Expect(kubeClient.verbs).Should(HaveKey("cdi.kubevirt.io/datavolumes/delete"))
+	granted := grantedVerbs(g)
+	for verb := range kubeClient.verbs {
+		g.Expect(granted).Should(HaveKey(verb))
+	}
+}
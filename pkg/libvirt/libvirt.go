@@ -0,0 +1,709 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	types2 "k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MetadataNamespace identifies the domain metadata element used to tag the domains this controller launched
+const MetadataNamespace = "https://github.com/redhat-appstudio/multi-platform-controller"
+
+const namePrefix = "mpc-"
+
+// InsecureSkipHostKey is the setting that allows connecting to a hypervisor without checking its SSH host key
+const InsecureSkipHostKey = "insecure-skip-host-key"
+
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
+func LibvirtProvider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	memory, err := strconv.Atoi(config["dynamic."+platformName+".memory"])
+	if err != nil {
+		memory = 4096
+	}
+	vcpus, err := strconv.Atoi(config["dynamic."+platformName+".vcpus"])
+	if err != nil {
+		vcpus = 2
+	}
+	disk, err := strconv.Atoi(config["dynamic."+platformName+".disk"])
+	if err != nil {
+		disk = 40
+	}
+	arch := config["dynamic."+platformName+".arch"]
+	if arch == "" {
+		arch = "x86_64"
+	}
+	machine := config["dynamic."+platformName+".machine"]
+	if machine == "" {
+		machine = defaultMachine(arch)
+	}
+	virtType := config["dynamic."+platformName+".virt-type"]
+	if virtType == "" {
+		virtType = "kvm"
+	}
+	pool := config["dynamic."+platformName+".pool"]
+	if pool == "" {
+		pool = "default"
+	}
+	network := config["dynamic."+platformName+".network"]
+	if network == "" {
+		network = "default"
+	}
+	addressSource := config["dynamic."+platformName+".address-source"]
+	if addressSource == "" {
+		addressSource = "lease"
+	}
+	user := config["dynamic."+platformName+".ssh-user"]
+	if user == "" {
+		user = "cloud-user"
+	}
+	testAddress := config["dynamic."+platformName+".test-address"]
+	if testAddress == "" {
+		testAddress = "127.0.0.1"
+	}
+	return LibvirtDynamicConfig{
+		Platform:            platformName,
+		Uri:                 config["dynamic."+platformName+".uri"],
+		Secret:              config["dynamic."+platformName+".libvirt-secret"],
+		Pool:                pool,
+		BaseImage:           config["dynamic."+platformName+".base-image"],
+		Network:             network,
+		Bridge:              config["dynamic."+platformName+".bridge"],
+		Arch:                arch,
+		Machine:             machine,
+		VirtType:            virtType,
+		Firmware:            config["dynamic."+platformName+".firmware"],
+		Memory:              memory,
+		Vcpus:               vcpus,
+		Disk:                disk,
+		SshPublicKey:        config["dynamic."+platformName+".ssh-public-key"],
+		User:                user,
+		AddressSource:       addressSource,
+		TestAddress:         testAddress,
+		SystemNamespace:     systemNamespace,
+		InsecureSkipHostKey: config["dynamic."+platformName+"."+InsecureSkipHostKey] == "true",
+	}
+}
+
+func (r LibvirtDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	log.Info(fmt.Sprintf("attempting to launch libvirt domain for %s", name))
+	conn, err := r.connect(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Disconnect()
+
+	domainName := namePrefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+	spec := domainSpec{
+		LibvirtDynamicConfig: r,
+		Name:                 domainName,
+		Metadata:             instanceMetadata{Platform: r.Platform, Tag: instanceTag, Created: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if !r.testMode() {
+		// The disk is a copy on write overlay of the base image, and the cloud-init seed is attached as a second disk
+		spec.DiskVolume, spec.SeedVolume, err = r.createVolumes(conn, domainName)
+		if err != nil {
+			r.deleteVolumes(conn, log, domainName)
+			return "", err
+		}
+	}
+	domainXml, err := spec.xml()
+	if err != nil {
+		r.deleteVolumes(conn, log, domainName)
+		return "", err
+	}
+	domain, err := conn.DomainDefineXML(domainXml)
+	if err != nil {
+		r.deleteVolumes(conn, log, domainName)
+		return "", fmt.Errorf("failed to define domain %s: %w", domainName, err)
+	}
+	err = conn.DomainCreate(domain)
+	if err != nil {
+		r.removeDomain(conn, log, domainName)
+		return "", fmt.Errorf("failed to start domain %s: %w", domainName, err)
+	}
+	return cloud.InstanceIdentifier(domainName), nil
+}
+
+func (r LibvirtDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	log.Info("attempting to count libvirt domains")
+	conn, err := r.connect(kubeClient, ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Disconnect()
+	domains, err := r.listDomains(conn, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list domains")
+		return 0, err
+	}
+	count := 0
+	for _, domain := range domains {
+		log.Info(fmt.Sprintf("counting domain %s towards running count", domain.Name))
+		count++
+	}
+	return count, nil
+}
+
+func (r LibvirtDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	log.Info(fmt.Sprintf("attempting to get libvirt domain address %s", instanceId))
+	conn, err := r.connect(kubeClient, ctx)
+	if err != nil {
+		log.Error(err, "failed to connect to libvirt")
+		//this might be transient, just log it
+		return "", nil
+	}
+	defer conn.Disconnect()
+	domain, err := conn.DomainLookupByName(string(instanceId))
+	if err != nil {
+		if golibvirt.IsNotFound(err) {
+			return "", fmt.Errorf("domain %s no longer exists", instanceId)
+		}
+		log.Error(err, "failed to look up domain")
+		return "", nil
+	}
+	state, _, err := conn.DomainGetState(domain, 0)
+	if err != nil {
+		log.Error(err, "failed to get domain state")
+		return "", nil
+	}
+	switch golibvirt.DomainState(state) {
+	case golibvirt.DomainShutdown, golibvirt.DomainShutoff, golibvirt.DomainCrashed:
+		return "", fmt.Errorf("domain %s is not running", instanceId)
+	case golibvirt.DomainRunning:
+		return r.checkDomainConnectivity(conn, log, domain), nil
+	}
+	return "", nil
+}
+
+// checkDomainConnectivity returns the address of the domain if SSH is reachable, or an empty string if not
+func (r LibvirtDynamicConfig) checkDomainConnectivity(conn *golibvirt.Libvirt, log *logr.Logger, domain golibvirt.Domain) string {
+	address := r.TestAddress
+	if !r.testMode() {
+		address = r.domainAddress(conn, log, domain)
+	}
+	if address == "" {
+		return ""
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(address, sshPort), 5*time.Second)
+	if err != nil {
+		log.Info("libvirt domain is not yet reachable", "domain", domain.Name, "error", err.Error())
+		return ""
+	}
+	defer c.Close()
+	return address
+}
+
+// domainAddress returns the first IPv4 address reported for the domain, or an empty string if it does not have one yet
+func (r LibvirtDynamicConfig) domainAddress(conn *golibvirt.Libvirt, log *logr.Logger, domain golibvirt.Domain) string {
+	source := golibvirt.DomainInterfaceAddressesSrcLease
+	switch r.AddressSource {
+	case "agent":
+		source = golibvirt.DomainInterfaceAddressesSrcAgent
+	case "arp":
+		source = golibvirt.DomainInterfaceAddressesSrcArp
+	}
+	interfaces, err := conn.DomainInterfaceAddresses(domain, uint32(source), 0)
+	if err != nil {
+		log.Info("failed to read domain addresses", "domain", domain.Name, "error", err.Error())
+		return ""
+	}
+	for _, i := range interfaces {
+		for _, addr := range i.Addrs {
+			if golibvirt.IPAddrType(addr.Type) == golibvirt.IPAddrTypeIpv4 && addr.Addr != "" {
+				return addr.Addr
+			}
+		}
+	}
+	return ""
+}
+
+func (r LibvirtDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to terminate libvirt domain %s", instance))
+	conn, err := r.connect(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+	return r.removeDomain(conn, log, string(instance))
+}
+
+// removeDomain destroys and undefines the domain, then deletes its volumes. A domain that no longer exists is not an error.
+func (r LibvirtDynamicConfig) removeDomain(conn *golibvirt.Libvirt, log *logr.Logger, name string) error {
+	domain, err := conn.DomainLookupByName(name)
+	if err == nil {
+		err = conn.DomainDestroy(domain)
+		if err != nil && !isError(err, golibvirt.ErrOperationInvalid) {
+			return fmt.Errorf("failed to destroy domain %s: %w", name, err)
+		}
+		err = conn.DomainUndefineFlags(domain, golibvirt.DomainUndefineManagedSave|golibvirt.DomainUndefineSnapshotsMetadata|golibvirt.DomainUndefineNvram)
+		if err != nil && !golibvirt.IsNotFound(err) {
+			return fmt.Errorf("failed to undefine domain %s: %w", name, err)
+		}
+	} else if !golibvirt.IsNotFound(err) {
+		return err
+	}
+	r.deleteVolumes(conn, log, name)
+	return nil
+}
+
+func (r LibvirtDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list libvirt domains")
+	conn, err := r.connect(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Disconnect()
+	domains, err := r.listDomains(conn, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list domains")
+		return nil, err
+	}
+	ret := []cloud.CloudVMInstance{}
+	for _, domain := range domains {
+		if domain.ID == -1 {
+			// not running
+			continue
+		}
+		address := r.checkDomainConnectivity(conn, log, domain.Domain)
+		if address == "" {
+			continue
+		}
+		startTime, err := time.Parse(time.RFC3339, domain.metadata.Created)
+		if err != nil {
+			log.Error(err, "failed to parse domain creation time", "domain", domain.Name)
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(domain.Name), StartTime: startTime, Address: address})
+		log.Info(fmt.Sprintf("counting domain %s towards running count", domain.Name))
+	}
+	return ret, nil
+}
+
+type taggedDomain struct {
+	golibvirt.Domain
+	metadata instanceMetadata
+}
+
+// listDomains returns all defined domains launched for this platform with the given tag
+func (r LibvirtDynamicConfig) listDomains(conn *golibvirt.Libvirt, instanceTag string) ([]taggedDomain, error) {
+	domains, _, err := conn.ConnectListAllDomains(1, golibvirt.ConnectListDomainsActive|golibvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, err
+	}
+	ret := []taggedDomain{}
+	for _, domain := range domains {
+		if !strings.HasPrefix(domain.Name, namePrefix) {
+			continue
+		}
+		data, err := conn.DomainGetMetadata(domain, int32(golibvirt.DomainMetadataElement), golibvirt.OptString{MetadataNamespace}, golibvirt.DomainAffectCurrent)
+		if err != nil {
+			if isError(err, golibvirt.ErrNoDomainMetadata) || golibvirt.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		metadata := instanceMetadata{}
+		if err := xml.Unmarshal([]byte(data), &metadata); err != nil {
+			continue
+		}
+		if metadata.Platform == r.Platform && metadata.Tag == instanceTag {
+			ret = append(ret, taggedDomain{Domain: domain, metadata: metadata})
+		}
+	}
+	return ret, nil
+}
+
+// createVolumes creates the domain disk as an overlay on the base image, and uploads the cloud-init seed image
+func (r LibvirtDynamicConfig) createVolumes(conn *golibvirt.Libvirt, name string) (string, string, error) {
+	pool, err := conn.StoragePoolLookupByName(r.Pool)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find storage pool %s: %w", r.Pool, err)
+	}
+	base, err := conn.StorageVolLookupByName(pool, r.BaseImage)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find base image %s in pool %s: %w", r.BaseImage, r.Pool, err)
+	}
+	basePath, err := conn.StorageVolGetPath(base)
+	if err != nil {
+		return "", "", err
+	}
+	diskXml, err := render(volumeTemplate, volumeSpec{Name: diskVolumeName(name), Capacity: uint64(r.Disk) << 30, Format: "qcow2", BackingPath: basePath})
+	if err != nil {
+		return "", "", err
+	}
+	_, err = conn.StorageVolCreateXML(pool, diskXml, 0)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create disk for domain %s: %w", name, err)
+	}
+
+	seed, err := r.seedImage(name)
+	if err != nil {
+		return "", "", err
+	}
+	seedXml, err := render(volumeTemplate, volumeSpec{Name: seedVolumeName(name), Capacity: uint64(len(seed)), Format: "raw"})
+	if err != nil {
+		return "", "", err
+	}
+	seedVol, err := conn.StorageVolCreateXML(pool, seedXml, 0)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create cloud-init seed for domain %s: %w", name, err)
+	}
+	err = conn.StorageVolUpload(seedVol, bytes.NewReader(seed), 0, uint64(len(seed)), 0)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to upload cloud-init seed for domain %s: %w", name, err)
+	}
+	return diskVolumeName(name), seedVolumeName(name), nil
+}
+
+func (r LibvirtDynamicConfig) deleteVolumes(conn *golibvirt.Libvirt, log *logr.Logger, name string) {
+	if r.testMode() {
+		return
+	}
+	pool, err := conn.StoragePoolLookupByName(r.Pool)
+	if err != nil {
+		log.Error(err, "failed to find storage pool", "pool", r.Pool)
+		return
+	}
+	for _, volume := range []string{diskVolumeName(name), seedVolumeName(name)} {
+		vol, err := conn.StorageVolLookupByName(pool, volume)
+		if err == nil {
+			err = conn.StorageVolDelete(vol, golibvirt.StorageVolDeleteNormal)
+		}
+		if err != nil && !isError(err, golibvirt.ErrNoStorageVol) {
+			log.Error(err, "failed to delete volume", "volume", volume)
+		}
+	}
+}
+
+// seedImage builds a NoCloud cloud-init ISO that creates the SSH user with the configured public key
+func (r LibvirtDynamicConfig) seedImage(name string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "cidata")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "seed.iso")
+	workDir := filepath.Join(dir, "work")
+	if err := os.Mkdir(workDir, 0700); err != nil {
+		return nil, err
+	}
+	seedDisk, err := diskfs.Create(image, 1<<20, diskfs.Raw, diskfs.SectorSizeDefault)
+	if err != nil {
+		return nil, err
+	}
+	// ISO9660 uses 2048 byte blocks
+	seedDisk.LogicalBlocksize = 2048
+	fs, err := seedDisk.CreateFilesystem(disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeISO9660, VolumeLabel: "cidata", WorkDir: workDir})
+	if err != nil {
+		return nil, err
+	}
+	userData, err := cloud.UserData(r.User, r.SshPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	metaData, err := cloud.MetaData(name)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{
+		"/meta-data": metaData,
+		"/user-data": userData,
+	}
+	for file, content := range files {
+		f, err := fs.OpenFile(file, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	iso, ok := fs.(*iso9660.FileSystem)
+	if !ok {
+		return nil, errors.New("unexpected seed filesystem type")
+	}
+	// Rock Ridge extensions are needed to keep the lower case file names cloud-init looks for
+	if err := iso.Finalize(iso9660.FinalizeOptions{RockRidge: true, VolumeIdentifier: "cidata"}); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(image)
+}
+
+// connect opens a connection to libvirt. For SSH transports the private key (id_rsa) and known_hosts are read from the
+// configured secret, known_hosts can only be left out if insecure-skip-host-key is set. Otherwise the connection is
+// local or uses TCP/TLS as described by the URI.
+func (r LibvirtDynamicConfig) connect(kubeClient client.Client, ctx context.Context) (*golibvirt.Libvirt, error) {
+	uri, err := url.Parse(r.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid libvirt URI %s: %w", r.Uri, err)
+	}
+	if !sshTransport(uri) {
+		return golibvirt.ConnectToURI(uri)
+	}
+	if kubeClient == nil || r.Secret == "" {
+		return nil, fmt.Errorf("libvirt-secret is required for %s", r.Uri)
+	}
+	s := v1.Secret{}
+	err = kubeClient.Get(ctx, types2.NamespacedName{Name: r.Secret, Namespace: r.SystemNamespace}, &s)
+	if err != nil {
+		return nil, err
+	}
+	// The dialer only reads keys from files, they are removed again once the connection is established
+	dir, err := os.MkdirTemp("", "libvirt-ssh")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := os.WriteFile(keyFile, s.Data["id_rsa"], 0600); err != nil {
+		return nil, err
+	}
+	options := []dialers.SSHOption{
+		dialers.UseSSHUsername(uri.User.Username()),
+		dialers.UseKeyFile(keyFile),
+		dialers.WithSSHAuthMethods((&dialers.SSHAuthMethods{}).PrivKey()),
+	}
+	if port := uri.Port(); port != "" {
+		options = append(options, dialers.UseSSHPort(port))
+	}
+	if socket := uri.Query().Get("socket"); socket != "" {
+		options = append(options, dialers.WithRemoteSocket(socket))
+	}
+	if knownHosts := s.Data["known_hosts"]; len(knownHosts) > 0 {
+		knownHostsFile := filepath.Join(dir, "known_hosts")
+		if err := os.WriteFile(knownHostsFile, knownHosts, 0600); err != nil {
+			return nil, err
+		}
+		options = append(options, dialers.UseKnownHostsFile(knownHostsFile))
+	} else if r.InsecureSkipHostKey {
+		options = append(options, dialers.WithInsecureIgnoreHostKey())
+	} else {
+		return nil, fmt.Errorf("libvirt secret %s has no known_hosts, the host key of %s can't be checked unless %s is set", r.Secret, uri.Hostname(), InsecureSkipHostKey)
+	}
+	conn := golibvirt.NewWithDialer(dialers.NewSSH(uri.Hostname(), options...))
+	if err := conn.ConnectToURI(golibvirt.RemoteURI(uri)); err != nil {
+		return nil, fmt.Errorf("failed to connect to libvirt: %w", err)
+	}
+	return conn, nil
+}
+
+// sshTransport is true if the URI connects to libvirt over SSH
+func sshTransport(uri *url.URL) bool {
+	transport := ""
+	if parts := strings.SplitN(uri.Scheme, "+", 2); len(parts) == 2 {
+		transport = parts[1]
+	}
+	return transport == "ssh" || transport == "libssh" || transport == "libssh2"
+}
+
+// UsesSsh is true if the libvirt URI is reached over SSH, which means the libvirt-secret is needed to connect
+func UsesSsh(uri string) bool {
+	parsed, err := url.Parse(uri)
+	return err == nil && sshTransport(parsed)
+}
+
+// testMode is true when using the libvirt test driver. Test domains don't boot, so no volumes are created and the
+// configured test-address is reported as the domain address.
+func (r LibvirtDynamicConfig) testMode() bool {
+	return strings.HasPrefix(r.Uri, "test:") || strings.HasPrefix(r.Uri, "test+")
+}
+
+func defaultMachine(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "q35"
+	case "aarch64", "riscv64":
+		return "virt"
+	}
+	return ""
+}
+
+func diskVolumeName(name string) string {
+	return name + ".qcow2"
+}
+
+func seedVolumeName(name string) string {
+	return name + "-seed.iso"
+}
+
+func isError(err error, code golibvirt.ErrorNumber) bool {
+	libvirtErr := golibvirt.Error{}
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(code)
+}
+
+type instanceMetadata struct {
+	XMLName  xml.Name `xml:"instance"`
+	Platform string   `xml:"platform"`
+	Tag      string   `xml:"tag"`
+	Created  string   `xml:"created"`
+}
+
+type domainSpec struct {
+	LibvirtDynamicConfig
+	Name       string
+	Metadata   instanceMetadata
+	DiskVolume string
+	SeedVolume string
+}
+
+func (d domainSpec) xml() (string, error) {
+	return render(domainTemplate, d)
+}
+
+type volumeSpec struct {
+	Name        string
+	Capacity    uint64
+	Format      string
+	BackingPath string
+}
+
+func render(t *template.Template, data interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func escape(value interface{}) string {
+	buf := bytes.Buffer{}
+	_ = xml.EscapeText(&buf, []byte(fmt.Sprint(value)))
+	return buf.String()
+}
+
+var funcs = template.FuncMap{"x": escape}
+
+// With virt-type qemu the guest is emulated with TCG, which allows architectures the hypervisor can't run natively
+var domainTemplate = template.Must(template.New("domain").Funcs(funcs).Parse(`<domain type='{{x .VirtType}}'>
+  <name>{{x .Name}}</name>
+  <metadata>
+    <mpc:instance xmlns:mpc='` + MetadataNamespace + `'>
+      <mpc:platform>{{x .Metadata.Platform}}</mpc:platform>
+      <mpc:tag>{{x .Metadata.Tag}}</mpc:tag>
+      <mpc:created>{{x .Metadata.Created}}</mpc:created>
+    </mpc:instance>
+  </metadata>
+  <memory unit='MiB'>{{.Memory}}</memory>
+  <vcpu>{{.Vcpus}}</vcpu>
+  <os{{if .Firmware}} firmware='{{x .Firmware}}'{{end}}>
+    <type arch='{{x .Arch}}'{{if .Machine}} machine='{{x .Machine}}'{{end}}>hvm</type>
+    <boot dev='hd'/>
+  </os>
+{{- if eq .Arch "x86_64"}}
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+{{- end}}
+{{- if eq .VirtType "kvm"}}
+  <cpu mode='host-passthrough'/>
+{{- end}}
+  <on_poweroff>destroy</on_poweroff>
+  <on_reboot>restart</on_reboot>
+  <on_crash>destroy</on_crash>
+  <devices>
+{{- if .DiskVolume}}
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source pool='{{x .Pool}}' volume='{{x .DiskVolume}}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+{{- end}}
+{{- if .SeedVolume}}
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source pool='{{x .Pool}}' volume='{{x .SeedVolume}}'/>
+      <target dev='vdb' bus='virtio'/>
+      <readonly/>
+    </disk>
+{{- end}}
+{{- if .Bridge}}
+    <interface type='bridge'>
+      <source bridge='{{x .Bridge}}'/>
+      <model type='virtio'/>
+    </interface>
+{{- else}}
+    <interface type='network'>
+      <source network='{{x .Network}}'/>
+      <model type='virtio'/>
+    </interface>
+{{- end}}
+    <serial type='pty'/>
+    <console type='pty'/>
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+    <rng model='virtio'>
+      <backend model='random'>/dev/urandom</backend>
+    </rng>
+  </devices>
+</domain>
+`))
+
+var volumeTemplate = template.Must(template.New("volume").Funcs(funcs).Parse(`<volume>
+  <name>{{x .Name}}</name>
+  <capacity unit='bytes'>{{.Capacity}}</capacity>
+  <target>
+    <format type='{{x .Format}}'/>
+  </target>
+{{- if .BackingPath}}
+  <backingStore>
+    <path>{{x .BackingPath}}</path>
+    <format type='qcow2'/>
+  </backingStore>
+{{- end}}
+</volume>
+`))
+
+type LibvirtDynamicConfig struct {
+	Platform        string
+	Uri             string
+	Secret          string
+	Pool            string
+	BaseImage       string
+	Network         string
+	Bridge          string
+	Arch            string
+	Machine         string
+	VirtType        string
+	Firmware        string
+	Memory          int
+	Vcpus           int
+	Disk            int
+	SshPublicKey    string
+	User            string
+	AddressSource   string
+	TestAddress     string
+	SystemNamespace string
+	// InsecureSkipHostKey allows connecting over SSH without a known_hosts in the secret, so the connection can be
+	// intercepted
+	InsecureSkipHostKey bool
+}
+
+func (r LibvirtDynamicConfig) SshUser() string {
+	return r.User
+}
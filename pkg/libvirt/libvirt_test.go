@@ -0,0 +1,191 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/diskfs/go-diskfs"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func TestEmulatedDomainXml(t *testing.T) {
+	g := NewGomegaWithT(t)
+	config := LibvirtProvider("linux-riscv64", map[string]string{
+		"dynamic.linux-riscv64.uri":        "qemu+ssh://root@hypervisor.lab/system",
+		"dynamic.linux-riscv64.base-image": "fedora-riscv64.qcow2",
+		"dynamic.linux-riscv64.arch":       "riscv64",
+		"dynamic.linux-riscv64.virt-type":  "qemu",
+		"dynamic.linux-riscv64.bridge":     "br0",
+	}, "multi-platform-controller").(LibvirtDynamicConfig)
+	g.Expect(config.Machine).Should(Equal("virt"))
+
+	spec := domainSpec{
+		LibvirtDynamicConfig: config,
+		Name:                 "mpc-test",
+		Metadata:             instanceMetadata{Platform: "linux-riscv64", Tag: "prod<riscv64>", Created: "2024-01-01T00:00:00Z"},
+		DiskVolume:           diskVolumeName("mpc-test"),
+		SeedVolume:           seedVolumeName("mpc-test"),
+	}
+	data, err := spec.xml()
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	domain := struct {
+		Type     string `xml:"type,attr"`
+		Metadata struct {
+			Instance instanceMetadata `xml:"instance"`
+		} `xml:"metadata"`
+		Os struct {
+			Type struct {
+				Arch    string `xml:"arch,attr"`
+				Machine string `xml:"machine,attr"`
+			} `xml:"type"`
+		} `xml:"os"`
+		Cpu   *struct{} `xml:"cpu"`
+		Disks []struct {
+			Source struct {
+				Volume string `xml:"volume,attr"`
+			} `xml:"source"`
+		} `xml:"devices>disk"`
+		Interface struct {
+			Source struct {
+				Bridge string `xml:"bridge,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+	}{}
+	g.Expect(xml.Unmarshal([]byte(data), &domain)).Should(Succeed())
+	g.Expect(domain.Type).Should(Equal("qemu"))
+	g.Expect(domain.Os.Type.Arch).Should(Equal("riscv64"))
+	g.Expect(domain.Os.Type.Machine).Should(Equal("virt"))
+	// host-passthrough is only valid for KVM guests
+	g.Expect(domain.Cpu).Should(BeNil())
+	g.Expect(domain.Metadata.Instance.Tag).Should(Equal("prod<riscv64>"))
+	g.Expect(domain.Disks).Should(HaveLen(2))
+	g.Expect(domain.Disks[0].Source.Volume).Should(Equal("mpc-test.qcow2"))
+	g.Expect(domain.Disks[1].Source.Volume).Should(Equal("mpc-test-seed.iso"))
+	g.Expect(domain.Interface.Source.Bridge).Should(Equal("br0"))
+}
+
+func TestSeedImage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	config := LibvirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder",
+	}, "multi-platform-controller").(LibvirtDynamicConfig)
+
+	seed, err := config.seedImage("mpc-test")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	image := filepath.Join(t.TempDir(), "seed.iso")
+	g.Expect(os.WriteFile(image, seed, 0600)).Should(Succeed())
+
+	seedDisk, err := diskfs.Open(image, diskfs.WithOpenMode(diskfs.ReadOnly))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	fs, err := seedDisk.GetFilesystem(0)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(strings.TrimRight(fs.Label(), "\x00 ")).Should(Equal("cidata"))
+	f, err := fs.OpenFile("/user-data", os.O_RDONLY)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	userData, err := io.ReadAll(f)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(string(userData)).Should(ContainSubstring("name: cloud-user"))
+	g.Expect(string(userData)).Should(ContainSubstring("- ssh-rsa AAAA builder"))
+}
+
+func TestSeedImageQuotesValues(t *testing.T) {
+	g := NewGomegaWithT(t)
+	config := LibvirtProvider("linux-arm64", map[string]string{
+		"dynamic.linux-arm64.ssh-user":       "builder\n  - name: root",
+		"dynamic.linux-arm64.ssh-public-key": "ssh-rsa AAAA builder: #1",
+	}, "multi-platform-controller").(LibvirtDynamicConfig)
+
+	seed, err := config.seedImage("mpc-test")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	image := filepath.Join(t.TempDir(), "seed.iso")
+	g.Expect(os.WriteFile(image, seed, 0600)).Should(Succeed())
+	seedDisk, err := diskfs.Open(image, diskfs.WithOpenMode(diskfs.ReadOnly))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	fs, err := seedDisk.GetFilesystem(0)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	f, err := fs.OpenFile("/user-data", os.O_RDONLY)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	data, err := io.ReadAll(f)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(string(data)).Should(HavePrefix("#cloud-config\n"))
+
+	// The values stay values, rather than adding users or keys
+	userData := struct {
+		Users []struct {
+			Name              string   `json:"name"`
+			SshAuthorizedKeys []string `json:"ssh_authorized_keys"`
+		} `json:"users"`
+	}{}
+	g.Expect(yaml.Unmarshal(data, &userData)).Should(Succeed())
+	g.Expect(userData.Users).Should(HaveLen(1))
+	g.Expect(userData.Users[0].Name).Should(Equal("builder\n  - name: root"))
+	g.Expect(userData.Users[0].SshAuthorizedKeys).Should(Equal([]string{"ssh-rsa AAAA builder: #1"}))
+}
+
+func TestTestMode(t *testing.T) {
+	g := NewGomegaWithT(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+	defer func() { sshPort = "22" }()
+
+	config := LibvirtProvider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.uri":          "test:///default",
+		"dynamic.linux-amd64.test-address": host,
+	}, "multi-platform-controller").(LibvirtDynamicConfig)
+	g.Expect(config.testMode()).Should(BeTrue())
+	g.Expect(LibvirtProvider("linux-amd64", map[string]string{"dynamic.linux-amd64.uri": "test+unix:///default"}, "multi-platform-controller").(LibvirtDynamicConfig).testMode()).Should(BeTrue())
+	g.Expect(LibvirtProvider("linux-amd64", map[string]string{"dynamic.linux-amd64.uri": "qemu:///system"}, "multi-platform-controller").(LibvirtDynamicConfig).testMode()).Should(BeFalse())
+
+	// Test domains have no volumes, and report the test address once it is reachable
+	data, err := domainSpec{LibvirtDynamicConfig: config, Name: "mpc-test"}.xml()
+	g.Expect(err).ShouldNot(HaveOccurred())
+	domain := struct {
+		Disks []struct{} `xml:"devices>disk"`
+	}{}
+	g.Expect(xml.Unmarshal([]byte(data), &domain)).Should(Succeed())
+	g.Expect(domain.Disks).Should(BeEmpty())
+	log := logr.Discard()
+	g.Expect(config.checkDomainConnectivity(nil, &log, golibvirt.Domain{Name: "mpc-test"})).Should(Equal(host))
+	listener.Close()
+	g.Expect(config.checkDomainConnectivity(nil, &log, golibvirt.Domain{Name: "mpc-test"})).Should(BeEmpty())
+}
+
+func TestConnectRequiresKnownHosts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	// Nothing listens on the port, so a connection that gets as far as dialing fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	address := listener.Addr().String()
+	listener.Close()
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "libvirtkeys", Namespace: "multi-platform-controller"}, Data: map[string][]byte{"id_rsa": []byte("key")}}
+	kubeClient := fake.NewClientBuilder().WithObjects(secret).Build()
+	config := map[string]string{
+		"dynamic.linux-riscv64.uri":            "qemu+ssh://root@" + address + "/system",
+		"dynamic.linux-riscv64.libvirt-secret": "libvirtkeys",
+	}
+
+	_, err = LibvirtProvider("linux-riscv64", config, "multi-platform-controller").(LibvirtDynamicConfig).connect(kubeClient, context.Background())
+	g.Expect(err).Should(MatchError(ContainSubstring("has no known_hosts")))
+
+	config["dynamic.linux-riscv64."+InsecureSkipHostKey] = "true"
+	_, err = LibvirtProvider("linux-riscv64", config, "multi-platform-controller").(LibvirtDynamicConfig).connect(kubeClient, context.Background())
+	g.Expect(err).Should(HaveOccurred())
+	g.Expect(err).ShouldNot(MatchError(ContainSubstring("has no known_hosts")))
+}
@@ -0,0 +1,346 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/gophercloud/gophercloud"
+	osclient "github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	types2 "k8s.io/apimachinery/pkg/types"
+	"net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+const (
+	MultiPlatformManaged = "multi-platform-managed"
+	PlatformKey          = "multi-platform-platform"
+	// FloatingIpDescription marks floating IPs allocated by the controller, only these are reused
+	FloatingIpDescription = "multi-platform-controller"
+)
+
+// sshPort is a variable so tests can check connectivity against a local listener
+var sshPort = "22"
+
+func OpenStackProvider(platformName string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+	user := config["dynamic."+platformName+".ssh-user"]
+	if user == "" {
+		user = "cloud-user"
+	}
+	securityGroups := []string{}
+	for _, i := range strings.Split(config["dynamic."+platformName+".security-groups"], ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			securityGroups = append(securityGroups, i)
+		}
+	}
+	return OpenStackDynamicConfig{
+		Platform:         platformName,
+		AuthUrl:          config["dynamic."+platformName+".auth-url"],
+		Region:           config["dynamic."+platformName+".region"],
+		Flavor:           config["dynamic."+platformName+".flavor"],
+		Image:            config["dynamic."+platformName+".image"],
+		Network:          config["dynamic."+platformName+".network"],
+		FloatingNetwork:  config["dynamic."+platformName+".floating-network"],
+		SecurityGroups:   securityGroups,
+		KeyName:          config["dynamic."+platformName+".key-name"],
+		AvailabilityZone: config["dynamic."+platformName+".availability-zone"],
+		Secret:           config["dynamic."+platformName+".openstack-secret"],
+		User:             user,
+		SystemNamespace:  systemNamespace,
+	}
+}
+
+func (r OpenStackDynamicConfig) LaunchInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	log.Info(fmt.Sprintf("attempting to launch OpenStack server for %s", name))
+	compute, _, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	createOpts := keypairs.CreateOptsExt{
+		CreateOptsBuilder: servers.CreateOpts{
+			Name:             "mpc-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			ImageRef:         r.Image,
+			FlavorRef:        r.Flavor,
+			Networks:         []servers.Network{{UUID: r.Network}},
+			SecurityGroups:   r.SecurityGroups,
+			AvailabilityZone: r.AvailabilityZone,
+			Metadata:         map[string]string{MultiPlatformManaged: "true", cloud.InstanceTag: instanceTag, PlatformKey: r.Platform, "Name": "multi-platform-builder-" + name},
+		},
+		KeyName: r.KeyName,
+	}
+	server, err := servers.Create(compute, createOpts).Extract()
+	if err != nil {
+		return "", err
+	}
+	return cloud.InstanceIdentifier(server.ID), nil
+}
+
+func (r OpenStackDynamicConfig) CountInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	log.Info("attempting to count OpenStack servers")
+	compute, _, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return 0, err
+	}
+	list, err := r.listServers(compute, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list servers")
+		return 0, err
+	}
+	count := 0
+	for _, server := range list {
+		log.Info(fmt.Sprintf("counting server %s towards running count", server.ID))
+		count++
+	}
+	return count, nil
+}
+
+func (r OpenStackDynamicConfig) GetInstanceAddress(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	log.Info(fmt.Sprintf("attempting to get OpenStack server address %s", instanceId))
+	compute, network, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return "", err
+	}
+	server, err := servers.Get(compute, string(instanceId)).Extract()
+	if err != nil {
+		if isNotFound(err) {
+			return "", fmt.Errorf("server %s no longer exists", instanceId)
+		}
+		log.Error(err, "failed to get server")
+		//this might be transient, just log it
+		return "", nil
+	}
+	switch server.Status {
+	case "ERROR", "SHUTOFF", "DELETED", "SOFT_DELETED":
+		return "", fmt.Errorf("server %s is %s", instanceId, server.Status)
+	case "ACTIVE":
+	default:
+		return "", nil
+	}
+
+	if r.FloatingNetwork == "" {
+		return checkAddressLive(serverAddress(server, "fixed"), log), nil
+	}
+	if address := serverAddress(server, "floating"); address != "" {
+		return checkAddressLive(address, log), nil
+	}
+	address, err := r.assignFloatingIp(network, server)
+	if err != nil {
+		log.Error(err, "failed to assign floating IP", "server", server.ID)
+		return "", nil
+	}
+	return checkAddressLive(address, log), nil
+}
+
+// assignFloatingIp associates a floating IP with the server port. Unbound floating IPs previously allocated by the
+// controller are reused before a new one is allocated, as they are often a scarce resource.
+func (r OpenStackDynamicConfig) assignFloatingIp(network *gophercloud.ServiceClient, server *servers.Server) (string, error) {
+	pages, err := ports.List(network, ports.ListOpts{DeviceID: server.ID}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	serverPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return "", err
+	}
+	if len(serverPorts) == 0 {
+		return "", fmt.Errorf("server %s has no ports yet", server.ID)
+	}
+	portId := serverPorts[0].ID
+
+	pages, err = floatingips.List(network, floatingips.ListOpts{FloatingNetworkID: r.FloatingNetwork, Description: FloatingIpDescription}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	existing, err := floatingips.ExtractFloatingIPs(pages)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range existing {
+		if ip.PortID != "" {
+			continue
+		}
+		updated, err := floatingips.Update(network, ip.ID, floatingips.UpdateOpts{PortID: &portId}).Extract()
+		if err != nil {
+			// most likely another reconcile grabbed it first
+			continue
+		}
+		return updated.FloatingIP, nil
+	}
+
+	ip, err := floatingips.Create(network, floatingips.CreateOpts{FloatingNetworkID: r.FloatingNetwork, PortID: portId, Description: FloatingIpDescription}).Extract()
+	if err != nil {
+		return "", err
+	}
+	return ip.FloatingIP, nil
+}
+
+// serverAddress returns the first IPv4 address of the given type (fixed or floating) from the server addresses
+func serverAddress(server *servers.Server, addressType string) string {
+	for _, addresses := range server.Addresses {
+		list, ok := addresses.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, i := range list {
+			address, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			addr, _ := address["addr"].(string)
+			version, _ := address["version"].(float64)
+			if address["OS-EXT-IPS:type"] == addressType && version == 4 && addr != "" {
+				return addr
+			}
+		}
+	}
+	return ""
+}
+
+func checkAddressLive(address string, log *logr.Logger) string {
+	if address == "" {
+		return ""
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, sshPort), 5*time.Second)
+	if err != nil {
+		log.Info("OpenStack server is not yet reachable", "address", address, "error", err.Error())
+		return ""
+	}
+	defer conn.Close()
+	return address
+}
+
+func (r OpenStackDynamicConfig) TerminateInstance(kubeClient client.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
+	log.Info(fmt.Sprintf("attempting to terminate OpenStack server %s", instance))
+	compute, _, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return err
+	}
+	// Any floating IP is disassociated when the server port is deleted, and is then reused by the next server
+	err = servers.Delete(compute, string(instance)).ExtractErr()
+	if err != nil && isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r OpenStackDynamicConfig) ListInstances(kubeClient client.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	log.Info("attempting to list OpenStack servers")
+	compute, _, err := r.authenticate(kubeClient, ctx)
+	if err != nil {
+		return nil, err
+	}
+	list, err := r.listServers(compute, instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list servers")
+		return nil, err
+	}
+	addressType := "fixed"
+	if r.FloatingNetwork != "" {
+		addressType = "floating"
+	}
+	ret := []cloud.CloudVMInstance{}
+	for i := range list {
+		server := &list[i]
+		if server.Status != "ACTIVE" {
+			continue
+		}
+		address := checkAddressLive(serverAddress(server, addressType), log)
+		if address == "" {
+			continue
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: cloud.InstanceIdentifier(server.ID), StartTime: server.Created, Address: address})
+		log.Info(fmt.Sprintf("counting server %s towards running count", server.ID))
+	}
+	return ret, nil
+}
+
+// listServers returns the servers launched for this platform with the given tag that have not failed or been deleted
+func (r OpenStackDynamicConfig) listServers(compute *gophercloud.ServiceClient, instanceTag string) ([]servers.Server, error) {
+	pages, err := servers.List(compute, servers.ListOpts{Name: "^mpc-"}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	all, err := servers.ExtractServers(pages)
+	if err != nil {
+		return nil, err
+	}
+	ret := []servers.Server{}
+	for _, server := range all {
+		if server.Metadata[MultiPlatformManaged] != "true" || server.Metadata[cloud.InstanceTag] != instanceTag || server.Metadata[PlatformKey] != r.Platform {
+			continue
+		}
+		switch server.Status {
+		case "ERROR", "SHUTOFF", "DELETED", "SOFT_DELETED":
+			continue
+		}
+		ret = append(ret, server)
+	}
+	return ret, nil
+}
+
+// authenticate uses the Keystone application credential in the configured secret, and returns the compute and
+// network clients
+func (r OpenStackDynamicConfig) authenticate(kubeClient client.Client, ctx context.Context) (*gophercloud.ServiceClient, *gophercloud.ServiceClient, error) {
+	s := v1.Secret{}
+	err := kubeClient.Get(ctx, types2.NamespacedName{Name: r.Secret, Namespace: r.SystemNamespace}, &s)
+	if err != nil {
+		return nil, nil, err
+	}
+	provider, err := osclient.NewClient(r.AuthUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	provider.Context = ctx
+	err = osclient.Authenticate(provider, gophercloud.AuthOptions{
+		IdentityEndpoint:            r.AuthUrl,
+		ApplicationCredentialID:     string(s.Data["application-credential-id"]),
+		ApplicationCredentialSecret: string(s.Data["application-credential-secret"]),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to authenticate with Keystone: %w", err)
+	}
+	endpoint := gophercloud.EndpointOpts{Region: r.Region}
+	compute, err := osclient.NewComputeV2(provider, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	network, err := osclient.NewNetworkV2(provider, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return compute, network, nil
+}
+
+func isNotFound(err error) bool {
+	notFound := gophercloud.ErrDefault404{}
+	return errors.As(err, &notFound)
+}
+
+type OpenStackDynamicConfig struct {
+	Platform         string
+	AuthUrl          string
+	Region           string
+	Flavor           string
+	Image            string
+	Network          string
+	FloatingNetwork  string
+	SecurityGroups   []string
+	KeyName          string
+	AvailabilityZone string
+	Secret           string
+	User             string
+	SystemNamespace  string
+}
+
+func (r OpenStackDynamicConfig) SshUser() string {
+	return r.User
+}
@@ -0,0 +1,233 @@
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const systemNamespace = "multi-platform-controller"
+
+// openStackStandIn implements just enough of Keystone, Nova and Neutron to launch servers and assign floating IPs
+type openStackStandIn struct {
+	lock        sync.Mutex
+	url         string
+	address     string
+	servers     map[string]map[string]interface{}
+	floatingIps map[string]map[string]interface{}
+	nextId      int
+}
+
+func (o *openStackStandIn) id(prefix string) string {
+	o.nextId++
+	return prefix + "-" + string(rune('a'+o.nextId))
+}
+
+func (o *openStackStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	body := map[string]interface{}{}
+	if req.Body != nil {
+		_ = json.NewDecoder(req.Body).Decode(&body)
+	}
+	if req.URL.Path == "/identity/v3/auth/tokens" {
+		credential, _ := body["auth"].(map[string]interface{})["identity"].(map[string]interface{})["application_credential"].(map[string]interface{})
+		if credential["id"] != "app-id" || credential["secret"] != "app-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "token")
+		w.WriteHeader(http.StatusCreated)
+		writeJson(w, map[string]interface{}{"token": map[string]interface{}{
+			"expires_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+			"catalog": []interface{}{
+				map[string]interface{}{"type": "compute", "endpoints": []interface{}{map[string]interface{}{"interface": "public", "region": "RegionOne", "url": o.url + "/compute/v2.1/"}}},
+				map[string]interface{}{"type": "network", "endpoints": []interface{}{map[string]interface{}{"interface": "public", "region": "RegionOne", "url": o.url + "/network/"}}},
+			},
+		}})
+		return
+	}
+	if req.Header.Get("X-Auth-Token") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := req.URL.Path
+	switch {
+	case path == "/compute/v2.1/servers" && req.Method == http.MethodPost:
+		server := body["server"].(map[string]interface{})
+		id := o.id("server")
+		o.servers[id] = map[string]interface{}{
+			"id":       id,
+			"name":     server["name"],
+			"status":   "ACTIVE",
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"metadata": server["metadata"],
+			"key_name": server["key_name"],
+			"addresses": map[string]interface{}{"private": []interface{}{
+				map[string]interface{}{"addr": "10.0.0.5", "version": 4, "OS-EXT-IPS:type": "fixed"},
+			}},
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJson(w, map[string]interface{}{"server": map[string]interface{}{"id": id}})
+	case path == "/compute/v2.1/servers/detail":
+		list := []interface{}{}
+		for _, s := range o.servers {
+			if strings.HasPrefix(s["name"].(string), "mpc-") {
+				list = append(list, s)
+			}
+		}
+		writeJson(w, map[string]interface{}{"servers": list})
+	case strings.HasPrefix(path, "/compute/v2.1/servers/"):
+		id := strings.TrimPrefix(path, "/compute/v2.1/servers/")
+		server := o.servers[id]
+		if server == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodDelete {
+			delete(o.servers, id)
+			for _, ip := range o.floatingIps {
+				if ip["port_id"] == "port-"+id {
+					ip["port_id"] = nil
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJson(w, map[string]interface{}{"server": server})
+	case path == "/network/v2.0/ports":
+		writeJson(w, map[string]interface{}{"ports": []interface{}{map[string]interface{}{"id": "port-" + req.URL.Query().Get("device_id"), "device_id": req.URL.Query().Get("device_id")}}})
+	case path == "/network/v2.0/floatingips" && req.Method == http.MethodGet:
+		list := []interface{}{}
+		for _, ip := range o.floatingIps {
+			if ip["description"] == req.URL.Query().Get("description") {
+				list = append(list, ip)
+			}
+		}
+		writeJson(w, map[string]interface{}{"floatingips": list})
+	case path == "/network/v2.0/floatingips" && req.Method == http.MethodPost:
+		ip := body["floatingip"].(map[string]interface{})
+		ip["id"] = o.id("fip")
+		ip["floating_ip_address"] = o.address
+		o.floatingIps[ip["id"].(string)] = ip
+		o.attach(ip)
+		w.WriteHeader(http.StatusCreated)
+		writeJson(w, map[string]interface{}{"floatingip": ip})
+	case strings.HasPrefix(path, "/network/v2.0/floatingips/") && req.Method == http.MethodPut:
+		ip := o.floatingIps[strings.TrimPrefix(path, "/network/v2.0/floatingips/")]
+		if ip == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ip["port_id"] = body["floatingip"].(map[string]interface{})["port_id"]
+		o.attach(ip)
+		writeJson(w, map[string]interface{}{"floatingip": ip})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// attach adds the floating IP to the addresses of the server that owns the port
+func (o *openStackStandIn) attach(ip map[string]interface{}) {
+	server := o.servers[strings.TrimPrefix(ip["port_id"].(string), "port-")]
+	addresses := server["addresses"].(map[string]interface{})
+	addresses["private"] = append(addresses["private"].([]interface{}), map[string]interface{}{"addr": ip["floating_ip_address"], "version": 4, "OS-EXT-IPS:type": "floating"})
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func TestOpenStackProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	log := logr.Discard()
+
+	// Instances are only returned once SSH is reachable, so point the floating IPs at a local listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	g.Expect(err).ShouldNot(HaveOccurred())
+	sshPort = port
+
+	standIn := &openStackStandIn{address: host, servers: map[string]map[string]interface{}{}, floatingIps: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	standIn.url = server.URL
+
+	secret := v1.Secret{}
+	secret.Name = "openstack"
+	secret.Namespace = systemNamespace
+	secret.Data = map[string][]byte{"application-credential-id": []byte("app-id"), "application-credential-secret": []byte("app-secret")}
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&secret).Build()
+
+	provider := OpenStackProvider("linux-amd64", map[string]string{
+		"dynamic.linux-amd64.auth-url":         server.URL + "/identity/v3",
+		"dynamic.linux-amd64.region":           "RegionOne",
+		"dynamic.linux-amd64.flavor":           "m1.large",
+		"dynamic.linux-amd64.image":            "rhel-9",
+		"dynamic.linux-amd64.network":          "private",
+		"dynamic.linux-amd64.floating-network": "public",
+		"dynamic.linux-amd64.security-groups":  "default, ssh",
+		"dynamic.linux-amd64.key-name":         "builder",
+		"dynamic.linux-amd64.openstack-secret": "openstack",
+	}, systemNamespace)
+
+	id, err := provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	launched := standIn.servers[string(id)]
+	g.Expect(launched).ShouldNot(BeNil())
+	g.Expect(launched["key_name"]).Should(Equal("builder"))
+	g.Expect(launched["metadata"]).Should(HaveKeyWithValue(cloud.InstanceTag, "prod-amd64"))
+
+	// The first lookup allocates a floating IP
+	address, err := provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+	g.Expect(standIn.floatingIps).Should(HaveLen(1))
+
+	count, err := provider.CountInstances(kubeClient, &log, ctx, "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(1))
+	count, err = provider.CountInstances(kubeClient, &log, ctx, "staging-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(count).Should(Equal(0))
+
+	instances, err := provider.ListInstances(kubeClient, &log, ctx, "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(instances).Should(HaveLen(1))
+	g.Expect(instances[0].InstanceId).Should(Equal(id))
+	g.Expect(instances[0].Address).Should(Equal(host))
+
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	g.Expect(standIn.servers).Should(BeEmpty())
+	// terminating an instance that is already gone is not an error
+	g.Expect(provider.TerminateInstance(kubeClient, &log, ctx, id)).Should(Succeed())
+	_, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).Should(HaveOccurred())
+
+	// The released floating IP is reused by the next server
+	id, err = provider.LaunchInstance(kubeClient, &log, ctx, "test", "prod-amd64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	address, err = provider.GetInstanceAddress(kubeClient, &log, ctx, id)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(address).Should(Equal(host))
+	g.Expect(standIn.floatingIps).Should(HaveLen(1))
+}
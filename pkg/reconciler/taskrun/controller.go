@@ -1,12 +1,104 @@
 package taskrun
 
 import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
 	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"time"
 )
 
+// periodicJobTimeout bounds a single run of a periodic job, so a cloud API that stops responding can't stall it forever
+const periodicJobTimeout = time.Minute * 10
+
 func SetupNewReconcilerWithManager(mgr ctrl.Manager, operatorNamespace string) error {
 	r := newReconciler(mgr, operatorNamespace)
+	// Each periodic job runs on its own, so a platform that is slow to list its instances only delays that job
+	jobs := map[string]func(ctx context.Context, log *logr.Logger){
+		"platform-status":  r.UpdatePlatformStatus,
+		"interruptions":    r.CheckInterruptions,
+		"warm-pools":       r.MaintainWarmPools,
+		"stop-idle":        r.StopIdleInstances,
+		"reaper":           r.ReapOrphanedInstances,
+		"namespace-usage":  r.UpdateNamespaceUsage,
+		"waiting-tasks":    r.CheckWaitingTasks,
+		"host-health":      r.CheckHostHealth,
+		"drain":            r.DrainHosts,
+		"host-key-pruning": r.PruneHostKeys,
+	}
+	for name, job := range jobs {
+		err := mgr.Add(periodicJob(name, time.Minute, job))
+		if err != nil {
+			return err
+		}
+	}
+	err := setupHostConfigWatch(mgr, r)
+	if err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.TaskRun{}).Complete(r)
 }
+
+// periodicJob runs the job every interval until the manager stops. A run is given at most periodicJobTimeout, and
+// ticks that are missed while it is running are dropped.
+func periodicJob(name string, interval time.Duration, job func(ctx context.Context, log *logr.Logger)) manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		log := ctrl.Log.WithName(name)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				runCtx, cancel := context.WithTimeout(ctx, periodicJobTimeout)
+				job(runCtx, &log)
+				cancel()
+			}
+		}
+	})
+}
+
+// setupHostConfigWatch reloads the platform config whenever the host-config ConfigMap or any of the platform objects
+// change. All changes are mapped to a single request, so bursts of changes only result in a single reload.
+func setupHostConfigWatch(mgr ctrl.Manager, r *ReconcileTaskRun) error {
+	hostConfig := types.NamespacedName{Namespace: r.operatorNamespace, Name: HostConfig}
+	toHostConfig := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: hostConfig}}
+	})
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("hostconfig").
+		For(&v12.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetNamespace() == hostConfig.Namespace && obj.GetName() == hostConfig.Name
+		})))
+	for _, obj := range []client.Object{&v1alpha1.HostPool{}, &v1alpha1.DynamicPlatform{}, &v1alpha1.DynamicPoolPlatform{}} {
+		// The CRDs are optional, the controller works with just the ConfigMap if they are not installed
+		gvk, err := apiutil.GVKForObject(obj, mgr.GetScheme())
+		if err != nil {
+			return err
+		}
+		_, err = mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			if isMissingKind(err) {
+				continue
+			}
+			return err
+		}
+		b = b.Watches(obj, toHostConfig)
+	}
+	return b.Complete(reconcile.Func(func(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+		log := ctrl.Log.WithName("hostconfig")
+		return reconcile.Result{}, r.RefreshPlatformConfig(ctx, &log)
+	}))
+}
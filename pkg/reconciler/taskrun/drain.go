@@ -0,0 +1,299 @@
+package taskrun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/apis"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+const (
+	// DrainAnnotation takes hosts out of service. It can be set on the host-config ConfigMap, a HostPool or a
+	// DynamicPoolPlatform, and is a comma separated list of host names or dynamic pool instance ids. Each can be
+	// followed by =update to run the update-host task on a static host, or =terminate to terminate a dynamic pool
+	// instance, once its running tasks have finished. Hosts stay out of service until they are removed from the list.
+	DrainAnnotation = "build.appstudio.redhat.com/drain"
+	// DrainStatusAnnotation is written by the controller on the same object, a JSON map of host to drainStatus
+	DrainStatusAnnotation = "build.appstudio.redhat.com/drain-status"
+
+	DrainActionUpdate    = "update"
+	DrainActionTerminate = "terminate"
+
+	DrainStateDraining     = "Draining"
+	DrainStateDrained      = "Drained"
+	DrainStateUpdating     = "Updating"
+	DrainStateUpdated      = "Updated"
+	DrainStateUpdateFailed = "UpdateFailed"
+	DrainStateTerminated   = "Terminated"
+	DrainStateFailed       = "Failed"
+)
+
+// drainStatus is the progress of draining a single host
+type drainStatus struct {
+	State  string `json:"state"`
+	Action string `json:"action,omitempty"`
+	// Tasks are the user tasks still running on the host
+	Tasks []string `json:"tasks,omitempty"`
+	// UpdateTask is the name of the update task run for the host
+	UpdateTask string `json:"updateTask,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// drainSource is an object with the drain annotation, and the hosts it drains mapped to their action
+type drainSource struct {
+	object client.Object
+	hosts  map[string]string
+}
+
+// parseDrainAnnotation parses a list of host[=action] entries
+func parseDrainAnnotation(value string) map[string]string {
+	ret := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, action, _ := strings.Cut(entry, "=")
+		ret[strings.TrimSpace(host)] = strings.TrimSpace(action)
+	}
+	return ret
+}
+
+// readDrainSources returns every config object with the drain annotation, or a status left over from one
+func (r *ReconcileTaskRun) readDrainSources(ctx context.Context) ([]drainSource, error) {
+	objects := []client.Object{}
+	cm := v12.ConfigMap{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: HostConfig}, &cm)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		objects = append(objects, &cm)
+	}
+	hostPools := v1alpha1.HostPoolList{}
+	err = r.client.List(ctx, &hostPools, client.InNamespace(r.operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		return nil, err
+	}
+	for i := range hostPools.Items {
+		objects = append(objects, &hostPools.Items[i])
+	}
+	dynamicPool := v1alpha1.DynamicPoolPlatformList{}
+	err = r.client.List(ctx, &dynamicPool, client.InNamespace(r.operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		return nil, err
+	}
+	for i := range dynamicPool.Items {
+		objects = append(objects, &dynamicPool.Items[i])
+	}
+	ret := []drainSource{}
+	for _, obj := range objects {
+		annotations := obj.GetAnnotations()
+		if annotations[DrainAnnotation] != "" || annotations[DrainStatusAnnotation] != "" {
+			ret = append(ret, drainSource{object: obj, hosts: parseDrainAnnotation(annotations[DrainAnnotation])})
+		}
+	}
+	return ret, nil
+}
+
+// drainedHosts returns the hosts that must not be given new tasks
+func (r *ReconcileTaskRun) drainedHosts(ctx context.Context) (map[string]bool, error) {
+	sources, err := r.readDrainSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]bool{}
+	for _, source := range sources {
+		for host := range source.hosts {
+			ret[host] = true
+		}
+	}
+	return ret, nil
+}
+
+// DrainHosts records the tasks still running on each drained host, and once there are none runs the drain action.
+// The progress is written to the drain status annotation of the object the host was drained from.
+func (r *ReconcileTaskRun) DrainHosts(ctx context.Context, log *logr.Logger) {
+	sources, err := r.readDrainSources(ctx)
+	if err != nil {
+		log.Error(err, "failed to read drained hosts")
+		return
+	}
+	if len(sources) == 0 {
+		return
+	}
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to drain hosts")
+		return
+	}
+	// A task may have just been assigned to the host, so read the tasks directly from the API server
+	var reader client.Reader = r.client
+	if r.apiReader != nil {
+		reader = r.apiReader
+	}
+	taskList := v1.TaskRunList{}
+	err = reader.List(ctx, &taskList, client.HasLabels{AssignedHost})
+	if err != nil {
+		log.Error(err, "failed to list tasks to drain hosts")
+		return
+	}
+	running := map[string][]string{}
+	for _, tr := range taskList.Items {
+		if tr.Labels[TaskTypeLabel] == "" && tr.Status.CompletionTime == nil {
+			host := tr.Labels[AssignedHost]
+			running[host] = append(running[host], tr.Namespace+"/"+tr.Name)
+		}
+	}
+	for _, source := range sources {
+		annotations := source.object.GetAnnotations()
+		previous := map[string]drainStatus{}
+		if value := annotations[DrainStatusAnnotation]; value != "" {
+			if err := json.Unmarshal([]byte(value), &previous); err != nil {
+				log.Error(err, "ignoring invalid drain status", "object", source.object.GetName())
+			}
+		}
+		status := map[string]drainStatus{}
+		for host, action := range source.hosts {
+			tasks := running[host]
+			sort.Strings(tasks)
+			if len(tasks) > 0 {
+				status[host] = drainStatus{State: DrainStateDraining, Action: action, Tasks: tasks}
+				continue
+			}
+			status[host] = r.finishDrain(ctx, log, data, host, action, previous[host])
+		}
+		if reflect.DeepEqual(status, previous) {
+			continue
+		}
+		if len(status) == 0 {
+			delete(annotations, DrainStatusAnnotation)
+		} else {
+			value, err := json.Marshal(status)
+			if err != nil {
+				log.Error(err, "failed to marshal drain status")
+				continue
+			}
+			annotations[DrainStatusAnnotation] = string(value)
+		}
+		source.object.SetAnnotations(annotations)
+		err = r.client.Update(ctx, source.object)
+		if err != nil {
+			log.Error(err, "failed to update drain status", "object", source.object.GetName())
+		}
+	}
+}
+
+// finishDrain runs the drain action on a host that has no tasks left, unless it has already been run
+func (r *ReconcileTaskRun) finishDrain(ctx context.Context, log *logr.Logger, data map[string]string, host string, action string, previous drainStatus) drainStatus {
+	switch previous.State {
+	case DrainStateDrained, DrainStateUpdated, DrainStateUpdateFailed, DrainStateTerminated:
+		if previous.Action == action {
+			return previous
+		}
+	}
+	ret := drainStatus{State: DrainStateDrained, Action: action}
+	switch action {
+	case "":
+	case DrainActionUpdate:
+		if previous.Action == action && previous.State == DrainStateUpdating {
+			return r.checkDrainUpdate(ctx, previous)
+		}
+		config := parseStaticHosts(data)[host]
+		if config == nil {
+			ret.State = DrainStateFailed
+			ret.Message = "only static hosts can be updated"
+			return ret
+		}
+		update := newUpdateTask(r.operatorNamespace, config, knownHostsFor(ctx, r.client, log, r.operatorNamespace, data, config))
+		err := r.client.Create(ctx, update)
+		if err != nil {
+			log.Error(err, "failed to create update task for drained host", "host", host)
+			ret.State = DrainStateDraining
+			return ret
+		}
+		log.Info("updating drained host", "host", host, "audit", "true")
+		ret.State = DrainStateUpdating
+		ret.UpdateTask = update.Name
+	case DrainActionTerminate:
+		err := r.terminateDrainedInstance(ctx, log, data, host)
+		if err != nil {
+			ret.State = DrainStateFailed
+			ret.Message = err.Error()
+			return ret
+		}
+		log.Info("terminated drained instance", "instance", host, "audit", "true")
+		ret.State = DrainStateTerminated
+	default:
+		ret.State = DrainStateFailed
+		ret.Message = fmt.Sprintf("unknown drain action %s, must be %s or %s", action, DrainActionUpdate, DrainActionTerminate)
+	}
+	return ret
+}
+
+// checkDrainUpdate checks if the update task for a drained host has finished
+func (r *ReconcileTaskRun) checkDrainUpdate(ctx context.Context, previous drainStatus) drainStatus {
+	update := v1.TaskRun{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: previous.UpdateTask}, &update)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			previous.State = DrainStateUpdateFailed
+			previous.Message = "update task was deleted before it finished"
+		}
+		return previous
+	}
+	if update.Status.CompletionTime == nil {
+		return previous
+	}
+	if update.Status.GetCondition(apis.ConditionSucceeded).IsTrue() {
+		previous.State = DrainStateUpdated
+	} else {
+		previous.State = DrainStateUpdateFailed
+		previous.Message = "update task " + update.Name + " failed"
+	}
+	return previous
+}
+
+// terminateDrainedInstance finds the dynamic pool that owns the instance, and terminates it
+func (r *ReconcileTaskRun) terminateDrainedInstance(ctx context.Context, log *logr.Logger, data map[string]string, instance string) error {
+	for _, platform := range strings.Split(data[DynamicPoolPlatforms], ",") {
+		if platform == "" {
+			continue
+		}
+		entry, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			return err
+		}
+		pool, ok := entry.config.(DynamicHostPool)
+		if !ok {
+			continue
+		}
+		instances, err := pool.cloudProvider.ListInstances(r.client, log, ctx, pool.instanceTag)
+		if err != nil {
+			return err
+		}
+		if stopper, ok := pool.cloudProvider.(cloud.InstanceStopper); ok {
+			stopped, err := stopper.ListStoppedInstances(r.client, log, ctx, pool.instanceTag)
+			if err != nil {
+				return err
+			}
+			instances = append(instances, stopped...)
+		}
+		for _, i := range instances {
+			if string(i.InstanceId) == instance {
+				return pool.cloudProvider.TerminateInstance(r.client, log, ctx, i.InstanceId)
+			}
+		}
+	}
+	return fmt.Errorf("instance %s was not found in any dynamic pool", instance)
+}
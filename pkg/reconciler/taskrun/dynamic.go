@@ -21,6 +21,9 @@ type DynamicResolver struct {
 	maxInstances int
 	instanceTag  string
 	timeout      int64
+	// minReady is the number of booted, idle instances to keep ready to hand to tasks
+	minReady int
+	warmTTL  time.Duration
 }
 
 func (r DynamicResolver) Deallocate(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger, tr *v1.TaskRun, secretName string, selectedHost string) error {
@@ -100,6 +103,7 @@ func (r DynamicResolver) Allocate(taskRun *ReconcileTaskRun, ctx context.Context
 		} else if address != "" {
 			tr.Labels[AssignedHost] = tr.Annotations[CloudInstanceId]
 			tr.Annotations[CloudAddress] = address
+			r.recordInstanceDetails(taskRun, ctx, log, tr)
 			err := taskRun.client.Update(ctx, tr)
 			if err != nil {
 				return reconcile.Result{}, err
@@ -132,9 +136,19 @@ func (r DynamicResolver) Allocate(taskRun *ReconcileTaskRun, ctx context.Context
 			return reconcile.Result{RequeueAfter: time.Second * 10}, nil
 		}
 	}
+	if r.minReady > 0 {
+		claimed, err := r.claimWarmInstance(taskRun, ctx, log, tr, secretName)
+		if claimed || err != nil {
+			return reconcile.Result{}, err
+		}
+	}
 	//first check this would not exceed the max tasks
+	//the count is only valid until the next launch, so nothing else can launch an instance of the platform until this one has
+	launchLock := taskRun.platformLaunchLock(r.platform)
+	launchLock.Lock()
 	instanceCount, err := r.CloudProvider.CountInstances(taskRun.client, log, ctx, r.instanceTag)
 	if instanceCount >= r.maxInstances || err != nil {
+		launchLock.Unlock()
 		if err != nil {
 			log.Error(err, "unable to count running instances, not allocating a new instance out of an abundance of caution")
 			log.Error(err, "Failed to count existing cloud instances")
@@ -156,6 +170,7 @@ func (r DynamicResolver) Allocate(taskRun *ReconcileTaskRun, ctx context.Context
 	log.Info(fmt.Sprintf("%d instances are running, creating a new instance", instanceCount))
 	log.Info("attempting to launch a new host for " + tr.Name)
 	instance, err := r.CloudProvider.LaunchInstance(taskRun.client, log, ctx, tr.Name, r.instanceTag)
+	launchLock.Unlock()
 
 	if err != nil {
 		launchErr := err
@@ -225,3 +240,23 @@ func (r DynamicResolver) Allocate(taskRun *ReconcileTaskRun, ctx context.Context
 	return reconcile.Result{}, nil
 
 }
+
+// recordInstanceDetails annotates the task with the zone, instance type and capacity type the instance was launched
+// with, for providers that can fall back to other options when the preferred one has no capacity
+func (r DynamicResolver) recordInstanceDetails(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger, tr *v1.TaskRun) {
+	describer, ok := r.CloudProvider.(cloud.InstanceDescriber)
+	if !ok {
+		return
+	}
+	details, err := describer.DescribeInstance(taskRun.client, log, ctx, cloud.InstanceIdentifier(tr.Annotations[CloudInstanceId]))
+	if err != nil {
+		// This is informational only, so don't fail the allocation
+		log.Error(err, "failed to describe cloud instance", "instance", tr.Annotations[CloudInstanceId])
+		return
+	}
+	for annotation, value := range map[string]string{CloudZone: details.Zone, CloudInstanceType: details.InstanceType, CloudCapacityType: details.CapacityType} {
+		if value != "" {
+			tr.Annotations[annotation] = value
+		}
+	}
+}
@@ -21,6 +21,11 @@ type DynamicHostPool struct {
 	concurrency   int
 	maxAge        time.Duration
 	instanceTag   string
+	// stopIdle stops instances that have been idle for the grace period, rather than leaving them running until they
+	// reach their maximum age. They are started again when they are needed.
+	stopIdle        bool
+	idleGracePeriod time.Duration
+	idle            *idleTracker
 }
 
 func (a DynamicHostPool) InstanceTag() string {
@@ -129,6 +134,16 @@ func (a DynamicHostPool) Allocate(r *ReconcileTaskRun, ctx context.Context, log
 		// Too many instances, we just have to wait
 		return reconcile.Result{RequeueAfter: time.Minute}, err
 	}
+	if a.stopIdle {
+		started, err := a.startStoppedInstance(r, ctx, log)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if started {
+			delete(tr.Labels, WaitingForPlatformLabel)
+			return reconcile.Result{RequeueAfter: time.Minute}, nil
+		}
+	}
 	name, err := getRandomString(8)
 	if err != nil {
 		return reconcile.Result{}, err
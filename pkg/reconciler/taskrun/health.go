@@ -0,0 +1,345 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"knative.dev/pkg/apis"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HostHealthCheckInterval is how often, in minutes, each static host is checked by the check-host-health task.
+	// Health checks are not run if it is not set.
+	HostHealthCheckInterval = "host-health-check-interval"
+	// HostHealthMinDisk is the free disk space, in GB, a host needs to pass its health check
+	HostHealthMinDisk = "host-health-min-disk"
+	// HostQuarantineThreshold is the number of provision failures in a row after which a static host is quarantined
+	HostQuarantineThreshold = "host-quarantine-threshold"
+	// HostQuarantinePeriod is how long, in minutes, a host is quarantined for when health checks are not enabled. With
+	// health checks the host is quarantined until it passes one.
+	HostQuarantinePeriod = "host-quarantine-period"
+)
+
+type healthSettings struct {
+	interval   time.Duration
+	minDisk    int
+	threshold  int
+	quarantine time.Duration
+}
+
+// readHealthSettings reads the health check settings, invalid values are logged and the default used
+func readHealthSettings(log *logr.Logger, data map[string]string) healthSettings {
+	ret := healthSettings{minDisk: 10, threshold: 3, quarantine: time.Minute * 30}
+	for key, setting := range map[string]*int{HostHealthMinDisk: &ret.minDisk, HostQuarantineThreshold: &ret.threshold} {
+		if value := data[key]; value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				log.Error(err, "unable to parse host health setting", "key", key, "value", value)
+			} else {
+				*setting = parsed
+			}
+		}
+	}
+	for key, setting := range map[string]*time.Duration{HostHealthCheckInterval: &ret.interval, HostQuarantinePeriod: &ret.quarantine} {
+		if value := data[key]; value != "" {
+			minutes, err := strconv.Atoi(value)
+			if err != nil || minutes < 0 {
+				log.Error(err, "unable to parse host health setting", "key", key, "value", value)
+			} else {
+				*setting = time.Minute * time.Duration(minutes)
+			}
+		}
+	}
+	return ret
+}
+
+type hostHealth struct {
+	unhealthy bool
+	reason    string
+	// until is when a quarantined host can be tried again, if it is zero the host has to pass a health check
+	until time.Time
+	// failures is the number of provision failures in a row
+	failures  int
+	lastCheck time.Time
+}
+
+// hostHealthTracker is the health of every static host, shared by all tasks. It is only kept in memory, if the
+// controller restarts all hosts are considered healthy until they are checked again.
+type hostHealthTracker struct {
+	lock  sync.Mutex
+	hosts map[string]*hostHealth
+}
+
+func newHostHealthTracker() *hostHealthTracker {
+	return &hostHealthTracker{hosts: map[string]*hostHealth{}}
+}
+
+func (t *hostHealthTracker) get(host string) *hostHealth {
+	h := t.hosts[host]
+	if h == nil {
+		h = &hostHealth{}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// schedulable returns false if new tasks should not be given the host
+func (t *hostHealthTracker) schedulable(host string, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	h := t.hosts[host]
+	if h == nil || !h.unhealthy {
+		return true
+	}
+	return !h.until.IsZero() && now.After(h.until)
+}
+
+// recordProvision updates the failure count of the host, and returns true if the host has just been quarantined or
+// restored. A host that is tried again after its quarantine period is quarantined again by a single failure.
+func (t *hostHealthTracker) recordProvision(host string, success bool, settings healthSettings, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	h := t.get(host)
+	if success {
+		changed := h.unhealthy
+		*h = hostHealth{lastCheck: h.lastCheck}
+		return changed
+	}
+	h.failures++
+	if settings.threshold == 0 || h.failures < settings.threshold {
+		return false
+	}
+	changed := !h.unhealthy || (!h.until.IsZero() && now.After(h.until))
+	h.unhealthy = true
+	h.reason = strconv.Itoa(h.failures) + " provision failures in a row"
+	h.until = time.Time{}
+	if settings.interval == 0 {
+		h.until = now.Add(settings.quarantine)
+	}
+	return changed
+}
+
+// recordCheck records the result of a health check, and returns true if the health of the host has changed
+func (t *hostHealthTracker) recordCheck(host string, passed bool, reason string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	h := t.get(host)
+	if passed {
+		changed := h.unhealthy
+		*h = hostHealth{lastCheck: h.lastCheck}
+		return changed
+	}
+	changed := !h.unhealthy
+	h.unhealthy = true
+	h.reason = reason
+	h.until = time.Time{}
+	return changed
+}
+
+// checkDue returns true, and records the check, if the host has not been checked within the interval
+func (t *hostHealthTracker) checkDue(host string, interval time.Duration, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	h := t.get(host)
+	if now.Sub(h.lastCheck) < interval {
+		return false
+	}
+	h.lastCheck = now
+	return true
+}
+
+// retain forgets hosts that have been removed from the config
+func (t *hostHealthTracker) retain(hosts map[string]*Host) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for host := range t.hosts {
+		if hosts[host] == nil {
+			delete(t.hosts, host)
+		}
+	}
+}
+
+// parseStaticHosts reads the host.<name>.<key> entries of the host config
+func parseStaticHosts(data map[string]string) map[string]*Host {
+	hosts := map[string]*Host{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, "host.") {
+			continue
+		}
+		k = k[len("host."):]
+		pos := strings.LastIndex(k, ".")
+		if pos == -1 {
+			continue
+		}
+		name := k[0:pos]
+		host := hosts[name]
+		if host == nil {
+			host = &Host{Name: name}
+			hosts[name] = host
+		}
+		switch k[pos+1:] {
+		case "address":
+			host.Address = v
+		case "user":
+			host.User = v
+		case "platform":
+			host.Platform = v
+		case "secret":
+			host.Secret = v
+		case "concurrency":
+			host.Concurrency, _ = strconv.Atoi(v)
+		}
+	}
+	return hosts
+}
+
+// CheckHostHealth launches a health check task for every static host that is due one
+func (r *ReconcileTaskRun) CheckHostHealth(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to check host health")
+		return
+	}
+	settings := readHealthSettings(log, data)
+	hosts := parseStaticHosts(data)
+	r.hostHealth.retain(hosts)
+	now := time.Now()
+	for name, host := range hosts {
+		r.publishHostHealth(name, host.Platform, now)
+	}
+	if settings.interval == 0 {
+		return
+	}
+	for name, host := range hosts {
+		if !r.hostHealth.checkDue(name, settings.interval, now) {
+			continue
+		}
+		running := v1.TaskRunList{}
+		err := r.client.List(ctx, &running, client.InNamespace(r.operatorNamespace), client.MatchingLabels{TaskTypeLabel: TaskTypeHealthCheck, AssignedHost: name})
+		if err != nil {
+			log.Error(err, "failed to list health check tasks", "host", name)
+			continue
+		}
+		if hasRunningTask(running.Items) {
+			continue
+		}
+		check := v1.TaskRun{}
+		check.GenerateName = "health-check-task"
+		check.Namespace = r.operatorNamespace
+		check.Labels = map[string]string{TaskTypeLabel: TaskTypeHealthCheck, AssignedHost: name}
+		check.Annotations = map[string]string{TaskTargetPlatformAnnotation: host.Platform}
+		check.Spec.TaskRef = &v1.TaskRef{Name: "check-host-health"}
+		check.Spec.Workspaces = []v1.WorkspaceBinding{{Name: "ssh", Secret: &v12.SecretVolumeSource{SecretName: host.Secret}}}
+		compute := map[v12.ResourceName]resource.Quantity{v12.ResourceCPU: resource.MustParse("100m"), v12.ResourceMemory: resource.MustParse("128Mi")}
+		check.Spec.ComputeResources = &v12.ResourceRequirements{Requests: compute, Limits: compute}
+		check.Spec.ServiceAccountName = ServiceAccountName
+		check.Spec.Params = []v1.Param{
+			{
+				Name:  "HOST",
+				Value: *v1.NewStructuredValues(host.Address),
+			},
+			{
+				Name:  "USER",
+				Value: *v1.NewStructuredValues(host.User),
+			},
+			{
+				Name:  "MIN_DISK",
+				Value: *v1.NewStructuredValues(strconv.Itoa(settings.minDisk)),
+			},
+			{
+				Name:  "KNOWN_HOSTS",
+				Value: *v1.NewStructuredValues(knownHostsFor(ctx, r.client, log, r.operatorNamespace, data, host)),
+			},
+		}
+		err = r.client.Create(ctx, &check)
+		if err != nil {
+			log.Error(err, "failed to create health check task", "host", name)
+		}
+	}
+}
+
+// handleHealthCheckTask records the result of a health check, failed checks are kept for an hour to view the logs
+func (r *ReconcileTaskRun) handleHealthCheckTask(ctx context.Context, log *logr.Logger, tr *v1.TaskRun) (reconcile.Result, error) {
+	if tr.Status.CompletionTime == nil {
+		return reconcile.Result{}, nil
+	}
+	condition := tr.Status.GetCondition(apis.ConditionSucceeded)
+	success := condition.IsTrue()
+	if tr.Annotations[ProvisionTaskProcessed] != "true" {
+		reason := "health check failed"
+		if condition != nil && condition.Message != "" {
+			reason = condition.Message
+		}
+		r.updateHostHealth(ctx, log, tr.Labels[AssignedHost], func(settings healthSettings) bool {
+			return r.hostHealth.recordCheck(tr.Labels[AssignedHost], success, reason)
+		})
+		if tr.Annotations == nil {
+			tr.Annotations = map[string]string{}
+		}
+		tr.Annotations[ProvisionTaskProcessed] = "true"
+		if !success {
+			return reconcile.Result{RequeueAfter: time.Hour}, r.client.Update(ctx, tr)
+		}
+	}
+	if success || tr.Status.CompletionTime.Add(time.Hour).Before(time.Now()) {
+		return reconcile.Result{}, r.client.Delete(ctx, tr)
+	}
+	return reconcile.Result{RequeueAfter: time.Hour}, nil
+}
+
+// recordProvisionResult feeds the result of a provision task into the circuit breaker of a static host
+func (r *ReconcileTaskRun) recordProvisionResult(ctx context.Context, log *logr.Logger, host string, success bool) {
+	r.updateHostHealth(ctx, log, host, func(settings healthSettings) bool {
+		return r.hostHealth.recordProvision(host, success, settings, time.Now())
+	})
+}
+
+// updateHostHealth applies the update to a static host, then publishes its health and wakes the tasks waiting for
+// its platform if it has been restored. Dynamic instances are ignored.
+func (r *ReconcileTaskRun) updateHostHealth(ctx context.Context, log *logr.Logger, host string, update func(settings healthSettings) bool) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to update host health")
+		return
+	}
+	config := parseStaticHosts(data)[host]
+	if config == nil {
+		return
+	}
+	if !update(readHealthSettings(log, data)) {
+		return
+	}
+	if !r.publishHostHealth(host, config.Platform, time.Now()) {
+		r.hostHealth.lock.Lock()
+		reason := r.hostHealth.hosts[host].reason
+		r.hostHealth.lock.Unlock()
+		log.Info("host is unhealthy, no new tasks will be assigned to it", "host", host, "reason", reason, "audit", "true")
+		return
+	}
+	log.Info("host is healthy again", "host", host, "audit", "true")
+	err = r.wakeWaitingTasks(ctx, log, config.Platform, config.Concurrency)
+	if err != nil {
+		log.Error(err, "failed to wake waiting tasks", "platform", config.Platform)
+	}
+}
+
+// publishHostHealth sets the health gauge of the host, and returns true if it can be given new tasks
+func (r *ReconcileTaskRun) publishHostHealth(host string, platform string, now time.Time) bool {
+	healthy := r.hostHealth.schedulable(host, now)
+	r.handleMetrics(platform, func(metrics *PlatformMetrics) {
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		metrics.hostHealth.WithLabelValues(host).Set(value)
+	})
+	return healthy
+}
@@ -0,0 +1,150 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+)
+
+// loadHostConfig returns the platform configuration in the flat host-config format.
+// Platforms defined by HostPool, DynamicPlatform and DynamicPoolPlatform objects replace any platforms defined in
+// the ConfigMap, global settings such as allowed-namespaces are still read from the ConfigMap if it exists.
+func loadHostConfig(ctx context.Context, kubeClient client.Reader, operatorNamespace string) (map[string]string, error) {
+	data := map[string]string{}
+	cm := v12.ConfigMap{}
+	cmErr := kubeClient.Get(ctx, types.NamespacedName{Namespace: operatorNamespace, Name: HostConfig}, &cm)
+	if cmErr != nil && !errors.IsNotFound(cmErr) {
+		return nil, cmErr
+	}
+	for k, v := range cm.Data {
+		data[k] = v
+	}
+	platforms, found, err := readPlatformObjects(ctx, kubeClient, operatorNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if cmErr != nil {
+			return nil, cmErr
+		}
+		return data, nil
+	}
+	for k := range data {
+		if isPlatformKey(k) {
+			delete(data, k)
+		}
+	}
+	for k, v := range platforms {
+		data[k] = v
+	}
+	return data, nil
+}
+
+func isPlatformKey(key string) bool {
+	return key == DynamicPlatforms || key == DynamicPoolPlatforms || strings.HasPrefix(key, "host.") || strings.HasPrefix(key, "dynamic.")
+}
+
+// readPlatformObjects converts all platform objects in the operator namespace to host-config keys
+// the returned boolean is false if there are no platform objects, or the CRDs are not installed
+func readPlatformObjects(ctx context.Context, kubeClient client.Reader, operatorNamespace string) (map[string]string, bool, error) {
+	ret := map[string]string{}
+	found := false
+
+	hostPools := v1alpha1.HostPoolList{}
+	err := kubeClient.List(ctx, &hostPools, client.InNamespace(operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		return nil, false, err
+	}
+	for i := range hostPools.Items {
+		found = true
+		addHostPool(ret, &hostPools.Items[i])
+	}
+
+	dynamic := v1alpha1.DynamicPlatformList{}
+	err = kubeClient.List(ctx, &dynamic, client.InNamespace(operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		return nil, false, err
+	}
+	dynamicPlatforms := []string{}
+	for i := range dynamic.Items {
+		found = true
+		dynamicPlatforms = append(dynamicPlatforms, addDynamicPlatform(ret, &dynamic.Items[i]))
+	}
+	if len(dynamicPlatforms) > 0 {
+		ret[DynamicPlatforms] = strings.Join(dynamicPlatforms, ",")
+	}
+
+	dynamicPool := v1alpha1.DynamicPoolPlatformList{}
+	err = kubeClient.List(ctx, &dynamicPool, client.InNamespace(operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		return nil, false, err
+	}
+	dynamicPoolPlatforms := []string{}
+	for i := range dynamicPool.Items {
+		found = true
+		dynamicPoolPlatforms = append(dynamicPoolPlatforms, addDynamicPoolPlatform(ret, &dynamicPool.Items[i]))
+	}
+	if len(dynamicPoolPlatforms) > 0 {
+		ret[DynamicPoolPlatforms] = strings.Join(dynamicPoolPlatforms, ",")
+	}
+	return ret, found, nil
+}
+
+// isMissingKind returns true if the platform CRDs are not installed, in which case only the ConfigMap is used
+func isMissingKind(err error) bool {
+	return meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err)
+}
+
+func addHostPool(data map[string]string, pool *v1alpha1.HostPool) {
+	for _, host := range pool.Spec.Hosts {
+		prefix := "host." + host.Name + "."
+		data[prefix+"address"] = host.Address
+		data[prefix+"platform"] = host.Platform
+		data[prefix+"user"] = host.User
+		data[prefix+"secret"] = host.Secret
+		data[prefix+"concurrency"] = strconv.Itoa(host.Concurrency)
+		if host.HostKey != "" {
+			data[prefix+HostKeyConfig] = host.HostKey
+		}
+	}
+}
+
+func addDynamicPlatform(data map[string]string, platform *v1alpha1.DynamicPlatform) string {
+	prefix := "dynamic." + platformLabel(platform.Spec.Platform) + "."
+	for k, v := range platform.Spec.Config {
+		data[prefix+k] = v
+	}
+	data[prefix+"type"] = platform.Spec.Type
+	data[prefix+"max-instances"] = strconv.Itoa(platform.Spec.MaxInstances)
+	data[prefix+"ssh-secret"] = platform.Spec.SshSecret
+	if platform.Spec.InstanceTag != "" {
+		data[prefix+"instance-tag"] = platform.Spec.InstanceTag
+	}
+	if platform.Spec.AllocationTimeout > 0 {
+		data[prefix+"allocation-timeout"] = strconv.FormatInt(platform.Spec.AllocationTimeout, 10)
+	}
+	return platform.Spec.Platform
+}
+
+func addDynamicPoolPlatform(data map[string]string, platform *v1alpha1.DynamicPoolPlatform) string {
+	prefix := "dynamic." + platformLabel(platform.Spec.Platform) + "."
+	for k, v := range platform.Spec.Config {
+		data[prefix+k] = v
+	}
+	data[prefix+"type"] = platform.Spec.Type
+	data[prefix+"max-instances"] = strconv.Itoa(platform.Spec.MaxInstances)
+	data[prefix+"concurrency"] = strconv.Itoa(platform.Spec.Concurrency)
+	data[prefix+"max-age"] = strconv.Itoa(platform.Spec.MaxAge)
+	data[prefix+"ssh-secret"] = platform.Spec.SshSecret
+	if platform.Spec.InstanceTag != "" {
+		data[prefix+"instance-tag"] = platform.Spec.InstanceTag
+	}
+	return platform.Spec.Platform
+}
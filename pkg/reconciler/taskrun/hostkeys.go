@@ -0,0 +1,398 @@
+package taskrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"net"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// HostKeysConfigMap holds the SSH host keys of every host the controller has provisioned, keyed by host name or
+	// instance id. Keys are added the first time a host is used, from the cloud console output if the provider can read
+	// it, otherwise from the first connection to the host. Remove a host's entry if it is rebuilt with new keys.
+	HostKeysConfigMap = "host-keys"
+	// HostKeyConfig pins the host key of a static host in the host config, host.<name>.host-key, which takes precedence
+	// over HostKeysConfigMap. It is in authorized keys format, one key per line.
+	HostKeyConfig = "host-key"
+
+	// HostKeysMissingAnnotation is written by the controller on HostKeysConfigMap, a JSON map of host to the time it
+	// was first found to no longer exist
+	HostKeysMissingAnnotation = "build.appstudio.redhat.com/host-keys-missing-since"
+	// hostKeyPruneGracePeriod is how long a host must be missing from every listing before its key is removed. Hosts
+	// that can't be reached or are still booting are not listed by some providers, so a host that is only missing for
+	// a short time must keep its key.
+	hostKeyPruneGracePeriod = time.Hour * 24
+
+	// hostKeyProbeUser is only used to start the SSH handshake, the connection is closed once the host key is received
+	hostKeyProbeUser = "multi-platform-controller"
+)
+
+// hostKeyMismatchError is returned when a host presents a different key to the one pinned for it
+type hostKeyMismatchError struct {
+	host      string
+	presented ssh.PublicKey
+}
+
+func (e *hostKeyMismatchError) Error() string {
+	return fmt.Sprintf("the SSH host key of %s (%s %s) does not match the key pinned for it, the host may have been rebuilt or the connection intercepted", e.host, e.presented.Type(), ssh.FingerprintSHA256(e.presented))
+}
+
+// parseHostKeys parses keys in authorized keys format, one per line
+func parseHostKeys(value string) ([]ssh.PublicKey, error) {
+	var ret []ssh.PublicKey
+	rest := []byte(value)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, key)
+		rest = next
+	}
+	return ret, nil
+}
+
+func marshalHostKeys(keys []ssh.PublicKey) string {
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadPinnedHostKeys returns the keys the host must present, or nil if none have been captured yet
+func loadPinnedHostKeys(ctx context.Context, kubeClient client.Reader, operatorNamespace string, data map[string]string, host string) ([]ssh.PublicKey, error) {
+	if value := data["host."+host+"."+HostKeyConfig]; value != "" {
+		keys, err := parseHostKeys(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key configured for %s: %w", host, err)
+		}
+		return keys, nil
+	}
+	cm := v12.ConfigMap{}
+	err := kubeClient.Get(ctx, types.NamespacedName{Namespace: operatorNamespace, Name: HostKeysConfigMap}, &cm)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys, err := parseHostKeys(cm.Data[host])
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key stored for %s: %w", host, err)
+	}
+	return keys, nil
+}
+
+// storeHostKeys records the keys of a host in HostKeysConfigMap. The config map has ConfigMapLabel so it is in the
+// manager's cache, it is read directly from the API server here so a map created without the label is found and
+// labelled rather than created again.
+func (r *ReconcileTaskRun) storeHostKeys(ctx context.Context, host string, keys []ssh.PublicKey) error {
+	var reader client.Reader = r.client
+	if r.apiReader != nil {
+		reader = r.apiReader
+	}
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		cm := v12.ConfigMap{}
+		err := reader.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: HostKeysConfigMap}, &cm)
+		if errors.IsNotFound(err) {
+			cm.Name = HostKeysConfigMap
+			cm.Namespace = r.operatorNamespace
+			cm.Labels = map[string]string{ConfigMapLabel: HostKeysConfigMap}
+			cm.Data = map[string]string{host: marshalHostKeys(keys)}
+			return r.client.Create(ctx, &cm)
+		} else if err != nil {
+			return err
+		}
+		if cm.Labels == nil {
+			cm.Labels = map[string]string{}
+		}
+		cm.Labels[ConfigMapLabel] = HostKeysConfigMap
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[host] = marshalHostKeys(keys)
+		return r.client.Update(ctx, &cm)
+	})
+}
+
+// knownHosts returns the known_hosts file for the keys of the host at the address
+func knownHosts(address string, keys []ssh.PublicKey) string {
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// knownHostsFor returns the known_hosts file for a static host, which is empty if its key has not been captured yet
+func knownHostsFor(ctx context.Context, kubeClient client.Reader, log *logr.Logger, operatorNamespace string, data map[string]string, host *Host) string {
+	keys, err := loadPinnedHostKeys(ctx, kubeClient, operatorNamespace, data, host.Name)
+	if err != nil {
+		log.Error(err, "failed to read host key", "host", host.Name)
+		return ""
+	}
+	return knownHosts(host.Address, keys)
+}
+
+// knownHostsForStaticHost is knownHostsFor when the host config has not already been loaded
+func (r *ReconcileTaskRun) knownHostsForStaticHost(ctx context.Context, log *logr.Logger, host *Host) string {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config for host key", "host", host.Name)
+		return ""
+	}
+	return knownHostsFor(ctx, r.client, log, r.operatorNamespace, data, host)
+}
+
+// hostKeyAlgorithms are the algorithms to ask the host for, so it presents one of the pinned keys rather than a key of
+// another type it also has
+func hostKeyAlgorithms(keys []ssh.PublicKey) []string {
+	var ret []string
+	for _, key := range keys {
+		if key.Type() == ssh.KeyAlgoRSA {
+			ret = append(ret, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		} else {
+			ret = append(ret, key.Type())
+		}
+	}
+	return ret
+}
+
+// pinnedHostKeyCallback only accepts one of the keys, if there are none any key is accepted
+func pinnedHostKeyCallback(host string, keys []ssh.PublicKey) ssh.HostKeyCallback {
+	if len(keys) == 0 {
+		return ssh.InsecureIgnoreHostKey() //#nosec G106 -- only before the first key of a host has been captured
+	}
+	return func(_ string, _ net.Addr, presented ssh.PublicKey) error {
+		for _, key := range keys {
+			if bytes.Equal(key.Marshal(), presented.Marshal()) {
+				return nil
+			}
+		}
+		return &hostKeyMismatchError{host: host, presented: presented}
+	}
+}
+
+// probeHostKey starts an SSH handshake with the host to get its key. If keys are given the host is asked for a key of
+// the same type, and a mismatch returns a hostKeyMismatchError.
+func probeHostKey(ctx context.Context, host string, address string, keys []ssh.PublicKey) (ssh.PublicKey, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	dialer := net.Dialer{Timeout: time.Second * 30}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var presented ssh.PublicKey
+	check := pinnedHostKeyCallback(host, keys)
+	config := &ssh.ClientConfig{
+		User:              hostKeyProbeUser,
+		HostKeyAlgorithms: hostKeyAlgorithms(keys),
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			presented = key
+			return check(hostname, remote, key)
+		},
+		Timeout: time.Second * 30,
+	}
+	_, _, _, err = ssh.NewClientConn(conn, address, config)
+	if presented == nil {
+		return nil, err
+	}
+	// The handshake fails once there are no auth methods left, or wraps the callback error, so check the key again
+	if err := check(address, conn.RemoteAddr(), presented); err != nil {
+		return nil, err
+	}
+	return presented, nil
+}
+
+// consoleHostKeys reads the keys of a dynamic instance from the cloud provider, if it supports it
+func (r *ReconcileTaskRun) consoleHostKeys(ctx context.Context, log *logr.Logger, data map[string]string, platform string, host string) []ssh.PublicKey {
+	entry, err := r.cachedPlatformConfig(log, data, platform)
+	if err != nil {
+		return nil
+	}
+	var provider cloud.CloudProvider
+	switch config := entry.config.(type) {
+	case DynamicResolver:
+		provider = config.CloudProvider
+	case DynamicHostPool:
+		provider = config.cloudProvider
+	}
+	reader, ok := provider.(cloud.HostKeyReader)
+	if !ok {
+		return nil
+	}
+	lines, err := reader.GetHostKeys(r.client, log, ctx, cloud.InstanceIdentifier(host))
+	if err != nil {
+		log.Error(err, "failed to read host keys from the cloud provider", "host", host)
+		return nil
+	}
+	keys, err := parseHostKeys(strings.Join(lines, "\n"))
+	if err != nil {
+		log.Error(err, "ignoring invalid host keys from the cloud provider", "host", host)
+		return nil
+	}
+	return keys
+}
+
+// verifyHostKey checks the host presents its pinned key, capturing the key if this is the first time the host has
+// been used. It returns the pinned keys.
+func (r *ReconcileTaskRun) verifyHostKey(ctx context.Context, log *logr.Logger, data map[string]string, platform string, host string, address string) ([]ssh.PublicKey, error) {
+	keys, err := loadPinnedHostKeys(ctx, r.client, r.operatorNamespace, data, host)
+	if err != nil {
+		return nil, err
+	}
+	captured := len(keys) == 0
+	if captured {
+		keys = r.consoleHostKeys(ctx, log, data, platform, host)
+	}
+	presented, err := r.hostKeyProbe(ctx, host, address, keys)
+	if err != nil {
+		return nil, err
+	}
+	if captured {
+		if len(keys) == 0 {
+			keys = []ssh.PublicKey{presented}
+		}
+		log.Info("pinning host key", "host", host, "fingerprint", ssh.FingerprintSHA256(presented), "audit", "true")
+		err = r.storeHostKeys(ctx, host, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// PruneHostKeys removes the keys of hosts that no longer exist. A host is only considered gone once it has been
+// missing from the host config and every platform's instances for hostKeyPruneGracePeriod, as providers don't list
+// instances that are booting or can't be reached. Nothing changes if any platform's instances can't be listed.
+func (r *ReconcileTaskRun) PruneHostKeys(ctx context.Context, log *logr.Logger) {
+	cm := v12.ConfigMap{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: HostKeysConfigMap}, &cm)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(err, "failed to read host keys")
+		}
+		return
+	}
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to prune host keys")
+		return
+	}
+	existing := map[string]bool{}
+	for name := range parseStaticHosts(data) {
+		existing[name] = true
+	}
+	for _, list := range []string{DynamicPlatforms, DynamicPoolPlatforms} {
+		for _, platform := range strings.Split(data[list], ",") {
+			if platform == "" {
+				continue
+			}
+			entry, err := r.cachedPlatformConfig(log, data, platform)
+			if err != nil {
+				log.Error(err, "failed to read platform config to prune host keys", "platform", platform)
+				return
+			}
+			var provider cloud.CloudProvider
+			var instanceTag string
+			switch config := entry.config.(type) {
+			case DynamicResolver:
+				provider, instanceTag = config.CloudProvider, config.instanceTag
+			case DynamicHostPool:
+				provider, instanceTag = config.cloudProvider, config.instanceTag
+			default:
+				continue
+			}
+			instances, err := provider.ListInstances(r.client, log, ctx, instanceTag)
+			if err != nil {
+				log.Error(err, "failed to list instances to prune host keys", "platform", platform)
+				return
+			}
+			if stopper, ok := provider.(cloud.InstanceStopper); ok {
+				stopped, err := stopper.ListStoppedInstances(r.client, log, ctx, instanceTag)
+				if err != nil {
+					log.Error(err, "failed to list stopped instances to prune host keys", "platform", platform)
+					return
+				}
+				instances = append(instances, stopped...)
+			}
+			for _, instance := range instances {
+				existing[string(instance.InstanceId)] = true
+			}
+		}
+	}
+	previous := map[string]time.Time{}
+	if value := cm.Annotations[HostKeysMissingAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &previous); err != nil {
+			log.Error(err, "ignoring invalid host keys missing annotation")
+		}
+	}
+	missing, pruned := pruneMissingHostKeys(cm.Data, existing, previous, time.Now())
+	for _, host := range pruned {
+		log.Info("removing host key of host that no longer exists", "host", host, "audit", "true")
+	}
+	if len(pruned) == 0 && reflect.DeepEqual(missing, previous) {
+		return
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	if len(missing) == 0 {
+		delete(cm.Annotations, HostKeysMissingAnnotation)
+	} else {
+		value, err := json.Marshal(missing)
+		if err != nil {
+			log.Error(err, "failed to marshal missing host keys")
+			return
+		}
+		cm.Annotations[HostKeysMissingAnnotation] = string(value)
+	}
+	err = r.client.Update(ctx, &cm)
+	if err != nil {
+		log.Error(err, "failed to prune host keys")
+	}
+}
+
+// pruneMissingHostKeys removes the keys of hosts that have been missing for hostKeyPruneGracePeriod from keys. It
+// returns when each remaining missing host was first found to be missing, and the hosts that were removed.
+func pruneMissingHostKeys(keys map[string]string, existing map[string]bool, previous map[string]time.Time, now time.Time) (map[string]time.Time, []string) {
+	missing := map[string]time.Time{}
+	pruned := []string{}
+	for host := range keys {
+		if existing[host] {
+			continue
+		}
+		since, ok := previous[host]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < hostKeyPruneGracePeriod {
+			missing[host] = since
+			continue
+		}
+		delete(keys, host)
+		pruned = append(pruned, host)
+	}
+	sort.Strings(pruned)
+	return missing, pruned
+}
@@ -34,6 +34,10 @@ func (hp HostPool) Allocate(r *ReconcileTaskRun, ctx context.Context, log *logr.
 	if err != nil {
 		return reconcile.Result{}, err
 	}
+	drained, err := r.drainedHosts(ctx)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
 	hostCount := map[string]int{}
 	for _, tr := range taskList.Items {
 		if tr.Labels[TaskTypeLabel] == "" {
@@ -61,6 +65,15 @@ func (hp HostPool) Allocate(r *ReconcileTaskRun, ctx context.Context, log *logr.
 			continue
 		}
 		hostWithOurPlatform = true
+		if !r.hostHealth.schedulable(k, time.Now()) {
+			// Tasks wait for the host to be restored, rather than failing because every host is unhealthy
+			log.Info("ignoring unhealthy host", "host", k)
+			continue
+		}
+		if drained[k] {
+			log.Info("ignoring drained host", "host", k)
+			continue
+		}
 		free := v.Concurrency - hostCount[k]
 
 		log.Info("considering host", "host", k, "freeSlots", free)
@@ -82,7 +95,6 @@ func (hp HostPool) Allocate(r *ReconcileTaskRun, ctx context.Context, log *logr.
 		//no host available
 		//add the waiting label
 		//TODO: is the requeue actually a good idea?
-		//TODO: timeout
 		tr.Labels[WaitingForPlatformLabel] = platformLabel(hp.targetPlatform)
 		return reconcile.Result{RequeueAfter: time.Minute}, r.client.Update(ctx, tr)
 	}
@@ -164,6 +176,10 @@ func (hp HostPool) Deallocate(r *ReconcileTaskRun, ctx context.Context, log *log
 				Name:  "USER",
 				Value: *v1.NewStructuredValues(selected.User),
 			},
+			{
+				Name:  "KNOWN_HOSTS",
+				Value: *v1.NewStructuredValues(r.knownHostsForStaticHost(ctx, log, selected)),
+			},
 		}
 		err = r.client.Create(ctx, &provision)
 		return err
@@ -0,0 +1,103 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CloudInterrupted records the reason the cloud instance running a task was reclaimed by the provider
+const CloudInterrupted = "build.appstudio.redhat.com/cloud-interrupted"
+
+// CheckInterruptions looks for running tasks whose cloud instance is being reclaimed by the provider, e.g. a spot
+// instance. The task gets an error in its secret and the instance is terminated, which also removes it from the pool.
+func (r *ReconcileTaskRun) CheckInterruptions(ctx context.Context, log *logr.Logger) {
+	taskList := v1.TaskRunList{}
+	err := r.client.List(ctx, &taskList, client.HasLabels{AssignedHost})
+	if err != nil {
+		log.Error(err, "failed to list task runs to check for interruptions")
+		return
+	}
+	// Pool instances are shared, so only check each one once
+	checked := map[string]string{}
+	for i := range taskList.Items {
+		tr := &taskList.Items[i]
+		if tr.Labels[TaskTypeLabel] != "" || tr.Status.CompletionTime != nil || tr.Annotations[CloudInterrupted] != "" {
+			continue
+		}
+		platform, err := extracPlatform(tr)
+		if err != nil {
+			continue
+		}
+		config, err := r.readTaskConfiguration(ctx, log, tr, platform)
+		if err != nil {
+			log.Error(err, "failed to read config to check for interruptions", "platform", platform)
+			continue
+		}
+		var provider cloud.CloudProvider
+		var instance string
+		switch c := config.(type) {
+		case DynamicResolver:
+			provider, instance = c.CloudProvider, tr.Annotations[CloudInstanceId]
+		case DynamicHostPool:
+			provider, instance = c.cloudProvider, tr.Labels[AssignedHost]
+		}
+		checker, ok := provider.(cloud.InterruptionChecker)
+		if !ok || instance == "" {
+			continue
+		}
+		msg, done := checked[instance]
+		if !done {
+			msg, err = checker.CheckInterruption(r.client, log, ctx, cloud.InstanceIdentifier(instance))
+			if err != nil {
+				log.Error(err, "failed to check instance for interruption", "instance", instance)
+				continue
+			}
+			checked[instance] = msg
+			if msg != "" {
+				log.Info("cloud instance was interrupted", "instance", instance, "reason", msg)
+				r.handleMetrics(platform, func(metrics *PlatformMetrics) {
+					metrics.instanceInterruptions.Inc()
+				})
+				err = provider.TerminateInstance(r.client, log, ctx, cloud.InstanceIdentifier(instance))
+				if err != nil {
+					log.Error(err, "failed to terminate interrupted instance", "instance", instance)
+				}
+			}
+		}
+		if msg != "" {
+			r.failInterruptedTask(ctx, log, tr, msg)
+		}
+	}
+}
+
+// failInterruptedTask puts the interruption message in the task's secret, so it is reported as the cause of the failure
+func (r *ReconcileTaskRun) failInterruptedTask(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, msg string) {
+	secretName := SecretPrefix + tr.Name
+	secret := v12.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: tr.Namespace, Name: secretName}, &secret)
+	if errors.IsNotFound(err) {
+		err = r.createErrorSecret(ctx, log, tr, secretName, msg)
+	} else if err == nil {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data["error"] = []byte(msg)
+		err = r.client.Update(ctx, &secret)
+	}
+	if err != nil {
+		log.Error(err, "failed to record interruption in task secret", "task", tr.Name)
+		return
+	}
+	r.eventRecorder.Event(tr, v12.EventTypeWarning, "CloudInstanceInterrupted", msg)
+	tr.Annotations[CloudInterrupted] = msg
+	err = r.client.Update(ctx, tr)
+	if err != nil {
+		log.Error(err, "failed to mark task as interrupted", "task", tr.Name)
+	}
+}
@@ -0,0 +1,206 @@
+package taskrun
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const MigratedFromAnnotation = "build.appstudio.redhat.com/migrated-from"
+
+// MigrateHostConfig converts the platforms defined in the host-config ConfigMap into HostPool, DynamicPlatform and
+// DynamicPoolPlatform objects. The generated objects produce exactly the same configuration as the ConfigMap, so
+// allocation behaviour does not change when the controller switches over. Nothing is done if any platform objects
+// already exist. The ConfigMap is left untouched, as it still holds the global settings.
+func MigrateHostConfig(ctx context.Context, kubeClient client.Client, operatorNamespace string, log *logr.Logger) error {
+	cm := v12.ConfigMap{}
+	err := kubeClient.Get(ctx, types.NamespacedName{Namespace: operatorNamespace, Name: HostConfig}, &cm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("no host-config ConfigMap found, nothing to migrate")
+			return nil
+		}
+		return err
+	}
+	_, found, err := readPlatformObjects(ctx, kubeClient, operatorNamespace)
+	if err != nil {
+		return err
+	}
+	if found {
+		log.Info("platform objects already exist, not migrating host-config")
+		return nil
+	}
+	objects, err := convertHostConfig(cm.Data, operatorNamespace)
+	if err != nil {
+		return err
+	}
+	// Once any platform object exists the platform keys in the ConfigMap are ignored, so every object is validated by
+	// the API server before any are created. Otherwise a rejected object would remove the platforms not yet migrated.
+	for _, obj := range objects {
+		err = kubeClient.Create(ctx, obj.DeepCopyObject().(client.Object), client.DryRunAll)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("host-config not migrated, %T %s is invalid: %w", obj, obj.GetName(), err)
+		}
+	}
+	for _, obj := range objects {
+		log.Info("creating platform object from host-config", "kind", fmt.Sprintf("%T", obj), "name", obj.GetName())
+		err = kubeClient.Create(ctx, obj)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertHostConfig builds all the objects up front so a config error does not result in a partial migration
+func convertHostConfig(data map[string]string, operatorNamespace string) ([]client.Object, error) {
+	ret := []client.Object{}
+	annotations := map[string]string{MigratedFromAnnotation: HostConfig}
+
+	for _, platform := range strings.Split(data[DynamicPlatforms], ",") {
+		if platform == "" {
+			continue
+		}
+		prefix := "dynamic." + platformLabel(platform) + "."
+		config := platformKeys(data, prefix)
+		obj := v1alpha1.DynamicPlatform{}
+		obj.Name = objectName(platform)
+		obj.Namespace = operatorNamespace
+		obj.Annotations = annotations
+		obj.Spec.Platform = platform
+		obj.Spec.Type = takeKey(config, "type")
+		obj.Spec.SshSecret = takeKey(config, "ssh-secret")
+		obj.Spec.InstanceTag = takeKey(config, "instance-tag")
+		maxInstances, err := strconv.Atoi(takeKey(config, "max-instances"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid max-instances for %s: %w", platform, err)
+		}
+		obj.Spec.MaxInstances = maxInstances
+		if timeout := takeKey(config, "allocation-timeout"); timeout != "" {
+			obj.Spec.AllocationTimeout, err = strconv.ParseInt(timeout, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allocation-timeout for %s: %w", platform, err)
+			}
+		}
+		if len(config) > 0 {
+			obj.Spec.Config = config
+		}
+		ret = append(ret, &obj)
+	}
+
+	for _, platform := range strings.Split(data[DynamicPoolPlatforms], ",") {
+		if platform == "" {
+			continue
+		}
+		prefix := "dynamic." + platformLabel(platform) + "."
+		config := platformKeys(data, prefix)
+		obj := v1alpha1.DynamicPoolPlatform{}
+		obj.Name = objectName(platform)
+		obj.Namespace = operatorNamespace
+		obj.Annotations = annotations
+		obj.Spec.Platform = platform
+		obj.Spec.Type = takeKey(config, "type")
+		obj.Spec.SshSecret = takeKey(config, "ssh-secret")
+		obj.Spec.InstanceTag = takeKey(config, "instance-tag")
+		var err error
+		for key, target := range map[string]*int{"max-instances": &obj.Spec.MaxInstances, "concurrency": &obj.Spec.Concurrency, "max-age": &obj.Spec.MaxAge} {
+			*target, err = strconv.Atoi(takeKey(config, key))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s for %s: %w", key, platform, err)
+			}
+		}
+		if len(config) > 0 {
+			obj.Spec.Config = config
+		}
+		ret = append(ret, &obj)
+	}
+
+	// Static hosts are grouped into one HostPool per platform
+	pools := map[string]*v1alpha1.HostPool{}
+	hosts := map[string]*v1alpha1.HostSpec{}
+	names := []string{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, "host.") {
+			continue
+		}
+		k = k[len("host."):]
+		pos := strings.LastIndex(k, ".")
+		if pos == -1 {
+			continue
+		}
+		name := k[0:pos]
+		host := hosts[name]
+		if host == nil {
+			host = &v1alpha1.HostSpec{Name: name}
+			hosts[name] = host
+			names = append(names, name)
+		}
+		switch k[pos+1:] {
+		case "address":
+			host.Address = v
+		case "user":
+			host.User = v
+		case "platform":
+			host.Platform = v
+		case "secret":
+			host.Secret = v
+		case "concurrency":
+			atoi, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid concurrency for host %s: %w", name, err)
+			}
+			host.Concurrency = atoi
+		case HostKeyConfig:
+			host.HostKey = v
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		host := hosts[name]
+		if host.Platform == "" {
+			// Hosts without a platform can never be allocated
+			continue
+		}
+		pool := pools[host.Platform]
+		if pool == nil {
+			pool = &v1alpha1.HostPool{}
+			pool.Name = objectName(host.Platform)
+			pool.Namespace = operatorNamespace
+			pool.Annotations = annotations
+			pools[host.Platform] = pool
+			ret = append(ret, pool)
+		}
+		pool.Spec.Hosts = append(pool.Spec.Hosts, *host)
+	}
+	return ret, nil
+}
+
+// platformKeys returns all keys with the given prefix, with the prefix removed
+func platformKeys(data map[string]string, prefix string) map[string]string {
+	ret := map[string]string{}
+	for k, v := range data {
+		if strings.HasPrefix(k, prefix) {
+			ret[k[len(prefix):]] = v
+		}
+	}
+	return ret
+}
+
+func takeKey(config map[string]string, key string) string {
+	ret := config[key]
+	delete(config, key)
+	return ret
+}
+
+// objectName turns a platform into a valid object name, e.g. linux/x86_64 becomes linux-x86-64
+func objectName(platform string) string {
+	return strings.ReplaceAll(strings.ToLower(platformLabel(platform)), "_", "-")
+}
@@ -0,0 +1,208 @@
+package taskrun
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// OrphanGracePeriod is how long, in minutes, a dynamic instance can exist without a task using it before it is
+	// terminated
+	OrphanGracePeriod = "orphan-grace-period"
+	// OrphanDryRun only reports orphaned instances, rather than terminating them
+	OrphanDryRun = "orphan-dry-run"
+	// MaxInstanceLifetime is the age, in minutes, at which a dynamic instance is terminated even if a task is still
+	// using it. It can also be set per platform. Zero, the default, means there is no limit.
+	MaxInstanceLifetime = "max-instance-lifetime"
+
+	ReasonOrphaned = "orphaned"
+	ReasonExpired  = "expired"
+)
+
+type orphanSettings struct {
+	gracePeriod time.Duration
+	dryRun      bool
+	maxLifetime time.Duration
+}
+
+// readOrphanSettings reads the reaper settings for a platform, invalid values are logged and the default used
+func readOrphanSettings(log *logr.Logger, data map[string]string, platform string) orphanSettings {
+	ret := orphanSettings{gracePeriod: time.Minute * 30, dryRun: data[OrphanDryRun] == "true"}
+	if value := data[OrphanGracePeriod]; value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes <= 0 {
+			log.Error(err, "unable to parse orphan grace period", "value", value)
+		} else {
+			ret.gracePeriod = time.Minute * time.Duration(minutes)
+		}
+	}
+	value := data["dynamic."+platformLabel(platform)+"."+MaxInstanceLifetime]
+	if value == "" {
+		value = data[MaxInstanceLifetime]
+	}
+	if value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil {
+			log.Error(err, "unable to parse max instance lifetime", "value", value)
+		} else {
+			ret.maxLifetime = time.Minute * time.Duration(minutes)
+		}
+	}
+	return ret
+}
+
+// ReapOrphanedInstances terminates dynamic instances that no task refers to, which happens if the controller restarts
+// after launching an instance but before recording it on the task, or if a task is force deleted. Instances older than
+// the maximum lifetime are terminated whether they are in use or not. Dynamic pool instances are never reaped, as they
+// are shared and are retired by max-age, even if a dynamic platform has the same instance tag.
+func (r *ReconcileTaskRun) ReapOrphanedInstances(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to reap orphaned instances")
+		return
+	}
+	assigned, err := r.assignedInstances(ctx)
+	if err != nil {
+		log.Error(err, "failed to list tasks to reap orphans")
+		return
+	}
+	poolInstances, err := r.dynamicPoolInstances(ctx, log, data)
+	if err != nil {
+		log.Error(err, "failed to list dynamic pool instances to reap orphans")
+		return
+	}
+	for _, platform := range strings.Split(data[DynamicPlatforms], ",") {
+		if platform == "" {
+			continue
+		}
+		entry, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			log.Error(err, "failed to read platform config to reap orphaned instances", "platform", platform)
+			continue
+		}
+		if resolver, ok := entry.config.(DynamicResolver); ok {
+			resolver.reapOrphanedInstances(r, ctx, log, readOrphanSettings(log, data, platform), assigned, poolInstances)
+		}
+	}
+}
+
+// assignedInstances returns the task using each instance or host. Every task is checked, not just those of one
+// platform, as platforms can share an instance tag and so list each other's instances. Tasks are read directly from the
+// API server, as the cache may not have seen an instance that was just recorded on a task yet.
+func (r *ReconcileTaskRun) assignedInstances(ctx context.Context) (map[string]*v1.TaskRun, error) {
+	var reader client.Reader = r.client
+	if r.apiReader != nil {
+		reader = r.apiReader
+	}
+	taskList := v1.TaskRunList{}
+	err := reader.List(ctx, &taskList)
+	if err != nil {
+		return nil, err
+	}
+	assigned := map[string]*v1.TaskRun{}
+	for i := range taskList.Items {
+		tr := &taskList.Items[i]
+		if id := tr.Annotations[CloudInstanceId]; id != "" {
+			assigned[id] = tr
+		}
+		if id := tr.Labels[AssignedHost]; id != "" {
+			assigned[id] = tr
+		}
+	}
+	return assigned, nil
+}
+
+// dynamicPoolInstances returns the instances of every dynamic pool
+func (r *ReconcileTaskRun) dynamicPoolInstances(ctx context.Context, log *logr.Logger, data map[string]string) (map[string]bool, error) {
+	ret := map[string]bool{}
+	for _, platform := range strings.Split(data[DynamicPoolPlatforms], ",") {
+		if platform == "" {
+			continue
+		}
+		entry, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			return nil, err
+		}
+		pool, ok := entry.config.(DynamicHostPool)
+		if !ok {
+			continue
+		}
+		instances, err := pool.cloudProvider.ListInstances(r.client, log, ctx, pool.instanceTag)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			ret[string(instance.InstanceId)] = true
+		}
+	}
+	return ret, nil
+}
+
+func (r DynamicResolver) reapOrphanedInstances(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger, settings orphanSettings, assigned map[string]*v1.TaskRun, poolInstances map[string]bool) {
+	instances, err := r.CloudProvider.ListInstances(taskRun.client, log, ctx, r.instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list instances to reap orphans", "platform", r.platform)
+		return
+	}
+	gracePeriod := settings.gracePeriod
+	if r.minReady > 0 {
+		// Warm instances are unassigned until they are claimed, and are recycled by the warm pool
+		gracePeriod += r.warmTTL
+	}
+	now := time.Now()
+	for _, instance := range instances {
+		if poolInstances[string(instance.InstanceId)] {
+			continue
+		}
+		tr := assigned[string(instance.InstanceId)]
+		var reason, msg string
+		if settings.maxLifetime > 0 && instance.StartTime.Add(settings.maxLifetime).Before(now) {
+			reason = ReasonExpired
+			msg = fmt.Sprintf("instance %s of platform %s was launched at %s and is past the maximum lifetime of %s", instance.InstanceId, r.platform, instance.StartTime.Format(time.RFC3339), settings.maxLifetime)
+		} else if tr == nil && instance.StartTime.Add(gracePeriod).Before(now) {
+			reason = ReasonOrphaned
+			msg = fmt.Sprintf("instance %s of platform %s was launched at %s and is not used by any task", instance.InstanceId, r.platform, instance.StartTime.Format(time.RFC3339))
+		} else {
+			continue
+		}
+		if settings.dryRun {
+			log.Info("dry run, not terminating instance", "instance", instance.InstanceId, "reason", reason)
+			taskRun.recordReaperEvent(ctx, log, tr, v12.EventTypeNormal, "InstanceReapDryRun", msg+", it would be terminated")
+			continue
+		}
+		log.Info("terminating instance", "instance", instance.InstanceId, "reason", reason)
+		err = r.CloudProvider.TerminateInstance(taskRun.client, log, ctx, instance.InstanceId)
+		if err != nil {
+			log.Error(err, "failed to terminate instance", "instance", instance.InstanceId)
+			continue
+		}
+		taskRun.recordReaperEvent(ctx, log, tr, v12.EventTypeWarning, "InstanceReaped", msg+", it was terminated")
+		taskRun.handleMetrics(r.platform, func(metrics *PlatformMetrics) {
+			metrics.reapedInstances.WithLabelValues(reason).Inc()
+		})
+	}
+}
+
+// recordReaperEvent records the event against the task using the instance, or the host config if there isn't one
+func (r *ReconcileTaskRun) recordReaperEvent(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, eventType string, reason string, msg string) {
+	var obj runtime.Object = tr
+	if tr == nil {
+		cm := v12.ConfigMap{}
+		err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: HostConfig}, &cm)
+		if err != nil {
+			log.Error(err, "unable to record event", "message", msg)
+			return
+		}
+		obj = &cm
+	}
+	r.eventRecorder.Event(obj, eventType, reason, msg)
+}
@@ -0,0 +1,143 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TaskPriorityLabel can be set as a label or annotation on a TaskRun to set its priority directly, higher values
+	// are allocated a host first
+	TaskPriorityLabel = "build.appstudio.redhat.com/priority"
+	// PriorityRulePrefix starts the keys that map TaskRun labels to a priority, in the form priority.<name>.<setting>.
+	// Tekton copies the labels of a PipelineRun to its TaskRuns, so these can match PipelineRun labels.
+	PriorityRulePrefix = "priority."
+	// PriorityAgingInterval is how many minutes a task has to wait to go up one priority level, so low priority tasks
+	// are not starved forever
+	PriorityAgingInterval = "priority-aging-interval"
+)
+
+type priorityRule struct {
+	name     string
+	selector labels.Selector
+	value    int
+}
+
+type priorityConfig struct {
+	// rules are sorted highest value first, the first that matches is used
+	rules []priorityRule
+	aging time.Duration
+}
+
+// parsePriorityConfig reads the priority rules from the host config. Invalid rules are logged and skipped.
+func parsePriorityConfig(log *logr.Logger, data map[string]string) priorityConfig {
+	ret := priorityConfig{aging: time.Minute * 10}
+	if value := data[PriorityAgingInterval]; value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes <= 0 {
+			log.Error(err, "unable to parse priority aging interval", "value", value)
+		} else {
+			ret.aging = time.Minute * time.Duration(minutes)
+		}
+	}
+	names := map[string]bool{}
+	for k := range data {
+		if strings.HasPrefix(k, PriorityRulePrefix) {
+			if pos := strings.LastIndex(k, "."); pos > len(PriorityRulePrefix) {
+				names[k[len(PriorityRulePrefix):pos]] = true
+			}
+		}
+	}
+	for name := range names {
+		prefix := PriorityRulePrefix + name + "."
+		selector, err := labels.Parse(data[prefix+"selector"])
+		if err != nil {
+			log.Error(err, "invalid priority selector, ignoring rule", "rule", name)
+			continue
+		}
+		value, err := strconv.Atoi(data[prefix+"value"])
+		if err != nil {
+			log.Error(err, "invalid priority value, ignoring rule", "rule", name)
+			continue
+		}
+		ret.rules = append(ret.rules, priorityRule{name: name, selector: selector, value: value})
+	}
+	sort.Slice(ret.rules, func(i, j int) bool {
+		if ret.rules[i].value != ret.rules[j].value {
+			return ret.rules[i].value > ret.rules[j].value
+		}
+		return ret.rules[i].name < ret.rules[j].name
+	})
+	return ret
+}
+
+// basePriority is the priority set on the task, or by the first rule that matches its labels, or zero
+func (p priorityConfig) basePriority(tr *v1.TaskRun) int {
+	for _, value := range []string{tr.Labels[TaskPriorityLabel], tr.Annotations[TaskPriorityLabel]} {
+		if value == "" {
+			continue
+		}
+		if priority, err := strconv.Atoi(value); err == nil {
+			return priority
+		}
+	}
+	for _, rule := range p.rules {
+		if rule.selector.Matches(labels.Set(tr.Labels)) {
+			return rule.value
+		}
+	}
+	return 0
+}
+
+// effectivePriority adds one for every aging interval the task has been waiting
+func (p priorityConfig) effectivePriority(tr *v1.TaskRun, now time.Time) int {
+	priority := p.basePriority(tr)
+	if waited := now.Sub(tr.CreationTimestamp.Time); waited > 0 && !tr.CreationTimestamp.IsZero() {
+		priority += int(waited / p.aging)
+	}
+	return priority
+}
+
+// before orders waiting tasks, highest effective priority first and then oldest first
+func (p priorityConfig) before(a *v1.TaskRun, b *v1.TaskRun, now time.Time) bool {
+	if pa, pb := p.effectivePriority(a, now), p.effectivePriority(b, now); pa != pb {
+		return pa > pb
+	}
+	return a.CreationTimestamp.Time.Before(b.CreationTimestamp.Time)
+}
+
+// higherPriorityWaiting returns true if another task with a higher priority is waiting for the platform, and could be
+// given a host. Warm instances are kept for these tasks, rather than being handed to whichever task happens to be
+// reconciled first.
+func (r *ReconcileTaskRun) higherPriorityWaiting(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, platform string) (bool, error) {
+	taskList := v1.TaskRunList{}
+	err := r.client.List(ctx, &taskList, client.MatchingLabels{WaitingForPlatformLabel: platformLabel(platform)})
+	if err != nil || len(taskList.Items) == 0 {
+		return false, err
+	}
+	waiting := []v1.TaskRun{}
+	for _, i := range taskList.Items {
+		if i.Namespace != tr.Namespace || i.Name != tr.Name {
+			waiting = append(waiting, i)
+		}
+	}
+	// Tasks from namespaces at their quota are skipped, as they can't use the instance
+	next, err := r.nextWaitingTask(ctx, log, platform, waiting)
+	if err != nil || next == nil {
+		return false, err
+	}
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		return false, err
+	}
+	priorities := parsePriorityConfig(log, data)
+	now := time.Now()
+	return priorities.effectivePriority(next, now) > priorities.effectivePriority(tr, now), nil
+}
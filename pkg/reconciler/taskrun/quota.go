@@ -0,0 +1,274 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NamespaceQuotaPrefix starts the keys that limit how many hosts each namespace can use at once, and how waiting
+// tasks are shared out between namespaces, in the form namespace-quota.<name>.<setting>
+const NamespaceQuotaPrefix = "namespace-quota."
+
+// namespaceQuota applies to every namespace matched by the regex. The limit is per namespace and platform, so two
+// namespaces matched by the same quota can each use max-hosts hosts.
+type namespaceQuota struct {
+	name       string
+	namespaces *regexp.Regexp
+	// platforms the quota applies to, all platforms if it is empty
+	platforms map[string]bool
+	// maxHosts is the number of hosts a namespace can use at once, zero is unlimited
+	maxHosts int
+	// weight is the share of the hosts a namespace gets relative to other namespaces when tasks are waiting
+	weight int
+}
+
+// parseNamespaceQuotas reads the quotas from the host config in name order, the first that matches a namespace is
+// used. Invalid quotas are logged and skipped.
+func parseNamespaceQuotas(log *logr.Logger, data map[string]string) []namespaceQuota {
+	names := map[string]bool{}
+	for k := range data {
+		if !strings.HasPrefix(k, NamespaceQuotaPrefix) {
+			continue
+		}
+		if pos := strings.LastIndex(k, "."); pos > len(NamespaceQuotaPrefix) {
+			names[k[len(NamespaceQuotaPrefix):pos]] = true
+		}
+	}
+	ret := []namespaceQuota{}
+	for name := range names {
+		prefix := NamespaceQuotaPrefix + name + "."
+		namespaces, err := regexp.Compile("^(?:" + data[prefix+"namespaces"] + ")$")
+		if err != nil || data[prefix+"namespaces"] == "" {
+			log.Error(err, "invalid namespace quota namespaces, ignoring quota", "quota", name)
+			continue
+		}
+		quota := namespaceQuota{name: name, namespaces: namespaces, platforms: map[string]bool{}, weight: 1}
+		for _, platform := range strings.Split(data[prefix+"platforms"], ",") {
+			if platform = strings.TrimSpace(platform); platform != "" {
+				quota.platforms[platform] = true
+			}
+		}
+		if value := data[prefix+"max-hosts"]; value != "" {
+			quota.maxHosts, err = strconv.Atoi(value)
+			if err != nil {
+				log.Error(err, "unable to parse namespace quota max hosts, ignoring quota", "quota", name)
+				continue
+			}
+		}
+		if value := data[prefix+"weight"]; value != "" {
+			quota.weight, err = strconv.Atoi(value)
+			if err != nil || quota.weight <= 0 {
+				log.Error(err, "unable to parse namespace quota weight, using 1", "quota", name)
+				quota.weight = 1
+			}
+		}
+		ret = append(ret, quota)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+	return ret
+}
+
+// quotaFor returns the quota for the namespace and platform, or nil if it is unlimited with the default weight
+func quotaFor(quotas []namespaceQuota, namespace string, platform string) *namespaceQuota {
+	for i := range quotas {
+		quota := &quotas[i]
+		if (len(quota.platforms) == 0 || quota.platforms[platform]) && quota.namespaces.MatchString(namespace) {
+			return quota
+		}
+	}
+	return nil
+}
+
+// usesHost returns true for user tasks that have a host, or are having one launched for them
+func usesHost(tr *v1.TaskRun, platform string) bool {
+	if tr.Labels[TaskTypeLabel] != "" || (tr.Labels[AssignedHost] == "" && tr.Annotations[CloudInstanceId] == "") {
+		return false
+	}
+	taskPlatform, err := extracPlatform(tr)
+	return err == nil && taskPlatform == platform
+}
+
+// namespaceQuotaReached checks if the namespace of the task is already using all the hosts its quota allows
+func (r *ReconcileTaskRun) namespaceQuotaReached(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, platform string) (bool, error) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		return false, err
+	}
+	quota := quotaFor(parseNamespaceQuotas(log, data), tr.Namespace, platform)
+	if quota == nil || quota.maxHosts == 0 {
+		return false, nil
+	}
+	taskList := v1.TaskRunList{}
+	err = r.client.List(ctx, &taskList, client.InNamespace(tr.Namespace))
+	if err != nil {
+		return false, err
+	}
+	inUse := 0
+	for i := range taskList.Items {
+		if taskList.Items[i].Name != tr.Name && usesHost(&taskList.Items[i], platform) {
+			inUse++
+		}
+	}
+	if inUse >= quota.maxHosts {
+		log.Info("namespace is using all the hosts allowed by its quota", "quota", quota.name, "hosts", inUse)
+		return true, nil
+	}
+	return false, nil
+}
+
+// waitForQuota queues the task until one of the hosts its namespace is using is released
+func (r *ReconcileTaskRun) waitForQuota(ctx context.Context, tr *v1.TaskRun, platform string) (reconcile.Result, error) {
+	if tr.Labels[WaitingForPlatformLabel] == platformLabel(platform) {
+		// Already waiting, nothing has changed
+		return reconcile.Result{}, nil
+	}
+	tr.Labels[WaitingForPlatformLabel] = platformLabel(platform)
+	return reconcile.Result{}, r.client.Update(ctx, tr)
+}
+
+// tenantShare is the state of a namespace used to decide which waiting task gets the next host
+type tenantShare struct {
+	inUse    int
+	weight   int
+	maxHosts int
+	// next is the waiting task of the namespace that should go first
+	next *v1.TaskRun
+}
+
+// nextWaitingTask picks the waiting task to get the next free host. The task with the highest priority goes first.
+// Between tasks of the same priority each namespace gets a share of the hosts in proportion to its weight, so the
+// namespace using the smallest share goes first, and within a namespace the oldest task goes first. Namespaces that are
+// at their quota are skipped, as their tasks would just go back to waiting.
+func (r *ReconcileTaskRun) nextWaitingTask(ctx context.Context, log *logr.Logger, platform string, waiting []v1.TaskRun) (*v1.TaskRun, error) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		return nil, err
+	}
+	quotas := parseNamespaceQuotas(log, data)
+	priorities := parsePriorityConfig(log, data)
+	now := time.Now()
+	tenants := map[string]*tenantShare{}
+	for i := range waiting {
+		tr := &waiting[i]
+		tenant := tenants[tr.Namespace]
+		if tenant == nil {
+			tenant = &tenantShare{weight: 1}
+			if quota := quotaFor(quotas, tr.Namespace, platform); quota != nil {
+				tenant.weight = quota.weight
+				tenant.maxHosts = quota.maxHosts
+			}
+			tenants[tr.Namespace] = tenant
+		}
+		if tenant.next == nil || priorities.before(tr, tenant.next, now) {
+			tenant.next = tr
+		}
+	}
+	if len(tenants) > 1 || hasLimitedTenant(tenants) {
+		taskList := v1.TaskRunList{}
+		err = r.client.List(ctx, &taskList)
+		if err != nil {
+			return nil, err
+		}
+		for i := range taskList.Items {
+			tr := &taskList.Items[i]
+			if tenant := tenants[tr.Namespace]; tenant != nil && usesHost(tr, platform) {
+				tenant.inUse++
+			}
+		}
+	}
+	var next *tenantShare
+	for _, tenant := range tenants {
+		if tenant.maxHosts > 0 && tenant.inUse >= tenant.maxHosts {
+			continue
+		}
+		if next == nil || fairShareBefore(tenant, next, priorities, now) {
+			next = tenant
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	return next.next, nil
+}
+
+func hasLimitedTenant(tenants map[string]*tenantShare) bool {
+	for _, tenant := range tenants {
+		if tenant.maxHosts > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fairShareBefore compares the priority of the next task of each namespace, then inUse/weight without dividing, and
+// then the age of the next task
+func fairShareBefore(a *tenantShare, b *tenantShare, priorities priorityConfig, now time.Time) bool {
+	if pa, pb := priorities.effectivePriority(a.next, now), priorities.effectivePriority(b.next, now); pa != pb {
+		return pa > pb
+	}
+	if lhs, rhs := a.inUse*b.weight, b.inUse*a.weight; lhs != rhs {
+		return lhs < rhs
+	}
+	return a.next.CreationTimestamp.Time.Before(b.next.CreationTimestamp.Time)
+}
+
+// UpdateNamespaceUsage publishes the number of hosts each namespace is using, and the number of tasks it has waiting
+func (r *ReconcileTaskRun) UpdateNamespaceUsage(ctx context.Context, log *logr.Logger) {
+	taskList := v1.TaskRunList{}
+	err := r.client.List(ctx, &taskList)
+	if err != nil {
+		log.Error(err, "failed to list task runs to update namespace usage")
+		return
+	}
+	inUse := map[string]map[string]int{}
+	waiting := map[string]map[string]int{}
+	for i := range taskList.Items {
+		tr := &taskList.Items[i]
+		if tr.Labels[TaskTypeLabel] != "" {
+			continue
+		}
+		platform, err := extracPlatform(tr)
+		if err != nil {
+			continue
+		}
+		if usesHost(tr, platform) {
+			if inUse[platform] == nil {
+				inUse[platform] = map[string]int{}
+			}
+			inUse[platform][tr.Namespace]++
+		} else if tr.Labels[WaitingForPlatformLabel] != "" {
+			if waiting[platform] == nil {
+				waiting[platform] = map[string]int{}
+			}
+			waiting[platform][tr.Namespace]++
+		}
+	}
+	r.configLock.Lock()
+	platforms := []string{}
+	for platform := range r.platformMetrics {
+		platforms = append(platforms, platform)
+	}
+	r.configLock.Unlock()
+	for _, platform := range platforms {
+		r.handleMetrics(platform, func(metrics *PlatformMetrics) {
+			metrics.namespaceHosts.Reset()
+			for namespace, count := range inUse[platform] {
+				metrics.namespaceHosts.WithLabelValues(namespace).Set(float64(count))
+			}
+			metrics.namespaceWaitingTasks.Reset()
+			for namespace, count := range waiting[platform] {
+				metrics.namespaceWaitingTasks.WithLabelValues(namespace).Set(float64(count))
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package taskrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	v12 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+// ConfigGenerationLabel records the config generation a task was allocated with, so it is deallocated with the
+// same settings even if the config changes while it is running
+const ConfigGenerationLabel = "build.appstudio.redhat.com/config-generation"
+
+type platformConfigEntry struct {
+	config     PlatformConfig
+	generation string
+}
+
+// configGeneration hashes all the config keys that affect the given platform, so unrelated changes do not cause a
+// platform to be rebuilt
+func configGeneration(data map[string]string, platform string) string {
+	keys := []string{}
+	prefix := "dynamic." + platformLabel(platform) + "."
+	hosts := map[string]bool{}
+	for k, v := range data {
+		if strings.HasPrefix(k, "host.") && strings.HasSuffix(k, ".platform") && v == platform {
+			hosts[k[0:len(k)-len("platform")]] = true
+		}
+	}
+	for k := range data {
+		if strings.HasPrefix(k, prefix) || k == "instance-tag" {
+			keys = append(keys, k)
+		} else if pos := strings.LastIndex(k, "."); strings.HasPrefix(k, "host.") && pos != -1 && hosts[k[0:pos+1]] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, list := range []string{DynamicPlatforms, DynamicPoolPlatforms} {
+		for _, p := range strings.Split(data[list], ",") {
+			if p == platform {
+				hash.Write([]byte(list + "\n"))
+			}
+		}
+	}
+	for _, k := range keys {
+		hash.Write([]byte(k + "=" + data[k] + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[0:12]
+}
+
+// cachedPlatformConfig returns the cached config for the platform, replacing it if the generation has changed.
+// The config being replaced is retired rather than discarded, as running tasks still need it to deallocate.
+func (r *ReconcileTaskRun) cachedPlatformConfig(log *logr.Logger, data map[string]string, targetPlatform string) (*platformConfigEntry, error) {
+	generation := configGeneration(data, targetPlatform)
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	existing := r.platformConfig[targetPlatform]
+	if existing != nil && existing.generation == generation {
+		return existing, nil
+	}
+	config, err := r.buildPlatformConfig(log, data, targetPlatform)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := r.registerMetrics(targetPlatform)
+	if err != nil {
+		return nil, err
+	}
+	r.platformMetrics[targetPlatform] = metrics
+	entry := &platformConfigEntry{config: config, generation: generation}
+	r.platformConfig[targetPlatform] = entry
+	metrics.configGeneration.Reset()
+	metrics.configGeneration.WithLabelValues(generation).Set(1)
+	if existing != nil {
+		r.retiredConfig[targetPlatform+"/"+existing.generation] = existing.config
+		log.Info("platform configuration reloaded", "platform", targetPlatform, "oldGeneration", existing.generation, "generation", generation)
+		ref := &v12.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: r.operatorNamespace, Name: HostConfig}
+		r.eventRecorder.Eventf(ref, v12.EventTypeNormal, "PlatformConfigReloaded", "platform %s is now running config generation %s (was %s)", targetPlatform, generation, existing.generation)
+	}
+	return entry, nil
+}
+
+// readTaskConfiguration returns the config a task was allocated with, which may since have been retired
+func (r *ReconcileTaskRun) readTaskConfiguration(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, targetPlatform string) (PlatformConfig, error) {
+	entry, err := r.readConfigurationEntry(ctx, log, targetPlatform, tr.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	generation := tr.Labels[ConfigGenerationLabel]
+	if generation == "" || generation == entry.generation {
+		return entry.config, nil
+	}
+	r.configLock.Lock()
+	retired := r.retiredConfig[targetPlatform+"/"+generation]
+	r.configLock.Unlock()
+	if retired == nil {
+		// The controller has restarted since the task was allocated, the current config is the best we have
+		log.Info("config generation for task is no longer available, using current config", "generation", generation)
+		return entry.config, nil
+	}
+	return retired, nil
+}
+
+// pruneRetiredConfig discards a retired config once no tasks other than the one just deallocated are using it
+func (r *ReconcileTaskRun) pruneRetiredConfig(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, targetPlatform string, generation string) {
+	r.configLock.Lock()
+	_, ok := r.retiredConfig[targetPlatform+"/"+generation]
+	r.configLock.Unlock()
+	if !ok {
+		return
+	}
+	taskList := v1.TaskRunList{}
+	err := r.client.List(ctx, &taskList, client.MatchingLabels{ConfigGenerationLabel: generation})
+	if err != nil {
+		log.Error(err, "failed to list tasks using retired config")
+		return
+	}
+	for _, i := range taskList.Items {
+		if i.Name != tr.Name || i.Namespace != tr.Namespace {
+			return
+		}
+	}
+	log.Info("discarding retired platform configuration", "platform", targetPlatform, "generation", generation)
+	r.configLock.Lock()
+	delete(r.retiredConfig, targetPlatform+"/"+generation)
+	r.configLock.Unlock()
+}
+
+// RefreshPlatformConfig rebuilds the config of any platform that has changed since it was last read
+func (r *ReconcileTaskRun) RefreshPlatformConfig(ctx context.Context, log *logr.Logger) error {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		return err
+	}
+	r.configLock.Lock()
+	platforms := []string{}
+	for platform := range r.platformConfig {
+		platforms = append(platforms, platform)
+	}
+	r.configLock.Unlock()
+	sort.Strings(platforms)
+	var lastErr error
+	for _, platform := range platforms {
+		_, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			log.Error(err, "failed to reload platform configuration, keeping existing config", "platform", platform)
+			lastErr = fmt.Errorf("failed to reload platform %s: %w", platform, err)
+		}
+	}
+	return lastErr
+}
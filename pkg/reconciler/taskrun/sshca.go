@@ -0,0 +1,113 @@
+package taskrun
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SshCaSecret is the name of a Secret in the operator namespace with an SSH CA key, ca-key. If it is set hosts
+	// provisioned by the controller (provision-mode ssh) trust the CA for build users, and each task gets a short-lived
+	// certificate instead of an authorized key. To rotate the CA move the old key to previous-ca-key, which hosts keep
+	// trusting, until every certificate signed by it has expired.
+	SshCaSecret = "ssh-ca-secret"
+	// SshCertValidity is how long a build certificate is valid in minutes, it can be set for a single platform with
+	// ssh-cert-validity.<platform>
+	SshCertValidity = "ssh-cert-validity"
+
+	SshCaKey         = "ca-key"
+	SshPreviousCaKey = "previous-ca-key"
+
+	defaultSshCertValidity = 240
+	// sshCertSkew allows for the clock of the host being behind the controller
+	sshCertSkew = time.Minute * 5
+)
+
+// userCA signs certificates for build users
+type userCA struct {
+	signer ssh.Signer
+	// trusted are the CA keys hosts trust, the current key and the previous one while it is being rotated
+	trusted  []ssh.PublicKey
+	validity time.Duration
+}
+
+func sshCertValidity(data map[string]string, platform string) time.Duration {
+	value := data[SshCertValidity+"."+platformLabel(platform)]
+	if value == "" {
+		value = data[SshCertValidity]
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes <= 0 {
+		minutes = defaultSshCertValidity
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// loadUserCA reads the CA from its Secret, it is read for every task so a rotated key is used straight away.
+// It returns nil if no CA is configured.
+func (r *ReconcileTaskRun) loadUserCA(ctx context.Context, data map[string]string, platform string) (*userCA, error) {
+	name := data[SshCaSecret]
+	if name == "" {
+		return nil, nil
+	}
+	secret := v12.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: name}, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH CA secret %s: %w", name, err)
+	}
+	signer, err := ssh.ParsePrivateKey(secret.Data[SshCaKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s in SSH CA secret %s: %w", SshCaKey, name, err)
+	}
+	ret := userCA{signer: signer, trusted: []ssh.PublicKey{signer.PublicKey()}, validity: sshCertValidity(data, platform)}
+	if previous := secret.Data[SshPreviousCaKey]; len(previous) > 0 {
+		previousSigner, err := ssh.ParsePrivateKey(previous)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s in SSH CA secret %s: %w", SshPreviousCaKey, name, err)
+		}
+		ret.trusted = append(ret.trusted, previousSigner.PublicKey())
+	}
+	return &ret, nil
+}
+
+// trustedKeys is the content of the TrustedUserCAKeys file on the hosts
+func (c *userCA) trustedKeys() string {
+	keys := []string{}
+	for _, key := range c.trusted {
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	return strings.Join(keys, "\n")
+}
+
+// issue signs a certificate that lets the key log in as the user, and nobody else, until the validity runs out
+func (c *userCA) issue(key ssh.PublicKey, user string, keyId string, now time.Time) (*ssh.Certificate, error) {
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          uint64(serial[0])<<56 | uint64(serial[1])<<48 | uint64(serial[2])<<40 | uint64(serial[3])<<32 | uint64(serial[4])<<24 | uint64(serial[5])<<16 | uint64(serial[6])<<8 | uint64(serial[7]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyId,
+		ValidPrincipals: []string{user},
+		ValidAfter:      uint64(now.Add(-sshCertSkew).Unix()),
+		ValidBefore:     uint64(now.Add(c.validity).Unix()),
+		Permissions: ssh.Permissions{Extensions: map[string]string{
+			"permit-pty":             "",
+			"permit-port-forwarding": "",
+		}},
+	}
+	err := cert.SignCert(rand.Reader, c.signer)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
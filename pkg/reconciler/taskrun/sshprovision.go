@@ -0,0 +1,464 @@
+package taskrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //#nosec G501 -- only used to derive the same user name as the clean-shared-host task
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"golang.org/x/crypto/ssh"
+	"io"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProvisionMode selects how build users are created on hosts. tekton, the default, runs the provision-shared-host
+	// task, ssh has the controller connect to the host itself. It can be set for a single platform with
+	// provision-mode.<platform>, e.g. provision-mode.linux-arm64.
+	ProvisionMode       = "provision-mode"
+	ProvisionModeTekton = "tekton"
+	ProvisionModeSsh    = "ssh"
+
+	// SshProvisionAnnotation records the host a user task is being provisioned on, so provisioning can be started again
+	// if the controller restarts before it has finished checking the host key, or provisioning the host over SSH
+	SshProvisionAnnotation = "build.appstudio.redhat.com/ssh-provision"
+
+	// OtpTlsSecret holds the certificate of the OTP server, if it exists build keys are stored in the OTP server
+	// rather than in the task secret
+	OtpTlsSecret = "otp-tls-secrets"
+
+	// sshProvisionWorkers is the number of hosts the controller provisions at once, other hosts queue for a worker
+	sshProvisionWorkers = 10
+)
+
+// serviceAccountTokenFile is the token the controller authenticates to the OTP server with
+var serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// provisionScript creates the build user and authorizes its key, it is safe to run more than once for the same user
+const provisionScript = `set -eu
+sudo dnf install podman -y
+id -u %[1]s >/dev/null 2>&1 || sudo useradd -m %[1]s -p %[2]s
+sudo su %[1]s -c 'mkdir -p /home/%[1]s/.ssh /home/%[1]s/build'
+echo '%[3]s' | sudo tee /home/%[1]s/.ssh/authorized_keys >/dev/null
+sudo chown %[1]s /home/%[1]s/.ssh/authorized_keys
+sudo chmod 0600 /home/%[1]s/.ssh/authorized_keys
+sudo restorecon -FRvv /home/%[1]s/.ssh
+`
+
+// caProvisionScript creates the build user, and makes sshd trust the user CA, so no key is stored on the host
+const caProvisionScript = `set -eu
+sudo dnf install podman -y
+id -u %[1]s >/dev/null 2>&1 || sudo useradd -m %[1]s -p %[2]s
+sudo su %[1]s -c 'mkdir -p /home/%[1]s/build'
+echo '%[3]s' | sudo tee /etc/ssh/multi-platform-user-ca.pub >/dev/null
+if [ ! -f /etc/ssh/sshd_config.d/50-multi-platform-user-ca.conf ]; then
+  echo 'TrustedUserCAKeys /etc/ssh/multi-platform-user-ca.pub' | sudo tee /etc/ssh/sshd_config.d/50-multi-platform-user-ca.conf >/dev/null
+  sudo systemctl reload sshd
+fi
+`
+
+func provisionMode(data map[string]string, platform string) string {
+	if mode := data[ProvisionMode+"."+platformLabel(platform)]; mode != "" {
+		return mode
+	}
+	if mode := data[ProvisionMode]; mode != "" {
+		return mode
+	}
+	return ProvisionModeTekton
+}
+
+// sshProvisionJob is everything needed to provision a host for a user task
+type sshProvisionJob struct {
+	Platform string `json:"platform"`
+	// Host is the assigned host, the host name or instance id
+	Host      string `json:"host"`
+	Address   string `json:"address"`
+	User      string `json:"user"`
+	SshSecret string `json:"sshSecret"`
+	// namespace, task and secret are those of the user task
+	namespace  string
+	taskRun    string
+	secretName string
+}
+
+type provisionedUser struct {
+	name string
+	// key is the PEM encoded private key of the user
+	key []byte
+	// cert is the certificate for the key in authorized keys format, if the user CA is used
+	cert []byte
+}
+
+// provisionCredentials are what the controller needs to provision a host
+type provisionCredentials struct {
+	// masterKey is the private key of the privileged user on the host
+	masterKey []byte
+	// ca signs a certificate for the build user, if one is configured
+	ca *userCA
+	// hostKeys are the pinned keys the host must present
+	hostKeys []ssh.PublicKey
+}
+
+// sshProvisioner runs provisioning jobs in a bounded pool of goroutines
+type sshProvisioner struct {
+	lock     sync.Mutex
+	inFlight map[string]bool
+	slots    chan struct{}
+	// provision creates the build user on the host
+	provision func(ctx context.Context, job sshProvisionJob, credentials provisionCredentials) (provisionedUser, error)
+}
+
+func newSshProvisioner() *sshProvisioner {
+	return &sshProvisioner{inFlight: map[string]bool{}, slots: make(chan struct{}, sshProvisionWorkers), provision: provisionOverSsh}
+}
+
+func (p *sshProvisioner) running(namespace string, taskRun string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.inFlight[namespace+"/"+taskRun]
+}
+
+// submit queues the job, unless the user task is already being provisioned
+func (p *sshProvisioner) submit(r *ReconcileTaskRun, log logr.Logger, job sshProvisionJob) {
+	key := job.namespace + "/" + job.taskRun
+	p.lock.Lock()
+	if p.inFlight[key] {
+		p.lock.Unlock()
+		return
+	}
+	p.inFlight[key] = true
+	p.lock.Unlock()
+	go func() {
+		p.slots <- struct{}{}
+		defer func() {
+			<-p.slots
+			p.lock.Lock()
+			delete(p.inFlight, key)
+			p.lock.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
+		defer cancel()
+		r.runSshProvision(ctx, &log, job)
+	}()
+}
+
+// startSshProvision records the job on the user task, and queues it
+func (r *ReconcileTaskRun) startSshProvision(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, job sshProvisionJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if tr.Annotations == nil {
+		tr.Annotations = map[string]string{}
+	}
+	tr.Annotations[SshProvisionAnnotation] = string(value)
+	err = r.client.Update(ctx, tr)
+	if err != nil {
+		return err
+	}
+	log.Info("provisioning host", "host", job.Host)
+	r.sshProvisioner.submit(r, log.WithValues("host", job.Host), job)
+	return nil
+}
+
+// resumeSshProvision starts provisioning again for a running task that has no secret or provision task yet, and is
+// not being provisioned, which happens if the controller restarted while provisioning it
+func (r *ReconcileTaskRun) resumeSshProvision(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, secretName string) error {
+	value := tr.Annotations[SshProvisionAnnotation]
+	if value == "" || r.sshProvisioner.running(tr.Namespace, tr.Name) {
+		return nil
+	}
+	job := sshProvisionJob{}
+	err := json.Unmarshal([]byte(value), &job)
+	if err != nil || job.Host != tr.Labels[AssignedHost] {
+		// Provisioned by another mode, or on a host that has since failed
+		return nil
+	}
+	secret := v12.Secret{}
+	err = r.client.Get(ctx, types.NamespacedName{Namespace: tr.Namespace, Name: secretName}, &secret)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	provisionTasks := v1.TaskRunList{}
+	err = r.client.List(ctx, &provisionTasks, client.InNamespace(r.operatorNamespace), client.MatchingLabels{TaskTypeLabel: TaskTypeProvision, UserTaskNamespace: tr.Namespace, UserTaskName: tr.Name, AssignedHost: job.Host})
+	if err != nil || len(provisionTasks.Items) > 0 {
+		return err
+	}
+	job.namespace = tr.Namespace
+	job.taskRun = tr.Name
+	job.secretName = secretName
+	log.Info("resuming provisioning", "host", job.Host)
+	r.sshProvisioner.submit(r, log.WithValues("host", job.Host), job)
+	return nil
+}
+
+// runSshProvision checks the host key, then provisions the host and writes the task secret, or in tekton mode starts
+// the provision task. Failures are handled the same way as a failed provision task, so another host is tried.
+func (r *ReconcileTaskRun) runSshProvision(ctx context.Context, log *logr.Logger, job sshProvisionJob) {
+	userTr := v1.TaskRun{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: job.namespace, Name: job.taskRun}, &userTr)
+	if err != nil {
+		// The task has gone, there is nothing to provision
+		log.Error(err, "failed to get user task to provision")
+		return
+	}
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config")
+		return
+	}
+	hostKeys, err := r.verifyHostKey(ctx, log, data, job.Platform, job.Host, job.Address)
+	if mismatch, ok := err.(*hostKeyMismatchError); ok {
+		log.Error(err, "host key mismatch", "audit", "true")
+		r.handleMetrics(job.Platform, func(metrics *PlatformMetrics) {
+			metrics.hostKeyMismatches.Inc()
+		})
+		err = r.createErrorSecret(ctx, log, &userTr, job.secretName, mismatch.Error())
+		if err != nil {
+			log.Error(err, "failed to create error secret")
+		}
+		return
+	}
+	if err == nil && provisionMode(data, job.Platform) != ProvisionModeSsh {
+		err = r.createProvisionTask(ctx, job, hostKeys)
+		if err == nil {
+			return
+		}
+	}
+	if err != nil {
+		// The host can't be reached, so try another one
+		log.Error(err, "failed to start provisioning host")
+		_, err = r.handleProvisionFailure(ctx, log, job.Platform, job.Host, job.namespace, job.taskRun)
+		if err != nil {
+			log.Error(err, "failed to record provision failure")
+		}
+		return
+	}
+	ca, err := r.loadUserCA(ctx, data, job.Platform)
+	if err != nil {
+		// This is not a problem with the host, so don't try another one
+		log.Error(err, "failed to load SSH CA")
+		err = r.createErrorSecret(ctx, log, &userTr, job.secretName, "failed to load SSH CA, system may not be configured correctly")
+		if err != nil {
+			log.Error(err, "failed to create error secret")
+		}
+		return
+	}
+	credentials := provisionCredentials{ca: ca, hostKeys: hostKeys}
+	masterKey := v12.Secret{}
+	err = r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: job.SshSecret}, &masterKey)
+	if err == nil {
+		credentials.masterKey = masterKey.Data["id_rsa"]
+	}
+	var user provisionedUser
+	if err == nil {
+		user, err = r.sshProvisioner.provision(ctx, job, credentials)
+	}
+	if err != nil {
+		log.Error(err, "failed to provision host over SSH")
+		_, err = r.handleProvisionFailure(ctx, log, job.Platform, job.Host, job.namespace, job.taskRun)
+		if err != nil {
+			log.Error(err, "failed to record provision failure")
+		}
+		return
+	}
+	r.recordProvisionResult(ctx, log, job.Host, true)
+	err = r.createBuildSecret(ctx, &userTr, job, user, knownHosts(job.Address, credentials.hostKeys))
+	if err != nil && !errors.IsAlreadyExists(err) {
+		log.Error(err, "failed to create secret for provisioned host")
+		err = r.createErrorSecret(ctx, log, &userTr, job.secretName, "failed to create a secret for the provisioned host")
+		if err != nil {
+			log.Error(err, "failed to create error secret")
+		}
+	}
+}
+
+// createBuildSecret writes the secret the build task uses to connect to the host. If the OTP server is installed the
+// key is stored there, and the secret has a one time password to fetch it.
+func (r *ReconcileTaskRun) createBuildSecret(ctx context.Context, tr *v1.TaskRun, job sshProvisionJob, user provisionedUser, knownHosts string) error {
+	secret := v12.Secret{}
+	secret.Namespace = tr.Namespace
+	secret.Name = job.secretName
+	secret.Labels = map[string]string{MultiPlatformSecretLabel: "true"}
+	secret.Data = map[string][]byte{
+		"host":     []byte(user.name + "@" + job.Address),
+		"user-dir": []byte("/home/" + user.name),
+	}
+	if user.cert != nil {
+		// ssh picks up the certificate next to the key file
+		secret.Data["id_rsa-cert.pub"] = user.cert
+	}
+	if knownHosts != "" {
+		secret.Data["known_hosts"] = []byte(knownHosts)
+	}
+	err := controllerutil.SetOwnerReference(tr, &secret, r.scheme)
+	if err != nil {
+		return err
+	}
+	tlsSecret := v12.Secret{}
+	err = r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: OtpTlsSecret}, &tlsSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && len(tlsSecret.Data["tls.crt"]) > 0 {
+		server := "https://multi-platform-otp-server." + r.operatorNamespace + ".svc.cluster.local"
+		otp, err := storeOtpKey(ctx, server+"/store-key", tlsSecret.Data["tls.crt"], user.key)
+		if err != nil {
+			return err
+		}
+		secret.Data["otp-ca"] = tlsSecret.Data["tls.crt"]
+		secret.Data["otp"] = otp
+		secret.Data["otp-server"] = []byte(server + "/otp")
+	} else {
+		secret.Data["id_rsa"] = user.key
+	}
+	return r.client.Create(ctx, &secret)
+}
+
+// storeOtpKey stores the key in the OTP server, and returns the one time password to fetch it
+func storeOtpKey(ctx context.Context, url string, ca []byte, key []byte) ([]byte, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid OTP server certificate")
+	}
+	httpClient := http.Client{Timeout: time.Second * 30, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(key))
+	if err != nil {
+		return nil, err
+	}
+	// The token is read each time as it is rotated by the kubelet
+	token, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OTP server returned %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// buildUserName is the name of the user a task runs as, it must match the name the clean-shared-host task removes
+func buildUserName(taskRun string, namespace string) string {
+	sum := md5.Sum([]byte(taskRun + namespace + "\n")) //#nosec G401
+	return "u-" + hex.EncodeToString(sum[:])[0:28]
+}
+
+// provisionOverSsh creates the build user on the host with a new key, and checks the user can log in. If there is a
+// user CA the key is not added to the host, it gets a certificate instead.
+func provisionOverSsh(ctx context.Context, job sshProvisionJob, credentials provisionCredentials) (provisionedUser, error) {
+	signer, err := ssh.ParsePrivateKey(credentials.masterKey)
+	if err != nil {
+		return provisionedUser{}, fmt.Errorf("failed to parse SSH key %s: %w", job.SshSecret, err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		return provisionedUser{}, err
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return provisionedUser{}, err
+	}
+	password := make([]byte, 12)
+	if _, err := rand.Read(password); err != nil {
+		return provisionedUser{}, err
+	}
+	name := buildUserName(job.taskRun, job.namespace)
+	buildSigner, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return provisionedUser{}, err
+	}
+	ret := provisionedUser{name: name, key: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})}
+	script := fmt.Sprintf(provisionScript, name, hex.EncodeToString(password), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))))
+	if ca := credentials.ca; ca != nil {
+		cert, err := ca.issue(publicKey, name, job.namespace+"/"+job.taskRun, time.Now())
+		if err != nil {
+			return provisionedUser{}, err
+		}
+		buildSigner, err = ssh.NewCertSigner(cert, buildSigner)
+		if err != nil {
+			return provisionedUser{}, err
+		}
+		ret.cert = ssh.MarshalAuthorizedKey(cert)
+		script = fmt.Sprintf(caProvisionScript, name, hex.EncodeToString(password), ca.trustedKeys())
+	}
+	err = runSshScript(ctx, job.Address, job.User, signer, credentials.hostKeys, script)
+	if err != nil {
+		return provisionedUser{}, fmt.Errorf("failed to create user on %s: %w", job.Address, err)
+	}
+	err = runSshScript(ctx, job.Address, name, buildSigner, credentials.hostKeys, "echo test")
+	if err != nil {
+		return provisionedUser{}, fmt.Errorf("build user can't log in to %s: %w", job.Address, err)
+	}
+	return ret, nil
+}
+
+// runSshScript runs the script on the host with bash, the output is included in the error if it fails
+func runSshScript(ctx context.Context, address string, user string, signer ssh.Signer, pinnedKeys []ssh.PublicKey, script string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	config := &ssh.ClientConfig{
+		User:              user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   pinnedHostKeyCallback(address, pinnedKeys),
+		HostKeyAlgorithms: hostKeyAlgorithms(pinnedKeys),
+		Timeout:           time.Second * 30,
+	}
+	client, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(script)
+	output, err := session.CombinedOutput("bash -s")
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		if len(lines) > 5 {
+			lines = lines[len(lines)-5:]
+		}
+		return fmt.Errorf("%w: %s", err, strings.Join(lines, "\n"))
+	}
+	return nil
+}
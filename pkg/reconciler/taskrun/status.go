@@ -0,0 +1,113 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// UpdatePlatformStatus writes the live host and instance counts to the status of the platform objects
+func (r *ReconcileTaskRun) UpdatePlatformStatus(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to update platform status")
+		return
+	}
+	taskList := v1.TaskRunList{}
+	err = r.client.List(ctx, &taskList, client.HasLabels{AssignedHost})
+	if err != nil {
+		log.Error(err, "failed to list task runs to update platform status")
+		return
+	}
+	hostCount := map[string]int{}
+	for _, tr := range taskList.Items {
+		if tr.Labels[TaskTypeLabel] == "" {
+			hostCount[tr.Labels[AssignedHost]]++
+		}
+	}
+	now := metav1.Now()
+
+	hostPools := v1alpha1.HostPoolList{}
+	err = r.client.List(ctx, &hostPools, client.InNamespace(r.operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		log.Error(err, "failed to list host pools")
+	}
+	for i := range hostPools.Items {
+		pool := &hostPools.Items[i]
+		pool.Status = v1alpha1.HostPoolStatus{HostCount: len(pool.Spec.Hosts), LastUpdated: &now}
+		for _, host := range pool.Spec.Hosts {
+			pool.Status.Hosts = append(pool.Status.Hosts, v1alpha1.HostStatus{Name: host.Name, Platform: host.Platform, RunningTasks: hostCount[host.Name]})
+			pool.Status.RunningTasks += hostCount[host.Name]
+		}
+		err = r.client.Status().Update(ctx, pool)
+		if err != nil {
+			log.Error(err, "failed to update host pool status", "name", pool.Name)
+		}
+	}
+
+	dynamic := v1alpha1.DynamicPlatformList{}
+	err = r.client.List(ctx, &dynamic, client.InNamespace(r.operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		log.Error(err, "failed to list dynamic platforms")
+	}
+	for i := range dynamic.Items {
+		platform := &dynamic.Items[i]
+		provider, instanceTag := r.statusCloudProvider(data, platform.Spec.Type, platform.Spec.Platform)
+		if provider == nil {
+			continue
+		}
+		count, err := provider.CountInstances(r.client, log, ctx, instanceTag)
+		if err != nil {
+			log.Error(err, "failed to count instances for platform status", "platform", platform.Spec.Platform)
+			continue
+		}
+		platform.Status = v1alpha1.DynamicPlatformStatus{Instances: count, LastUpdated: &now}
+		err = r.client.Status().Update(ctx, platform)
+		if err != nil {
+			log.Error(err, "failed to update dynamic platform status", "name", platform.Name)
+		}
+	}
+
+	dynamicPool := v1alpha1.DynamicPoolPlatformList{}
+	err = r.client.List(ctx, &dynamicPool, client.InNamespace(r.operatorNamespace))
+	if err != nil && !isMissingKind(err) {
+		log.Error(err, "failed to list dynamic pool platforms")
+	}
+	for i := range dynamicPool.Items {
+		platform := &dynamicPool.Items[i]
+		provider, instanceTag := r.statusCloudProvider(data, platform.Spec.Type, platform.Spec.Platform)
+		if provider == nil {
+			continue
+		}
+		instances, err := provider.ListInstances(r.client, log, ctx, instanceTag)
+		if err != nil {
+			log.Error(err, "failed to list instances for platform status", "platform", platform.Spec.Platform)
+			continue
+		}
+		platform.Status = v1alpha1.DynamicPoolPlatformStatus{Instances: len(instances), LastUpdated: &now}
+		for _, instance := range instances {
+			platform.Status.RunningTasks += hostCount[string(instance.InstanceId)]
+		}
+		err = r.client.Status().Update(ctx, platform)
+		if err != nil {
+			log.Error(err, "failed to update dynamic pool platform status", "name", platform.Name)
+		}
+	}
+}
+
+func (r *ReconcileTaskRun) statusCloudProvider(data map[string]string, typeName string, platform string) (cloud.CloudProvider, string) {
+	allocfunc := r.cloudProviders[typeName]
+	if allocfunc == nil {
+		return nil, ""
+	}
+	platformConfigName := platformLabel(platform)
+	instanceTag := data["dynamic."+platformConfigName+".instance-tag"]
+	if instanceTag == "" {
+		instanceTag = data["instance-tag"]
+	}
+	return allocfunc(platformConfigName, data, r.operatorNamespace), instanceTag
+}
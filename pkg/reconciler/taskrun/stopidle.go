@@ -0,0 +1,197 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleTracker remembers when each instance of a dynamic pool was first seen without any tasks. It is only kept in
+// memory, if the controller restarts the instances get a fresh grace period.
+type idleTracker struct {
+	lock  sync.Mutex
+	since map[string]time.Time
+}
+
+// idleFor records that the instance is idle, and returns how long it has been idle for
+func (t *idleTracker) idleFor(instance string, now time.Time) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	since, ok := t.since[instance]
+	if !ok {
+		t.since[instance] = now
+		return 0
+	}
+	return now.Sub(since)
+}
+
+func (t *idleTracker) forget(instance string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.since, instance)
+}
+
+// retain forgets every instance that is not in the list, i.e. they have been stopped or terminated
+func (t *idleTracker) retain(instances []cloud.CloudVMInstance) {
+	current := map[string]bool{}
+	for _, instance := range instances {
+		current[string(instance.InstanceId)] = true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for instance := range t.since {
+		if !current[instance] {
+			delete(t.since, instance)
+		}
+	}
+}
+
+// startStoppedInstance starts the most recently launched stopped instance, so it has the longest time left before it
+// reaches its maximum age. Stopped instances that are already past their maximum age are terminated instead. It
+// returns false if there was nothing to start, in which case a new instance should be launched.
+func (a DynamicHostPool) startStoppedInstance(r *ReconcileTaskRun, ctx context.Context, log *logr.Logger) (bool, error) {
+	stopper, ok := a.cloudProvider.(cloud.InstanceStopper)
+	if !ok {
+		return false, nil
+	}
+	stopped, err := stopper.ListStoppedInstances(r.client, log, ctx, a.instanceTag)
+	if err != nil {
+		return false, err
+	}
+	stopped = a.terminateExpiredStoppedInstances(r, ctx, log, stopped)
+	drained, err := r.drainedHosts(ctx)
+	if err != nil {
+		return false, err
+	}
+	sort.Slice(stopped, func(i, j int) bool {
+		return stopped[i].StartTime.After(stopped[j].StartTime)
+	})
+	for _, instance := range stopped {
+		if drained[string(instance.InstanceId)] {
+			continue
+		}
+		err = stopper.StartInstance(r.client, log, ctx, instance.InstanceId)
+		if err != nil {
+			// Most likely it is still stopping, try the next one
+			log.Error(err, "unable to start stopped instance", "instance", instance.InstanceId)
+			continue
+		}
+		log.Info("started stopped instance", "instance", instance.InstanceId)
+		return true, nil
+	}
+	return false, nil
+}
+
+// terminateExpiredStoppedInstances terminates stopped instances past their maximum age, so they are replaced by
+// instances launched from the current image. It returns the instances that are still stopped.
+func (a DynamicHostPool) terminateExpiredStoppedInstances(r *ReconcileTaskRun, ctx context.Context, log *logr.Logger, stopped []cloud.CloudVMInstance) []cloud.CloudVMInstance {
+	ret := []cloud.CloudVMInstance{}
+	for _, instance := range stopped {
+		if instance.StartTime.Add(a.maxAge).Before(time.Now()) {
+			log.Info("terminating old stopped instance", "instance", instance.InstanceId)
+			err := a.cloudProvider.TerminateInstance(r.client, log, ctx, instance.InstanceId)
+			if err != nil {
+				log.Error(err, "unable to terminate stopped instance", "instance", instance.InstanceId)
+				ret = append(ret, instance)
+			}
+		} else {
+			ret = append(ret, instance)
+		}
+	}
+	return ret
+}
+
+// stopIdleInstances stops running instances that have had no tasks for the grace period, and terminates stopped
+// instances that are past their maximum age
+func (a DynamicHostPool) stopIdleInstances(r *ReconcileTaskRun, ctx context.Context, log *logr.Logger) {
+	stopper, ok := a.cloudProvider.(cloud.InstanceStopper)
+	if !ok {
+		return
+	}
+	instances, err := a.cloudProvider.ListInstances(r.client, log, ctx, a.instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list instances to stop", "platform", a.platform)
+		return
+	}
+	a.idle.retain(instances)
+	// A task may have just been assigned to the instance, so read the tasks directly from the API server
+	var reader client.Reader = r.client
+	if r.apiReader != nil {
+		reader = r.apiReader
+	}
+	now := time.Now()
+	for _, instance := range instances {
+		if instance.StartTime.Add(a.maxAge).Before(now) {
+			// Old instances are terminated once they are idle
+			continue
+		}
+		trs := v1.TaskRunList{}
+		err := reader.List(ctx, &trs, client.MatchingLabels{AssignedHost: string(instance.InstanceId)})
+		if err != nil {
+			log.Error(err, "failed to list tasks for instance", "instance", instance.InstanceId)
+			continue
+		}
+		if hasRunningTask(trs.Items) {
+			a.idle.forget(string(instance.InstanceId))
+			continue
+		}
+		if a.idle.idleFor(string(instance.InstanceId), now) < a.idleGracePeriod {
+			continue
+		}
+		log.Info("stopping idle instance", "instance", instance.InstanceId)
+		err = stopper.StopInstance(r.client, log, ctx, instance.InstanceId)
+		if err != nil {
+			log.Error(err, "unable to stop idle instance", "instance", instance.InstanceId)
+			continue
+		}
+		a.idle.forget(string(instance.InstanceId))
+	}
+
+	stopped, err := stopper.ListStoppedInstances(r.client, log, ctx, a.instanceTag)
+	if err != nil {
+		log.Error(err, "failed to list stopped instances", "platform", a.platform)
+		return
+	}
+	stopped = a.terminateExpiredStoppedInstances(r, ctx, log, stopped)
+	r.handleMetrics(a.platform, func(metrics *PlatformMetrics) {
+		metrics.stoppedInstances.Set(float64(len(stopped)))
+	})
+}
+
+// hasRunningTask ignores finished provision tasks, which keep their host label until they are cleaned up
+func hasRunningTask(trs []v1.TaskRun) bool {
+	for _, tr := range trs {
+		if tr.Status.CompletionTime == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// StopIdleInstances stops the idle instances of every dynamic pool with stop-idle-instances set
+func (r *ReconcileTaskRun) StopIdleInstances(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to stop idle instances")
+		return
+	}
+	for _, platform := range strings.Split(data[DynamicPoolPlatforms], ",") {
+		if data["dynamic."+platformLabel(platform)+".stop-idle-instances"] != "true" {
+			continue
+		}
+		entry, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			log.Error(err, "failed to read platform config to stop idle instances", "platform", platform)
+			continue
+		}
+		if pool, ok := entry.config.(DynamicHostPool); ok && pool.stopIdle {
+			pool.stopIdleInstances(r, ctx, log)
+		}
+	}
+}
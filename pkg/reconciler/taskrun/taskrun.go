@@ -6,13 +6,19 @@ import (
 	errors2 "github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redhat-appstudio/multi-platform-controller/pkg/aws"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/azure"
 	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/gcp"
 	"github.com/redhat-appstudio/multi-platform-controller/pkg/ibm"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/kubevirt"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/libvirt"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/openstack"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"regexp"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"golang.org/x/crypto/ssh"
 	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -25,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -45,6 +52,9 @@ const (
 	CloudFailures          = "build.appstudio.redhat.com/cloud-failure-count"
 	CloudAddress           = "build.appstudio.redhat.com/cloud-address"
 	CloudDynamicPlatform   = "build.appstudio.redhat.com/cloud-dynamic-platform"
+	CloudZone              = "build.appstudio.redhat.com/cloud-zone"
+	CloudInstanceType      = "build.appstudio.redhat.com/cloud-instance-type"
+	CloudCapacityType      = "build.appstudio.redhat.com/cloud-capacity-type"
 	ProvisionTaskProcessed = "build.appstudio.redhat.com/provision-task-processed"
 	ProvisionTaskFinalizer = "build.appstudio.redhat.com/provision-task-finalizer"
 
@@ -65,6 +75,7 @@ const (
 	TaskTypeProvision            = "provision"
 	TaskTypeUpdate               = "update"
 	TaskTypeClean                = "clean"
+	TaskTypeHealthCheck          = "health-check"
 
 	ServiceAccountName = "multi-platform-controller"
 
@@ -81,9 +92,20 @@ type ReconcileTaskRun struct {
 	scheme            *runtime.Scheme
 	eventRecorder     record.EventRecorder
 	operatorNamespace string
-	platformConfig    map[string]PlatformConfig
-	platformMetrics   map[string]*PlatformMetrics
-	cloudProviders    map[string]func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider
+	// configLock guards platformConfig, retiredConfig and platformMetrics, which are shared with the config reloader
+	configLock      sync.Mutex
+	platformConfig  map[string]*platformConfigEntry
+	retiredConfig   map[string]PlatformConfig
+	platformMetrics map[string]*PlatformMetrics
+	cloudProviders  map[string]func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider
+	hostHealth      *hostHealthTracker
+	// launchLock guards launchLocks, which stop the instances of a dynamic platform being counted while another
+	// instance is being launched, so max-instances can't be exceeded
+	launchLock     sync.Mutex
+	launchLocks    map[string]*sync.Mutex
+	sshProvisioner *sshProvisioner
+	// hostKeyProbe gets the SSH host key of a host, checking it against the pinned keys if there are any
+	hostKeyProbe func(ctx context.Context, host string, address string, keys []ssh.PublicKey) (ssh.PublicKey, error)
 }
 
 type PlatformMetrics struct {
@@ -95,9 +117,21 @@ type PlatformMetrics struct {
 	provisionFailures      prometheus.Counter
 	cleanupFailures        prometheus.Counter
 	hostAllocationFailures prometheus.Counter
+	instanceInterruptions  prometheus.Counter
+	instanceLaunches       *prometheus.CounterVec
+	capacityErrors         *prometheus.CounterVec
+	warmInstances          prometheus.Gauge
+	stoppedInstances       prometheus.Gauge
+	reapedInstances        *prometheus.CounterVec
+	waitTimeouts           prometheus.Counter
+	hostKeyMismatches      prometheus.Counter
+	hostHealth             *prometheus.GaugeVec
+	namespaceHosts         *prometheus.GaugeVec
+	namespaceWaitingTasks  *prometheus.GaugeVec
+	configGeneration       *prometheus.GaugeVec
 }
 
-func newReconciler(mgr ctrl.Manager, operatorNamespace string) reconcile.Reconciler {
+func newReconciler(mgr ctrl.Manager, operatorNamespace string) *ReconcileTaskRun {
 	return &ReconcileTaskRun{
 		apiReader:         mgr.GetAPIReader(),
 		client:            mgr.GetClient(),
@@ -105,8 +139,12 @@ func newReconciler(mgr ctrl.Manager, operatorNamespace string) reconcile.Reconci
 		eventRecorder:     mgr.GetEventRecorderFor("ComponentBuild"),
 		operatorNamespace: operatorNamespace,
 		platformMetrics:   map[string]*PlatformMetrics{},
-		platformConfig:    map[string]PlatformConfig{},
-		cloudProviders:    map[string]func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider{"aws": aws.Ec2Provider, "ibmz": ibm.IBMZProvider, "ibmp": ibm.IBMPowerProvider},
+		platformConfig:    map[string]*platformConfigEntry{},
+		retiredConfig:     map[string]PlatformConfig{},
+		hostHealth:        newHostHealthTracker(),
+		sshProvisioner:    newSshProvisioner(),
+		hostKeyProbe:      probeHostKey,
+		cloudProviders:    map[string]func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider{"aws": aws.Ec2Provider, "ibmz": ibm.IBMZProvider, "ibmp": ibm.IBMPowerProvider, "gcp": gcp.GceProvider, "azure": azure.AzureProvider, "libvirt": libvirt.LibvirtProvider, "kubevirt": kubevirt.KubeVirtProvider, "openstack": openstack.OpenStackProvider},
 	}
 }
 
@@ -150,6 +188,10 @@ func (r *ReconcileTaskRun) handleTaskRunReceived(ctx context.Context, log *logr.
 			log.Info("Reconciling provision task")
 			return r.handleProvisionTask(ctx, log, tr)
 		}
+		if taskType == TaskTypeHealthCheck {
+			log.Info("Reconciling health check task")
+			return r.handleHealthCheckTask(ctx, log, tr)
+		}
 		if taskType == TaskTypeUpdate {
 			// We don't care about these
 			return reconcile.Result{}, nil
@@ -196,30 +238,40 @@ func (r *ReconcileTaskRun) handleTaskRunReceived(ctx context.Context, log *logr.
 // called when a task has finished, we look for waiting tasks
 // and then potentially requeue one of them
 func (r *ReconcileTaskRun) handleWaitingTasks(ctx context.Context, log *logr.Logger, platform string) (reconcile.Result, error) {
+	return reconcile.Result{}, r.wakeWaitingTasks(ctx, log, platform, 1)
+}
+
+// wakeWaitingTasks requeues up to count waiting tasks for the platform, in the order they should get a host
+func (r *ReconcileTaskRun) wakeWaitingTasks(ctx context.Context, log *logr.Logger, platform string, count int) error {
 
 	//try and requeue a waiting task if one exists
 	taskList := v1.TaskRunList{}
 
 	err := r.client.List(ctx, &taskList, client.MatchingLabels{WaitingForPlatformLabel: platformLabel(platform)})
 	if err != nil {
-		return reconcile.Result{}, err
+		return err
 	}
-	var oldest *v1.TaskRun
-	var oldestTs time.Time
-	for i := range taskList.Items {
-		tr := taskList.Items[i]
-		if oldest == nil || oldestTs.After(tr.CreationTimestamp.Time) {
-			oldestTs = tr.CreationTimestamp.Time
-			oldest = &tr
+	waiting := taskList.Items
+	for i := 0; i < count && len(waiting) > 0; i++ {
+		next, err := r.nextWaitingTask(ctx, log, platform, waiting)
+		if err != nil || next == nil {
+			return err
 		}
-	}
-	if oldest != nil {
 		//remove the waiting label, which will trigger a requeue
-		delete(oldest.Labels, WaitingForPlatformLabel)
-		return reconcile.Result{}, r.client.Update(ctx, oldest)
+		delete(next.Labels, WaitingForPlatformLabel)
+		err = r.client.Update(ctx, next)
+		if err != nil {
+			return err
+		}
+		remaining := []v1.TaskRun{}
+		for _, tr := range waiting {
+			if tr.Namespace != next.Namespace || tr.Name != next.Name {
+				remaining = append(remaining, tr)
+			}
+		}
+		waiting = remaining
 	}
-	return reconcile.Result{}, nil
-
+	return nil
 }
 
 func (r *ReconcileTaskRun) handleCleanTask(ctx context.Context, log *logr.Logger, tr *v1.TaskRun) (reconcile.Result, error) {
@@ -268,40 +320,23 @@ func (r *ReconcileTaskRun) handleProvisionTask(ctx context.Context, log *logr.Lo
 	userNamespace := tr.Labels[UserTaskNamespace]
 	userTaskName := tr.Labels[UserTaskName]
 	if !success {
-		r.handleMetrics(tr.Annotations[TaskTargetPlatformAnnotation], func(metrics *PlatformMetrics) {
-			metrics.provisionFailures.Inc()
-		})
 		assigned := tr.Labels[AssignedHost]
-		log.Info(fmt.Sprintf("provision task for host %s for user task %s/%sfailed", assigned, userNamespace, userTaskName))
-		if assigned != "" {
-			userTr := v1.TaskRun{}
-			err := r.client.Get(ctx, types.NamespacedName{Namespace: userNamespace, Name: userTaskName}, &userTr)
-			if err == nil {
-				if userTr.Annotations == nil {
-					userTr.Annotations = map[string]string{}
-				}
-				//add to failed hosts and remove assigned
-				//this will cause it to try again
-				failed := strings.Split(userTr.Annotations[FailedHosts], ",")
-				if failed[0] == "" {
-					failed = []string{}
-				}
-				failed = append(failed, assigned)
-				userTr.Annotations[FailedHosts] = strings.Join(failed, ",")
-				delete(userTr.Labels, AssignedHost)
-				err = r.client.Update(ctx, &userTr)
-				if err != nil {
-					return reconcile.Result{}, err
-				}
-				delete(tr.Labels, AssignedHost)
-				err := r.client.Update(ctx, tr)
-				if err != nil {
-					return reconcile.Result{}, err
-				}
+		found, err := r.handleProvisionFailure(ctx, log, tr.Annotations[TaskTargetPlatformAnnotation], assigned, userNamespace, userTaskName)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if found {
+			delete(tr.Labels, AssignedHost)
+			err := r.client.Update(ctx, tr)
+			if err != nil {
+				return reconcile.Result{}, err
 			}
 		}
 	} else {
 		log.Info("provision task succeeded")
+		if assigned := tr.Labels[AssignedHost]; assigned != "" {
+			r.recordProvisionResult(ctx, log, assigned, true)
+		}
 		//verify we ended up with a secret
 		secret := v12.Secret{}
 		err := r.client.Get(ctx, types.NamespacedName{Namespace: userNamespace, Name: secretName}, &secret)
@@ -329,6 +364,37 @@ func (r *ReconcileTaskRun) handleProvisionTask(ctx context.Context, log *logr.Lo
 	return reconcile.Result{}, r.client.Update(ctx, tr)
 }
 
+// handleProvisionFailure adds the host to the failed hosts of the user task and unassigns it, so another host is tried.
+// It returns false if the user task no longer exists.
+func (r *ReconcileTaskRun) handleProvisionFailure(ctx context.Context, log *logr.Logger, platform string, assigned string, userNamespace string, userTaskName string) (bool, error) {
+	r.handleMetrics(platform, func(metrics *PlatformMetrics) {
+		metrics.provisionFailures.Inc()
+	})
+	log.Info(fmt.Sprintf("provision task for host %s for user task %s/%sfailed", assigned, userNamespace, userTaskName))
+	if assigned == "" {
+		return false, nil
+	}
+	r.recordProvisionResult(ctx, log, assigned, false)
+	userTr := v1.TaskRun{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: userNamespace, Name: userTaskName}, &userTr)
+	if err != nil {
+		return false, nil
+	}
+	if userTr.Annotations == nil {
+		userTr.Annotations = map[string]string{}
+	}
+	//add to failed hosts and remove assigned
+	//this will cause it to try again
+	failed := strings.Split(userTr.Annotations[FailedHosts], ",")
+	if failed[0] == "" {
+		failed = []string{}
+	}
+	failed = append(failed, assigned)
+	userTr.Annotations[FailedHosts] = strings.Join(failed, ",")
+	delete(userTr.Labels, AssignedHost)
+	return true, r.client.Update(ctx, &userTr)
+}
+
 // This creates an secret with the 'error' field set
 // This will result in the pipeline run immediately failing with the message printed in the logs
 func (r *ReconcileTaskRun) createErrorSecret(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, secretName string, msg string) error {
@@ -412,15 +478,15 @@ func extracPlatform(tr *v1.TaskRun) (string, error) {
 func (r *ReconcileTaskRun) handleHostAllocation(ctx context.Context, log *logr.Logger, tr *v1.TaskRun, secretName string, targetPlatform string) (reconcile.Result, error) {
 	log.Info("attempting to allocate host")
 
-	if tr.Labels == nil {
-		tr.Labels = map[string]string{}
-	}
 	if r.apiReader != nil {
 		err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: tr.Namespace, Name: tr.Name}, tr)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
 	}
+	if tr.Labels == nil {
+		tr.Labels = map[string]string{}
+	}
 	//check the secret does not already exist
 	secret := v12.Secret{}
 	err := r.client.Get(ctx, types.NamespacedName{Namespace: tr.Namespace, Name: secretName}, &secret)
@@ -434,18 +500,33 @@ func (r *ReconcileTaskRun) handleHostAllocation(ctx context.Context, log *logr.L
 	}
 
 	//lets allocate a host, get the map with host info
-	hosts, err := r.readConfiguration(ctx, log, targetPlatform, tr.Namespace)
+	entry, err := r.readConfigurationEntry(ctx, log, targetPlatform, tr.Namespace)
 	if err != nil {
 		log.Error(err, "failed to read host config")
 		r.handleMetrics(targetPlatform, func(metrics *PlatformMetrics) { metrics.hostAllocationFailures.Inc() })
 		return reconcile.Result{}, r.createErrorSecret(ctx, log, tr, secretName, "failed to read host config "+err.Error())
 	}
+	hosts := entry.config
 	if tr.Annotations == nil {
 		tr.Annotations = map[string]string{}
 	}
+	if tr.Annotations[CloudInstanceId] == "" {
+		// Once an instance has been launched the task must stay on the config it was launched with
+		tr.Labels[ConfigGenerationLabel] = entry.generation
+	}
 	wasWaiting := tr.Labels[WaitingForPlatformLabel] != ""
 	startTime := time.Now().Unix()
-	ret, err := hosts.Allocate(r, ctx, log, tr, secretName)
+	var ret reconcile.Result
+	quotaReached := false
+	if tr.Annotations[CloudInstanceId] == "" {
+		// A task that already has an instance launched for it is counted towards the quota
+		quotaReached, err = r.namespaceQuotaReached(ctx, log, tr, targetPlatform)
+	}
+	if err == nil && quotaReached {
+		ret, err = r.waitForQuota(ctx, tr, targetPlatform)
+	} else if err == nil {
+		ret, err = hosts.Allocate(r, ctx, log, tr, secretName)
+	}
 	isWaiting := tr.Labels[WaitingForPlatformLabel] != ""
 
 	if err != nil {
@@ -468,6 +549,11 @@ func (r *ReconcileTaskRun) handleHostAllocation(ctx context.Context, log *logr.L
 				metrics.waitTime.Observe(float64(time.Now().Unix() - tr.CreationTimestamp.Unix()))
 			})
 		}
+		if isWaiting && tr.Annotations[WaitingSinceAnnotation] == "" {
+			// Kept if the task is woken and has to wait again, so max-wait applies to the total time spent waiting
+			tr.Annotations[WaitingSinceAnnotation] = strconv.FormatInt(startTime, 10)
+			err = r.client.Update(ctx, tr)
+		}
 		if isWaiting && !wasWaiting {
 			r.handleMetrics(targetPlatform, func(metrics *PlatformMetrics) {
 				metrics.waitingTasks.Inc()
@@ -491,7 +577,7 @@ func (r *ReconcileTaskRun) handleHostAssigned(ctx context.Context, log *logr.Log
 		if err != nil {
 			return reconcile.Result{}, err
 		}
-		config, err := r.readConfiguration(ctx, log, platform, tr.Namespace)
+		config, err := r.readTaskConfiguration(ctx, log, tr, platform)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
@@ -509,10 +595,15 @@ func (r *ReconcileTaskRun) handleHostAssigned(ctx context.Context, log *logr.Log
 		}
 		controllerutil.RemoveFinalizer(tr, PipelineFinalizer)
 		delete(tr.Labels, AssignedHost)
+		generation := tr.Labels[ConfigGenerationLabel]
+		delete(tr.Labels, ConfigGenerationLabel)
 		err = r.client.Update(ctx, tr)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
+		if generation != "" {
+			r.pruneRetiredConfig(ctx, log, tr, platform, generation)
+		}
 
 		secret := v12.Secret{}
 		//delete the secret
@@ -532,17 +623,26 @@ func (r *ReconcileTaskRun) handleHostAssigned(ctx context.Context, log *logr.Log
 		}
 		return r.handleWaitingTasks(ctx, log, platform)
 	}
-	return reconcile.Result{}, nil
+	return reconcile.Result{}, r.resumeSshProvision(ctx, log, tr, secretName)
 }
 
 func (r *ReconcileTaskRun) readConfiguration(ctx context.Context, log *logr.Logger, targetPlatform string, targetNamespace string) (PlatformConfig, error) {
-	cm := v12.ConfigMap{}
-	err := r.client.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: HostConfig}, &cm)
+	entry, err := r.readConfigurationEntry(ctx, log, targetPlatform, targetNamespace)
 	if err != nil {
 		return nil, err
 	}
+	return entry.config, nil
+}
 
-	namespaces := cm.Data[AllowedNamespaces]
+// readConfigurationEntry returns the current configuration for the platform, rebuilding it if the
+// underlying config has changed since it was last read
+func (r *ReconcileTaskRun) readConfigurationEntry(ctx context.Context, log *logr.Logger, targetPlatform string, targetNamespace string) (*platformConfigEntry, error) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := data[AllowedNamespaces]
 	if namespaces != "" {
 		parts := strings.Split(namespaces, ",")
 		ok := false
@@ -561,30 +661,30 @@ func (r *ReconcileTaskRun) readConfiguration(ctx context.Context, log *logr.Logg
 			return nil, fmt.Errorf("namespace %s does not match any namespace defined in allowed namespaces, ask an administrator to enable multi platform builds for your namespace", targetNamespace)
 		}
 	}
-	existing := r.platformConfig[targetPlatform]
-	if existing != nil {
-		return existing, nil
-	}
+	return r.cachedPlatformConfig(log, data, targetPlatform)
+}
 
-	dynamic := cm.Data[DynamicPlatforms]
+// buildPlatformConfig creates the PlatformConfig for a platform from the host-config data
+func (r *ReconcileTaskRun) buildPlatformConfig(log *logr.Logger, data map[string]string, targetPlatform string) (PlatformConfig, error) {
+	dynamic := data[DynamicPlatforms]
 	for _, platform := range strings.Split(dynamic, ",") {
 		platformConfigName := strings.ReplaceAll(platform, "/", "-")
 		if platform == targetPlatform {
 
-			typeName := cm.Data["dynamic."+platformConfigName+".type"]
+			typeName := data["dynamic."+platformConfigName+".type"]
 			allocfunc := r.cloudProviders[typeName]
 			if allocfunc == nil {
 				return nil, errors2.New("unknown dynamic provisioning type " + typeName)
 			}
-			maxInstances, err := strconv.Atoi(cm.Data["dynamic."+platformConfigName+".max-instances"])
+			maxInstances, err := strconv.Atoi(data["dynamic."+platformConfigName+".max-instances"])
 			if err != nil {
 				return nil, err
 			}
-			instanceTag := cm.Data["dynamic."+platformConfigName+".instance-tag"]
+			instanceTag := data["dynamic."+platformConfigName+".instance-tag"]
 			if instanceTag == "" {
-				instanceTag = cm.Data["instance-tag"]
+				instanceTag = data["instance-tag"]
 			}
-			timeoutSeconds := cm.Data["dynamic."+platformConfigName+".allocation-timeout"]
+			timeoutSeconds := data["dynamic."+platformConfigName+".allocation-timeout"]
 			timeout := int64(600) //default to 10 minutes
 			if timeoutSeconds != "" {
 				timeoutInt, err := strconv.Atoi(timeoutSeconds)
@@ -594,72 +694,91 @@ func (r *ReconcileTaskRun) readConfiguration(ctx context.Context, log *logr.Logg
 					timeout = int64(timeoutInt)
 				}
 			}
+			minReady := 0
+			if value := data["dynamic."+platformConfigName+".min-ready"]; value != "" {
+				minReady, err = strconv.Atoi(value)
+				if err != nil {
+					log.Error(err, "unable to parse min ready")
+					minReady = 0
+				}
+			}
+			warmTTL := 60 //default to an hour
+			if value := data["dynamic."+platformConfigName+".warm-ttl"]; value != "" {
+				warmTTLInt, err := strconv.Atoi(value)
+				if err != nil {
+					log.Error(err, "unable to parse warm ttl")
+				} else {
+					warmTTL = warmTTLInt
+				}
+			}
 			ret := DynamicResolver{
-				CloudProvider: allocfunc(platformConfigName, cm.Data, r.operatorNamespace),
-				sshSecret:     cm.Data["dynamic."+platformConfigName+".ssh-secret"],
+				CloudProvider: r.newCloudProvider(allocfunc, platformConfigName, data, platform),
+				sshSecret:     data["dynamic."+platformConfigName+".ssh-secret"],
 				platform:      platform,
 				maxInstances:  maxInstances,
 				instanceTag:   instanceTag,
 				timeout:       timeout,
+				minReady:      minReady,
+				warmTTL:       time.Duration(warmTTL) * time.Minute,
 			}
-			r.platformConfig[targetPlatform] = ret
-			metrics, err := r.registerMetrics(targetPlatform)
-			if err != nil {
-				return nil, err
-			}
-			r.platformMetrics[targetPlatform] = metrics
 			return ret, nil
 		}
 	}
 
-	dynamicPool := cm.Data[DynamicPoolPlatforms]
+	dynamicPool := data[DynamicPoolPlatforms]
 	for _, platform := range strings.Split(dynamicPool, ",") {
 		platformConfigName := strings.ReplaceAll(platform, "/", "-")
 		if platform == targetPlatform {
 
-			typeName := cm.Data["dynamic."+platformConfigName+".type"]
+			typeName := data["dynamic."+platformConfigName+".type"]
 			allocfunc := r.cloudProviders[typeName]
 			if allocfunc == nil {
 				return nil, errors2.New("unknown dynamic provisioning type " + typeName)
 			}
-			maxInstances, err := strconv.Atoi(cm.Data["dynamic."+platformConfigName+".max-instances"])
+			maxInstances, err := strconv.Atoi(data["dynamic."+platformConfigName+".max-instances"])
 			if err != nil {
 				return nil, err
 			}
-			concurrency, err := strconv.Atoi(cm.Data["dynamic."+platformConfigName+".concurrency"])
+			concurrency, err := strconv.Atoi(data["dynamic."+platformConfigName+".concurrency"])
 			if err != nil {
 				return nil, err
 			}
-			maxAge, err := strconv.Atoi(cm.Data["dynamic."+platformConfigName+".max-age"]) // Minutes
+			maxAge, err := strconv.Atoi(data["dynamic."+platformConfigName+".max-age"]) // Minutes
 			if err != nil {
 				return nil, err
 			}
 
-			instanceTag := cm.Data["dynamic."+platformConfigName+".instance-tag"]
+			instanceTag := data["dynamic."+platformConfigName+".instance-tag"]
 			if instanceTag == "" {
-				instanceTag = cm.Data["instance-tag"]
+				instanceTag = data["instance-tag"]
 			}
-			ret := DynamicHostPool{
-				cloudProvider: allocfunc(platformConfigName, cm.Data, r.operatorNamespace),
-				sshSecret:     cm.Data["dynamic."+platformConfigName+".ssh-secret"],
-				platform:      platform,
-				maxInstances:  maxInstances,
-				maxAge:        time.Minute * time.Duration(maxAge),
-				concurrency:   concurrency,
-				instanceTag:   instanceTag,
+			idleGracePeriod := 10 // Minutes
+			if value := data["dynamic."+platformConfigName+".idle-grace-period"]; value != "" {
+				idleGracePeriodInt, err := strconv.Atoi(value)
+				if err != nil {
+					log.Error(err, "unable to parse idle grace period")
+				} else {
+					idleGracePeriod = idleGracePeriodInt
+				}
 			}
-			r.platformConfig[targetPlatform] = ret
-			metrics, err := r.registerMetrics(targetPlatform)
-			if err != nil {
-				return nil, err
+			ret := DynamicHostPool{
+				cloudProvider:   r.newCloudProvider(allocfunc, platformConfigName, data, platform),
+				sshSecret:       data["dynamic."+platformConfigName+".ssh-secret"],
+				platform:        platform,
+				maxInstances:    maxInstances,
+				maxAge:          time.Minute * time.Duration(maxAge),
+				concurrency:     concurrency,
+				instanceTag:     instanceTag,
+				stopIdle:        data["dynamic."+platformConfigName+".stop-idle-instances"] == "true",
+				idleGracePeriod: time.Minute * time.Duration(idleGracePeriod),
+				idle:            &idleTracker{since: map[string]time.Time{}},
 			}
-			r.platformMetrics[targetPlatform] = metrics
 			return ret, nil
 		}
 	}
 
 	ret := HostPool{hosts: map[string]*Host{}, targetPlatform: targetPlatform}
-	for k, v := range cm.Data {
+	for k, v := range data {
 		if !strings.HasPrefix(k, "host.") {
 			continue
 		}
@@ -691,17 +810,13 @@ func (r *ReconcileTaskRun) readConfiguration(ctx context.Context, log *logr.Logg
 				return nil, err
 			}
 			host.Concurrency = atoi
+		case HostKeyConfig:
+			// Read when the host is provisioned
 		default:
 			log.Info("unknown key", "key", key)
 		}
 
 	}
-	r.platformConfig[targetPlatform] = ret
-	metrics, err := r.registerMetrics(targetPlatform)
-	if err != nil {
-		return nil, err
-	}
-	r.platformMetrics[targetPlatform] = metrics
 	return ret, nil
 }
 
@@ -721,14 +836,21 @@ func launchProvisioningTask(r *ReconcileTaskRun, ctx context.Context, log *logr.
 		log.Error(fmt.Errorf("failed to find SSH secret %s", sshSecret), "failed to find SSH secret")
 		return r.createErrorSecret(ctx, log, tr, secretName, "failed to get SSH secret, system may not be configured correctly")
 	}
+	// The host key is checked before the host is provisioned, which means connecting to the host. That is done by the
+	// provisioner workers, so an unreachable host doesn't hold up the reconciler.
+	job := sshProvisionJob{Platform: platform, Host: tr.Labels[AssignedHost], Address: address, User: user, SshSecret: sshSecret, namespace: tr.Namespace, taskRun: tr.Name, secretName: secretName}
+	return r.startSshProvision(ctx, log, tr, job)
+}
 
+// createProvisionTask starts the provision-shared-host task for the job, with the pinned keys of the host
+func (r *ReconcileTaskRun) createProvisionTask(ctx context.Context, job sshProvisionJob, pinnedKeys []ssh.PublicKey) error {
 	provision := v1.TaskRun{}
 	provision.GenerateName = "provision-task"
 	provision.Namespace = r.operatorNamespace
-	provision.Labels = map[string]string{TaskTypeLabel: TaskTypeProvision, UserTaskNamespace: tr.Namespace, UserTaskName: tr.Name, AssignedHost: tr.Labels[AssignedHost]}
-	provision.Annotations = map[string]string{TaskTargetPlatformAnnotation: platformLabel(platform)}
+	provision.Labels = map[string]string{TaskTypeLabel: TaskTypeProvision, UserTaskNamespace: job.namespace, UserTaskName: job.taskRun, AssignedHost: job.Host}
+	provision.Annotations = map[string]string{TaskTargetPlatformAnnotation: platformLabel(job.Platform)}
 	provision.Spec.TaskRef = &v1.TaskRef{Name: "provision-shared-host"}
-	provision.Spec.Workspaces = []v1.WorkspaceBinding{{Name: "ssh", Secret: &v12.SecretVolumeSource{SecretName: sshSecret}}}
+	provision.Spec.Workspaces = []v1.WorkspaceBinding{{Name: "ssh", Secret: &v12.SecretVolumeSource{SecretName: job.SshSecret}}}
 	computeRequests := map[v12.ResourceName]resource.Quantity{v12.ResourceCPU: resource.MustParse("100m"), v12.ResourceMemory: resource.MustParse("256Mi")}
 	computeLimits := map[v12.ResourceName]resource.Quantity{v12.ResourceCPU: resource.MustParse("100m"), v12.ResourceMemory: resource.MustParse("512Mi")}
 	provision.Spec.ComputeResources = &v12.ResourceRequirements{Requests: computeRequests, Limits: computeLimits}
@@ -736,28 +858,31 @@ func launchProvisioningTask(r *ReconcileTaskRun, ctx context.Context, log *logr.
 	provision.Spec.Params = []v1.Param{
 		{
 			Name:  "SECRET_NAME",
-			Value: *v1.NewStructuredValues(secretName),
+			Value: *v1.NewStructuredValues(job.secretName),
 		},
 		{
 			Name:  "TASKRUN_NAME",
-			Value: *v1.NewStructuredValues(tr.Name),
+			Value: *v1.NewStructuredValues(job.taskRun),
 		},
 		{
 			Name:  "NAMESPACE",
-			Value: *v1.NewStructuredValues(tr.Namespace),
+			Value: *v1.NewStructuredValues(job.namespace),
 		},
 		{
 			Name:  "HOST",
-			Value: *v1.NewStructuredValues(address),
+			Value: *v1.NewStructuredValues(job.Address),
 		},
 		{
 			Name:  "USER",
-			Value: *v1.NewStructuredValues(user),
+			Value: *v1.NewStructuredValues(job.User),
+		},
+		{
+			Name:  "KNOWN_HOSTS",
+			Value: *v1.NewStructuredValues(knownHosts(job.Address, pinnedKeys)),
 		},
 	}
 
-	err = r.client.Create(ctx, &provision)
-	return err
+	return r.client.Create(ctx, &provision)
 }
 
 type Host struct {
@@ -858,13 +983,164 @@ func (r *ReconcileTaskRun) registerMetrics(platform string) (*PlatformMetrics, e
 	if err != nil {
 		return nil, err
 	}
+	ret.instanceInterruptions = prometheus.NewCounter(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "instance_interruptions",
+		Help:        "The number of times a running cloud instance has been reclaimed by the provider, e.g. a spot interruption"})
+	err = metrics.Registry.Register(ret.instanceInterruptions)
+	if err != nil {
+		return nil, err
+	}
+	ret.instanceLaunches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "instance_launches",
+		Help:        "The number of cloud instances launched, by capacity type, instance type and zone"}, []string{"capacity_type", "instance_type", "zone"})
+	err = metrics.Registry.Register(ret.instanceLaunches)
+	if err != nil {
+		return nil, err
+	}
+	ret.capacityErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "capacity_errors",
+		Help:        "The number of launch attempts that failed due to a lack of capacity or quota, causing a fallback to the next subnet or instance type"}, []string{"capacity_type", "instance_type", "subnet", "code"})
+	err = metrics.Registry.Register(ret.capacityErrors)
+	if err != nil {
+		return nil, err
+	}
+	ret.warmInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "warm_instances",
+		Help:        "The number of idle instances that are ready or booting in the warm pool"})
+	err = metrics.Registry.Register(ret.warmInstances)
+	if err != nil {
+		return nil, err
+	}
+	ret.stoppedInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "stopped_instances",
+		Help:        "The number of idle instances that have been stopped and can be started again"})
+	err = metrics.Registry.Register(ret.stoppedInstances)
+	if err != nil {
+		return nil, err
+	}
+	ret.reapedInstances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "reaped_instances",
+		Help:        "The number of instances terminated because no task was using them, or they were past the maximum lifetime"}, []string{"reason"})
+	err = metrics.Registry.Register(ret.reapedInstances)
+	if err != nil {
+		return nil, err
+	}
+	ret.waitTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "wait_timeouts",
+		Help:        "The number of tasks that were failed because they waited longer than max-wait for a host"})
+	err = metrics.Registry.Register(ret.waitTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	ret.hostKeyMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "host_key_mismatches",
+		Help:        "The number of times a host presented a different SSH host key to the one pinned for it"})
+	err = metrics.Registry.Register(ret.hostKeyMismatches)
+	if err != nil {
+		return nil, err
+	}
+	ret.hostHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "host_health",
+		Help:        "Whether each static host can be given new tasks, 0 if it failed its health check or is quarantined"}, []string{"host"})
+	err = metrics.Registry.Register(ret.hostHealth)
+	if err != nil {
+		return nil, err
+	}
+	ret.namespaceHosts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "namespace_hosts",
+		Help:        "The number of hosts each namespace is using"}, []string{"namespace"})
+	err = metrics.Registry.Register(ret.namespaceHosts)
+	if err != nil {
+		return nil, err
+	}
+	ret.namespaceWaitingTasks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "namespace_waiting_tasks",
+		Help:        "The number of tasks each namespace has waiting for a host"}, []string{"namespace"})
+	err = metrics.Registry.Register(ret.namespaceWaitingTasks)
+	if err != nil {
+		return nil, err
+	}
+	ret.configGeneration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		ConstLabels: map[string]string{"platform": platform},
+		Namespace:   strings.ReplaceAll(r.operatorNamespace, "-", "_"),
+		Name:        "config_generation",
+		Help:        "The config generation the platform is currently running, the gauge for the active generation is set to 1"}, []string{"generation"})
+	err = metrics.Registry.Register(ret.configGeneration)
+	if err != nil {
+		return nil, err
+	}
 	return &ret, nil
 }
 
+// newCloudProvider creates the cloud provider for a platform, recording its launch attempts in the platform's metrics
+// if it reports them
+func (r *ReconcileTaskRun) newCloudProvider(allocfunc func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider, platformConfigName string, data map[string]string, platform string) cloud.CloudProvider {
+	provider := allocfunc(platformConfigName, data, r.operatorNamespace)
+	if reporter, ok := provider.(cloud.LaunchReporter); ok {
+		provider = reporter.WithLaunchMetrics(&launchMetrics{reconciler: r, platform: platform})
+	}
+	return provider
+}
+
+// launchMetrics records a provider's launch attempts in the metrics of the platform
+type launchMetrics struct {
+	reconciler *ReconcileTaskRun
+	platform   string
+}
+
+func (l *launchMetrics) InstanceLaunched(capacityType string, instanceType string, zone string) {
+	l.reconciler.handleMetrics(l.platform, func(metrics *PlatformMetrics) {
+		metrics.instanceLaunches.WithLabelValues(capacityType, instanceType, zone).Inc()
+	})
+}
+
+func (l *launchMetrics) CapacityError(capacityType string, instanceType string, subnet string, code string) {
+	l.reconciler.handleMetrics(l.platform, func(metrics *PlatformMetrics) {
+		metrics.capacityErrors.WithLabelValues(capacityType, instanceType, subnet, code).Inc()
+	})
+}
+
 func (r *ReconcileTaskRun) handleMetrics(platform string, f func(metrics *PlatformMetrics)) {
+	r.configLock.Lock()
 	metrics := r.platformMetrics[platform]
+	r.configLock.Unlock()
 	if metrics == nil {
 		return
 	}
 	f(metrics)
 }
+
+// platformLaunchLock returns the lock held while counting and launching the instances of the platform
+func (r *ReconcileTaskRun) platformLaunchLock(platform string) *sync.Mutex {
+	r.launchLock.Lock()
+	defer r.launchLock.Unlock()
+	if r.launchLocks == nil {
+		r.launchLocks = map[string]*sync.Mutex{}
+	}
+	if r.launchLocks[platform] == nil {
+		r.launchLocks[platform] = &sync.Mutex{}
+	}
+	return r.launchLocks[platform]
+}
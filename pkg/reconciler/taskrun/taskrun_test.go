@@ -1,15 +1,30 @@
 package taskrun
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/apis/hostpool/v1alpha1"
 	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"knative.dev/pkg/apis"
+	"net"
+	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,6 +37,7 @@ import (
 	"k8s.io/client-go/tools/record"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 const systemNamespace = "multi-platform-controller"
@@ -35,8 +51,9 @@ func setupClientAndReconciler(objs []runtimeclient.Object) (runtimeclient.Client
 	_ = pipelinev1.AddToScheme(scheme)
 	_ = v1.AddToScheme(scheme)
 	_ = appsv1.AddToScheme(scheme)
-	client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
-	reconciler := &ReconcileTaskRun{client: client, scheme: scheme, eventRecorder: &record.FakeRecorder{}, operatorNamespace: systemNamespace, cloudProviders: map[string]func(platform string, config map[string]string, systemnamespace string) cloud.CloudProvider{"mock": MockCloudSetup}, platformConfig: map[string]PlatformConfig{}, platformMetrics: platformMetrics}
+	_ = v1alpha1.AddToScheme(scheme)
+	client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).WithStatusSubresource(&v1alpha1.HostPool{}, &v1alpha1.DynamicPlatform{}, &v1alpha1.DynamicPoolPlatform{}).Build()
+	reconciler := &ReconcileTaskRun{client: client, scheme: scheme, eventRecorder: &record.FakeRecorder{}, operatorNamespace: systemNamespace, cloudProviders: map[string]func(platform string, config map[string]string, systemnamespace string) cloud.CloudProvider{"mock": MockCloudSetup}, platformConfig: map[string]*platformConfigEntry{}, retiredConfig: map[string]PlatformConfig{}, platformMetrics: platformMetrics, hostHealth: newHostHealthTracker(), sshProvisioner: newSshProvisioner(), hostKeyProbe: fakeHostKeyProbe}
 	return client, reconciler
 }
 
@@ -51,6 +68,271 @@ func TestConfigMapParsing(t *testing.T) {
 	g.Expect(config.hosts["host1"].Platform).Should(Equal("linux/arm64"))
 }
 
+func TestPlatformObjectParsing(t *testing.T) {
+	g := NewGomegaWithT(t)
+	pool := v1alpha1.HostPool{}
+	pool.Name = "linux-arm64"
+	pool.Namespace = systemNamespace
+	pool.Spec.Hosts = []v1alpha1.HostSpec{{Name: "host3", Address: "host3.com", Platform: "linux/arm64", User: "ec2-user", Secret: "awskeys", Concurrency: 2}}
+	dynamic := v1alpha1.DynamicPlatform{}
+	dynamic.Name = "linux-amd64"
+	dynamic.Namespace = systemNamespace
+	dynamic.Spec = v1alpha1.DynamicPlatformSpec{Platform: "linux/amd64", Type: "mock", MaxInstances: 3, SshSecret: "awskeys", AllocationTimeout: 20}
+	_, reconciler := setupClientAndReconciler(append(createHostConfig(), &pool, &dynamic))
+	discard := logr.Discard()
+
+	//the objects replace the hosts in the config map
+	configIface, err := reconciler.readConfiguration(context.Background(), &discard, "linux/arm64", userNamespace)
+	g.Expect(err).ToNot(HaveOccurred())
+	config := configIface.(HostPool)
+	g.Expect(len(config.hosts)).To(Equal(1))
+	g.Expect(config.hosts["host3"].Concurrency).Should(Equal(2))
+
+	configIface, err = reconciler.readConfiguration(context.Background(), &discard, "linux/amd64", userNamespace)
+	g.Expect(err).ToNot(HaveOccurred())
+	resolver := configIface.(DynamicResolver)
+	g.Expect(resolver.maxInstances).Should(Equal(3))
+	g.Expect(resolver.timeout).Should(Equal(int64(20)))
+
+	//global settings still come from the config map
+	_, err = reconciler.readConfiguration(context.Background(), &discard, "linux/amd64", "other")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestMigrateHostConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createDynamicPoolHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	for k, v := range createHostConfig()[0].(*v1.ConfigMap).Data {
+		cm.Data[k] = v
+	}
+	cm.Data["host.host1."+HostKeyConfig] = marshalHostKeys([]ssh.PublicKey{defaultTestHostKey})
+	client, _ := setupClientAndReconciler(objs)
+	discard := logr.Discard()
+	g.Expect(MigrateHostConfig(context.Background(), client, systemNamespace, &discard)).ShouldNot(HaveOccurred())
+
+	pools := v1alpha1.HostPoolList{}
+	g.Expect(client.List(context.Background(), &pools)).ShouldNot(HaveOccurred())
+	g.Expect(len(pools.Items)).Should(Equal(1))
+	g.Expect(len(pools.Items[0].Spec.Hosts)).Should(Equal(2))
+	dynamicPools := v1alpha1.DynamicPoolPlatformList{}
+	g.Expect(client.List(context.Background(), &dynamicPools)).ShouldNot(HaveOccurred())
+	g.Expect(len(dynamicPools.Items)).Should(Equal(1))
+	g.Expect(dynamicPools.Items[0].Spec.Config["region"]).Should(Equal("us-east-1"))
+
+	//the migrated objects must result in the same configuration
+	data, err := loadHostConfig(context.Background(), client, systemNamespace)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(data).Should(Equal(cm.Data))
+
+	//running it again is a no-op
+	g.Expect(MigrateHostConfig(context.Background(), client, systemNamespace, &discard)).ShouldNot(HaveOccurred())
+}
+
+// rejectingClient fails to create objects of the given type, as a validating webhook would
+type rejectingClient struct {
+	runtimeclient.Client
+	reject runtimeclient.Object
+}
+
+func (c rejectingClient) Create(ctx context.Context, obj runtimeclient.Object, opts ...runtimeclient.CreateOption) error {
+	if reflect.TypeOf(obj) == reflect.TypeOf(c.reject) {
+		return errors.NewBadRequest("rejected")
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestMigrateHostConfigCreatesNothingIfAnObjectIsRejected(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createDynamicPoolHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	for k, v := range createHostConfig()[0].(*v1.ConfigMap).Data {
+		cm.Data[k] = v
+	}
+	client, _ := setupClientAndReconciler(objs)
+	discard := logr.Discard()
+	rejecting := rejectingClient{Client: client, reject: &v1alpha1.HostPool{}}
+	g.Expect(MigrateHostConfig(context.Background(), rejecting, systemNamespace, &discard)).Should(HaveOccurred())
+
+	dynamicPools := v1alpha1.DynamicPoolPlatformList{}
+	g.Expect(client.List(context.Background(), &dynamicPools)).ShouldNot(HaveOccurred())
+	g.Expect(dynamicPools.Items).Should(BeEmpty())
+	// every platform is still read from the ConfigMap
+	data, err := loadHostConfig(context.Background(), client, systemNamespace)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(data).Should(Equal(cm.Data))
+
+	// once the problem is fixed the migration runs
+	g.Expect(MigrateHostConfig(context.Background(), client, systemNamespace, &discard)).ShouldNot(HaveOccurred())
+	pools := v1alpha1.HostPoolList{}
+	g.Expect(client.List(context.Background(), &pools)).ShouldNot(HaveOccurred())
+	g.Expect(pools.Items).Should(HaveLen(1))
+}
+
+func TestHotReload(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client, reconciler := setupClientAndReconciler(createHostConfig())
+	discard := logr.Discard()
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	oldGeneration := tr.Labels[ConfigGenerationLabel]
+	g.Expect(oldGeneration).ShouldNot(BeEmpty())
+
+	//changes to other platforms do not affect the generation
+	cm := v1.ConfigMap{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &cm)).ShouldNot(HaveOccurred())
+	cm.Data["host.host3.address"] = "host3.com"
+	cm.Data["host.host3.platform"] = "linux/amd64"
+	g.Expect(client.Update(context.Background(), &cm)).ShouldNot(HaveOccurred())
+	g.Expect(reconciler.RefreshPlatformConfig(context.Background(), &discard)).ShouldNot(HaveOccurred())
+	g.Expect(reconciler.platformConfig["linux/arm64"].generation).Should(Equal(oldGeneration))
+
+	cm.Data["host.host1.concurrency"] = "8"
+	g.Expect(client.Update(context.Background(), &cm)).ShouldNot(HaveOccurred())
+	g.Expect(reconciler.RefreshPlatformConfig(context.Background(), &discard)).ShouldNot(HaveOccurred())
+	entry := reconciler.platformConfig["linux/arm64"]
+	g.Expect(entry.generation).ShouldNot(Equal(oldGeneration))
+	g.Expect(entry.config.(HostPool).hosts["host1"].Concurrency).Should(Equal(8))
+
+	//the running task still uses the config it was allocated with
+	config, err := reconciler.readTaskConfiguration(context.Background(), &discard, tr, "linux/arm64")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(config.(HostPool).hosts["host1"].Concurrency).Should(Equal(4))
+
+	//once the task is finished the old config is discarded
+	tr = getUserTaskRun(g, client, "test")
+	tr.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+	g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+	_, err = reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	tr = getUserTaskRun(g, client, "test")
+	g.Expect(tr.Labels[ConfigGenerationLabel]).Should(BeEmpty())
+	g.Expect(reconciler.retiredConfig).Should(BeEmpty())
+}
+
+func TestValidateHostConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	_, reconciler := setupClientAndReconciler(createHostConfig())
+	g.Expect(reconciler.ValidateHostConfig(context.Background(), createHostConfig()[0].(*v1.ConfigMap).Data)).Should(BeEmpty())
+	g.Expect(reconciler.ValidateHostConfig(context.Background(), createDynamicHostConfig()[0].(*v1.ConfigMap).Data)).Should(BeEmpty())
+
+	data := createHostConfig()[0].(*v1.ConfigMap).Data
+	data["allowed-namespaces"] = "default,system-("
+	data["host.host1.concurrency"] = "four"
+	data["host.host2.secret"] = "missing"
+	data["host.host1.host-key"] = "ssh-ed25519 not-a-key"
+	data["host.host2.host-key"] = marshalHostKeys([]ssh.PublicKey{defaultTestHostKey})
+	data["dynamic-platforms"] = "linux/amd64,linux/s390x"
+	data["dynamic.linux-amd64.type"] = "mock"
+	data["dynamic.linux-amd64.max-instances"] = "2"
+	data["dynamic.linux-s390x.type"] = "unknown"
+	data["dynamic.linux-s390x.max-instances"] = "2"
+	data["dynamic.linux-s390x.ssh-secret"] = "awskeys"
+	data["dynamic.linux-amd64.spot"] = "yes"
+	data["dynamic.linux-amd64.spot-max-price"] = "$0.10"
+	data["dynamic.linux-amd64.min-ready"] = "3"
+	data["dynamic.linux-amd64.warm-ttl"] = "0"
+	data[OrphanGracePeriod] = "0"
+	data[OrphanDryRun] = "maybe"
+	data["namespace-quota.team.namespaces"] = "team-("
+	data["namespace-quota.team.weight"] = "0"
+	data["namespace-quota.other.max-hosts"] = "1"
+	data["priority.release.selector"] = "event-type in (push"
+	data["priority.release.value"] = "high"
+	data["max-wait.linux-arm64"] = "-5"
+	data["provision-mode.linux-arm64"] = "scp"
+	data["ssh-cert-validity"] = "forever"
+	data[HostQuarantineThreshold] = "many"
+	errs := reconciler.ValidateHostConfig(context.Background(), data)
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf(
+		"data[allowed-namespaces]",
+		"data[orphan-grace-period]",
+		"data[orphan-dry-run]",
+		"data[namespace-quota.team.namespaces]",
+		"data[namespace-quota.team.weight]",
+		"data[namespace-quota.other.namespaces]",
+		"data[priority.release.selector]",
+		"data[priority.release.value]",
+		"data[max-wait.linux-arm64]",
+		"data[provision-mode.linux-arm64]",
+		"data[ssh-cert-validity]",
+		"data[host-quarantine-threshold]",
+		"data[host.host1.concurrency]",
+		"data[host.host2.secret]",
+		"data[host.host1.host-key]",
+		"data[dynamic.linux-amd64.ssh-secret]",
+		"data[dynamic.linux-amd64.spot]",
+		"data[dynamic.linux-amd64.spot-max-price]",
+		"data[dynamic.linux-amd64.min-ready]",
+		"data[dynamic.linux-amd64.warm-ttl]",
+		"data[dynamic.linux-s390x.type]"))
+
+	// A launch template can provide the instance settings
+	reconciler.cloudProviders["aws"] = MockCloudSetup
+	data = createDynamicHostConfig()[0].(*v1.ConfigMap).Data
+	data["dynamic.linux-arm64.type"] = "aws"
+	data["dynamic.linux-arm64.region"] = "us-east-1"
+	data["dynamic.linux-arm64.launch-template-id"] = "lt-0123456789"
+	data["dynamic.linux-arm64.tags"] = "team=build,cost-center"
+	delete(data, "dynamic.linux-arm64.ami")
+	delete(data, "dynamic.linux-arm64.instance-type")
+	delete(data, "dynamic.linux-arm64.key-name")
+	delete(data, "dynamic.linux-arm64.aws-secret")
+	fields = []string{}
+	for _, err := range reconciler.ValidateHostConfig(context.Background(), data) {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf("data[dynamic.linux-arm64.aws-secret]", "data[dynamic.linux-arm64.tags]"))
+
+	data = createDynamicPoolHostConfig()[0].(*v1.ConfigMap).Data
+	data["dynamic.linux-arm64.stop-idle-instances"] = "true"
+	data["dynamic.linux-arm64.idle-grace-period"] = "15"
+	g.Expect(reconciler.ValidateHostConfig(context.Background(), data)).Should(BeEmpty())
+	data["dynamic.linux-arm64.stop-idle-instances"] = "yes"
+	data["dynamic.linux-arm64.idle-grace-period"] = "-1"
+	fields = []string{}
+	for _, err := range reconciler.ValidateHostConfig(context.Background(), data) {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf("data[dynamic.linux-arm64.stop-idle-instances]", "data[dynamic.linux-arm64.idle-grace-period]"))
+
+	// One time spot requests can't be stopped
+	data = createDynamicPoolHostConfig()[0].(*v1.ConfigMap).Data
+	data["dynamic.linux-arm64.stop-idle-instances"] = "true"
+	data["dynamic.linux-arm64.spot"] = "true"
+	fields = []string{}
+	for _, err := range reconciler.ValidateHostConfig(context.Background(), data) {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf("data[dynamic.linux-arm64.stop-idle-instances]"))
+
+	// A hypervisor reached over SSH needs known_hosts, unless the host key check is explicitly skipped
+	reconciler.cloudProviders["libvirt"] = MockCloudSetup
+	data = createDynamicHostConfig()[0].(*v1.ConfigMap).Data
+	data["dynamic.linux-arm64.type"] = "libvirt"
+	data["dynamic.linux-arm64.uri"] = "qemu+ssh://root@hypervisor.example.com/system"
+	data["dynamic.linux-arm64.base-image"] = "fedora.qcow2"
+	data["dynamic.linux-arm64.ssh-public-key"] = "ssh-ed25519 key"
+	data["dynamic.linux-arm64.libvirt-secret"] = "awskeys"
+	fields = []string{}
+	for _, err := range reconciler.ValidateHostConfig(context.Background(), data) {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf("data[dynamic.linux-arm64.libvirt-secret]"))
+	data["dynamic.linux-arm64.insecure-skip-host-key"] = "true"
+	g.Expect(reconciler.ValidateHostConfig(context.Background(), data)).Should(BeEmpty())
+	data["dynamic.linux-arm64.insecure-skip-host-key"] = "yes"
+	fields = []string{}
+	for _, err := range reconciler.ValidateHostConfig(context.Background(), data) {
+		fields = append(fields, err.Field)
+	}
+	g.Expect(fields).Should(ConsistOf("data[dynamic.linux-arm64.insecure-skip-host-key]"))
+}
+
 func TestAllowedNamepsaces(t *testing.T) {
 	g := NewGomegaWithT(t)
 	_, reconciler := setupClientAndReconciler(createHostConfig())
@@ -94,6 +376,9 @@ func TestAllocateCloudHost(t *testing.T) {
 	g.Expect(params["USER"]).To(Equal("root"))
 	g.Expect(params["HOST"]).Should(Equal("test.host.com"))
 	g.Expect(cloudImpl.Addressses[("test")]).Should(Equal("test.host.com"))
+	g.Expect(tr.Annotations).Should(HaveKeyWithValue(CloudZone, "us-east-1b"))
+	g.Expect(tr.Annotations).Should(HaveKeyWithValue(CloudInstanceType, "t4g.large"))
+	g.Expect(tr.Annotations).Should(HaveKeyWithValue(CloudCapacityType, "spot"))
 
 	runSuccessfulProvision(provision, g, client, tr, reconciler)
 
@@ -221,6 +506,515 @@ func TestAllocateCloudHostWithDynamicPool(t *testing.T) {
 
 }
 
+func TestAllocateCloudHostFromWarmPool(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["dynamic.linux-arm64.min-ready"] = "1"
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+
+	reconciler.MaintainWarmPools(context.Background(), &log)
+	g.Expect(cloudImpl.Running).Should(Equal(1))
+	var warm cloud.InstanceIdentifier
+	for k := range cloudImpl.Addressses {
+		warm = k
+	}
+
+	// The task gets the warm instance straight away, and a replacement is launched
+	tr := runUserPipeline(g, client, reconciler, "test")
+	g.Expect(tr.Labels[AssignedHost]).Should(Equal(string(warm)))
+	g.Expect(tr.Annotations[CloudAddress]).Should(Equal(cloudImpl.Addressses[warm]))
+	getProvisionTaskRun(g, client, tr)
+	g.Expect(cloudImpl.Running).Should(Equal(2))
+
+	tr = runUserPipeline(g, client, reconciler, "test2")
+	g.Expect(tr.Labels[AssignedHost]).ShouldNot(Equal(string(warm)))
+	g.Expect(tr.Labels[AssignedHost]).Should(HavePrefix("warm-"))
+
+	// The pool can't exceed max-instances, so the next task waits
+	createUserTaskRun(g, client, "test3", "linux/arm64")
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test3"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+	tr = getUserTaskRun(g, client, "test3")
+	g.Expect(tr.Labels[AssignedHost]).Should(BeEmpty())
+	g.Expect(tr.Labels[WaitingForPlatformLabel]).ShouldNot(BeEmpty())
+	g.Expect(cloudImpl.Running).Should(Equal(2))
+}
+
+func TestWarmPoolIgnoresInstancesOfOtherPlatforms(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["dynamic.linux-arm64.min-ready"] = "1"
+	client, reconciler := setupClientAndReconciler(objs)
+
+	// The mock lists every instance whatever the tag, as if the platforms shared one
+	createOtherPlatformTask(g, client, "other", "shared")
+	cloudImpl.Addressses["shared"] = "shared.host.com"
+	cloudImpl.Running = 1
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	g.Expect(tr.Labels[AssignedHost]).ShouldNot(Equal("shared"))
+	g.Expect(cloudImpl.Running).Should(Equal(2))
+}
+
+// slowLaunchCloud takes a while to launch an instance, so concurrent launches overlap
+type slowLaunchCloud struct {
+	*MockCloud
+	lock sync.Mutex
+}
+
+func (s *slowLaunchCloud) ListInstances(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.MockCloud.ListInstances(kubeClient, log, ctx, instanceTag)
+}
+
+func (s *slowLaunchCloud) CountInstances(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceTag string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.MockCloud.CountInstances(kubeClient, log, ctx, instanceTag)
+}
+
+func (s *slowLaunchCloud) LaunchInstance(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, name string, instanceTag string) (cloud.InstanceIdentifier, error) {
+	time.Sleep(time.Millisecond * 20)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.MockCloud.LaunchInstance(kubeClient, log, ctx, name, instanceTag)
+}
+
+func TestWarmPoolLaunchesDoNotExceedMaxInstances(t *testing.T) {
+	g := NewGomegaWithT(t)
+	provider := &slowLaunchCloud{MockCloud: &MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}}
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["dynamic.linux-arm64.type"] = "slow"
+	cm.Data["dynamic.linux-arm64.min-ready"] = "2"
+	_, reconciler := setupClientAndReconciler(objs)
+	reconciler.cloudProviders["slow"] = func(platform string, config map[string]string, systemNamespace string) cloud.CloudProvider {
+		return provider
+	}
+	log := logr.Discard()
+
+	// Every replenish sees an empty pool unless launches are serialized
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reconciler.MaintainWarmPools(context.Background(), &log)
+		}()
+	}
+	wg.Wait()
+	g.Expect(provider.Running).Should(Equal(2))
+}
+
+func TestDynamicPoolStopsIdleInstances(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicPoolHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["dynamic.linux-arm64.stop-idle-instances"] = "true"
+	cm.Data["dynamic.linux-arm64.idle-grace-period"] = "0"
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	host := tr.Labels[AssignedHost]
+	provision := getProvisionTaskRun(g, client, tr)
+	runSuccessfulProvision(provision, g, client, tr, reconciler)
+
+	// The instance is in use, so it is left running
+	reconciler.StopIdleInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Stopped).Should(BeEmpty())
+
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: tr.Namespace, Name: tr.Name}, tr)).ShouldNot(HaveOccurred())
+	tr.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+	tr.Status.SetCondition(&apis.Condition{
+		Type:               apis.ConditionSucceeded,
+		Status:             "True",
+		LastTransitionTime: apis.VolatileTime{Inner: metav1.Time{Time: time.Now().Add(time.Hour * -2)}},
+	})
+	g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: tr.Namespace, Name: tr.Name}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	reconciler.StopIdleInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Stopped).Should(HaveKey(cloud.InstanceIdentifier(host)))
+	g.Expect(cloudImpl.Running).Should(Equal(0))
+
+	// The next task starts the stopped instance rather than launching a new one
+	tr = runUserPipeline(g, client, reconciler, "test2")
+	g.Expect(tr.Labels[AssignedHost]).Should(Equal(host))
+	g.Expect(cloudImpl.Stopped).Should(BeEmpty())
+	g.Expect(cloudImpl.Running).Should(Equal(1))
+
+	// Stopped instances past their max age are terminated
+	cloudImpl.Stopped["old"] = cloud.CloudVMInstance{InstanceId: "old", StartTime: time.Now().Add(-time.Hour)}
+	reconciler.StopIdleInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Stopped).Should(BeEmpty())
+	g.Expect(cloudImpl.Terminated).Should(Equal(1))
+}
+
+func TestReapOrphanedInstances(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data[OrphanDryRun] = "true"
+	client, reconciler := setupClientAndReconciler(objs)
+	recorder := record.NewFakeRecorder(10)
+	reconciler.eventRecorder = recorder
+	log := logr.Discard()
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	used := cloud.InstanceIdentifier(tr.Annotations[CloudInstanceId])
+	cloudImpl.Addressses["orphan"] = "orphan.host.com"
+	cloudImpl.Addressses["new"] = "new.host.com"
+	cloudImpl.Running += 2
+	cloudImpl.StartTimes = map[cloud.InstanceIdentifier]time.Time{used: time.Now().Add(-time.Hour), "orphan": time.Now().Add(-time.Hour)}
+
+	reconciler.ReapOrphanedInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Terminated).Should(Equal(0))
+	g.Expect(drainEvents(recorder)).Should(ContainElement(ContainSubstring("InstanceReapDryRun")))
+
+	// Only the old instance that no task is using is terminated
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: cm.Namespace, Name: cm.Name}, cm)).ShouldNot(HaveOccurred())
+	cm.Data[OrphanDryRun] = "false"
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	reconciler.ReapOrphanedInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Terminated).Should(Equal(1))
+	g.Expect(cloudImpl.Addressses).ShouldNot(HaveKey(cloud.InstanceIdentifier("orphan")))
+	g.Expect(cloudImpl.Addressses).Should(HaveKey(used))
+	g.Expect(cloudImpl.Addressses).Should(HaveKey(cloud.InstanceIdentifier("new")))
+	g.Expect(drainEvents(recorder)).Should(ContainElement(ContainSubstring("InstanceReaped")))
+
+	// Instances past their maximum lifetime are terminated even if they are in use
+	cm.Data["dynamic.linux-arm64."+MaxInstanceLifetime] = "30"
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	reconciler.ReapOrphanedInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Addressses).ShouldNot(HaveKey(used))
+	g.Expect(cloudImpl.Addressses).Should(HaveKey(cloud.InstanceIdentifier("new")))
+	g.Expect(drainEvents(recorder)).Should(ContainElement(ContainSubstring("past the maximum lifetime")))
+}
+
+// createOtherPlatformTask creates a task of another platform that is using the instance
+func createOtherPlatformTask(g *WithT, client runtimeclient.Client, name string, instance string) {
+	createUserTaskRun(g, client, name, "linux/amd64")
+	tr := getUserTaskRun(g, client, name)
+	tr.Labels = map[string]string{CloudDynamicPlatform: "linux-amd64", AssignedHost: instance}
+	tr.Annotations = map[string]string{CloudInstanceId: instance}
+	g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+}
+
+func TestReapOrphanedInstancesWithSharedInstanceTag(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+
+	// The mock lists every instance whatever the tag, as if the platforms shared one
+	createOtherPlatformTask(g, client, "other", "shared")
+	cloudImpl.Addressses["shared"] = "shared.host.com"
+	cloudImpl.Addressses["orphan"] = "orphan.host.com"
+	cloudImpl.StartTimes = map[cloud.InstanceIdentifier]time.Time{"shared": time.Now().Add(-time.Hour), "orphan": time.Now().Add(-time.Hour)}
+
+	reconciler.ReapOrphanedInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Addressses).Should(HaveKey(cloud.InstanceIdentifier("shared")))
+	g.Expect(cloudImpl.Addressses).ShouldNot(HaveKey(cloud.InstanceIdentifier("orphan")))
+
+	// Instances of a dynamic pool are never reaped, even though no task is using them
+	cm.Data[DynamicPoolPlatforms] = "linux/amd64"
+	cm.Data["dynamic.linux-amd64.type"] = "mock"
+	cm.Data["dynamic.linux-amd64.ssh-secret"] = "awskeys"
+	cm.Data["dynamic.linux-amd64.max-instances"] = "2"
+	cm.Data["dynamic.linux-amd64.concurrency"] = "2"
+	cm.Data["dynamic.linux-amd64.max-age"] = "20"
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	cloudImpl.Addressses["pool"] = "pool.host.com"
+	cloudImpl.StartTimes["pool"] = time.Now().Add(-time.Hour)
+	reconciler.ReapOrphanedInstances(context.Background(), &log)
+	g.Expect(cloudImpl.Addressses).Should(HaveKey(cloud.InstanceIdentifier("pool")))
+	g.Expect(cloudImpl.Terminated).Should(Equal(1))
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	ret := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			ret = append(ret, event)
+		default:
+			return ret
+		}
+	}
+}
+
+func TestPeriodicJobsRunIndependently(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A job that blocks until it times out does not hold up another job
+	slow := periodicJob("slow", time.Millisecond*10, func(ctx context.Context, log *logr.Logger) {
+		<-ctx.Done()
+	})
+	var runs atomic.Int32
+	fast := periodicJob("fast", time.Millisecond*10, func(ctx context.Context, log *logr.Logger) {
+		runs.Add(1)
+	})
+	go func() { _ = slow.Start(ctx) }()
+	go func() { _ = fast.Start(ctx) }()
+	g.Eventually(runs.Load).Should(BeNumerically(">=", 3))
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["namespace-quota.default.namespaces"] = userNamespace
+	cm.Data["namespace-quota.default.max-hosts"] = "1"
+	client, reconciler := setupClientAndReconciler(objs)
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+
+	// There are free hosts, but the namespace is already using its quota
+	createUserTaskRun(g, client, "test2", "linux/arm64")
+	for i := 0; i < 2; i++ {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+	waiting := getUserTaskRun(g, client, "test2")
+	g.Expect(waiting.Labels[AssignedHost]).Should(BeEmpty())
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(Equal("linux-arm64"))
+
+	// Releasing the host lets the waiting task run
+	tr.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+	g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	waiting = getUserTaskRun(g, client, "test2")
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(BeEmpty())
+	_, err = reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(getUserTaskRun(g, client, "test2").Labels[AssignedHost]).ShouldNot(BeEmpty())
+}
+
+func TestWaitTimeout(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["namespace-quota.default.namespaces"] = userNamespace
+	cm.Data["namespace-quota.default.max-hosts"] = "1"
+	cm.Data["max-wait.linux-arm64"] = "30"
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+
+	runUserPipeline(g, client, reconciler, "test")
+	createUserTaskRun(g, client, "test2", "linux/arm64")
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	waiting := getUserTaskRun(g, client, "test2")
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(Equal("linux-arm64"))
+	g.Expect(waiting.Annotations[WaitingSinceAnnotation]).ShouldNot(BeEmpty())
+
+	// The time waited is recorded until it reaches max-wait
+	waiting.Annotations[WaitingSinceAnnotation] = strconv.FormatInt(time.Now().Add(-time.Minute*20).Unix(), 10)
+	g.Expect(client.Update(context.Background(), waiting)).ShouldNot(HaveOccurred())
+	reconciler.CheckWaitingTasks(context.Background(), &log)
+	waiting = getUserTaskRun(g, client, "test2")
+	g.Expect(waiting.Annotations[WaitDurationAnnotation]).Should(Equal("20m0s"))
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(Equal("linux-arm64"))
+
+	waiting.Annotations[WaitingSinceAnnotation] = strconv.FormatInt(time.Now().Add(-time.Minute*40).Unix(), 10)
+	g.Expect(client.Update(context.Background(), waiting)).ShouldNot(HaveOccurred())
+	reconciler.CheckWaitingTasks(context.Background(), &log)
+	waiting = getUserTaskRun(g, client, "test2")
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(BeEmpty())
+	secret := v1.Secret{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + "test2"}, &secret)).ShouldNot(HaveOccurred())
+	g.Expect(string(secret.Data["error"])).Should(ContainSubstring("there are 1 tasks waiting for this platform"))
+
+	// The label is also cleared from a task that already has the finalizer
+	createUserTaskRun(g, client, "test3", "linux/arm64")
+	_, err = reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test3"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	waiting = getUserTaskRun(g, client, "test3")
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(Equal("linux-arm64"))
+	controllerutil.AddFinalizer(waiting, PipelineFinalizer)
+	waiting.Annotations[WaitingSinceAnnotation] = strconv.FormatInt(time.Now().Add(-time.Minute*40).Unix(), 10)
+	g.Expect(client.Update(context.Background(), waiting)).ShouldNot(HaveOccurred())
+	reconciler.CheckWaitingTasks(context.Background(), &log)
+	waiting = getUserTaskRun(g, client, "test3")
+	g.Expect(waiting.Labels[WaitingForPlatformLabel]).Should(BeEmpty())
+	g.Expect(waiting.Annotations[WaitDurationAnnotation]).Should(Equal("40m0s"))
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + "test3"}, &secret)).ShouldNot(HaveOccurred())
+}
+
+func TestFairShareWaitingTasks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+	task := func(namespace string, name string, host string, age time.Duration) pipelinev1.TaskRun {
+		tr := pipelinev1.TaskRun{}
+		tr.Namespace = namespace
+		tr.Name = name
+		tr.CreationTimestamp = metav1.Time{Time: time.Now().Add(-age)}
+		tr.Labels = map[string]string{}
+		if host != "" {
+			tr.Labels[AssignedHost] = host
+		} else {
+			tr.Labels[WaitingForPlatformLabel] = "linux-arm64"
+		}
+		tr.Spec.Params = []pipelinev1.Param{{Name: PlatformParam, Value: *pipelinev1.NewStructuredValues("linux/arm64")}}
+		return tr
+	}
+	for _, tr := range []pipelinev1.TaskRun{task("tenant-a", "a1", "host1", 0), task("tenant-a", "a2", "host1", 0), task("tenant-b", "b1", "host2", 0)} {
+		running := tr
+		g.Expect(client.Create(context.Background(), &running)).ShouldNot(HaveOccurred())
+	}
+	waiting := []pipelinev1.TaskRun{task("tenant-a", "a3", "", time.Minute*5), task("tenant-a", "a4", "", time.Minute), task("tenant-b", "b2", "", time.Minute)}
+
+	// tenant-b is using fewer hosts, so it goes first even though tenant-a has been waiting longer
+	next, err := reconciler.nextWaitingTask(context.Background(), &log, "linux/arm64", waiting)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(next.Name).Should(Equal("b2"))
+
+	// With a bigger share tenant-a goes first, starting with its oldest task
+	cm.Data["namespace-quota.a.namespaces"] = "tenant-a"
+	cm.Data["namespace-quota.a.weight"] = "4"
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	next, err = reconciler.nextWaitingTask(context.Background(), &log, "linux/arm64", waiting)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(next.Name).Should(Equal("a3"))
+
+	// Unless it is at its quota
+	cm.Data["namespace-quota.a.max-hosts"] = "2"
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	next, err = reconciler.nextWaitingTask(context.Background(), &log, "linux/arm64", waiting)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(next.Name).Should(Equal("b2"))
+}
+
+func TestTaskPriority(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log := logr.Discard()
+	priorities := parsePriorityConfig(&log, map[string]string{
+		"priority.release.selector": "pipelinesascode.tekton.dev/event-type=push",
+		"priority.release.value":    "100",
+		"priority.nightly.selector": "schedule",
+		"priority.nightly.value":    "-10",
+		PriorityAgingInterval:       "5",
+	})
+	now := time.Now()
+	tr := &pipelinev1.TaskRun{}
+	tr.CreationTimestamp = metav1.Time{Time: now}
+	tr.Labels = map[string]string{"pipelinesascode.tekton.dev/event-type": "push"}
+	g.Expect(priorities.effectivePriority(tr, now)).Should(Equal(100))
+	tr.Labels = map[string]string{"schedule": "nightly"}
+	g.Expect(priorities.effectivePriority(tr, now)).Should(Equal(-10))
+	// Set directly on the task
+	tr.Annotations = map[string]string{TaskPriorityLabel: "50"}
+	g.Expect(priorities.effectivePriority(tr, now)).Should(Equal(50))
+	// Waiting tasks go up one level every aging interval
+	g.Expect(priorities.effectivePriority(tr, now.Add(time.Minute*16))).Should(Equal(53))
+}
+
+func TestWarmInstanceReservedForHigherPriority(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	defer func() {
+		cloudImpl = MockCloud{Addressses: map[cloud.InstanceIdentifier]string{}}
+	}()
+	objs := createDynamicHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data["dynamic.linux-arm64.max-instances"] = "1"
+	cm.Data["dynamic.linux-arm64.min-ready"] = "1"
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+
+	// A high priority task is waiting for the instance to boot
+	createUserTaskRun(g, client, "high", "linux/arm64")
+	high := getUserTaskRun(g, client, "high")
+	high.Labels = map[string]string{WaitingForPlatformLabel: "linux-arm64", TaskPriorityLabel: "10"}
+	g.Expect(client.Update(context.Background(), high)).ShouldNot(HaveOccurred())
+	reconciler.MaintainWarmPools(context.Background(), &log)
+	g.Expect(cloudImpl.Running).Should(Equal(1))
+
+	// A lower priority task can't take it
+	createUserTaskRun(g, client, "low", "linux/arm64")
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "low"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+	g.Expect(getUserTaskRun(g, client, "low").Labels[AssignedHost]).Should(BeEmpty())
+
+	// The next maintenance wakes the high priority task, which gets the instance
+	reconciler.MaintainWarmPools(context.Background(), &log)
+	g.Expect(getUserTaskRun(g, client, "high").Labels[WaitingForPlatformLabel]).Should(BeEmpty())
+	g.Expect(getUserTaskRun(g, client, "low").Labels[WaitingForPlatformLabel]).ShouldNot(BeEmpty())
+	for i := 0; i < 2; i++ {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "high"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+	g.Expect(getUserTaskRun(g, client, "high").Labels[AssignedHost]).ShouldNot(BeEmpty())
+}
+
+func TestCloudHostInterrupted(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client, reconciler := setupClientAndReconciler(createDynamicHostConfig())
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	provision := getProvisionTaskRun(g, client, tr)
+	runSuccessfulProvision(provision, g, client, tr, reconciler)
+	log := logr.Discard()
+	terminated := cloudImpl.Terminated
+
+	// Nothing happens while the instance is healthy
+	reconciler.CheckInterruptions(context.Background(), &log)
+	g.Expect(cloudImpl.Terminated).Should(Equal(terminated))
+	g.Expect(getSecret(g, client, tr).Data["error"]).Should(BeEmpty())
+
+	cloudImpl.Interrupted = map[cloud.InstanceIdentifier]string{cloud.InstanceIdentifier(tr.Labels[AssignedHost]): "spot instance was reclaimed"}
+	defer func() {
+		cloudImpl.Interrupted = nil
+	}()
+	reconciler.CheckInterruptions(context.Background(), &log)
+	g.Expect(cloudImpl.Terminated).Should(Equal(terminated + 1))
+	secret := getSecret(g, client, tr)
+	g.Expect(string(secret.Data["error"])).Should(Equal("spot instance was reclaimed"))
+	g.Expect(string(secret.Data["id_rsa"])).Should(Equal("expected"))
+	tr = getUserTaskRun(g, client, "test")
+	g.Expect(tr.Annotations[CloudInterrupted]).Should(Equal("spot instance was reclaimed"))
+
+	// Already handled, so the instance is not terminated again
+	reconciler.CheckInterruptions(context.Background(), &log)
+	g.Expect(cloudImpl.Terminated).Should(Equal(terminated + 1))
+}
+
 func TestProvisionFailure(t *testing.T) {
 	g := NewGomegaWithT(t)
 	client, reconciler := setupClientAndReconciler(createHostConfig())
@@ -267,6 +1061,385 @@ func TestProvisionFailure(t *testing.T) {
 	g.Expect(secret.Data["error"]).ToNot(BeEmpty())
 }
 
+func TestHostHealthAndQuarantine(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data[HostHealthCheckInterval] = "5"
+	cm.Data[HostQuarantineThreshold] = "1"
+	client, reconciler := setupClientAndReconciler(objs)
+	log := logr.Discard()
+	complete := func(tr *pipelinev1.TaskRun, status v1.ConditionStatus, msg string) {
+		tr.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+		tr.Status.SetCondition(&apis.Condition{
+			Type:               apis.ConditionSucceeded,
+			Status:             status,
+			Message:            msg,
+			LastTransitionTime: apis.VolatileTime{Inner: metav1.Time{Time: time.Now()}},
+		})
+		g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: tr.Namespace, Name: tr.Name}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+
+	// Each host gets one health check, host1 fails it
+	reconciler.CheckHostHealth(context.Background(), &log)
+	reconciler.CheckHostHealth(context.Background(), &log)
+	checks := pipelinev1.TaskRunList{}
+	g.Expect(client.List(context.Background(), &checks, runtimeclient.MatchingLabels{TaskTypeLabel: TaskTypeHealthCheck})).ShouldNot(HaveOccurred())
+	g.Expect(checks.Items).Should(HaveLen(2))
+	for i := range checks.Items {
+		if checks.Items[i].Labels[AssignedHost] == "host1" {
+			complete(&checks.Items[i], "False", "podman is not working on the host")
+		}
+	}
+	g.Expect(reconciler.hostHealth.schedulable("host1", time.Now())).Should(BeFalse())
+
+	// New tasks go to the healthy host, which is quarantined after a provision failure
+	tr := runUserPipeline(g, client, reconciler, "test")
+	g.Expect(tr.Labels[AssignedHost]).Should(Equal("host2"))
+	complete(getProvisionTaskRun(g, client, tr), "False", "")
+	g.Expect(reconciler.hostHealth.schedulable("host2", time.Now())).Should(BeFalse())
+
+	// With no healthy hosts tasks wait, rather than failing
+	createUserTaskRun(g, client, "test2", "linux/arm64")
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(getUserTaskRun(g, client, "test2").Labels[WaitingForPlatformLabel]).Should(Equal("linux-arm64"))
+
+	// Passing a health check restores the host and wakes the waiting tasks
+	check := pipelinev1.TaskRun{}
+	check.Namespace = systemNamespace
+	check.Name = "health-check-host1"
+	check.Labels = map[string]string{TaskTypeLabel: TaskTypeHealthCheck, AssignedHost: "host1"}
+	g.Expect(client.Create(context.Background(), &check)).ShouldNot(HaveOccurred())
+	complete(&check, "True", "")
+	g.Expect(reconciler.hostHealth.schedulable("host1", time.Now())).Should(BeTrue())
+	g.Expect(getUserTaskRun(g, client, "test2").Labels[WaitingForPlatformLabel]).Should(BeEmpty())
+	_, err = reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(getUserTaskRun(g, client, "test2").Labels[AssignedHost]).Should(Equal("host1"))
+}
+
+func TestSshProvision(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objs := createHostConfig()
+	objs[0].(*v1.ConfigMap).Data[ProvisionMode+".linux-arm64"] = ProvisionModeSsh
+	client, reconciler := setupClientAndReconciler(objs)
+	// The first host fails to provision, and the task is moved to the other one
+	var calls atomic.Int32
+	release := make(chan struct{})
+	reconciler.sshProvisioner.provision = func(ctx context.Context, job sshProvisionJob, credentials provisionCredentials) (provisionedUser, error) {
+		<-release
+		if calls.Add(1) == 1 {
+			return provisionedUser{}, fmt.Errorf("connection refused")
+		}
+		return provisionedUser{name: buildUserName(job.taskRun, job.namespace), key: []byte("expected")}, nil
+	}
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	failed := tr.Labels[AssignedHost]
+	close(release)
+	g.Eventually(func() string {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return getUserTaskRun(g, client, "test").Annotations[FailedHosts]
+	}).Should(Equal(failed))
+	g.Eventually(func() error {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test"}})
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + "test"}, &v1.Secret{})
+	}).Should(Succeed())
+
+	tr = getUserTaskRun(g, client, "test")
+	g.Expect(tr.Labels[AssignedHost]).ShouldNot(Equal(failed))
+	secret := getSecret(g, client, tr)
+	g.Expect(secret.Data["id_rsa"]).Should(Equal([]byte("expected")))
+	g.Expect(string(secret.Data["host"])).Should(HavePrefix(buildUserName("test", userNamespace) + "@"))
+	g.Expect(calls.Load()).Should(Equal(int32(2)))
+	// No provision tasks are used
+	list := pipelinev1.TaskRunList{}
+	g.Expect(client.List(context.Background(), &list, runtimeclient.MatchingLabels{TaskTypeLabel: TaskTypeProvision})).ShouldNot(HaveOccurred())
+	g.Expect(list.Items).Should(BeEmpty())
+}
+
+func TestSshProvisionWithCA(t *testing.T) {
+	g := NewGomegaWithT(t)
+	newKey := func() []byte {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		block, err := ssh.MarshalPrivateKey(key, "")
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return pem.EncodeToMemory(block)
+	}
+	objs := createHostConfig()
+	cm := objs[0].(*v1.ConfigMap)
+	cm.Data[ProvisionMode] = ProvisionModeSsh
+	cm.Data[SshCaSecret] = "ssh-user-ca"
+	cm.Data[SshCertValidity+".linux-arm64"] = "60"
+	caSecret := v1.Secret{}
+	caSecret.Name = "ssh-user-ca"
+	caSecret.Namespace = systemNamespace
+	caSecret.Data = map[string][]byte{SshCaKey: newKey(), SshPreviousCaKey: newKey()}
+	client, reconciler := setupClientAndReconciler(append(objs, &caSecret))
+	var trusted string
+	reconciler.sshProvisioner.provision = func(ctx context.Context, job sshProvisionJob, credentials provisionCredentials) (provisionedUser, error) {
+		// The same certificate provisionOverSsh would issue
+		signer, err := ssh.ParsePrivateKey(newKey())
+		if err != nil {
+			return provisionedUser{}, err
+		}
+		name := buildUserName(job.taskRun, job.namespace)
+		cert, err := credentials.ca.issue(signer.PublicKey(), name, job.namespace+"/"+job.taskRun, time.Now())
+		if err != nil {
+			return provisionedUser{}, err
+		}
+		trusted = credentials.ca.trustedKeys()
+		return provisionedUser{name: name, key: []byte("expected"), cert: ssh.MarshalAuthorizedKey(cert)}, nil
+	}
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	g.Eventually(func() error {
+		return client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + "test"}, &v1.Secret{})
+	}).Should(Succeed())
+	secret := getSecret(g, client, tr)
+	g.Expect(secret.Data["error"]).Should(BeEmpty())
+	// Hosts trust both the current and previous CA while it is rotated
+	g.Expect(strings.Split(trusted, "\n")).Should(HaveLen(2))
+
+	// The certificate is only valid for the build user, for the configured time
+	key, _, _, _, err := ssh.ParseAuthorizedKey(secret.Data["id_rsa-cert.pub"])
+	g.Expect(err).ShouldNot(HaveOccurred())
+	cert := key.(*ssh.Certificate)
+	g.Expect(cert.ValidPrincipals).Should(Equal([]string{buildUserName("test", userNamespace)}))
+	g.Expect(time.Until(time.Unix(int64(cert.ValidBefore), 0))).Should(BeNumerically("~", time.Hour, time.Minute))
+	ca, err := ssh.ParsePrivateKey(caSecret.Data[SshCaKey])
+	g.Expect(err).ShouldNot(HaveOccurred())
+	checker := ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+	}}
+	g.Expect(checker.CheckCert(buildUserName("test", userNamespace), cert)).Should(Succeed())
+	g.Expect(checker.CheckCert("root", cert)).ShouldNot(Succeed())
+}
+
+func TestHostKeyPinning(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client, reconciler := setupClientAndReconciler(createHostConfig())
+
+	// The key is captured the first time a host is used, and the provision task only trusts that key
+	tr := runUserPipeline(g, client, reconciler, "test")
+	host := tr.Labels[AssignedHost]
+	provision := getProvisionTaskRun(g, client, tr)
+	cm := v1.ConfigMap{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostKeysConfigMap}, &cm)).ShouldNot(HaveOccurred())
+	g.Expect(cm.Data[host]).Should(Equal(marshalHostKeys([]ssh.PublicKey{defaultTestHostKey})))
+	knownHostsParam := ""
+	for _, param := range provision.Spec.Params {
+		if param.Name == "KNOWN_HOSTS" {
+			knownHostsParam = param.Value.StringVal
+		}
+	}
+	address := createHostConfig()[0].(*v1.ConfigMap).Data["host."+host+".address"]
+	g.Expect(knownHostsParam).Should(Equal(knownhosts.Line([]string{address}, defaultTestHostKey)))
+
+	// A host that presents a different key to its pinned one is not provisioned
+	hostConfig := v1.ConfigMap{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &hostConfig)).ShouldNot(HaveOccurred())
+	pinned := marshalHostKeys([]ssh.PublicKey{newTestHostKey()})
+	hostConfig.Data["host.host1."+HostKeyConfig] = pinned
+	hostConfig.Data["host.host2."+HostKeyConfig] = pinned
+	g.Expect(client.Update(context.Background(), &hostConfig)).ShouldNot(HaveOccurred())
+	createUserTaskRun(g, client, "test2", "linux/arm64")
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: userNamespace, Name: "test2"}})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Eventually(func() string {
+		secret := v1.Secret{}
+		_ = client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + "test2"}, &secret)
+		return string(secret.Data["error"])
+	}).Should(ContainSubstring("does not match the key pinned for it"))
+}
+
+func TestHostKeyProbeDoesNotBlockReconcile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client, reconciler := setupClientAndReconciler(createHostConfig())
+	unblock := make(chan struct{})
+	reconciler.hostKeyProbe = func(ctx context.Context, host string, address string, keys []ssh.PublicKey) (ssh.PublicKey, error) {
+		<-unblock
+		return defaultTestHostKey, nil
+	}
+
+	// The host is assigned without waiting for it to answer, and provisioned once it does
+	tr := runUserPipeline(g, client, reconciler, "test")
+	g.Expect(tr.Annotations).Should(HaveKey(SshProvisionAnnotation))
+	list := pipelinev1.TaskRunList{}
+	g.Expect(client.List(context.Background(), &list, runtimeclient.MatchingLabels{TaskTypeLabel: TaskTypeProvision})).Should(Succeed())
+	g.Expect(list.Items).Should(BeEmpty())
+	close(unblock)
+	getProvisionTaskRun(g, client, tr)
+}
+
+func TestHostKeyPinningWithLabelFilteredCache(t *testing.T) {
+	g := NewGomegaWithT(t)
+	// A map left without the label is only visible to the API reader, it is labelled when the next key is stored
+	legacy := v1.ConfigMap{}
+	legacy.Name = HostKeysConfigMap
+	legacy.Namespace = systemNamespace
+	legacy.Data = map[string]string{"old-host": marshalHostKeys([]ssh.PublicKey{newTestHostKey()})}
+	client, reconciler := setupClientAndReconciler(append(createHostConfig(), &legacy))
+	reconciler.apiReader = client
+	reconciler.client = &labelFilteredClient{Client: client}
+
+	for _, name := range []string{"test", "test2", "test3"} {
+		tr := runUserPipeline(g, client, reconciler, name)
+		getProvisionTaskRun(g, client, tr)
+		secret := v1.Secret{}
+		err := client.Get(context.Background(), types.NamespacedName{Namespace: userNamespace, Name: SecretPrefix + name}, &secret)
+		g.Expect(errors.IsNotFound(err)).Should(BeTrue())
+	}
+	cm := v1.ConfigMap{}
+	g.Expect(reconciler.client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostKeysConfigMap}, &cm)).ShouldNot(HaveOccurred())
+	g.Expect(cm.Labels).Should(HaveKey(ConfigMapLabel))
+	g.Expect(cm.Data).Should(HaveKey("old-host"))
+	g.Expect(cm.Data).Should(HaveLen(3))
+}
+
+func TestPruneHostKeys(t *testing.T) {
+	g := NewGomegaWithT(t)
+	keys := v1.ConfigMap{}
+	keys.Name = HostKeysConfigMap
+	keys.Namespace = systemNamespace
+	keys.Labels = map[string]string{ConfigMapLabel: HostKeysConfigMap}
+	keys.Data = map[string]string{
+		"host1":        marshalHostKeys([]ssh.PublicKey{defaultTestHostKey}),
+		"missing-host": marshalHostKeys([]ssh.PublicKey{defaultTestHostKey}),
+	}
+	client, reconciler := setupClientAndReconciler(append(createHostConfig(), &keys))
+	log := logr.Discard()
+	get := func() *v1.ConfigMap {
+		cm := v1.ConfigMap{}
+		g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostKeysConfigMap}, &cm)).ShouldNot(HaveOccurred())
+		return &cm
+	}
+
+	// A missing host keeps its key until it has been missing for the grace period
+	reconciler.PruneHostKeys(context.Background(), &log)
+	cm := get()
+	g.Expect(cm.Data).Should(HaveKey("missing-host"))
+	g.Expect(cm.Annotations[HostKeysMissingAnnotation]).Should(ContainSubstring("missing-host"))
+	g.Expect(cm.Annotations[HostKeysMissingAnnotation]).ShouldNot(ContainSubstring("host1"))
+
+	missing := map[string]time.Time{"missing-host": time.Now().Add(-hostKeyPruneGracePeriod - time.Minute)}
+	value, err := json.Marshal(missing)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	cm.Annotations[HostKeysMissingAnnotation] = string(value)
+	g.Expect(client.Update(context.Background(), cm)).ShouldNot(HaveOccurred())
+	reconciler.PruneHostKeys(context.Background(), &log)
+	cm = get()
+	g.Expect(cm.Data).ShouldNot(HaveKey("missing-host"))
+	g.Expect(cm.Data).Should(HaveKey("host1"))
+	g.Expect(cm.Annotations).ShouldNot(HaveKey(HostKeysMissingAnnotation))
+
+	// A host that is listed again is no longer considered missing
+	since := time.Now().Add(-time.Hour)
+	remaining, pruned := pruneMissingHostKeys(map[string]string{"a": "", "b": ""}, map[string]bool{"a": true}, map[string]time.Time{"a": since, "b": since}, time.Now())
+	g.Expect(pruned).Should(BeEmpty())
+	g.Expect(remaining).Should(Equal(map[string]time.Time{"b": since}))
+}
+
+func TestProbeHostKey(t *testing.T) {
+	g := NewGomegaWithT(t)
+	config := &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, fmt.Errorf("not allowed")
+	}}
+	var hostKeys []ssh.PublicKey
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	for _, key := range []interface{}{edKey, rsaKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		config.AddHostKey(signer)
+		hostKeys = append(hostKeys, signer.PublicKey())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+	address := listener.Addr().String()
+
+	key, err := probeHostKey(context.Background(), "host1", address, nil)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(key).ShouldNot(BeNil())
+	// The host is asked for the type of key that is pinned
+	for _, pinned := range hostKeys {
+		key, err = probeHostKey(context.Background(), "host1", address, []ssh.PublicKey{pinned})
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(key.Marshal()).Should(Equal(pinned.Marshal()))
+	}
+	_, err = probeHostKey(context.Background(), "host1", address, []ssh.PublicKey{newTestHostKey()})
+	g.Expect(err).Should(BeAssignableToTypeOf(&hostKeyMismatchError{}))
+}
+
+func TestDrainHost(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client, reconciler := setupClientAndReconciler(createHostConfig())
+	log := logr.Discard()
+	drainStatusOf := func() map[string]drainStatus {
+		cm := v1.ConfigMap{}
+		g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &cm)).ShouldNot(HaveOccurred())
+		ret := map[string]drainStatus{}
+		g.Expect(json.Unmarshal([]byte(cm.Annotations[DrainStatusAnnotation]), &ret)).ShouldNot(HaveOccurred())
+		return ret
+	}
+
+	tr := runUserPipeline(g, client, reconciler, "test")
+	drained := tr.Labels[AssignedHost]
+	cm := v1.ConfigMap{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &cm)).ShouldNot(HaveOccurred())
+	cm.Annotations = map[string]string{DrainAnnotation: drained + "=update"}
+	g.Expect(client.Update(context.Background(), &cm)).ShouldNot(HaveOccurred())
+
+	// The running task is left to finish, but new tasks go to the other host
+	reconciler.DrainHosts(context.Background(), &log)
+	g.Expect(drainStatusOf()[drained]).Should(Equal(drainStatus{State: DrainStateDraining, Action: DrainActionUpdate, Tasks: []string{userNamespace + "/test"}}))
+	g.Expect(runUserPipeline(g, client, reconciler, "test2").Labels[AssignedHost]).ShouldNot(Equal(drained))
+
+	// Once the task has finished the host is updated
+	tr.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+	g.Expect(client.Update(context.Background(), tr)).ShouldNot(HaveOccurred())
+	reconciler.DrainHosts(context.Background(), &log)
+	status := drainStatusOf()[drained]
+	g.Expect(status.State).Should(Equal(DrainStateUpdating))
+	update := pipelinev1.TaskRun{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: status.UpdateTask}, &update)).ShouldNot(HaveOccurred())
+	g.Expect(update.Labels[AssignedHost]).Should(Equal(drained))
+	update.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+	update.Status.SetCondition(&apis.Condition{Type: apis.ConditionSucceeded, Status: "True"})
+	g.Expect(client.Update(context.Background(), &update)).ShouldNot(HaveOccurred())
+	reconciler.DrainHosts(context.Background(), &log)
+	g.Expect(drainStatusOf()[drained].State).Should(Equal(DrainStateUpdated))
+
+	// Removing the host from the annotation returns it to service
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &cm)).ShouldNot(HaveOccurred())
+	delete(cm.Annotations, DrainAnnotation)
+	g.Expect(client.Update(context.Background(), &cm)).ShouldNot(HaveOccurred())
+	reconciler.DrainHosts(context.Background(), &log)
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Namespace: systemNamespace, Name: HostConfig}, &cm)).ShouldNot(HaveOccurred())
+	g.Expect(cm.Annotations).ShouldNot(HaveKey(DrainStatusAnnotation))
+}
+
 func TestProvisionSuccessButNoSecret(t *testing.T) {
 	g := NewGomegaWithT(t)
 	client, reconciler := setupClientAndReconciler(createHostConfig())
@@ -465,20 +1638,24 @@ func runUserPipeline(g *WithT, client runtimeclient.Client, reconciler *Reconcil
 	return tr
 }
 
+// getProvisionTaskRun waits for the provision task, which is started once the host key has been checked
 func getProvisionTaskRun(g *WithT, client runtimeclient.Client, tr *pipelinev1.TaskRun) *pipelinev1.TaskRun {
-	list := pipelinev1.TaskRunList{}
-	err := client.List(context.Background(), &list)
-	g.Expect(err).ToNot(HaveOccurred())
-	for i := range list.Items {
-		if list.Items[i].Labels[AssignedHost] == "" {
-			continue
-		}
-		if list.Items[i].Labels[UserTaskName] == tr.Name {
-			return &list.Items[i]
+	var ret *pipelinev1.TaskRun
+	g.Eventually(func() *pipelinev1.TaskRun {
+		list := pipelinev1.TaskRunList{}
+		err := client.List(context.Background(), &list)
+		g.Expect(err).ToNot(HaveOccurred())
+		for i := range list.Items {
+			if list.Items[i].Labels[AssignedHost] == "" {
+				continue
+			}
+			if list.Items[i].Labels[UserTaskName] == tr.Name {
+				ret = &list.Items[i]
+			}
 		}
-	}
-	g.Expect("could not find task").Should(BeEmpty())
-	return nil
+		return ret
+	}).ShouldNot(BeNil(), "could not find task")
+	return ret
 }
 
 func getUserTaskRun(g *WithT, client runtimeclient.Client, name string) *pipelinev1.TaskRun {
@@ -500,6 +1677,50 @@ func createUserTaskRun(g *WithT, client runtimeclient.Client, name string, platf
 
 }
 
+// testHostKeys are the SSH host keys of the test hosts, hosts without one present defaultTestHostKey
+var testHostKeys = map[string]ssh.PublicKey{}
+var defaultTestHostKey = newTestHostKey()
+
+func newTestHostKey() ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// labelFilteredClient only returns the ConfigMaps the manager's cache holds, the fake client returns all of them
+type labelFilteredClient struct {
+	runtimeclient.Client
+}
+
+func (c *labelFilteredClient) Get(ctx context.Context, key runtimeclient.ObjectKey, obj runtimeclient.Object, opts ...runtimeclient.GetOption) error {
+	err := c.Client.Get(ctx, key, obj, opts...)
+	if err != nil {
+		return err
+	}
+	if cm, ok := obj.(*v1.ConfigMap); ok && cm.Labels[ConfigMapLabel] == "" {
+		return errors.NewNotFound(v1.Resource("configmaps"), key.Name)
+	}
+	return nil
+}
+
+func fakeHostKeyProbe(ctx context.Context, host string, address string, keys []ssh.PublicKey) (ssh.PublicKey, error) {
+	presented := testHostKeys[host]
+	if presented == nil {
+		presented = defaultTestHostKey
+	}
+	err := pinnedHostKeyCallback(host, keys)(address, nil, presented)
+	if err != nil {
+		return nil, err
+	}
+	return presented, nil
+}
+
 func createHostConfig() []runtimeclient.Object {
 	cm := v1.ConfigMap{}
 	cm.Name = HostConfig
@@ -580,12 +1801,52 @@ type MockCloud struct {
 	Addressses        map[cloud.InstanceIdentifier]string
 	FailGetAddress    bool
 	TimeoutGetAddress bool
+	Interrupted       map[cloud.InstanceIdentifier]string
+	Stopped           map[cloud.InstanceIdentifier]cloud.CloudVMInstance
+	StartTimes        map[cloud.InstanceIdentifier]time.Time
+}
+
+func (m *MockCloud) StopInstance(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	if m.Stopped == nil {
+		m.Stopped = map[cloud.InstanceIdentifier]cloud.CloudVMInstance{}
+	}
+	m.Running--
+	m.Stopped[instanceId] = cloud.CloudVMInstance{InstanceId: instanceId, StartTime: time.Now(), Address: m.Addressses[instanceId]}
+	delete(m.Addressses, instanceId)
+	return nil
+}
+
+func (m *MockCloud) StartInstance(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) error {
+	m.Running++
+	m.Addressses[instanceId] = m.Stopped[instanceId].Address
+	delete(m.Stopped, instanceId)
+	return nil
+}
+
+func (m *MockCloud) ListStoppedInstances(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
+	ret := []cloud.CloudVMInstance{}
+	for _, v := range m.Stopped {
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func (m *MockCloud) DescribeInstance(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (*cloud.InstanceDetails, error) {
+	return &cloud.InstanceDetails{Zone: "us-east-1b", InstanceType: "t4g.large", CapacityType: "spot"}, nil
+}
+
+func (m *MockCloud) CheckInterruption(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceId cloud.InstanceIdentifier) (string, error) {
+	return m.Interrupted[instanceId], nil
 }
 
 func (m *MockCloud) ListInstances(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instanceTag string) ([]cloud.CloudVMInstance, error) {
 	ret := []cloud.CloudVMInstance{}
 	for k, v := range m.Addressses {
-		ret = append(ret, cloud.CloudVMInstance{InstanceId: k, StartTime: time.Now(), Address: v})
+		start, ok := m.StartTimes[k]
+		if !ok {
+			start = time.Now()
+		}
+		ret = append(ret, cloud.CloudVMInstance{InstanceId: k, StartTime: start, Address: v})
 	}
 	return ret, nil
 }
@@ -607,8 +1868,12 @@ func (m *MockCloud) LaunchInstance(kubeClient runtimeclient.Client, log *logr.Lo
 }
 
 func (m *MockCloud) TerminateInstance(kubeClient runtimeclient.Client, log *logr.Logger, ctx context.Context, instance cloud.InstanceIdentifier) error {
-	m.Running--
 	m.Terminated++
+	if _, ok := m.Stopped[instance]; ok {
+		delete(m.Stopped, instance)
+		return nil
+	}
+	m.Running--
 	delete(m.Addressses, instance)
 	return nil
 }
@@ -0,0 +1,396 @@
+package taskrun
+
+import (
+	"context"
+	"fmt"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/libvirt"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// providerKeys lists the settings a dynamic platform must have for each provider type.
+// Secrets are also checked to exist in the operator namespace.
+type providerKeys struct {
+	required []string
+	secrets  []string
+	// alternatives are other keys that can be set instead of a required key
+	alternatives map[string][]string
+}
+
+var providerConfigKeys = map[string]providerKeys{
+	"aws": {required: []string{"region", "ami", "instance-type", "key-name", "aws-secret", "security-group"}, secrets: []string{"aws-secret"},
+		alternatives: map[string][]string{"ami": {"launch-template-id"}, "instance-type": {"launch-template-id"}, "key-name": {"launch-template-id"}, "security-group": {"security-group-ids", "launch-template-id"}}},
+	"ibmz":      {required: []string{"region", "key", "subnet", "vpc", "image-id", "secret", "url", "profile"}, secrets: []string{"secret"}},
+	"ibmp":      {required: []string{"key", "image", "secret", "url", "crn", "network", "system"}, secrets: []string{"secret"}},
+	"gcp":       {required: []string{"project", "zone", "machine-type", "image-family", "gcp-secret"}, secrets: []string{"gcp-secret"}},
+	"azure":     {required: []string{"subscription-id", "resource-group", "location", "vm-size", "image", "subnet-id", "ssh-public-key", "azure-secret"}, secrets: []string{"azure-secret"}},
+	"libvirt":   {required: []string{"uri", "base-image", "ssh-public-key"}, secrets: []string{"libvirt-secret"}},
+	"kubevirt":  {required: []string{"ssh-public-key"}},
+	"openstack": {required: []string{"auth-url", "flavor", "image", "network", "key-name", "openstack-secret"}, secrets: []string{"openstack-secret"}},
+}
+
+var hostKeys = []string{"address", "user", "platform", "secret", "concurrency"}
+
+// optionalHostKeys can be set for a host, but are not required
+var optionalHostKeys = []string{HostKeyConfig}
+
+// ValidateHostConfig checks host-config data for errors that would otherwise only be reported when a task tries to
+// allocate a host. Referenced secrets must exist in the operator namespace.
+func (r *ReconcileTaskRun) ValidateHostConfig(ctx context.Context, data map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	dataPath := field.NewPath("data")
+
+	if namespaces := data[AllowedNamespaces]; namespaces != "" {
+		for _, i := range strings.Split(namespaces, ",") {
+			if _, err := regexp.Compile(i); err != nil {
+				errs = append(errs, field.Invalid(dataPath.Key(AllowedNamespaces), i, "invalid regex: "+err.Error()))
+			}
+		}
+	}
+
+	if value, ok := data[OrphanGracePeriod]; ok {
+		errs = append(errs, validateInt(dataPath.Key(OrphanGracePeriod), value, false)...)
+	}
+	if value, ok := data[MaxInstanceLifetime]; ok {
+		errs = append(errs, validateInt(dataPath.Key(MaxInstanceLifetime), value, true)...)
+	}
+	if value, ok := data[OrphanDryRun]; ok && value != "true" && value != "false" {
+		errs = append(errs, field.NotSupported(dataPath.Key(OrphanDryRun), value, []string{"true", "false"}))
+	}
+
+	for _, key := range []string{HostHealthCheckInterval, HostHealthMinDisk, HostQuarantineThreshold, HostQuarantinePeriod} {
+		if value, ok := data[key]; ok {
+			errs = append(errs, validateInt(dataPath.Key(key), value, true)...)
+		}
+	}
+	for k, v := range data {
+		if k == MaxWait || strings.HasPrefix(k, MaxWait+".") {
+			errs = append(errs, validateInt(dataPath.Key(k), v, true)...)
+		}
+		if k == SshCertValidity || strings.HasPrefix(k, SshCertValidity+".") {
+			errs = append(errs, validateInt(dataPath.Key(k), v, false)...)
+		}
+		if (k == ProvisionMode || strings.HasPrefix(k, ProvisionMode+".")) && v != ProvisionModeTekton && v != ProvisionModeSsh {
+			errs = append(errs, field.NotSupported(dataPath.Key(k), v, []string{ProvisionModeTekton, ProvisionModeSsh}))
+		}
+	}
+
+	errs = append(errs, validateNamespaceQuotas(data)...)
+	errs = append(errs, validatePriorityRules(data)...)
+
+	seen := map[string]bool{}
+	for _, list := range []string{DynamicPlatforms, DynamicPoolPlatforms} {
+		for _, platform := range strings.Split(data[list], ",") {
+			if platform == "" {
+				continue
+			}
+			if seen[platform] {
+				errs = append(errs, field.Duplicate(dataPath.Key(list), platform))
+				continue
+			}
+			seen[platform] = true
+			errs = append(errs, r.validateDynamicPlatform(ctx, data, platform, list == DynamicPoolPlatforms)...)
+		}
+	}
+
+	hosts := map[string]map[string]string{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, "host.") {
+			continue
+		}
+		pos := strings.LastIndex(k, ".")
+		if pos <= len("host.") {
+			errs = append(errs, field.Invalid(dataPath.Key(k), v, "host keys must be in the form host.<name>.<setting>"))
+			continue
+		}
+		name := k[len("host."):pos]
+		if hosts[name] == nil {
+			hosts[name] = map[string]string{}
+		}
+		hosts[name][k[pos+1:]] = v
+	}
+	names := []string{}
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, r.validateHost(ctx, dataPath, name, hosts[name])...)
+	}
+	return errs
+}
+
+func (r *ReconcileTaskRun) validateDynamicPlatform(ctx context.Context, data map[string]string, platform string, pool bool) field.ErrorList {
+	errs := field.ErrorList{}
+	dataPath := field.NewPath("data")
+	prefix := "dynamic." + platformLabel(platform) + "."
+
+	typeName := data[prefix+"type"]
+	if typeName == "" {
+		errs = append(errs, field.Required(dataPath.Key(prefix+"type"), "platform "+platform+" has no provider type"))
+	} else if r.cloudProviders[typeName] == nil {
+		supported := []string{}
+		for k := range r.cloudProviders {
+			supported = append(supported, k)
+		}
+		sort.Strings(supported)
+		errs = append(errs, field.NotSupported(dataPath.Key(prefix+"type"), typeName, supported))
+	}
+
+	numeric := []string{"max-instances"}
+	if pool {
+		numeric = append(numeric, "concurrency", "max-age")
+	}
+	for _, key := range numeric {
+		errs = append(errs, validateInt(dataPath.Key(prefix+key), data[prefix+key], true)...)
+	}
+	optional := []string{"allocation-timeout", MaxInstanceLifetime}
+	if pool {
+		optional = append(optional, "idle-grace-period")
+	} else {
+		optional = append(optional, "min-ready", "warm-ttl")
+	}
+	for _, key := range optional {
+		if value, ok := data[prefix+key]; ok {
+			errs = append(errs, validateInt(dataPath.Key(prefix+key), value, key != "warm-ttl")...)
+		}
+	}
+	minReady, err := strconv.Atoi(data[prefix+"min-ready"])
+	if maxInstances, maxErr := strconv.Atoi(data[prefix+"max-instances"]); err == nil && maxErr == nil && minReady > maxInstances {
+		errs = append(errs, field.Invalid(dataPath.Key(prefix+"min-ready"), data[prefix+"min-ready"], "must not be more than max-instances"))
+	}
+
+	if stop, ok := data[prefix+"stop-idle-instances"]; ok {
+		if stop != "true" && stop != "false" {
+			errs = append(errs, field.NotSupported(dataPath.Key(prefix+"stop-idle-instances"), stop, []string{"true", "false"}))
+		} else if stop == "true" && r.cloudProviders[typeName] != nil {
+			if _, ok := r.cloudProviders[typeName](platformLabel(platform), data, r.operatorNamespace).(cloud.InstanceStopper); !ok {
+				errs = append(errs, field.Invalid(dataPath.Key(prefix+"stop-idle-instances"), stop, "provider type "+typeName+" can't stop instances"))
+			}
+		}
+	}
+	if spot, ok := data[prefix+"spot"]; ok && spot != "true" && spot != "false" {
+		errs = append(errs, field.NotSupported(dataPath.Key(prefix+"spot"), spot, []string{"true", "false"}))
+	}
+	if data[prefix+"spot"] == "true" && data[prefix+"stop-idle-instances"] == "true" {
+		// Spot instances are requested once, and are terminated rather than stopped
+		errs = append(errs, field.Invalid(dataPath.Key(prefix+"stop-idle-instances"), "true", "spot instances can't be stopped"))
+	}
+	if price := data[prefix+"spot-max-price"]; price != "" {
+		if val, err := strconv.ParseFloat(price, 64); err != nil || val <= 0 {
+			errs = append(errs, field.Invalid(dataPath.Key(prefix+"spot-max-price"), price, "must be a positive hourly price in USD"))
+		}
+	}
+
+	if tags := data[prefix+"tags"]; tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if key, _, found := strings.Cut(tag, "="); !found || strings.TrimSpace(key) == "" {
+				errs = append(errs, field.Invalid(dataPath.Key(prefix+"tags"), tags, "tags must be in the form key=value,key2=value2"))
+				break
+			}
+		}
+	}
+
+	secrets := []string{"ssh-secret"}
+	required := []string{"ssh-secret"}
+	keys := providerConfigKeys[typeName]
+	required = append(required, keys.required...)
+	secrets = append(secrets, keys.secrets...)
+	for _, key := range required {
+		provided := false
+		for _, alternative := range keys.alternatives[key] {
+			provided = provided || data[prefix+alternative] != ""
+		}
+		if data[prefix+key] == "" && !provided {
+			errs = append(errs, field.Required(dataPath.Key(prefix+key), "required for "+typeName+" platform "+platform))
+		}
+	}
+	for _, key := range secrets {
+		if data[prefix+key] != "" {
+			errs = append(errs, r.validateSecret(ctx, dataPath.Key(prefix+key), data[prefix+key])...)
+		}
+	}
+	if typeName == "libvirt" {
+		errs = append(errs, r.validateLibvirtHostKey(ctx, dataPath, prefix, data)...)
+	}
+	return errs
+}
+
+// validateLibvirtHostKey checks the host key of a hypervisor reached over SSH can be checked, which needs known_hosts
+// in the libvirt-secret unless insecure-skip-host-key is set
+func (r *ReconcileTaskRun) validateLibvirtHostKey(ctx context.Context, dataPath *field.Path, prefix string, data map[string]string) field.ErrorList {
+	key := prefix + libvirt.InsecureSkipHostKey
+	if value, ok := data[key]; ok && value != "true" && value != "false" {
+		return field.ErrorList{field.NotSupported(dataPath.Key(key), value, []string{"true", "false"})}
+	}
+	name := data[prefix+"libvirt-secret"]
+	if data[key] == "true" || name == "" || !libvirt.UsesSsh(data[prefix+"uri"]) {
+		return nil
+	}
+	reader := r.apiReader
+	if reader == nil {
+		reader = r.client
+	}
+	secret := v12.Secret{}
+	err := reader.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: name}, &secret)
+	if err != nil {
+		// Already reported by validateSecret
+		return nil
+	}
+	if len(secret.Data["known_hosts"]) == 0 {
+		return field.ErrorList{field.Invalid(dataPath.Key(prefix+"libvirt-secret"), name, "has no known_hosts, so the host key of the hypervisor can't be checked, set "+libvirt.InsecureSkipHostKey+" to connect anyway")}
+	}
+	return nil
+}
+
+func (r *ReconcileTaskRun) validateHost(ctx context.Context, dataPath *field.Path, name string, host map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	prefix := "host." + name + "."
+	for key := range host {
+		supported := append(append([]string{}, hostKeys...), optionalHostKeys...)
+		found := false
+		for _, i := range supported {
+			if i == key {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, field.NotSupported(dataPath.Key(prefix+key), key, supported))
+		}
+	}
+	for _, key := range hostKeys {
+		if host[key] == "" {
+			errs = append(errs, field.Required(dataPath.Key(prefix+key), "required for host "+name))
+		}
+	}
+	if host["concurrency"] != "" {
+		errs = append(errs, validateInt(dataPath.Key(prefix+"concurrency"), host["concurrency"], false)...)
+	}
+	if host["secret"] != "" {
+		errs = append(errs, r.validateSecret(ctx, dataPath.Key(prefix+"secret"), host["secret"])...)
+	}
+	if value := host[HostKeyConfig]; value != "" {
+		if _, err := parseHostKeys(value); err != nil {
+			errs = append(errs, field.Invalid(dataPath.Key(prefix+HostKeyConfig), value, "must be SSH public keys in authorized keys format: "+err.Error()))
+		}
+	}
+	return errs
+}
+
+func validateInt(path *field.Path, value string, allowZero bool) field.ErrorList {
+	if value == "" {
+		return field.ErrorList{field.Required(path, "")}
+	}
+	val, err := strconv.Atoi(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, "must be an integer")}
+	}
+	if val < 0 {
+		return field.ErrorList{field.Invalid(path, value, "must not be negative")}
+	}
+	if val == 0 && !allowZero {
+		return field.ErrorList{field.Invalid(path, value, "must be greater than zero")}
+	}
+	return nil
+}
+
+func (r *ReconcileTaskRun) validateSecret(ctx context.Context, path *field.Path, name string) field.ErrorList {
+	// The cache only holds labeled secrets, so read directly from the API server
+	reader := r.apiReader
+	if reader == nil {
+		reader = r.client
+	}
+	secret := v12.Secret{}
+	err := reader.Get(ctx, types.NamespacedName{Namespace: r.operatorNamespace, Name: name}, &secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return field.ErrorList{field.NotFound(path, name)}
+		}
+		return field.ErrorList{field.InternalError(path, fmt.Errorf("failed to read secret %s: %w", name, err))}
+	}
+	return nil
+}
+
+// validateNamespaceQuotas checks the namespace-quota.<name>.<setting> keys
+func validateNamespaceQuotas(data map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	dataPath := field.NewPath("data")
+	names := map[string]bool{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, NamespaceQuotaPrefix) {
+			continue
+		}
+		pos := strings.LastIndex(k, ".")
+		if pos <= len(NamespaceQuotaPrefix) {
+			errs = append(errs, field.Invalid(dataPath.Key(k), v, "namespace quota keys must be in the form namespace-quota.<name>.<setting>"))
+			continue
+		}
+		names[k[len(NamespaceQuotaPrefix):pos]] = true
+		switch setting := k[pos+1:]; setting {
+		case "namespaces":
+			if _, err := regexp.Compile(v); err != nil {
+				errs = append(errs, field.Invalid(dataPath.Key(k), v, "invalid regex: "+err.Error()))
+			}
+		case "platforms":
+		case "max-hosts":
+			errs = append(errs, validateInt(dataPath.Key(k), v, true)...)
+		case "weight":
+			errs = append(errs, validateInt(dataPath.Key(k), v, false)...)
+		default:
+			errs = append(errs, field.NotSupported(dataPath.Key(k), setting, []string{"namespaces", "platforms", "max-hosts", "weight"}))
+		}
+	}
+	for name := range names {
+		if key := NamespaceQuotaPrefix + name + ".namespaces"; data[key] == "" {
+			errs = append(errs, field.Required(dataPath.Key(key), "namespace quota "+name+" does not match any namespaces"))
+		}
+	}
+	return errs
+}
+
+// validatePriorityRules checks the priority.<name>.<setting> keys and the aging interval
+func validatePriorityRules(data map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	dataPath := field.NewPath("data")
+	if value, ok := data[PriorityAgingInterval]; ok {
+		errs = append(errs, validateInt(dataPath.Key(PriorityAgingInterval), value, false)...)
+	}
+	names := map[string]bool{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, PriorityRulePrefix) {
+			continue
+		}
+		pos := strings.LastIndex(k, ".")
+		if pos <= len(PriorityRulePrefix) {
+			errs = append(errs, field.Invalid(dataPath.Key(k), v, "priority keys must be in the form priority.<name>.<setting>"))
+			continue
+		}
+		names[k[len(PriorityRulePrefix):pos]] = true
+		switch setting := k[pos+1:]; setting {
+		case "selector":
+			if _, err := labels.Parse(v); err != nil {
+				errs = append(errs, field.Invalid(dataPath.Key(k), v, "invalid label selector: "+err.Error()))
+			}
+		case "value":
+			if _, err := strconv.Atoi(v); err != nil {
+				errs = append(errs, field.Invalid(dataPath.Key(k), v, "must be an integer"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(dataPath.Key(k), setting, []string{"selector", "value"}))
+		}
+	}
+	for name := range names {
+		if key := PriorityRulePrefix + name + ".value"; data[key] == "" {
+			errs = append(errs, field.Required(dataPath.Key(key), "priority rule "+name+" has no value"))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,138 @@
+package taskrun
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"time"
+)
+
+const (
+	// MaxWait is how many minutes a task can wait for a host before it is failed. It can be set for a single platform
+	// with max-wait.<platform>, e.g. max-wait.linux-s390x. Zero, the default, waits forever.
+	MaxWait = "max-wait"
+
+	// WaitingSinceAnnotation is when the task started waiting for a host, in unix seconds
+	WaitingSinceAnnotation = "build.appstudio.redhat.com/waiting-since"
+	// WaitDurationAnnotation is how long the task has been waiting for a host so far
+	WaitDurationAnnotation = "build.appstudio.redhat.com/wait-duration"
+)
+
+// maxWait returns the longest a task can wait for a host on the platform, or zero if there is no limit
+func maxWait(log *logr.Logger, data map[string]string, platform string) time.Duration {
+	value := data[MaxWait+"."+platformLabel(platform)]
+	if value == "" {
+		value = data[MaxWait]
+	}
+	if value == "" {
+		return 0
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil {
+		log.Error(err, "unable to parse max wait", "platform", platform, "value", value)
+		return 0
+	}
+	return time.Minute * time.Duration(minutes)
+}
+
+// waitingSince returns when the task started waiting, which is kept when the task is woken and has to wait again
+func waitingSince(tr *v1.TaskRun) time.Time {
+	if value := tr.Annotations[WaitingSinceAnnotation]; value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(seconds, 0)
+		}
+	}
+	return tr.CreationTimestamp.Time
+}
+
+// platformCapacity describes how many tasks the platform can run at once
+func platformCapacity(config PlatformConfig) string {
+	switch c := config.(type) {
+	case DynamicResolver:
+		return fmt.Sprintf("%d instances", c.maxInstances)
+	case DynamicHostPool:
+		return fmt.Sprintf("%d instances running %d tasks each", c.maxInstances, c.concurrency)
+	case HostPool:
+		slots := 0
+		for _, host := range c.hosts {
+			if host.Platform == c.targetPlatform {
+				slots += host.Concurrency
+			}
+		}
+		return fmt.Sprintf("%d hosts with %d task slots", len(c.hosts), slots)
+	}
+	return "unknown capacity"
+}
+
+// CheckWaitingTasks records how long each waiting task has been waiting, and fails tasks that have been waiting for
+// longer than the max-wait of their platform, rather than leaving them to be killed by the pipeline timeout
+func (r *ReconcileTaskRun) CheckWaitingTasks(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to check waiting tasks")
+		return
+	}
+	taskList := v1.TaskRunList{}
+	err = r.client.List(ctx, &taskList, client.HasLabels{WaitingForPlatformLabel})
+	if err != nil {
+		log.Error(err, "failed to list waiting tasks")
+		return
+	}
+	queues := map[string]int{}
+	for _, tr := range taskList.Items {
+		queues[tr.Labels[WaitingForPlatformLabel]]++
+	}
+	now := time.Now()
+	for i := range taskList.Items {
+		tr := &taskList.Items[i]
+		if tr.Status.CompletionTime != nil || tr.GetDeletionTimestamp() != nil {
+			continue
+		}
+		platform, err := extracPlatform(tr)
+		if err != nil {
+			continue
+		}
+		if tr.Annotations == nil {
+			tr.Annotations = map[string]string{}
+		}
+		waited := now.Sub(waitingSince(tr)).Truncate(time.Second)
+		limit := maxWait(log, data, platform)
+		if limit == 0 || waited < limit {
+			duration := waited.Truncate(time.Minute).String()
+			if tr.Annotations[WaitDurationAnnotation] == duration {
+				continue
+			}
+			tr.Annotations[WaitDurationAnnotation] = duration
+			err = r.client.Update(ctx, tr)
+			if err != nil {
+				log.Error(err, "failed to update wait duration", "task", tr.Name)
+			}
+			continue
+		}
+		capacity := "unknown capacity"
+		if config, err := r.readConfiguration(ctx, log, platform, tr.Namespace); err == nil {
+			capacity = platformCapacity(config)
+		}
+		msg := fmt.Sprintf("timed out after waiting %s for a %s host, there are %d tasks waiting for this platform which has a capacity of %s, all of which are in use", waited, platform, queues[tr.Labels[WaitingForPlatformLabel]], capacity)
+		log.Info("task waited too long for a host", "task", tr.Name, "platform", platform, "waited", waited)
+		delete(tr.Labels, WaitingForPlatformLabel)
+		tr.Annotations[WaitDurationAnnotation] = waited.String()
+		err = r.client.Update(ctx, tr)
+		if err != nil {
+			log.Error(err, "failed to stop task that waited too long from waiting", "task", tr.Name)
+			continue
+		}
+		err = r.createErrorSecret(ctx, log, tr, SecretPrefix+tr.Name, msg)
+		if err != nil {
+			log.Error(err, "failed to fail task that waited too long", "task", tr.Name)
+			continue
+		}
+		r.handleMetrics(platform, func(metrics *PlatformMetrics) {
+			metrics.waitTimeouts.Inc()
+			metrics.waitingTasks.Dec()
+		})
+	}
+}
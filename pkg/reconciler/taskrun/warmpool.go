@@ -0,0 +1,212 @@
+package taskrun
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/redhat-appstudio/multi-platform-controller/pkg/cloud"
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// warmPool is a snapshot of the instances of a dynamic platform that are not assigned to a task
+type warmPool struct {
+	// ready instances have booted and are reachable, oldest first
+	ready []cloud.CloudVMInstance
+	// booting instances have been launched but are not reachable yet
+	booting int
+	// total is every instance of the platform, including those assigned to tasks
+	total int
+}
+
+// readWarmPool works out which instances are warm. Tasks are read directly from the API server, as a stale cache could
+// result in an instance that was just handed out being given to a second task, and tasks of every platform are
+// checked, as another platform with the same instance tag can be using one of the listed instances.
+func (r DynamicResolver) readWarmPool(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger) (*warmPool, error) {
+	total, err := r.CloudProvider.CountInstances(taskRun.client, log, ctx, r.instanceTag)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := r.CloudProvider.ListInstances(taskRun.client, log, ctx, r.instanceTag)
+	if err != nil {
+		return nil, err
+	}
+	assigned, err := taskRun.assignedInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Instances of this platform assigned to tasks, including those still booting
+	inUse := 0
+	for id, tr := range assigned {
+		if tr.Annotations[CloudInstanceId] == id && tr.Labels[CloudDynamicPlatform] == platformLabel(r.platform) {
+			inUse++
+		}
+	}
+	pool := warmPool{total: total}
+	for _, instance := range instances {
+		if assigned[string(instance.InstanceId)] == nil {
+			pool.ready = append(pool.ready, instance)
+		}
+	}
+	sort.Slice(pool.ready, func(i, j int) bool {
+		return pool.ready[i].StartTime.Before(pool.ready[j].StartTime)
+	})
+	pool.booting = total - inUse - len(pool.ready)
+	if pool.booting < 0 {
+		pool.booting = 0
+	}
+	return &pool, nil
+}
+
+// claimWarmInstance hands a ready warm instance to the task, and launches a replacement. It returns false if there
+// was no warm instance available, in which case the task is allocated as normal.
+func (r DynamicResolver) claimWarmInstance(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger, tr *v1.TaskRun, secretName string) (bool, error) {
+	pool, err := r.readWarmPool(taskRun, ctx, log)
+	if err != nil {
+		log.Error(err, "failed to read warm pool, launching a new instance instead")
+		return false, nil
+	}
+	if len(pool.ready) == 0 {
+		// Make sure there is something on the way for the next task
+		r.replenishWarmPool(taskRun, ctx, log)
+		return false, nil
+	}
+	higher, err := taskRun.higherPriorityWaiting(ctx, log, tr, r.platform)
+	if err != nil {
+		log.Error(err, "failed to check for higher priority tasks")
+	} else if higher {
+		// The warm instances are kept for the higher priority tasks, which are woken by maintainWarmPool
+		log.Info("not claiming warm instance as a higher priority task is waiting")
+		return false, nil
+	}
+	// Use the oldest instance, so fewer are recycled unused
+	instance := pool.ready[0]
+	pool.ready = pool.ready[1:]
+	log.Info("assigning warm instance", "instance", instance.InstanceId)
+
+	delete(tr.Labels, WaitingForPlatformLabel)
+	tr.Annotations[AllocationStartTimeAnnotation] = strconv.FormatInt(time.Now().Unix(), 10)
+	tr.Annotations[CloudInstanceId] = string(instance.InstanceId)
+	tr.Annotations[CloudAddress] = instance.Address
+	tr.Labels[CloudDynamicPlatform] = platformLabel(r.platform)
+	tr.Labels[AssignedHost] = string(instance.InstanceId)
+	controllerutil.AddFinalizer(tr, PipelineFinalizer)
+	r.recordInstanceDetails(taskRun, ctx, log, tr)
+	err = taskRun.client.Update(ctx, tr)
+	if err != nil {
+		// The instance is still unassigned, so it stays in the pool
+		return true, err
+	}
+	err = launchProvisioningTask(taskRun, ctx, log, tr, secretName, r.sshSecret, instance.Address, r.CloudProvider.SshUser(), r.platform)
+	if err != nil {
+		log.Error(err, "Failed to provision warm host")
+		terr := r.CloudProvider.TerminateInstance(taskRun.client, log, ctx, instance.InstanceId)
+		if terr != nil {
+			log.Error(terr, "Failed to terminate instance")
+		}
+		delete(tr.Labels, AssignedHost)
+		delete(tr.Annotations, CloudInstanceId)
+		updateErr := taskRun.client.Update(ctx, tr)
+		if updateErr != nil {
+			log.Error(updateErr, "Could not unassign task after provisioning failure")
+		}
+		return true, err
+	}
+	r.replenishWarmPool(taskRun, ctx, log)
+	return true, nil
+}
+
+// replenishWarmPool launches instances until min-ready are ready or booting, without exceeding max-instances. The pool
+// is read again once no other instance of the platform can be launched, as it may have changed since it was last read.
+// It returns the pool, or nil if it could not be read.
+func (r DynamicResolver) replenishWarmPool(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger) *warmPool {
+	launchLock := taskRun.platformLaunchLock(r.platform)
+	launchLock.Lock()
+	defer launchLock.Unlock()
+	pool, err := r.readWarmPool(taskRun, ctx, log)
+	if err != nil {
+		log.Error(err, "failed to read warm pool", "platform", r.platform)
+		return nil
+	}
+	needed := r.minReady - len(pool.ready) - pool.booting
+	for i := 0; i < needed && pool.total < r.maxInstances; i++ {
+		name, err := getRandomString(8)
+		if err != nil {
+			log.Error(err, "failed to generate warm instance name")
+			return pool
+		}
+		instance, err := r.CloudProvider.LaunchInstance(taskRun.client, log, ctx, "warm-"+name, r.instanceTag)
+		if err != nil {
+			log.Error(err, "failed to launch warm instance")
+			return pool
+		}
+		log.Info("launched warm instance", "instance", instance)
+		pool.booting++
+		pool.total++
+	}
+	return pool
+}
+
+// maintainWarmPool recycles warm instances that have been idle for longer than the warm TTL, and tops the pool up
+func (r DynamicResolver) maintainWarmPool(taskRun *ReconcileTaskRun, ctx context.Context, log *logr.Logger) {
+	pool, err := r.readWarmPool(taskRun, ctx, log)
+	if err != nil {
+		log.Error(err, "failed to read warm pool", "platform", r.platform)
+		return
+	}
+	ready := []cloud.CloudVMInstance{}
+	for _, instance := range pool.ready {
+		if instance.StartTime.Add(r.warmTTL).Before(time.Now()) {
+			log.Info("recycling idle warm instance", "instance", instance.InstanceId)
+			err = r.CloudProvider.TerminateInstance(taskRun.client, log, ctx, instance.InstanceId)
+			if err != nil {
+				log.Error(err, "failed to terminate warm instance", "instance", instance.InstanceId)
+				ready = append(ready, instance)
+				continue
+			}
+			pool.total--
+		} else {
+			ready = append(ready, instance)
+		}
+	}
+	pool.ready = ready
+	if len(pool.ready) > 0 {
+		// Hand the ready instances to waiting tasks, highest priority first
+		err = taskRun.wakeWaitingTasks(ctx, log, r.platform, len(pool.ready))
+		if err != nil {
+			log.Error(err, "failed to wake waiting tasks", "platform", r.platform)
+		}
+	}
+	if replenished := r.replenishWarmPool(taskRun, ctx, log); replenished != nil {
+		pool = replenished
+	}
+	taskRun.handleMetrics(r.platform, func(metrics *PlatformMetrics) {
+		metrics.warmInstances.Set(float64(len(pool.ready) + pool.booting))
+	})
+}
+
+// MaintainWarmPools keeps the warm pool of every dynamic platform with min-ready set topped up
+func (r *ReconcileTaskRun) MaintainWarmPools(ctx context.Context, log *logr.Logger) {
+	data, err := loadHostConfig(ctx, r.client, r.operatorNamespace)
+	if err != nil {
+		log.Error(err, "failed to read host config to maintain warm pools")
+		return
+	}
+	for _, platform := range strings.Split(data[DynamicPlatforms], ",") {
+		minReady := data["dynamic."+platformLabel(platform)+".min-ready"]
+		if minReady == "" || minReady == "0" {
+			continue
+		}
+		entry, err := r.cachedPlatformConfig(log, data, platform)
+		if err != nil {
+			log.Error(err, "failed to read platform config to maintain warm pool", "platform", platform)
+			continue
+		}
+		if resolver, ok := entry.config.(DynamicResolver); ok && resolver.minReady > 0 {
+			resolver.maintainWarmPool(r, ctx, log)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package taskrun
+
+import (
+	"context"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const HostConfigWebhookPath = "/validate-host-config"
+
+// hostConfigValidator rejects host-config changes that would fail when a task tries to allocate a host
+type hostConfigValidator struct {
+	reconciler *ReconcileTaskRun
+	decoder    *admission.Decoder
+}
+
+func SetupHostConfigWebhook(mgr ctrl.Manager, operatorNamespace string) {
+	mgr.GetWebhookServer().Register(HostConfigWebhookPath, &webhook.Admission{Handler: &hostConfigValidator{
+		reconciler: newReconciler(mgr, operatorNamespace),
+		decoder:    admission.NewDecoder(mgr.GetScheme()),
+	}})
+}
+
+func (v *hostConfigValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1.Delete || req.Namespace != v.reconciler.operatorNamespace || req.Name != HostConfig {
+		return admission.Allowed("")
+	}
+	cm := v12.ConfigMap{}
+	err := v.decoder.Decode(req, &cm)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	errs := v.reconciler.ValidateHostConfig(ctx, cm.Data)
+	if len(errs) == 0 {
+		return admission.Allowed("")
+	}
+	invalid := errors.NewInvalid(schema.GroupKind{Kind: "ConfigMap"}, cm.Name, errs)
+	return admission.Response{AdmissionResponse: admissionv1.AdmissionResponse{Allowed: false, Result: &invalid.ErrStatus}}
+}